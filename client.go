@@ -2,6 +2,7 @@ package remoton
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -13,7 +14,6 @@ import (
 	"time"
 
 	jswebsocket "github.com/gopherjs/websocket"
-	"github.com/pierrec/lz4"
 	"golang.org/x/net/websocket"
 )
 
@@ -31,6 +31,26 @@ type Client struct {
 	Prefix    string
 	TLSConfig *tls.Config
 	Origin    string
+
+	//Proxy returns the proxy to use for a given request the same as
+	//http.Transport.Proxy, if nil HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+	//from environment are used. Use http.ProxyURL for a explicit proxy.
+	//Supported schemes http, https and socks5
+	Proxy func(*http.Request) (*url.URL, error)
+
+	//Dialer used for open connections to server and proxies,
+	//if nil it uses net.Dialer
+	Dialer Dialer
+
+	//KeepAlive detect dead server on tunnels, it's enabled only
+	//when server has keepalive enabled. On websocket tunnels only the
+	//server send pings so Timeout must be greater than server Interval
+	KeepAlive KeepAlive
+}
+
+//Dialer allow custom transports for the client
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 //SessionClient it's a session where we can create Services a services it's
@@ -45,24 +65,106 @@ type SessionClient struct {
 	//to guess from baseUrl
 	WSURL string
 
+	//Rendezvous udp address for hole punching announced
+	//by the server, empty when not supported
+	Rendezvous string
+
+	//Audit the server records the session, see WithAudit
+	Audit bool
+
 	APIURL  string
 	hclient *http.Client
 }
 
+//DialOption configure connections of Dial and Listen
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	service  string
+	compress *CompressOptions
+	identity *Identity
+	consent  Consent
+}
+
+//WithCompression negotiate compression with the peer,
+//the peer must use it too on Dial or Listen
+func WithCompression(opts CompressOptions) DialOption {
+	return func(c *dialOptions) {
+		c.compress = &opts
+	}
+}
+
+func newDialOptions(service string, opts []DialOption) dialOptions {
+	options := dialOptions{service: service}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+//wrap *conn* asking consent first and then compression
+func (c dialOptions) wrap(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		return conn, err
+	}
+
+	var consented *ConsentConn
+	switch {
+	case c.identity != nil:
+		access, err := requestConsent(conn, c.service, *c.identity)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		consented = &ConsentConn{Access: access, Identity: *c.identity}
+	case c.consent != nil:
+		access, identity, err := acceptConsent(conn, c.service, c.consent)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		consented = &ConsentConn{Access: access, Identity: identity}
+	}
+
+	if c.compress != nil {
+		cconn, err := NewCompressConn(conn, *c.compress)
+		if err != nil {
+			return nil, err
+		}
+		conn = cconn
+	}
+	if consented != nil {
+		consented.Conn = conn
+		return consented, nil
+	}
+	return conn, nil
+}
+
 //SessionListen tunnel type websocket by default
 type SessionListen struct {
 	*SessionClient
 	service string
+	opts    dialOptions
 }
 
 //Accept implements the net.Accept for Websocket
 func (c *SessionListen) Accept() (net.Conn, error) {
-	return c.dialWebsocket(c.service, "/listen")
+	for {
+		conn, err := c.opts.wrap(c.dialWebsocket(c.service, "/listen"))
+		if !consentRefused(err) {
+			return conn, err
+		}
+	}
 }
 
 //Accept implements the net.Accept for TCP
 func (c *SessionListen) AcceptTCP() (net.Conn, error) {
-	return c.dialTCP(c.service, "/listen")
+	for {
+		conn, err := c.opts.wrap(c.dialTCP(c.service, "/listen"))
+		if !consentRefused(err) {
+			return conn, err
+		}
+	}
 }
 
 func (c *SessionListen) Close() error {
@@ -78,10 +180,16 @@ func (c *SessionListen) Addr() net.Addr {
 type SessionListenTCP struct {
 	*SessionClient
 	service string
+	opts    dialOptions
 }
 
 func (c *SessionListenTCP) Accept() (net.Conn, error) {
-	return c.dialTCP(c.service, "/listen")
+	for {
+		conn, err := c.opts.wrap(c.dialTCP(c.service, "/listen"))
+		if !consentRefused(err) {
+			return conn, err
+		}
+	}
 }
 
 func (c *SessionListenTCP) Close() error {
@@ -93,12 +201,25 @@ func (c *SessionListenTCP) Addr() net.Addr {
 	return nil
 }
 
+//SessionOption configure the session created by NewSession
+type SessionOption func(*http.Request)
+
+//WithAudit ask the server to record the session, SessionClient.Audit
+//tells if the server does it
+func WithAudit() SessionOption {
+	return func(req *http.Request) {
+		req.Header.Set(headerAudit, "1")
+	}
+}
+
 //NewSession create a session on server
-func (c *Client) NewSession(_url string, authToken string) (*SessionClient, error) {
+func (c *Client) NewSession(_url string, authToken string, opts ...SessionOption) (*SessionClient, error) {
 
 	hclient := &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: c.TLSConfig,
+			Proxy:           c.proxyFunc(),
+			DialContext:     c.dialer().DialContext,
 		},
 	}
 
@@ -107,6 +228,9 @@ func (c *Client) NewSession(_url string, authToken string) (*SessionClient, erro
 		return nil, err
 	}
 	req.Header.Set("X-Auth-Token", authToken)
+	for _, opt := range opts {
+		opt(req)
+	}
 	resp, err := hclient.Do(req)
 	if err != nil {
 		return nil, err
@@ -132,31 +256,38 @@ func (c *SessionClient) Destroy() {
 	c.hclient.Do(req)
 }
 
-//Dial create a new *service* -net.Conn- Websocket
-func (c *SessionClient) Dial(service string) (net.Conn, error) {
+//Dial create a new *service* -net.Conn- Websocket,
+//the connection has CloseWrite for half-close
+func (c *SessionClient) Dial(service string, opts ...DialOption) (net.Conn, error) {
 	if runtime.GOARCH == "js" {
-		return c.dialWebsocketJS(service, "/dial")
+		return newDialOptions(service, opts).wrap(c.dialWebsocketJS(service, "/dial"))
 	}
-	return c.dialWebsocket(service, "/dial")
+	return newDialOptions(service, opts).wrap(c.dialWebsocket(service, "/dial"))
 }
 
-//Dial create  a new *service* -net.Conn- TCP
-func (c *SessionClient) DialTCP(service string) (net.Conn, error) {
-	return c.dialTCP(service, "/dial")
+//Dial create  a new *service* -net.Conn- TCP,
+//the connection has CloseWrite for half-close
+func (c *SessionClient) DialTCP(service string, opts ...DialOption) (net.Conn, error) {
+	return newDialOptions(service, opts).wrap(c.dialTCP(service, "/dial"))
 }
 
 //Listen implementes net.Listener for Websocket connections
-func (c *SessionClient) Listen(service string) net.Listener {
-	return &SessionListen{c, service}
+func (c *SessionClient) Listen(service string, opts ...DialOption) net.Listener {
+	return &SessionListen{c, service, newDialOptions(service, opts)}
 }
 
 //Listen implementes net.Listener for TCP connections
-func (c *SessionClient) ListenTCP(service string) net.Listener {
-	return &SessionListenTCP{c, service}
+func (c *SessionClient) ListenTCP(service string, opts ...DialOption) net.Listener {
+	return &SessionListenTCP{c, service, newDialOptions(service, opts)}
 }
 
 func (c *SessionClient) dialTCP(service string, action string) (net.Conn, error) {
+	return c.dialTCPContext(context.Background(), service, action)
+}
 
+//dialTCPContext like dialTCP, *ctx* interrupts it while the
+//server waits the peer of the service
+func (c *SessionClient) dialTCPContext(ctx context.Context, service string, action string) (net.Conn, error) {
 	burl, err := url.Parse(c.APIURL)
 	if err != nil {
 		return nil, err
@@ -168,15 +299,40 @@ func (c *SessionClient) dialTCP(service string, action string) (net.Conn, error)
 		return nil, err
 	}
 
-	var conn net.Conn
-	if burl.Scheme == "https" {
-		conn, err = tls.Dial("tcp", burl.Host, c.TLSConfig)
-	} else {
-		conn, err = net.Dial("tcp", burl.Host)
+	rawconn, err := c.dialURLContext(ctx, burl)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rawconn.Close()
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+	conn, err := c.upgradeTCP(rawconn, burl)
+	close(stop)
+	if <-interrupted {
+		if err == nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
 	}
 	if err != nil {
+		rawconn.Close()
 		return nil, err
 	}
+	return conn, nil
+}
+
+//upgradeTCP the connection *rawconn* to the tunnel of *burl*
+func (c *SessionClient) upgradeTCP(rawconn net.Conn, burl *url.URL) (net.Conn, error) {
+	conn := newActivityConn(rawconn)
 
 	br := bufio.NewReader(conn)
 	bw := bufio.NewWriter(conn)
@@ -185,12 +341,14 @@ func (c *SessionClient) dialTCP(service string, action string) (net.Conn, error)
 	bw.WriteString("Connection: Upgrade\r\n")
 	header := http.Header{}
 	header.Set("X-Auth-Session", c.AuthToken)
-	err = header.Write(bw)
-	if err != nil {
+	if c.KeepAlive.enabled() {
+		header.Set(headerKeepAlive, "1")
+	}
+	if err := header.Write(bw); err != nil {
 		return nil, err
 	}
 	bw.WriteString("\r\n")
-	if err = bw.Flush(); err != nil {
+	if err := bw.Flush(); err != nil {
 		return nil, err
 	}
 
@@ -199,10 +357,15 @@ func (c *SessionClient) dialTCP(service string, action string) (net.Conn, error)
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("sessionClient.dialTCP: http response error %s", resp.Status)
+		return nil, ErrHTTP{resp.StatusCode,
+			"sessionClient.dialTCP: http response error " + resp.Status}
 	}
 
-	return conn, nil
+	if c.KeepAlive.enabled() && resp.Header.Get(headerKeepAlive) != "" {
+		framed := newFramedConn(rawconn, br)
+		return newKeepAliveConn(framed, conn, framed, c.KeepAlive), nil
+	}
+	return &bufferedConn{rawconn, br}, nil
 }
 
 func (c *SessionClient) dialWebsocketJS(service string, action string) (net.Conn, error) {
@@ -232,10 +395,9 @@ func (c *SessionClient) dialWebsocketJS(service string, action string) (net.Conn
 	return jswebsocket.Dial(wsurl)
 }
 
-func (c *SessionClient) dialWebsocket(service string, action string) (*websocket.Conn, error) {
+func (c *SessionClient) dialWebsocket(service string, action string) (net.Conn, error) {
 	var origin string
 	var wsurl string
-	useTls := false
 
 	if c.Origin == "" {
 		origin = "http://localhost"
@@ -250,7 +412,6 @@ func (c *SessionClient) dialWebsocket(service string, action string) (*websocket
 		}
 		if burl.Scheme == "https" {
 			burl.Scheme = "wss"
-			useTls = true
 		} else {
 			burl.Scheme = "ws"
 		}
@@ -264,73 +425,29 @@ func (c *SessionClient) dialWebsocket(service string, action string) (*websocket
 	if err != nil {
 		return nil, err
 	}
-	conf.Protocol = []string{"binary"}
+	conf.Protocol = offerWsProtocols(c.KeepAlive.enabled())
 	conf.Location.Path = fmt.Sprintf(
 		c.Prefix+"/session/%s/conn/%s%s/websocket", c.ID, service, action,
 	)
 
-	//TODO use root cert
-	if useTls {
-		conf.TlsConfig = c.TLSConfig
+	rawconn, err := c.dialURL(conf.Location)
+	if err != nil {
+		return nil, err
 	}
-	wsconn, err := websocket.DialConfig(conf)
+	conn := newActivityConn(rawconn)
+	wsconn, err := websocket.NewClient(conf, conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	return wsconn, nil
-}
-
-func CompressConnection(conn net.Conn) net.Conn {
-	src, dst := net.Pipe()
-
-	go cpdeflate(src, conn)
-	go cpflate(conn, src)
-
-	return dst
-}
-
-func cpflate(dst, src io.ReadWriteCloser) {
-	w := lz4.NewWriter(dst)
-
-	errc := make(chan error)
-	rbuf := make(chan []byte)
-
-	go func() {
-		for {
-			buf := make([]byte, 32*512)
-			rlen, err := src.Read(buf)
-			if err != nil {
-				errc <- err
-			}
-			rbuf <- buf[0:rlen]
-		}
-	}()
-
-loop:
-	for {
-		select {
-		case <-time.Tick(time.Millisecond * 16):
-			w.Flush()
-		case buf := <-rbuf:
-			_, err := w.Write(buf)
-			if err != nil {
-				break loop
-			}
-			w.Flush()
-
-		case <-errc:
-
-			break loop
-		}
-
+	protocol := negotiatedWsProtocol(wsconn)
+	//server will send pings
+	if protocol.keepAlive {
+		return newKeepAliveConn(newWsConn(wsconn, protocol), conn, nil, c.KeepAlive), nil
 	}
-}
-
-func cpdeflate(dst, src io.ReadWriteCloser) {
-	r := lz4.NewReader(src)
 
-	io.Copy(dst, r)
+	return newWsConn(wsconn, protocol), nil
 }
 
 //NetCopy code from io.Copy but with deadline
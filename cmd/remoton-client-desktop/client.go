@@ -2,94 +2,191 @@ package main
 
 import (
 	"crypto/x509"
-	"io"
+	"errors"
 	"net"
-	"net/rpc"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/bit4bit/remoton"
 	"github.com/bit4bit/remoton/common"
+	"github.com/bit4bit/remoton/common/chat"
+	"github.com/bit4bit/remoton/common/control"
+	"github.com/bit4bit/remoton/common/filetransfer"
 	"github.com/bit4bit/remoton/common/p2p/nat"
-	"github.com/bit4bit/remoton/xpra"
+	"github.com/bit4bit/remoton/common/recording"
+	"github.com/bit4bit/remoton/common/rfb"
+	"github.com/bit4bit/remoton/desktop"
 )
 
 type callbackNewConnection func(net.Addr)
 
-//chatRemoton handle remote chat
+//errSwitching the view-only mode it's being switched
+var errSwitching = errors.New("switching the view-only mode, try again")
+
+//chatRemoton handle the chat room of the session
 type chatRemoton struct {
-	cbSend map[net.Conn]func(string)
-	onRecv func(msg string)
+	mutex  sync.Mutex
+	room   *chat.Room
+	name   string
+	onRecv func(msg chat.Message)
+	//Transcripts directory where the chat it's recorded, empty disable
+	Transcripts string
 }
 
 func newChatRemoton() *chatRemoton {
 	return &chatRemoton{
-		cbSend: make(map[net.Conn]func(string)),
+		name: chat.DefaultName(),
 	}
 }
 
-//Send message to next peer
-func (c *chatRemoton) Send(msg string) {
-	for _, f := range c.cbSend {
-		if f != nil {
-			f(msg)
-		}
-	}
+//current room of the session, nil when stopped
+func (c *chatRemoton) current() *chat.Room {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.room
+}
 
+//Send message to the supporters on the room
+func (c *chatRemoton) Send(text string) chat.Message {
+	if room := c.current(); room != nil {
+		return room.Send(text)
+	}
+	return chat.NewText(c.name, text)
 }
 
-//OnRecv callback for new message
-func (c *chatRemoton) OnRecv(f func(msg string)) {
-	c.onRecv = f
+//Typing tell the supporters the customer it's writing
+func (c *chatRemoton) Typing() {
+	if room := c.current(); room != nil {
+		room.Typing()
+	}
 }
 
-func (c *chatRemoton) init() {
-	if c.cbSend == nil {
-		c.cbSend = make(map[net.Conn]func(string))
+//MarkRead the messages received
+func (c *chatRemoton) MarkRead() {
+	if room := c.current(); room != nil {
+		room.MarkRead()
 	}
 }
 
-//Start service
-func (c *chatRemoton) Start(session *remoton.SessionClient) {
-	go c.start(session)
+//Roster names on the room
+func (c *chatRemoton) Roster() []string {
+	if room := c.current(); room != nil {
+		return room.Roster()
+	}
+	return nil
 }
 
-func (c *chatRemoton) start(session *remoton.SessionClient) {
+//OnRecv callback for new message, typing, acks and roster
+func (c *chatRemoton) OnRecv(f func(msg chat.Message)) {
+	c.onRecv = f
+}
 
-	l := session.Listen("chat")
+//chatIdentity name of the supporter approved by the customer
+func chatIdentity(conn net.Conn) string {
+	if consent, ok := remoton.ConsentOf(conn); ok {
+		return consent.Identity.Name
+	}
+	return ""
+}
 
-	for {
-		wsconn, err := l.Accept()
+//Start the room of *session*, the supporters join it
+func (c *chatRemoton) Start(session *remoton.SessionClient, opts ...remoton.DialOption) {
+	room := chat.NewRoom(c.name)
+	room.Identify = chatIdentity
+	room.ViewOnly = remoton.ViewOnly
+	if c.onRecv != nil {
+		room.OnMessage(c.onRecv)
+	}
+	if c.Transcripts != "" {
+		transcript, err := chat.OpenTranscript(c.Transcripts, session.ID)
 		if err != nil {
-			break
+			log.Error("transcript: ", err)
+		} else {
+			room.Transcript = transcript
 		}
+	}
+	c.mutex.Lock()
+	c.room = room
+	c.mutex.Unlock()
+	go room.Serve(session.Listen(chat.Service, opts...))
+}
 
-		c.init()
+func (c *chatRemoton) Stop() {
+	c.mutex.Lock()
+	room := c.room
+	c.room = nil
+	c.mutex.Unlock()
+	if room != nil {
+		room.Close()
+		if room.Transcript != nil {
+			room.Transcript.Close()
+		}
+	}
+}
 
-		go func(remoteConn net.Conn) {
-			c.cbSend[remoteConn] = func(msg string) {
-				remoteConn.Write([]byte(msg))
-			}
+//filesRemoton transfer files with the supporter
+type filesRemoton struct {
+	listener   net.Listener
+	compressed net.Listener
+	server     *filetransfer.Server
+	onOffer    func(offer filetransfer.Offer) bool
+	onReceived func(offer filetransfer.Offer, path string, err error)
+}
+
+func newFilesRemoton() *filesRemoton {
+	return &filesRemoton{}
+}
+
+//OnOffer callback asking the customer to accept a file
+func (c *filesRemoton) OnOffer(f func(offer filetransfer.Offer) bool) {
+	c.onOffer = f
+}
+
+//OnReceived callback for files saved or failed
+func (c *filesRemoton) OnReceived(f func(offer filetransfer.Offer, path string, err error)) {
+	c.onReceived = f
+}
 
-			for {
-				buf := make([]byte, 32*512)
-				rlen, err := remoteConn.Read(buf)
-				if err != nil {
-					delete(c.cbSend, remoteConn)
-					break
-				}
-				if c.onRecv != nil {
-					c.onRecv(strings.TrimSpace(string(buf[0:rlen])))
-				}
+//Start service, the supporters agreeing the compression
+//connect to the compressed one
+func (c *filesRemoton) Start(session *remoton.SessionClient, opts ...remoton.DialOption) {
+	c.listener = session.Listen(filetransfer.Service, opts...)
+	c.compressed = session.Listen(filetransfer.ServiceCompressed,
+		append(opts[:len(opts):len(opts)], remoton.WithCompression(remoton.CompressOptions{Adaptive: true}))...)
+	c.server = filetransfer.NewServer(filetransfer.Config{
+		Dir:    filetransfer.DefaultDir(),
+		Prompt: c.onOffer,
+		Received: func(offer filetransfer.Offer, path string, err error) {
+			if c.onReceived != nil {
+				c.onReceived(offer, path, err)
 			}
+		},
+	})
+	c.server.ViewOnly = remoton.ViewOnly
+	go c.server.Serve(c.listener)
+	go c.server.Serve(c.compressed)
+}
 
-		}(wsconn)
+//Send file *name* to the supporter
+func (c *filesRemoton) Send(name string, progress func(sent, total int64)) error {
+	if c.server == nil {
+		return filetransfer.ErrNotConnected
 	}
-
+	return c.server.Send(name, progress)
 }
 
-func (c *chatRemoton) Stop() {
+func (c *filesRemoton) Stop() {
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.compressed != nil {
+		c.compressed.Close()
+	}
+	if c.server != nil {
+		c.server.Close()
+	}
 }
 
 type vncRemoton struct {
@@ -97,128 +194,118 @@ type vncRemoton struct {
 	onConnection func(net.Addr)
 	natif        nat.Interface
 	iport        int
-	eport        int
-	elistener    net.Listener //external listener for public access
-	xpra         *xpra.Xpra
+	listener     *remoton.P2PListener
+	backend      desktop.Backend
+	//Backends to share the desktop by preference, the first installed it's used
+	Backends []desktop.Backend
+	//allowProcesses consent of the customer, 1 when allowed
+	allowProcesses int32
+	//view view-only mode switched by the customer
+	view       *control.ViewSwitch
+	onViewOnly func(viewOnly bool)
+	mutex      sync.Mutex
+	running    bool
+	//tunnels of the supporters open to a backend without RFB
+	tunnels int
+	//switching the view-only mode, the desktop server it's restarting
+	switching bool
+	//Recordings directory where the desktop it's recorded, empty disable
+	Recordings string
+	//XpraRange versions of xpra of the supporters accepted, see control.ParseRange
+	XpraRange string
+	//record the next connections of the supporters, 1 when enabled
+	record  int32
+	session string
 }
 
 func newVncRemoton() *vncRemoton {
-	return &vncRemoton{xpra: &xpra.Xpra{}}
+	return &vncRemoton{Backends: desktop.Backends(), view: control.NewViewSwitch(false)}
 }
 
-//Start vnc server now it's xpra and connect to server
-func (c *vncRemoton) Start(session *remoton.SessionClient, password string) error {
+//server first backend installed
+func (c *vncRemoton) server() (desktop.Backend, error) {
+	for _, backend := range c.Backends {
+		if backend.CanServe() {
+			return backend, nil
+		}
+	}
+	return nil, desktop.ErrNoBackend
+}
+
+//Start the desktop server xpra or vnc and connect to server
+func (c *vncRemoton) Start(session *remoton.SessionClient, password string, opts ...remoton.DialOption) error {
 	var err error
 	var port string
 	port, c.iport = common.FindFreePortTCP(6900)
 
 	addrSrv := net.JoinHostPort("localhost", port)
-	c.xpra.SetPassword(password)
-	err = c.xpra.Bind(addrSrv)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.session = session.ID
+	c.backend, err = c.server()
+	if err != nil {
+		return err
+	}
+	c.backend.SetPassword(password)
+	c.backend.SetViewOnly(c.view.ViewOnly())
+	err = c.backend.Serve(addrSrv)
 	if err != nil {
 		log.Error("vncRemoton:", err)
 		return err
 	}
+	addrSrv = c.backend.Addr()
 	conn, err := net.DialTimeout("tcp", addrSrv, time.Second*3)
 	if err != nil {
-		c.xpra.Terminate()
+		c.backend.Terminate()
 		return err
 	}
 	conn.Close()
-	log.Println("started xpra")
+	log.Println("started", c.backend.Protocol(), c.backend.Version())
 
-	go c.startNat(addrSrv)
-	go c.startRPC(
-		common.Capabilities{
-			XpraVersion: c.xpra.Version(),
-		},
-		session,
-		addrSrv)
-	go c.start(session, addrSrv)
-	return nil
-}
-
-//startNat add support for nat
-func (c *vncRemoton) startNat(addrSrv string) error {
-	var err error
-	var eport string
-	eport, c.eport = common.FindFreePortTCP(44442)
+	//support direct connections behind nat
 	c.natif, err = nat.Parse("any")
 	if err != nil {
 		log.Error(err)
-		return err
-	}
-
-	if _, err = c.natif.ExternalIP(); err != nil {
-		return err
-	}
-
-	if err = c.natif.DeleteMapping("TCP", 9932, c.eport); err != nil {
-		log.Infof("can't delete external map: %s", err.Error())
 	}
-
-	if err = c.natif.AddMapping("TCP", 9932, c.eport, "remoton", time.Hour); err != nil {
-		log.Infof("can't add mapping external map: %d -> %d", 9932, c.eport)
-		return err
-	}
-
-	c.elistener, err = net.Listen("tcp", net.JoinHostPort("0.0.0.0", eport))
+	c.listener, err = session.ListenP2P("nx", remoton.P2PConfig{NAT: c.natif}, opts...)
 	if err != nil {
+		c.backend.Terminate()
 		return err
 	}
-	log.Println("Nat enabled")
-	//redict from public to localhost
-	go func() {
-		eip, err := c.natif.ExternalIP()
-		if err != nil {
-			return
-		}
-
-		for {
-			conn, err := c.elistener.Accept()
-			if err != nil {
-				break
-			}
-			//only allow frow gateway
-			if !strings.EqualFold(conn.RemoteAddr().String(), eip.String()) {
-				conn.Close()
-				continue
-			}
-			proxy, err := net.DialTimeout("tcp", addrSrv, time.Second)
-			if err != nil {
-				break
-			}
-			go io.Copy(conn, proxy)
-			go io.Copy(proxy, conn)
-		}
-	}()
 
+	caps := desktop.ServerCapabilities(c.backend)
+	caps.XpraRange = c.XpraRange
+	caps.Protocols = append(caps.Protocols, control.ProtocolChat, control.ProtocolViewOnly, control.ProtocolFiles)
+	caps.Compression = remoton.CompressAlgorithms()
+	go c.startRPC(caps,
+		session.Listen("rpc", opts...),
+		addrSrv)
+	go c.start(c.listener, addrSrv, c.backend.Protocol())
+	c.running = true
 	return nil
 }
 
-func (c *vncRemoton) stopNat() {
-	if c.natif != nil {
-		if err := c.natif.DeleteMapping("TCP", 9932, c.eport); err != nil {
-			log.Infof("can't delete external map: %s", err.Error())
-		}
-	}
-	if c.elistener != nil {
-		c.elistener.Close()
+func (c *vncRemoton) startRPC(caps common.Capabilities, l net.Listener, addrSrv string) {
+	detected := c.listener.NAT()
+	log.Println("vncRemoton.startRPC: nat", detected.NAT, detected.Mapped)
+	mapping := c.listener.Mapping()
+	if mapping != nil {
+		log.Println("vncRemoton.startRPC: external port", mapping.ExternalPort)
 	}
-}
-
-func (c *vncRemoton) startRPC(caps common.Capabilities, session *remoton.SessionClient, addrSrv string) {
-	l := session.Listen("rpc")
-	srv := rpc.NewServer()
-	srv.Register(&common.RemotonClient{
-		Capabilities: &caps,
-		NatIF:        c.natif,
+	err := common.ServeRPC(l, &common.RemotonClient{
+		Capabilities:   &caps,
+		NatIF:          c.natif,
+		Mapping:        mapping,
+		STUN:           detected,
+		AllowProcesses: c.ProcessesAllowed,
+		View:           c.view,
 	})
-	srv.Accept(l)
+	log.Println("vncRemoton.startRPC:", err)
 }
 
-func (c *vncRemoton) start(session *remoton.SessionClient, addrSrv string) {
-	l := session.ListenTCP("nx")
+//start tunneling the supporters to the desktop on *addrSrv*,
+//the VNC tunnels are parsed to enforce the view-only mode
+func (c *vncRemoton) start(l *remoton.P2PListener, addrSrv string, protocol string) {
 	for {
 		log.Println("vncRemoton.start: waiting connection")
 		wsconn, err := l.Accept()
@@ -226,6 +313,20 @@ func (c *vncRemoton) start(session *remoton.SessionClient, addrSrv string) {
 			log.Error(err)
 			break
 		}
+		log.Println("vncRemoton.start: connection", wsconn.(*remoton.P2PConn).Path)
+		consent, ok := remoton.ConsentOf(wsconn)
+		viewOnly := false
+		if ok {
+			log.Println("vncRemoton.start:", consent.Identity, "with", consent.Access)
+			viewOnly = consent.Access == remoton.AccessViewOnly
+		}
+		if protocol != control.ProtocolVNC {
+			if err := c.admit(ok, viewOnly); err != nil {
+				log.Error("vncRemoton.start: ", err)
+				wsconn.Close()
+				continue
+			}
+		}
 
 		if c.onConnection != nil {
 			c.onConnection(wsconn.RemoteAddr())
@@ -234,52 +335,231 @@ func (c *vncRemoton) start(session *remoton.SessionClient, addrSrv string) {
 		conn, err := net.Dial("tcp", addrSrv)
 		if err != nil {
 			log.Error("vncRemoton.start:", addrSrv, err)
-			break
+			wsconn.Close()
+			if protocol != control.ProtocolVNC {
+				c.release()
+			}
+			continue
 		}
 
-		go c.handleTunnel(conn, wsconn)
+		var recorder *recording.Writer
+		if c.Recording() {
+			meta := recording.Metadata{Session: c.session, Service: "nx", Protocol: protocol}
+			if ok {
+				meta.Supporter = consent.Identity.String()
+			}
+			recorder, err = c.createRecording(meta)
+			if err != nil {
+				log.Error("vncRemoton.start: recording ", err)
+			} else {
+				conn = recorder.Desktop(conn)
+			}
+		}
+
+		go func(conn net.Conn) {
+			if protocol == control.ProtocolVNC {
+				c.handleRFB(conn, wsconn, viewOnly)
+			} else {
+				c.handleTunnel(conn, wsconn)
+			}
+			if recorder != nil {
+				recorder.Close()
+			}
+		}(conn)
+	}
+}
+
+//createRecording of the connection of a supporter on Recordings
+func (c *vncRemoton) createRecording(meta recording.Metadata) (*recording.Writer, error) {
+	w, err := recording.Create(c.Recordings, meta)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("vncRemoton: recording", meta.Session, "of", meta.Supporter)
+	return w, nil
+}
+
+//SetRecording record the desktop on the next connections of the
+//supporters, it needs Recordings
+func (c *vncRemoton) SetRecording(record bool) {
+	var value int32
+	if record && c.Recordings != "" {
+		value = 1
+	}
+	atomic.StoreInt32(&c.record, value)
+}
+
+//Recording the connections of the supporters
+func (c *vncRemoton) Recording() bool {
+	return atomic.LoadInt32(&c.record) == 1
+}
+
+//admit a supporter to a backend without RFB, its view-only mode it's
+//the one of the desktop so a granted *viewOnly* switches it when nobody
+//it's connected and mixed access levels are refused
+func (c *vncRemoton) admit(consented, viewOnly bool) error {
+	c.mutex.Lock()
+	if consented && c.switching {
+		c.mutex.Unlock()
+		return errSwitching
+	}
+	switched := consented && c.view.ViewOnly() != viewOnly
+	if switched && c.tunnels > 0 {
+		c.mutex.Unlock()
+		return errors.New("the supporters connected have another access, mixed access unsupported by " + c.backend.Protocol())
+	}
+	c.tunnels++
+	c.switching = switched
+	onViewOnly := c.onViewOnly
+	c.mutex.Unlock()
+
+	if !switched {
+		return nil
 	}
+	if err := c.switchViewOnly(viewOnly); err != nil {
+		c.release()
+		return err
+	}
+	if onViewOnly != nil {
+		onViewOnly(viewOnly)
+	}
+	return nil
 }
 
 func (c *vncRemoton) handleTunnel(local net.Conn, remote net.Conn) {
 	log.Println("vncRemoton.handleTunnel")
-	errc := make(chan error, 2)
-	go func() {
-		_, err := io.Copy(local, remote)
-		errc <- err
-	}()
-	go func() {
-		_, err := io.Copy(remote, local)
-		errc <- err
-	}()
+	log.Println("vncRemoton: closing connections", remoton.Join(local, remote))
+	c.release()
+}
+
+//release the tunnel of a supporter admitted
+func (c *vncRemoton) release() {
+	c.mutex.Lock()
+	c.tunnels--
+	c.mutex.Unlock()
+}
+
+//handleRFB drops the input of the supporter while the desktop
+//it's view-only or the supporter was granted *viewOnly*
+func (c *vncRemoton) handleRFB(local net.Conn, remote net.Conn, viewOnly bool) {
+	relay := &rfb.Relay{
+		ViewOnly: func() bool {
+			return viewOnly || c.view.ViewOnly()
+		},
+		OnEncodings: func(encodings []rfb.Encoding) {
+			log.Println("vncRemoton.handleRFB: encodings", encodings)
+		},
+	}
+	log.Println("vncRemoton: closing connections", relay.Join(remote, local))
+}
+
+//AllowProcesses consent of the customer to the supporter
+//listing and killing processes
+func (c *vncRemoton) AllowProcesses(allow bool) {
+	var value int32
+	if allow {
+		value = 1
+	}
+	atomic.StoreInt32(&c.allowProcesses, value)
+}
+
+//ProcessesAllowed by the customer
+func (c *vncRemoton) ProcessesAllowed() bool {
+	return atomic.LoadInt32(&c.allowProcesses) == 1
+}
+
+//SetViewOnly disable the keyboard and mouse of the supporters,
+//the desktop server it's restarted and the supporters attach again
+func (c *vncRemoton) SetViewOnly(viewOnly bool) error {
+	c.mutex.Lock()
+	if c.switching {
+		c.mutex.Unlock()
+		return errSwitching
+	}
+	if c.view.ViewOnly() == viewOnly {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.switching = true
+	c.mutex.Unlock()
+	return c.switchViewOnly(viewOnly)
+}
+
+//switchViewOnly restart the desktop server outside the lock,
+//the switch was reserved with switching
+func (c *vncRemoton) switchViewOnly(viewOnly bool) error {
+	c.mutex.Lock()
+	running, backend := c.running, c.backend
+	c.mutex.Unlock()
 
-	log.Println("vncRemoton: closing connections", <-errc)
+	var err error
+	if running {
+		backend.SetViewOnly(viewOnly)
+		err = backend.Restart()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.switching = false
+	//stopped meanwhile
+	if running && !c.running {
+		backend.Terminate()
+	}
+	if err != nil {
+		return err
+	}
+	//the supporters attach when the server it's ready
+	c.view.Set(viewOnly)
+	return nil
+}
+
+//ViewOnly the supporters can't use the keyboard and mouse
+func (c *vncRemoton) ViewOnly() bool {
+	return c.view.ViewOnly()
 }
 
 func (c *vncRemoton) OnConnection(cb func(addr net.Addr)) {
 	c.onConnection = cb
 }
 
+//OnViewOnly called when the access granted to a supporter
+//switches the view-only mode of the desktop
+func (c *vncRemoton) OnViewOnly(cb func(viewOnly bool)) {
+	c.onViewOnly = cb
+}
+
 func (c *vncRemoton) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.running = false
 	if c.conn != nil {
 		c.conn.Close()
 	}
-	go c.stopNat()
-	c.xpra.Terminate()
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.backend != nil {
+		c.backend.Terminate()
+	}
 }
 
 type clientRemoton struct {
 	client  *remoton.Client
 	Chat    *chatRemoton
 	VNC     *vncRemoton
+	Files   *filesRemoton
 	session *remoton.SessionClient
 	started bool
+	//Audit ask the server to record the session
+	Audit     bool
+	onConsent remoton.Consent
 }
 
 func newClient(rclient *remoton.Client) *clientRemoton {
 	return &clientRemoton{client: rclient,
 		Chat:    newChatRemoton(),
 		VNC:     newVncRemoton(),
+		Files:   newFilesRemoton(),
 		started: false}
 }
 
@@ -297,21 +577,38 @@ func (c *clientRemoton) SetInsecure() {
 
 func (c *clientRemoton) Start(srvAddr string, authToken, password string) error {
 	var err error
-	c.session, err = c.client.NewSession("https://"+srvAddr, authToken)
+	var opts []remoton.SessionOption
+	if c.Audit {
+		opts = append(opts, remoton.WithAudit())
+	}
+	c.session, err = c.client.NewSession("https://"+srvAddr, authToken, opts...)
 	if err != nil {
 		return err
 	}
 
-	err = c.VNC.Start(c.session, password)
+	//every supporter connection waits the customer approval,
+	//the access it's enforced per connection
+	var consent []remoton.DialOption
+	if c.onConsent != nil {
+		consent = append(consent, remoton.WithConsent(remoton.RememberConsent(c.onConsent)))
+	}
+	err = c.VNC.Start(c.session, password, consent...)
 	if err != nil {
 		return err
 	}
-	c.Chat.Start(c.session)
+	c.Chat.Start(c.session, consent...)
+	c.Files.Start(c.session, consent...)
 
 	c.started = true
 	return nil
 }
 
+//OnConsent callback asking the customer the access of a supporter,
+//it's asked once per supporter on the session
+func (c *clientRemoton) OnConsent(f func(req remoton.ConsentRequest) remoton.Access) {
+	c.onConsent = f
+}
+
 func (c *clientRemoton) MachineID() string {
 	if c.session == nil {
 		return ""
@@ -325,6 +622,7 @@ func (c *clientRemoton) Stop() {
 
 func (c *clientRemoton) Terminate() {
 	c.Chat.Stop()
+	c.Files.Stop()
 	c.VNC.Stop()
 	if c.session != nil {
 		c.session.Destroy()
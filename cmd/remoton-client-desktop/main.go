@@ -10,16 +10,22 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"unsafe"
 
 	"github.com/bit4bit/remoton"
 	"github.com/bit4bit/remoton/common"
+	"github.com/bit4bit/remoton/common/chat"
+	"github.com/bit4bit/remoton/common/control"
+	"github.com/bit4bit/remoton/common/filetransfer"
+	"github.com/bit4bit/remoton/desktop"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mattn/go-gtk/gdk"
@@ -31,6 +37,12 @@ var (
 	clremoton       *clientRemoton
 	machinePassword string
 	insecure        = flag.Bool("insecure", false, "skip verify tls")
+	audit           = flag.Bool("audit", false, "ask the server to record the chat of the session")
+	transcripts     = flag.String("transcripts", "", "directory where the chat transcripts are saved, empty disable")
+	desktopFlag     = flag.String("desktop", "", "desktop shared xpra or vnc, empty the first installed")
+	vncServer       = flag.String("vnc-server", "", "address of a running RFB server shared instead of x11vnc")
+	recordings      = flag.String("recordings", "", "directory where the desktop sessions are recorded, empty disable")
+	xpraRange       = flag.String("xpra-range", "", "versions of xpra of the supporters accepted as \">=4.0 <6\", empty the same major")
 )
 
 func main() {
@@ -40,7 +52,25 @@ func main() {
 	common.SetDefaultGtkTheme()
 
 	machinePassword = remoton.GenerateAuthUser()
-	clremoton = newClient(&remoton.Client{Prefix: "/remoton", TLSConfig: &tls.Config{}})
+	clremoton = newClient(&remoton.Client{Prefix: "/remoton", TLSConfig: &tls.Config{},
+		KeepAlive: remoton.DefaultKeepAlive})
+	clremoton.Audit = *audit
+	clremoton.Chat.Transcripts = *transcripts
+	clremoton.VNC.Recordings = *recordings
+	if _, err := control.ParseRange(*xpraRange); err != nil {
+		log.Fatal(err)
+	}
+	clremoton.VNC.XpraRange = *xpraRange
+	vnc := desktop.NewVNC()
+	vnc.Server = *vncServer
+	clremoton.VNC.Backends = []desktop.Backend{desktop.NewXpra(), vnc}
+	if *desktopFlag != "" {
+		backend, err := desktop.Choose(*desktopFlag, clremoton.VNC.Backends...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clremoton.VNC.Backends = []desktop.Backend{backend}
+	}
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGABRT, syscall.SIGKILL, syscall.SIGTERM)
 	go func() {
@@ -132,10 +162,34 @@ func main() {
 	}
 
 	btnSrv := gtk.NewButtonWithLabel("Start")
+	checkViewOnly := gtk.NewCheckButtonWithLabel("View only, the supporter can't use keyboard and mouse")
 	clremoton.VNC.OnConnection(func(addr net.Addr) {
-		statusbar.Push(contextID, "Someone connected")
+		common.GtkMain(func() {
+			statusbar.Push(contextID, "Someone connected")
+		})
 		log.Println("New connection from:" + addr.String())
 	})
+	clremoton.OnConsent(func(req remoton.ConsentRequest) remoton.Access {
+		access := remoton.AccessDenied
+		common.GtkMain(func() {
+			choice := common.GtkChoose(window,
+				fmt.Sprintf("The supporter %s wants to connect (%s).\nAllow it?", req.Identity, req.Service),
+				"Deny", "View only", "Full control")
+			switch choice {
+			case 1:
+				access = remoton.AccessViewOnly
+			case 2:
+				access = remoton.AccessFull
+			}
+			statusbar.Push(contextID, fmt.Sprintf("%s: %s", req.Identity.Name, access))
+		})
+		return access
+	})
+	clremoton.VNC.OnViewOnly(func(viewOnly bool) {
+		common.GtkMain(func() {
+			checkViewOnly.SetActive(viewOnly)
+		})
+	})
 	btnSrv.Clicked(func() {
 		if *insecure {
 			clremoton.SetInsecure()
@@ -177,6 +231,92 @@ func main() {
 	})
 	controlBox.Add(btnSrv)
 
+	checkProcesses := gtk.NewCheckButtonWithLabel("Allow supporter to see and kill processes")
+	checkProcesses.Connect("toggled", func() {
+		clremoton.VNC.AllowProcesses(checkProcesses.GetActive())
+	})
+	controlBox.Add(checkProcesses)
+
+	checkViewOnly.Connect("toggled", func() {
+		viewOnly := checkViewOnly.GetActive()
+		if viewOnly == clremoton.VNC.ViewOnly() {
+			return
+		}
+		statusbar.Push(contextID, "Switching view only")
+		go func() {
+			err := clremoton.VNC.SetViewOnly(viewOnly)
+			if err != nil {
+				log.Error(err)
+			}
+			common.GtkMain(func() {
+				switch {
+				case err != nil:
+					statusbar.Push(contextID, "Failed switching view only")
+				case viewOnly:
+					statusbar.Push(contextID, "View only")
+				default:
+					statusbar.Push(contextID, "Full control")
+				}
+			})
+		}()
+	})
+	controlBox.Add(checkViewOnly)
+
+	checkRecord := gtk.NewCheckButtonWithLabel("Record the desktop of this session")
+	checkRecord.SetSensitive(*recordings != "")
+	checkRecord.Connect("toggled", func() {
+		clremoton.VNC.SetRecording(checkRecord.GetActive())
+		if checkRecord.GetActive() {
+			statusbar.Push(contextID, "Recording on "+*recordings)
+		} else {
+			statusbar.Push(contextID, "Not recording")
+		}
+	})
+	controlBox.Add(checkRecord)
+
+	btnSendFile := gtk.NewButtonWithLabel("Send file")
+	btnSendFile.Clicked(func() {
+		name := common.GtkChooseFile(window, "Send file to supporter")
+		if name == "" {
+			return
+		}
+		statusbar.Push(contextID, "Sending "+filepath.Base(name))
+		go func() {
+			err := clremoton.Files.Send(name, nil)
+			if err != nil {
+				log.Error(err)
+			}
+			common.GtkMain(func() {
+				if err != nil {
+					statusbar.Push(contextID, "Failed sending "+filepath.Base(name))
+					return
+				}
+				statusbar.Push(contextID, "Sent "+filepath.Base(name))
+			})
+		}()
+	})
+	controlBox.Add(btnSendFile)
+	clremoton.Files.OnOffer(func(offer filetransfer.Offer) bool {
+		accept := false
+		common.GtkMain(func() {
+			accept = common.GtkConfirm(window, fmt.Sprintf("Accept the file %s (%d bytes) from the supporter?",
+				offer.Name, offer.Size))
+		})
+		return accept
+	})
+	clremoton.Files.OnReceived(func(offer filetransfer.Offer, path string, err error) {
+		if err != nil {
+			log.Error(err)
+		}
+		common.GtkMain(func() {
+			if err != nil {
+				statusbar.Push(contextID, "Failed receiving "+offer.Name)
+				return
+			}
+			statusbar.Push(contextID, "Received "+path)
+		})
+	})
+
 	//---
 	// CHAT
 	//---
@@ -186,25 +326,46 @@ func main() {
 
 	swinChat := gtk.NewScrolledWindow(nil, nil)
 	chatHistory := gtk.NewTextView()
-	clremoton.Chat.OnRecv(func(msg string) {
-		chatHistoryRecv(chatHistory, msg)
+	chatStatus := gtk.NewLabel("")
+	chatRoster := gtk.NewLabel("")
+	clremoton.Chat.OnRecv(func(msg chat.Message) {
+		common.GtkMain(func() {
+			switch msg.Kind {
+			case chat.KindText:
+				chatHistoryRecv(chatHistory, msg.String())
+			case chat.KindRoster:
+				chatRoster.SetText("In chat: " + strings.Join(msg.Members, ", "))
+				return
+			case chat.KindJoin, chat.KindLeave:
+				chatHistoryRecv(chatHistory, msg.Status())
+			}
+			chatStatus.SetText(msg.Status())
+		})
 	})
 
 	swinChat.Add(chatHistory)
 
 	chatEntry := gtk.NewEntry()
+	chatEntry.Connect("focus-in-event", func() {
+		clremoton.Chat.MarkRead()
+	})
 	chatEntry.Connect("key-press-event", func(ctx *glib.CallbackContext) {
 		arg := ctx.Args(0)
 		event := *(**gdk.EventKey)(unsafe.Pointer(&arg))
+		clremoton.Chat.MarkRead()
 		if event.Keyval == gdk.KEY_Return {
 			msgToSend := chatEntry.GetText()
-			clremoton.Chat.Send(msgToSend)
-			chatHistorySend(chatHistory, msgToSend)
+			msg := clremoton.Chat.Send(msgToSend)
+			chatHistorySend(chatHistory, msg.String())
 			chatEntry.SetText("")
+		} else {
+			clremoton.Chat.Typing()
 		}
 
 	})
+	chatBox.Add(chatRoster)
 	chatBox.Add(chatEntry)
+	chatBox.Add(chatStatus)
 	chatBox.Add(swinChat)
 
 	hpaned.Pack1(frameControl, false, false)
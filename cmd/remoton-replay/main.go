@@ -0,0 +1,148 @@
+//remoton-replay serves a desktop session recorded by the client to a
+//local viewer, xpra or vnc as it was recorded.
+//
+//The recording it's played as it was, the handshake of the viewer it's
+//ignored: the RFB SetPixelFormat and SetEncodings of the viewer don't
+//change the recorded updates and the xpra hello it's answered with the
+//recorded one. The replay works with a viewer asking what the recorded
+//viewer asked, the same viewer and options used on the session.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bit4bit/remoton/common/recording"
+	"github.com/bit4bit/remoton/desktop"
+)
+
+var (
+	listen      = flag.String("listen", "localhost:0", "address where the viewer connects")
+	speed       = flag.Float64("speed", 1, "speed of the replay, 2 twice as fast, 0 without waiting")
+	attach      = flag.Bool("attach", true, "launch the viewer of the protocol recorded")
+	desktopFlag = flag.String("desktop", "", "protocol of the viewer xpra or vnc, empty the recorded")
+	info        = flag.Bool("info", false, "print the metadata and the chunks of the recording and exit")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] recording%s\n", os.Args[0], recording.Ext)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := recording.NewReader(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *info {
+		if err := printInfo(reader); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	protocol := reader.Metadata.Protocol
+	if *desktopFlag != "" {
+		protocol = *desktopFlag
+	}
+	if err := replay(reader, protocol); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//replay the recording to the first viewer connected, what the
+//viewer sends it's discarded
+func replay(reader *recording.Reader, protocol string) error {
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Println("replaying", reader.Metadata.Session, "on", l.Addr())
+
+	if *attach {
+		viewer, err := desktop.Choose(protocol, desktop.Backends()...)
+		if err != nil {
+			return fmt.Errorf("%v: %q use -desktop", err, protocol)
+		}
+		//the recorded server accepts any password
+		viewer.SetPassword("remoton-replay")
+		viewer.SetViewOnly(true)
+		if err := viewer.Attach(l.Addr().String()); err != nil {
+			return err
+		}
+		defer viewer.Terminate()
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//the input of the viewer goes nowhere
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	start := time.Now()
+	err = reader.Play(conn, *speed)
+	log.Println("replayed in", time.Since(start))
+	if err != nil {
+		return err
+	}
+	//the last frame stays until the viewer it's closed
+	<-closed
+	return nil
+}
+
+func printInfo(reader *recording.Reader) error {
+	meta := reader.Metadata
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "session\t%s\n", meta.Session)
+	fmt.Fprintf(w, "service\t%s\n", meta.Service)
+	fmt.Fprintf(w, "protocol\t%s\n", meta.Protocol)
+	fmt.Fprintf(w, "started\t%s\n", meta.Started.Format(time.RFC3339))
+	fmt.Fprintf(w, "supporter\t%s\n", meta.Supporter)
+
+	chunks := make(map[recording.Direction]int)
+	bytes := make(map[recording.Direction]int)
+	var duration time.Duration
+	for {
+		chunk, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunks[chunk.Direction]++
+		bytes[chunk.Direction] += len(chunk.Data)
+		duration = chunk.Offset
+	}
+	fmt.Fprintf(w, "duration\t%s\n", duration)
+	for _, direction := range []recording.Direction{recording.FromDesktop, recording.FromViewer} {
+		fmt.Fprintf(w, "%s\t%d chunks\t%d bytes\n", direction, chunks[direction], bytes[direction])
+	}
+	return w.Flush()
+}
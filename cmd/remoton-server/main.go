@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/subtle"
 	"flag"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -11,6 +13,8 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/bit4bit/remoton"
+	"github.com/bit4bit/remoton/common/chat"
+	"github.com/bit4bit/remoton/common/p2p/stun"
 
 	"github.com/throttled/throttled"
 	"github.com/throttled/throttled/store"
@@ -22,6 +26,11 @@ var (
 	certFile      = flag.String("cert", "cert.pem", "cert pem")
 	keyFile       = flag.String("key", "key.pem", "key pem")
 	profile       = flag.String("cpuprofile", "", "output profile to file")
+	keepAlive     = flag.Duration("keepalive", remoton.DefaultKeepAlive.Interval, "interval of tunnels heartbeat, 0 disable")
+	keepAliveWait = flag.Duration("keepalive-timeout", remoton.DefaultKeepAlive.Timeout, "close tunnels without heartbeat after")
+	rendezvous    = flag.String("rendezvous", ":9935", "udp address of the STUN server for hole punching, empty disable")
+	stunAlternate = flag.String("stun-alternate", ":9936", "second udp address of the STUN server for nat detection, empty disable")
+	transcripts   = flag.String("transcripts", "", "directory of the chat transcripts of audited sessions, empty disable")
 )
 
 func main() {
@@ -55,13 +64,58 @@ func main() {
 		&throttled.VaryBy{RemoteAddr: true},
 		store.NewMemStore(100),
 	)
+	srv := remoton.NewServer(func(authToken string, r *http.Request) bool {
+		return validToken(authToken)
+	}, func() string {
+		return remoton.GenerateAuthUser()
+	})
+	srv.KeepAlive = remoton.KeepAlive{Interval: *keepAlive, Timeout: *keepAliveWait}
+	srv.OnTunnelClose = func(sessionID, service string, err error) {
+		if err != nil {
+			log.Infof("tunnel %s/%s closed: %s", sessionID, service, err)
+		}
+	}
+
+	if *rendezvous != "" {
+		pc, err := net.ListenPacket("udp", *rendezvous)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("STUN at UDP ", *rendezvous)
+		stunSrv := &stun.Server{Primary: pc}
+		if *stunAlternate != "" {
+			stunSrv.Alternate, err = net.ListenPacket("udp", *stunAlternate)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Println("STUN alternate at UDP ", *stunAlternate)
+		}
+		go func() {
+			log.Error(stunSrv.Serve())
+		}()
+		_, rport, err := net.SplitHostPort(*rendezvous)
+		if err != nil {
+			log.Fatal(err)
+		}
+		//clients use the host of the server
+		srv.Rendezvous = net.JoinHostPort("", rport)
+	}
+
 	mux := http.NewServeMux()
-	mux.Handle("/remoton/", http.StripPrefix("/remoton",
-		remoton.NewServer(func(authToken string, r *http.Request) bool {
-			return authToken == *authTokenFlag
-		}, func() string {
-			return remoton.GenerateAuthUser()
-		})))
+	mux.Handle("/remoton/", http.StripPrefix("/remoton", srv))
+
+	if *transcripts != "" {
+		archive := &chat.Archive{Dir: *transcripts}
+		srv.Audit = func(sessionID, service string) (io.WriteCloser, io.WriteCloser, error) {
+			if service != chat.Service {
+				return nil, nil, nil
+			}
+			return archive.Recorders(sessionID)
+		}
+		log.Println("Chat transcripts of audited sessions at ", *transcripts)
+		mux.Handle("/remoton/transcript/", http.StripPrefix("/remoton/transcript/",
+			hTranscript(archive)))
+	}
 
 	log.Println("Listen at HTTPS ", *listenAddr)
 	sSecure := &http.Server{
@@ -88,3 +142,48 @@ func main() {
 
 	log.Fatal(sSecure.ListenAndServeTLS(*certFile, *keyFile))
 }
+
+//validToken compares *token* with the auth-token in constant time
+func validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*authTokenFlag)) == 1
+}
+
+//hTranscript of the session on the path, the query *format*
+//it's text by default, html or jsonl.
+//need header *X-Auth-Token*
+func hTranscript(archive *chat.Archive) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r.Header.Get("X-Auth-Token")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sessionID := r.URL.Path
+		msgs, err := archive.Read(sessionID)
+		if os.IsNotExist(err) || err == chat.ErrInvalidSession {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch r.URL.Query().Get("format") {
+		case "html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			err = chat.ExportHTML(w, sessionID, msgs)
+		case "jsonl":
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			err = chat.ExportJSONL(w, msgs)
+		case "", "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			err = chat.ExportText(w, msgs)
+		default:
+			http.Error(w, "unknown format", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Error("transcript: ", err)
+		}
+	})
+}
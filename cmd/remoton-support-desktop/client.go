@@ -3,66 +3,103 @@
 package main
 
 import (
-	"fmt"
-	"io"
+	"errors"
 	"net"
-	"net/rpc"
-	"strings"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/bit4bit/remoton"
 	"github.com/bit4bit/remoton/common"
+	"github.com/bit4bit/remoton/common/chat"
+	"github.com/bit4bit/remoton/common/control"
+	"github.com/bit4bit/remoton/common/filetransfer"
+	"github.com/bit4bit/remoton/common/sysinfo"
+	"github.com/bit4bit/remoton/desktop"
 	"github.com/bit4bit/remoton/xpra"
 )
 
-type chatRemoton struct {
-	onRecv func(msg string)
-	chRecv chan string
-	conn   net.Conn
-}
+//ProfileAuto chooses the profile measuring the link with the client
+const ProfileAuto = "auto"
 
-func (c *chatRemoton) init() {
-	if c.chRecv == nil {
-		c.chRecv = make(chan string)
-	}
+//probeSize bytes received measuring the throughput
+const probeSize = 256 << 10
+
+//withIdentity presents the supporter to the customer, it asks
+//the consent once for all the connections
+var withIdentity = remoton.WithIdentity(remoton.NewIdentity(chat.DefaultName()))
+
+type chatRemoton struct {
+	onRecv     func(msg chat.Message)
+	conn       *chat.Conn
+	transcript *chat.Transcript
+	//Transcripts directory where the chat it's recorded, empty disable
+	Transcripts string
 }
 
 func (c *chatRemoton) Start(session *remoton.SessionClient) error {
-	chatConn, err := session.Dial("chat")
+	chatConn, err := session.Dial(chat.Service, withIdentity)
 	if err != nil {
 		return err
 	}
-	c.conn = chatConn
-	c.init()
-	go c.handle()
-	return nil
+	if c.Transcripts != "" {
+		c.transcript, err = chat.OpenTranscript(c.Transcripts, session.ID)
+		if err != nil {
+			log.Error("transcript: ", err)
+		}
+	}
+	c.conn = chat.NewConn(chatConn, chat.DefaultName())
+	go c.handle(c.conn, c.transcript)
+	//the room answers with the history and the roster
+	return c.conn.Join()
 }
 
-func (c *chatRemoton) handle() {
+func (c *chatRemoton) handle(conn *chat.Conn, transcript *chat.Transcript) {
 
 	for {
-		buf := make([]byte, 32*512)
-		rlen, err := c.conn.Read(buf)
+		msg, err := conn.Receive()
 		if err != nil {
 			log.Error(err)
 			break
 		}
+		if transcript != nil {
+			transcript.Record(msg)
+		}
 
 		if c.onRecv != nil {
-			c.onRecv(strings.TrimSpace(string(buf[0:rlen])))
+			c.onRecv(msg)
 		}
 	}
 }
 
-func (c *chatRemoton) Send(msg string) {
+func (c *chatRemoton) Send(text string) chat.Message {
+	if c.conn == nil {
+		return chat.NewText(chat.DefaultName(), text)
+	}
+	msg, err := c.conn.Send(text)
+	if err != nil {
+		log.Error(err)
+	}
+	if c.transcript != nil {
+		c.transcript.Record(msg)
+	}
+	return msg
+}
+
+//Typing tell the client the supporter it's writing
+func (c *chatRemoton) Typing() {
 	if c.conn != nil {
-		c.conn.Write([]byte(msg))
+		c.conn.Typing()
 	}
 }
 
-func (c *chatRemoton) OnRecv(f func(msg string)) {
+//MarkRead the messages received
+func (c *chatRemoton) MarkRead() {
+	if c.conn != nil {
+		c.conn.MarkRead()
+	}
+}
+
+func (c *chatRemoton) OnRecv(f func(msg chat.Message)) {
 	c.onRecv = f
 }
 
@@ -70,82 +107,272 @@ func (c *chatRemoton) Terminate() {
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	if c.transcript != nil {
+		c.transcript.Close()
+		c.transcript = nil
+	}
+}
+
+//filesRemoton transfer files with the client
+type filesRemoton struct {
+	client     *filetransfer.Client
+	onOffer    func(offer filetransfer.Offer) bool
+	onReceived func(offer filetransfer.Offer, path string, err error)
+}
+
+//OnOffer callback asking the supporter to accept a file
+func (c *filesRemoton) OnOffer(f func(offer filetransfer.Offer) bool) {
+	c.onOffer = f
+}
+
+//OnReceived callback for files saved or failed
+func (c *filesRemoton) OnReceived(f func(offer filetransfer.Offer, path string, err error)) {
+	c.onReceived = f
+}
+
+//Start transfering files with the client, compressed when
+//*agreement* has a compression
+func (c *filesRemoton) Start(session *remoton.SessionClient, agreement *control.Agreement) error {
+	if !agreement.Supports(control.ProtocolFiles) {
+		return errors.New("the client can't transfer files")
+	}
+	service := filetransfer.Service
+	opts := []remoton.DialOption{withIdentity}
+	if agreement.Compression != remoton.CompressNone {
+		service = filetransfer.ServiceCompressed
+		opts = append(opts, remoton.WithCompression(remoton.CompressOptions{
+			Algorithms: []string{agreement.Compression},
+			Adaptive:   true,
+		}))
+	}
+	client, err := filetransfer.Dial(func() (net.Conn, error) {
+		return session.Dial(service, opts...)
+	}, filetransfer.Config{
+		Dir:    filetransfer.DefaultDir(),
+		Prompt: c.onOffer,
+		Received: func(offer filetransfer.Offer, path string, err error) {
+			if c.onReceived != nil {
+				c.onReceived(offer, path, err)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	c.client = client
+	return nil
+}
+
+//Send file *name* to the client
+func (c *filesRemoton) Send(name string, progress func(sent, total int64)) error {
+	if c.client == nil {
+		return filetransfer.ErrNotConnected
+	}
+	return c.client.Send(name, progress)
+}
+
+func (c *filesRemoton) Terminate() {
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
 }
 
 type tunnelRemoton struct {
-	listener net.Listener
-	xpraSrv  *xpra.Xpra
+	listener     net.Listener
+	viewer       desktop.Backend
+	ctl          *control.Client
+	onSystemInfo func(info *sysinfo.Info)
+	onViewOnly   func(viewOnly bool)
+	onProfile    func(profile string)
+	//Profile of the xpra viewer or ProfileAuto
+	Profile string
+	//Options of xpra overriding the profile
+	Options map[string]string
+	//Backends to view the desktop, the client chooses the protocol
+	Backends []desktop.Backend
+	//XpraRange versions of xpra of the client accepted, see control.ParseRange
+	XpraRange string
+	agreement *control.Agreement
+}
+
+//OnSystemInfo called with the information of the machine of the client
+func (c *tunnelRemoton) OnSystemInfo(f func(info *sysinfo.Info)) {
+	c.onSystemInfo = f
+}
+
+//OnViewOnly called when the client switches the view-only mode
+func (c *tunnelRemoton) OnViewOnly(f func(viewOnly bool)) {
+	c.onViewOnly = f
+}
+
+//OnProfile called with the profile of the viewer
+func (c *tunnelRemoton) OnProfile(f func(profile string)) {
+	c.onProfile = f
 }
 
 func (c *tunnelRemoton) Start(session *remoton.SessionClient, password string) error {
-	if c.xpraSrv == nil {
-		c.xpraSrv = &xpra.Xpra{}
+	if c.Backends == nil {
+		c.Backends = desktop.Backends()
 	}
-	c.xpraSrv.SetPassword(password)
-
-	rpconn, err := session.Dial("rpc")
+	caps := desktop.ViewerCapabilities(c.Backends...)
+	caps.XpraRange = c.XpraRange
+	caps.Protocols = append(caps.Protocols, control.ProtocolChat, control.ProtocolViewOnly, control.ProtocolFiles)
+	caps.Compression = remoton.CompressAlgorithms()
+	ctl, err := control.Dial(func() (net.Conn, error) {
+		return session.Dial("rpc", withIdentity)
+	}, caps)
 	if err != nil {
 		return err
 	}
-	defer rpconn.Close()
+	watching := false
+	defer func() {
+		if !watching {
+			ctl.Close()
+		}
+	}()
+	if ctl.Legacy() {
+		log.Infof("client without control protocol, using legacy rpc")
+	}
 
-	rpcclient := rpc.NewClient(rpconn)
-	defer rpcclient.Close()
+	agreement, err := control.Negotiate(caps, ctl.Peer)
+	if err != nil {
+		return err
+	}
+	log.Infof("using %s with client, protocols %v", agreement.Desktop, agreement.Protocols)
+	c.agreement = agreement
+	c.viewer, err = desktop.Choose(agreement.Desktop, c.Backends...)
+	if err != nil {
+		return err
+	}
+	c.viewer.SetPassword(password)
 
-	var capsClient common.Capabilities
-	err = rpcclient.Call("RemotonClient.GetCapabilities", struct{}{}, &capsClient)
+	//BUG --auth=file xpra not work, so we secure it over tunnel SSL
+	platform, err := ctl.Platform()
 	if err != nil {
 		return err
 	}
-	if !strings.EqualFold(capsClient.XpraVersion, c.xpraSrv.Version()) {
-		return fmt.Errorf("mismatch xpra version was %s expected %s",
-			capsClient.XpraVersion, c.xpraSrv.Version())
-	}
-
-	serverDirect := false
-	var clientExternalIP net.IP
-	var clientExternalPort int
-	err = rpcclient.Call("RemotonClient.GetExternalIP", struct{}{}, &clientExternalIP)
-	if err == nil {
-		rpcclient.Call("RemotonClient.GetExternalPort", struct{}{}, &clientExternalPort)
-		conn, err := net.DialTimeout("tcp",
-			fmt.Sprintf("%s:%d", clientExternalIP.String(), clientExternalPort),
-			time.Second*3)
-		if err == nil {
-			conn.Close()
-			serverDirect = true
+	if network, err := ctl.Network(); err == nil {
+		log.Infof("client nat %s external %s", network.NAT, network.ExternalIP)
+	}
+	if info, err := ctl.SystemInfo(); err != nil {
+		log.Error(err)
+	} else if c.onSystemInfo != nil {
+		c.onSystemInfo(info)
+	}
+
+	if profiler, ok := c.viewer.(desktop.Profiler); ok {
+		c.chooseProfile(ctl, profiler)
+	}
+
+	revision := -1
+	if agreement.Supports(control.ProtocolViewOnly) {
+		view, err := ctl.View(revision)
+		if err != nil {
+			log.Error(err)
 		} else {
-			log.Infof("failed connect direct to client %s:%d fallback to server",
-				clientExternalIP, clientExternalPort)
+			revision = view.Revision
+			c.setViewOnly(view.ViewOnly)
 		}
+	}
+	if err := c.srvTunnel(session, platform.OS != "windows"); err != nil {
+		return err
+	}
+	if revision >= 0 {
+		watching = true
+		c.ctl = ctl
+		go c.watchView(ctl, revision)
+	}
+	return nil
+}
 
+//chooseProfile of the viewer, auto measures the link with the client
+func (c *tunnelRemoton) chooseProfile(ctl *control.Client, profiler desktop.Profiler) {
+	profile := c.Profile
+	if profile == "" || profile == ProfileAuto {
+		profile = xpra.ProfileBalanced
+		link, err := ctl.Measure(3, probeSize)
+		if err != nil {
+			log.Error("measuring link: ", err)
+		} else {
+			profile = xpra.ProfileFor(link.Latency, link.Throughput)
+			log.Infof("link latency %s throughput %.0f KB/s, using %s",
+				link.Latency, link.Throughput/1024, profile)
+		}
+	}
+	if err := profiler.SetProfile(profile, c.Options); err != nil {
+		log.Error(err)
+		return
+	}
+	if c.onProfile != nil {
+		c.onProfile(profile)
 	}
+}
 
-	//BUG --auth=file xpra not work, so we secure it over tunnel SSL
-	var clientOS string
-	rpcclient.Call("RemotonClient.GetOS", struct{}{}, &clientOS)
-	if clientOS == "windows" {
-		serverDirect = false
+//SetProfile of the viewer, it attaches again when connected
+func (c *tunnelRemoton) SetProfile(profile string) error {
+	c.Profile = profile
+	if c.viewer == nil || profile == ProfileAuto {
+		return nil
+	}
+	profiler, ok := c.viewer.(desktop.Profiler)
+	if !ok {
+		return errors.New("the viewer has no profiles")
+	}
+	if profiler.Profile() == profile {
+		return nil
+	}
+	if err := profiler.SetProfile(profile, c.Options); err != nil {
+		return err
+	}
+	if c.onProfile != nil {
+		c.onProfile(profile)
 	}
+	return c.viewer.Restart()
+}
 
-	if serverDirect {
-		return c.srvDirect(session, clientExternalIP)
+func (c *tunnelRemoton) setViewOnly(viewOnly bool) {
+	c.viewer.SetViewOnly(viewOnly)
+	if c.onViewOnly != nil {
+		c.onViewOnly(viewOnly)
 	}
-	return c.srvTunnel(session)
 }
 
-func (c *tunnelRemoton) srvDirect(session *remoton.SessionClient,
-	externalIP net.IP) error {
-	log.Println("direct connection")
+//watchView attach again when the client switches the view-only mode
+func (c *tunnelRemoton) watchView(ctl *control.Client, revision int) {
+	for {
+		view, err := ctl.View(revision)
+		if err != nil {
+			log.Error("view: ", err)
+			return
+		}
+		if view.Revision == revision {
+			continue
+		}
+		revision = view.Revision
+		log.Infof("client switched view-only %v", view.ViewOnly)
+		c.setViewOnly(view.ViewOnly)
+		if err := c.viewer.Restart(); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+}
 
-	err := c.xpraSrv.Attach(net.JoinHostPort(externalIP.String(), "9932"))
+//dial the client direct when p2p allowed or through the server
+func (c *tunnelRemoton) dial(session *remoton.SessionClient, p2p bool) (net.Conn, error) {
+	if !p2p {
+		return session.DialTCP("nx", withIdentity)
+	}
+	conn, err := session.DialP2P("nx", withIdentity)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	log.Infof("%s connection to client", conn.Path)
+	return conn, nil
 }
 
-func (c *tunnelRemoton) srvTunnel(session *remoton.SessionClient) error {
+func (c *tunnelRemoton) srvTunnel(session *remoton.SessionClient, p2p bool) error {
 	port, _ := common.FindFreePortTCP(55123)
 	addrSrv := "localhost:" + port
 	log.Println("listen at " + addrSrv)
@@ -163,7 +390,7 @@ func (c *tunnelRemoton) srvTunnel(session *remoton.SessionClient) error {
 				log.Error(err)
 				break
 			}
-			remote, err := session.DialTCP("nx")
+			remote, err := c.dial(session, p2p)
 			if err != nil {
 				log.Error(err)
 				listener.Close()
@@ -175,8 +402,8 @@ func (c *tunnelRemoton) srvTunnel(session *remoton.SessionClient) error {
 		}
 	}(listener)
 	
-	log.Println("Xpra " + c.xpraSrv.Version() + " attaching to " + addrSrv)
-	err = c.xpraSrv.Attach(addrSrv)
+	log.Println(c.viewer.Protocol() + " " + c.viewer.Version() + " attaching to " + addrSrv)
+	err = c.viewer.Attach(addrSrv)
 	if err != nil {
 		listener.Close()
 		return err
@@ -185,28 +412,26 @@ func (c *tunnelRemoton) srvTunnel(session *remoton.SessionClient) error {
 }
 
 func (c *tunnelRemoton) handle(local, remoto net.Conn) {
+	if err := remoton.Join(local, remoto); err != nil {
+		log.Error(err)
+	}
+}
 
-	errc := make(chan error, 2)
-
-	go func() {
-		_, err := io.Copy(local, remoto)
-		errc <- err
-	}()
-	go func() {
-		_, err := io.Copy(remoto, local)
-		errc <- err
-	}()
-
-	log.Error(<-errc)
-	local.Close()
-	remoto.Close()
+//Agreement with the client, nil before Start
+func (c *tunnelRemoton) Agreement() *control.Agreement {
+	return c.agreement
 }
 
 func (c *tunnelRemoton) Terminate() {
+	if c.ctl != nil {
+		c.ctl.Close()
+		c.ctl = nil
+	}
 	if c.listener != nil {
 		c.listener.Close()
 	}
-	if c.xpraSrv != nil {
-		c.xpraSrv.Terminate()
+	if c.viewer != nil {
+		c.viewer.Terminate()
+		c.viewer = nil
 	}
 }
@@ -10,11 +10,19 @@ package main
 import (
 	"flag"
 	"crypto/tls"
+	"fmt"
 	"github.com/bit4bit/remoton"
 	"github.com/bit4bit/remoton/common"
+	"github.com/bit4bit/remoton/common/chat"
+	"github.com/bit4bit/remoton/common/control"
+	"github.com/bit4bit/remoton/common/filetransfer"
+	"github.com/bit4bit/remoton/common/sysinfo"
+	"github.com/bit4bit/remoton/xpra"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"unsafe"
 
@@ -28,17 +36,34 @@ var (
 	rclient   *remoton.Client
 	chatSrv   = &chatRemoton{}
 	tunnelSrv = &tunnelRemoton{}
+	filesSrv  = &filesRemoton{}
 	insecure = flag.Bool("insecure", false, "insecure tls")
+	transcripts = flag.String("transcripts", "", "directory where the chat transcripts are saved, empty disable")
+	profile = flag.String("profile", ProfileAuto, "xpra profile low-bandwidth, balanced, high-quality, lan or auto measuring the link")
+	xpraOptions = flag.String("xpra-options", "", "xpra options overriding the profile as key=value separated by commas")
+	xpraRange = flag.String("xpra-range", "", "versions of xpra of the client accepted as \">=4.0 <6\", empty the same major")
 )
 
 func main() {
 	flag.Parse()
+	chatSrv.Transcripts = *transcripts
+	tunnelSrv.Profile = *profile
+	options, err := xpra.ParseOptions(*xpraOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tunnelSrv.Options = options
+	if _, err := control.ParseRange(*xpraRange); err != nil {
+		log.Fatal(err)
+	}
+	tunnelSrv.XpraRange = *xpraRange
 	
 	common.SetDefaultGtkTheme()
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	rclient = &remoton.Client{Prefix: "/remoton", TLSConfig: &tls.Config{}}
+	rclient = &remoton.Client{Prefix: "/remoton", TLSConfig: &tls.Config{},
+		KeepAlive: remoton.DefaultKeepAlive}
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGABRT, syscall.SIGKILL, syscall.SIGTERM)
 	go func() {
@@ -92,22 +117,43 @@ func main() {
 	swinChat.Add(chatHistory)
 
 	chatEntry := gtk.NewEntry()
+	chatEntry.Connect("focus-in-event", func() {
+		chatSrv.MarkRead()
+	})
 	chatEntry.Connect("key-press-event", func(ctx *glib.CallbackContext) {
 		arg := ctx.Args(0)
 		event := *(**gdk.EventKey)(unsafe.Pointer(&arg))
+		chatSrv.MarkRead()
 		if event.Keyval == gdk.KEY_Return {
 			msgToSend := chatEntry.GetText()
-			chatSrv.Send(msgToSend)
-			chatHistorySend(chatHistory, msgToSend)
+			msg := chatSrv.Send(msgToSend)
+			chatHistorySend(chatHistory, msg.String())
 			chatEntry.SetText("")
+		} else {
+			chatSrv.Typing()
 		}
 
 	})
-	chatSrv.OnRecv(func(msg string) {
-		log.Println(msg)
-		chatHistoryRecv(chatHistory, msg)
+	chatStatus := gtk.NewLabel("")
+	chatRoster := gtk.NewLabel("")
+	chatSrv.OnRecv(func(msg chat.Message) {
+		common.GtkMain(func() {
+			switch msg.Kind {
+			case chat.KindText:
+				log.Println(msg)
+				chatHistoryRecv(chatHistory, msg.String())
+			case chat.KindRoster:
+				chatRoster.SetText("In chat: " + strings.Join(msg.Members, ", "))
+				return
+			case chat.KindJoin, chat.KindLeave:
+				chatHistoryRecv(chatHistory, msg.Status())
+			}
+			chatStatus.SetText(msg.Status())
+		})
 	})
+	chatBox.Add(chatRoster)
 	chatBox.Add(chatEntry)
+	chatBox.Add(chatStatus)
 	chatBox.Add(swinChat)
 
 	//---
@@ -137,6 +183,59 @@ func main() {
 	btnCert := gtk.NewFileChooserButton("Cert", gtk.FILE_CHOOSER_ACTION_OPEN)
 	controlBox.Add(btnCert)
 	btn := gtk.NewButtonWithLabel("Connect")
+
+	frameInfo := gtk.NewFrame("Client")
+	infoBox := gtk.NewVBox(false, 1)
+	infoLabel := gtk.NewLabel("")
+	viewLabel := gtk.NewLabel("")
+	infoBox.Add(infoLabel)
+	infoBox.Add(viewLabel)
+	frameInfo.Add(infoBox)
+	//called from Start on the main loop too
+	tunnelSrv.OnSystemInfo(func(info *sysinfo.Info) {
+		common.GtkIdle(func() {
+			infoLabel.SetText(info.String())
+		})
+	})
+	profileCombo := gtk.NewComboBoxText()
+	profiles := append([]string{ProfileAuto}, xpra.ProfileNames...)
+	for i, name := range profiles {
+		profileCombo.AppendText(name)
+		if name == tunnelSrv.Profile {
+			profileCombo.SetActive(i)
+		}
+	}
+	profileLabel := gtk.NewLabel("")
+	//called from Start on the main loop and from SetProfile
+	tunnelSrv.OnProfile(func(profile string) {
+		common.GtkIdle(func() {
+			profileLabel.SetText("Profile: " + profile)
+		})
+	})
+	profileCombo.Connect("changed", func() {
+		name := profileCombo.GetActiveText()
+		go func() {
+			if err := tunnelSrv.SetProfile(name); err != nil {
+				log.Error(err)
+				common.GtkMain(func() {
+					profileLabel.SetText("Failed switching profile " + name)
+				})
+			}
+		}()
+	})
+	infoBox.Add(profileCombo)
+	infoBox.Add(profileLabel)
+	//called from Start on the main loop too
+	tunnelSrv.OnViewOnly(func(viewOnly bool) {
+		common.GtkIdle(func() {
+			if viewOnly {
+				viewLabel.SetText("View only: keyboard and mouse disabled by the client")
+			} else {
+				viewLabel.SetText("Full control")
+			}
+		})
+	})
+
 	started := false
 	btn.Clicked(func() {
 		if *insecure {
@@ -168,11 +267,17 @@ func main() {
 				return
 			}
 
+			if err := filesSrv.Start(session, tunnelSrv.Agreement()); err != nil {
+				log.Error(err)
+			}
+
 			btn.SetLabel("Disconnect")
 			started = true
 		} else {
 			chatSrv.Terminate()
 			tunnelSrv.Terminate()
+			filesSrv.Terminate()
+			infoLabel.SetText("")
 			btn.SetLabel("Connect")
 			started = false
 		}
@@ -180,6 +285,57 @@ func main() {
 	})
 	controlBox.Add(btn)
 
+	filesLabel := gtk.NewLabel("")
+	btnSendFile := gtk.NewButtonWithLabel("Send file")
+	btnSendFile.Clicked(func() {
+		name := common.GtkChooseFile(window, "Send file to client")
+		if name == "" {
+			return
+		}
+		filesLabel.SetText("Sending " + filepath.Base(name))
+		go func() {
+			err := filesSrv.Send(name, func(sent, total int64) {
+				//the transfer doesn't wait the label
+				common.GtkIdle(func() {
+					filesLabel.SetText(fmt.Sprintf("Sending %s %d%%", filepath.Base(name), sent*100/total))
+				})
+			})
+			if err != nil {
+				log.Error(err)
+			}
+			common.GtkMain(func() {
+				if err != nil {
+					filesLabel.SetText("Failed sending " + filepath.Base(name))
+					return
+				}
+				filesLabel.SetText("Sent " + filepath.Base(name))
+			})
+		}()
+	})
+	filesSrv.OnOffer(func(offer filetransfer.Offer) bool {
+		accept := false
+		common.GtkMain(func() {
+			accept = common.GtkConfirm(window, fmt.Sprintf("Accept the file %s (%d bytes) from the client?",
+				offer.Name, offer.Size))
+		})
+		return accept
+	})
+	filesSrv.OnReceived(func(offer filetransfer.Offer, path string, err error) {
+		if err != nil {
+			log.Error(err)
+		}
+		common.GtkMain(func() {
+			if err != nil {
+				filesLabel.SetText("Failed receiving " + offer.Name)
+				return
+			}
+			filesLabel.SetText("Received " + path)
+		})
+	})
+	controlBox.Add(btnSendFile)
+	controlBox.Add(filesLabel)
+	controlBox.Add(frameInfo)
+
 	hpaned.Pack1(frameControl, false, false)
 	hpaned.Pack2(frameChat, false, false)
 	window.Add(appLayout)
@@ -0,0 +1,267 @@
+// Package chat it's the protocol of the "chat" service.
+//
+// Every message it's a JSON line with an id, the name of the sender
+// and the time it was sent. Text messages are acknowledged as
+// delivered when received and as read when the user sees them,
+// typing notifications tell when the peer it's writing.
+package chat
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Service name on the session
+const Service = "chat"
+
+//Kinds of messages
+const (
+	KindText      = "text"
+	KindTyping    = "typing"
+	KindDelivered = "delivered"
+	KindRead      = "read"
+	//KindJoin and KindLeave of the members of a room
+	KindJoin   = "join"
+	KindLeave  = "leave"
+	KindRoster = "roster"
+)
+
+//maxLine longer messages are a broken peer
+const maxLine = 64 * 1024
+
+//typingIdle after the last Typing the stop it's sent
+var typingIdle = time.Second * 3
+
+//Message of the chat
+type Message struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+	//Ref id of the message acknowledged
+	Ref  string    `json:"ref,omitempty"`
+	From string    `json:"from,omitempty"`
+	Text string    `json:"text,omitempty"`
+	Time time.Time `json:"time"`
+	//Typing started or stopped
+	Typing bool `json:"typing,omitempty"`
+	//History sent before joining the room, it's not acknowledged
+	History bool `json:"history,omitempty"`
+	//Members names of the room on KindRoster
+	Members []string `json:"members,omitempty"`
+}
+
+//NewText message of *from*
+func NewText(from, text string) Message {
+	return Message{Kind: KindText, ID: newID(), From: from, Text: text, Time: time.Now()}
+}
+
+//String for the history of the chat
+func (m Message) String() string {
+	from := m.From
+	if from == "" {
+		from = "remote"
+	}
+	return fmt.Sprintf("[%s] %s: %s", m.Time.Local().Format("15:04"), from, m.Text)
+}
+
+//Status of typing and acks for the user, empty when there is nothing to show
+func (m Message) Status() string {
+	from := m.From
+	if from == "" {
+		from = "remote"
+	}
+	switch m.Kind {
+	case KindTyping:
+		if m.Typing {
+			return from + " is typing..."
+		}
+	case KindDelivered:
+		return "delivered to " + from
+	case KindRead:
+		return "read by " + from
+	case KindJoin:
+		return from + " joined"
+	case KindLeave:
+		return from + " left"
+	}
+	return ""
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//DefaultName of the user running the process
+func DefaultName() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "remoton"
+}
+
+//Conn chat over a connection
+type Conn struct {
+	conn    io.ReadWriteCloser
+	scanner *bufio.Scanner
+	//Name of the sender of the messages
+	Name string
+
+	wmutex sync.Mutex
+	typist typist
+
+	mutex  sync.Mutex
+	unread []string
+}
+
+//NewConn chat over *conn* as *name*
+func NewConn(conn io.ReadWriteCloser, name string) *Conn {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxLine)
+	c := &Conn{conn: conn, scanner: scanner, Name: name}
+	c.typist.notify = func(typing bool) {
+		c.Write(c.control(KindTyping, "", typing))
+	}
+	return c
+}
+
+//Write *msg* as a line
+func (c *Conn) Write(msg Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	_, err = c.conn.Write(append(line, '\n'))
+	return err
+}
+
+//Send *text* to the peer, it stops the typing
+func (c *Conn) Send(text string) (Message, error) {
+	c.typist.stop()
+	msg := NewText(c.Name, text)
+	return msg, c.Write(msg)
+}
+
+//Typing tell the peer the user it's writing, the stop it's
+//sent when Typing it's not called again in a while
+func (c *Conn) Typing() {
+	c.typist.start()
+}
+
+//Join the room of the peer, it answers with the
+//history and the members
+func (c *Conn) Join() error {
+	return c.Write(c.control(KindJoin, "", false))
+}
+
+//MarkRead the messages received, the peer it's told they were read
+func (c *Conn) MarkRead() error {
+	c.mutex.Lock()
+	unread := c.unread
+	c.unread = nil
+	c.mutex.Unlock()
+	for _, id := range unread {
+		if err := c.Write(c.control(KindRead, id, false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) control(kind, ref string, typing bool) Message {
+	return Message{Kind: kind, ID: newID(), Ref: ref, From: c.Name,
+		Time: time.Now(), Typing: typing}
+}
+
+//Receive the next message of the peer, text messages are
+//acknowledged as delivered. Lines of peers without the
+//protocol are received as text.
+func (c *Conn) Receive() (Message, error) {
+	for {
+		if !c.scanner.Scan() {
+			err := c.scanner.Err()
+			if err == nil {
+				err = io.EOF
+			}
+			return Message{}, err
+		}
+		line := strings.TrimSpace(c.scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var msg Message
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &msg) != nil {
+			msg = Message{Kind: KindText, Text: line, Time: time.Now()}
+		}
+		if msg.Kind != KindText {
+			return msg, nil
+		}
+		if msg.ID != "" && !msg.History {
+			c.mutex.Lock()
+			c.unread = append(c.unread, msg.ID)
+			c.mutex.Unlock()
+			//not blocking the reading while the peer writes
+			go c.Write(c.control(KindDelivered, msg.ID, false))
+		}
+		return msg, nil
+	}
+}
+
+//Close the connection
+func (c *Conn) Close() error {
+	c.typist.cancel()
+	return c.conn.Close()
+}
+
+//typist notifies when the user starts and stops writing
+type typist struct {
+	notify func(typing bool)
+
+	mutex sync.Mutex
+	timer *time.Timer
+}
+
+func (t *typist) start() {
+	t.mutex.Lock()
+	if t.timer != nil {
+		t.timer.Reset(typingIdle)
+		t.mutex.Unlock()
+		return
+	}
+	t.timer = time.AfterFunc(typingIdle, t.stop)
+	t.mutex.Unlock()
+	t.notify(true)
+}
+
+func (t *typist) stop() {
+	if t.cancel() {
+		t.notify(false)
+	}
+}
+
+//cancel the timer, true when the user was typing
+func (t *typist) cancel() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer == nil {
+		return false
+	}
+	t.timer.Stop()
+	t.timer = nil
+	return true
+}
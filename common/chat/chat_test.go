@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+//pump the messages received on a channel
+func pump(c *Conn) chan Message {
+	ch := make(chan Message, 16)
+	go func() {
+		defer close(ch)
+		for {
+			msg, err := c.Receive()
+			if err != nil {
+				return
+			}
+			ch <- msg
+		}
+	}()
+	return ch
+}
+
+func next(t *testing.T, ch chan Message) Message {
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(time.Second * 2):
+		t.Fatal("timeout waiting message")
+	}
+	return Message{}
+}
+
+func TestSendReceive(t *testing.T) {
+	c1, c2 := net.Pipe()
+	support, client := NewConn(c1, "supporter"), NewConn(c2, "customer")
+	defer support.Close()
+	defer client.Close()
+	fromClient, fromSupport := pump(support), pump(client)
+
+	sent, err := support.Send("hola, ¿qué ves en pantalla?\nnada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := next(t, fromSupport)
+	if msg.Kind != KindText || msg.ID != sent.ID || msg.From != "supporter" ||
+		msg.Text != sent.Text || !msg.Time.Equal(sent.Time) {
+		t.Errorf("want %+v get %+v", sent, msg)
+	}
+
+	ack := next(t, fromClient)
+	if ack.Kind != KindDelivered || ack.Ref != sent.ID || ack.From != "customer" {
+		t.Errorf("want delivered of %s get %+v", sent.ID, ack)
+	}
+
+	if err := client.MarkRead(); err != nil {
+		t.Fatal(err)
+	}
+	ack = next(t, fromClient)
+	if ack.Kind != KindRead || ack.Ref != sent.ID {
+		t.Errorf("want read of %s get %+v", sent.ID, ack)
+	}
+	//already read
+	client.MarkRead()
+	client.Send("ok")
+	if msg := next(t, fromClient); msg.Kind != KindText || msg.Text != "ok" {
+		t.Errorf("want text get %+v", msg)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	idle := typingIdle
+	typingIdle = time.Millisecond * 50
+	defer func() { typingIdle = idle }()
+
+	c1, c2 := net.Pipe()
+	support, client := NewConn(c1, "supporter"), NewConn(c2, "customer")
+	defer support.Close()
+	defer client.Close()
+	fromSupport := pump(client)
+
+	support.Typing()
+	support.Typing()
+	if msg := next(t, fromSupport); msg.Kind != KindTyping || !msg.Typing {
+		t.Errorf("want typing get %+v", msg)
+	}
+	if msg := next(t, fromSupport); msg.Kind != KindTyping || msg.Typing {
+		t.Errorf("want typing stopped get %+v", msg)
+	}
+
+	support.Typing()
+	next(t, fromSupport)
+	support.Send("listo")
+	if msg := next(t, fromSupport); msg.Kind != KindTyping || msg.Typing {
+		t.Errorf("want typing stopped get %+v", msg)
+	}
+	if msg := next(t, fromSupport); msg.Kind != KindText {
+		t.Errorf("want text get %+v", msg)
+	}
+}
+
+func TestLegacyPeer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewConn(c2, "customer")
+	defer client.Close()
+	defer c1.Close()
+	fromSupport := pump(client)
+
+	c1.Write([]byte("hola\n\n"))
+	msg := next(t, fromSupport)
+	if msg.Kind != KindText || msg.Text != "hola" || msg.ID != "" {
+		t.Errorf("want legacy text get %+v", msg)
+	}
+	if msg.String()[8:] != "remote: hola" {
+		t.Errorf("unexpected history line %q", msg.String())
+	}
+}
@@ -0,0 +1,353 @@
+package chat
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//maxHistory messages delivered to the late joiners
+const maxHistory = 200
+
+//memberQueue messages waiting to be written to a member,
+//the members taking longer are disconnected
+const memberQueue = maxHistory + 64
+
+//Room of a session hosted by the customer, the supporters
+//joining are told the members and get the history
+type Room struct {
+	//Name of the host on the chat
+	Name string
+	//Transcript records the messages of the room when not nil
+	Transcript *Transcript
+	//Identify the member connected on *conn* by the session, the name
+	//on the roster instead of the one it says, empty when unknown
+	Identify func(conn net.Conn) string
+	//ViewOnly reports the members the customer allowed only to view,
+	//they read the room but their messages aren't delivered
+	ViewOnly func(conn net.Conn) bool
+
+	typist    typist
+	onMessage func(msg Message)
+
+	mutex   sync.Mutex
+	members map[*Conn]*member
+	joined  int
+	history []Message
+	//origin of the messages on the history, nil for the host
+	origin map[string]*Conn
+	closed bool
+}
+
+type member struct {
+	name string
+	//identified the name was given by the session
+	identified bool
+	joined     bool
+	viewOnly   bool
+	//out messages waiting the writer of the member
+	out  chan Message
+	done chan struct{}
+}
+
+//NewRoom hosted by *name*
+func NewRoom(name string) *Room {
+	r := &Room{
+		Name:    name,
+		members: make(map[*Conn]*member),
+		origin:  make(map[string]*Conn),
+	}
+	r.typist.notify = func(typing bool) {
+		r.broadcast(nil, Message{Kind: KindTyping, ID: newID(), From: r.Name,
+			Time: time.Now(), Typing: typing})
+	}
+	return r
+}
+
+//OnMessage callback for the messages of the members, the
+//acks of the host messages, join and leave, and the roster
+func (r *Room) OnMessage(f func(msg Message)) {
+	r.mutex.Lock()
+	r.onMessage = f
+	r.mutex.Unlock()
+}
+
+func (r *Room) notify(msg Message) {
+	r.mutex.Lock()
+	f := r.onMessage
+	r.mutex.Unlock()
+	if f != nil {
+		f(msg)
+	}
+}
+
+//Serve the connections of *l* until it's closed
+func (r *Room) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		name := ""
+		if r.Identify != nil {
+			name = r.Identify(conn)
+		}
+		viewOnly := r.ViewOnly != nil && r.ViewOnly(conn)
+		go r.join(conn, name, viewOnly)
+	}
+}
+
+//Join *conn* to the room with the name the member says
+func (r *Room) Join(conn io.ReadWriteCloser) {
+	r.JoinAs(conn, "")
+}
+
+//JoinAs *conn* to the room as *name*, empty takes the name the member
+//says. The messages are read until it's closed
+func (r *Room) JoinAs(conn io.ReadWriteCloser, name string) {
+	r.join(conn, name, false)
+}
+
+func (r *Room) join(conn io.ReadWriteCloser, name string, viewOnly bool) {
+	c := NewConn(conn, r.Name)
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		c.Close()
+		return
+	}
+	r.joined++
+	m := &member{name: name, identified: name != "", viewOnly: viewOnly,
+		out: make(chan Message, memberQueue), done: make(chan struct{})}
+	if name == "" {
+		m.name = "supporter " + strconv.Itoa(r.joined)
+	}
+	r.members[c] = m
+	r.mutex.Unlock()
+	go r.write(c, m)
+
+	for {
+		msg, err := c.Receive()
+		if err != nil {
+			break
+		}
+		r.dispatch(c, msg)
+	}
+	c.Close()
+
+	r.mutex.Lock()
+	delete(r.members, c)
+	r.mutex.Unlock()
+	close(m.done)
+	if m.joined {
+		r.announce(Message{Kind: KindLeave, ID: newID(), From: m.name, Time: time.Now()})
+	}
+}
+
+//write the messages queued to *m* until it leaves
+func (r *Room) write(c *Conn, m *member) {
+	for {
+		select {
+		case msg := <-m.out:
+			if err := c.Write(msg); err != nil {
+				c.Close()
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+//deliver *msg* to the writer of *m*, a member too slow
+//it's disconnected, the room doesn't wait it
+func (r *Room) deliver(c *Conn, m *member, msg Message) {
+	select {
+	case m.out <- msg:
+	default:
+		c.Close()
+	}
+}
+
+//dispatch *msg* of the member *c*
+func (r *Room) dispatch(c *Conn, msg Message) {
+	r.mutex.Lock()
+	m := r.members[c]
+	if m == nil || m.viewOnly && (msg.Kind == KindText || msg.Kind == KindTyping) {
+		r.mutex.Unlock()
+		return
+	}
+	if msg.Kind == KindJoin {
+		if m.joined {
+			r.mutex.Unlock()
+			return
+		}
+		if m.identified {
+			m.name = r.unique(m.name)
+		} else if msg.From != "" {
+			m.name = r.unique(msg.From)
+		}
+		m.joined = true
+	}
+	//the name on the roster not the one the member says
+	msg.From = m.name
+	r.mutex.Unlock()
+
+	switch msg.Kind {
+	case KindJoin:
+		for _, old := range r.History() {
+			old.History = true
+			r.deliver(c, m, old)
+		}
+		r.announce(msg)
+	case KindText:
+		if msg.ID == "" {
+			msg.ID = newID()
+		}
+		msg.History = false
+		r.remember(c, msg)
+		r.broadcast(c, msg)
+		r.notify(msg)
+	case KindTyping:
+		r.broadcast(c, msg)
+		r.notify(msg)
+	case KindDelivered, KindRead:
+		r.mutex.Lock()
+		origin, ok := r.origin[msg.Ref]
+		sender := r.members[origin]
+		r.mutex.Unlock()
+		if !ok || origin == c {
+			return
+		}
+		if origin == nil {
+			r.notify(msg)
+		} else if sender != nil {
+			r.deliver(origin, sender, msg)
+		}
+	}
+}
+
+//unique *name* on the roster, called with the mutex
+func (r *Room) unique(name string) string {
+	taken := map[string]bool{r.Name: true}
+	for _, m := range r.members {
+		if m.joined {
+			taken[m.name] = true
+		}
+	}
+	unique := name
+	for i := 2; taken[unique]; i++ {
+		unique = name + " (" + strconv.Itoa(i) + ")"
+	}
+	return unique
+}
+
+//remember *msg* of *origin* on the history
+func (r *Room) remember(origin *Conn, msg Message) {
+	if r.Transcript != nil {
+		r.Transcript.Record(msg)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.history = append(r.history, msg)
+	r.origin[msg.ID] = origin
+	if len(r.history) > maxHistory {
+		delete(r.origin, r.history[0].ID)
+		r.history = append([]Message(nil), r.history[1:]...)
+	}
+}
+
+//announce the join or leave of a member with the roster
+func (r *Room) announce(msg Message) {
+	roster := Message{Kind: KindRoster, ID: newID(), From: r.Name,
+		Time: time.Now(), Members: r.Roster()}
+	if r.Transcript != nil {
+		r.Transcript.Record(msg)
+	}
+	r.broadcast(nil, msg)
+	r.broadcast(nil, roster)
+	r.notify(msg)
+	r.notify(roster)
+}
+
+//broadcast *msg* to the members except *from*, the peers
+//not joining are members without name on the roster
+func (r *Room) broadcast(from *Conn, msg Message) {
+	r.mutex.Lock()
+	members := make(map[*Conn]*member, len(r.members))
+	for c, m := range r.members {
+		if c != from {
+			members[c] = m
+		}
+	}
+	r.mutex.Unlock()
+	for c, m := range members {
+		r.deliver(c, m, msg)
+	}
+}
+
+//Roster names of the host and the joined members
+func (r *Room) Roster() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	roster := []string{r.Name}
+	for _, m := range r.members {
+		if m.joined {
+			roster = append(roster, m.name)
+		}
+	}
+	sort.Strings(roster[1:])
+	return roster
+}
+
+//History of the text messages of the room
+func (r *Room) History() []Message {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Message(nil), r.history...)
+}
+
+//Send *text* of the host to the members, it stops the typing
+func (r *Room) Send(text string) Message {
+	r.typist.stop()
+	msg := NewText(r.Name, text)
+	r.remember(nil, msg)
+	r.broadcast(nil, msg)
+	return msg
+}
+
+//Typing tell the members the host it's writing
+func (r *Room) Typing() {
+	r.typist.start()
+}
+
+//MarkRead the messages received by the host
+func (r *Room) MarkRead() {
+	r.mutex.Lock()
+	var conns []*Conn
+	for c := range r.members {
+		conns = append(conns, c)
+	}
+	r.mutex.Unlock()
+	for _, c := range conns {
+		c.MarkRead()
+	}
+}
+
+//Close the connections of the members
+func (r *Room) Close() {
+	r.typist.cancel()
+	r.mutex.Lock()
+	r.closed = true
+	var conns []*Conn
+	for c := range r.members {
+		conns = append(conns, c)
+	}
+	r.mutex.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
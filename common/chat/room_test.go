@@ -0,0 +1,199 @@
+package chat
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//joinRoom a supporter named *name* to *room*
+func joinRoom(t *testing.T, room *Room, name string) (*Conn, chan Message) {
+	c1, c2 := net.Pipe()
+	go room.Join(c2)
+	conn := NewConn(c1, name)
+	recv := pump(conn)
+	if err := conn.Join(); err != nil {
+		t.Fatal(err)
+	}
+	return conn, recv
+}
+
+//skip the messages until one of *kind*
+func skip(t *testing.T, ch chan Message, kind string) Message {
+	for {
+		if msg := next(t, ch); msg.Kind == kind {
+			return msg
+		}
+	}
+}
+
+func TestRoom(t *testing.T) {
+	room := NewRoom("customer")
+	defer room.Close()
+	events := make(chan Message, 64)
+	room.OnMessage(func(msg Message) { events <- msg })
+
+	alice, fromAlice := joinRoom(t, room, "alice")
+	defer alice.Close()
+	if msg := next(t, fromAlice); msg.Kind != KindJoin || msg.From != "alice" {
+		t.Errorf("want join of alice get %+v", msg)
+	}
+	roster := next(t, fromAlice)
+	if want := []string{"customer", "alice"}; !reflect.DeepEqual(roster.Members, want) {
+		t.Errorf("want roster %v get %+v", want, roster)
+	}
+	skip(t, events, KindRoster)
+
+	hello := room.Send("hola")
+	if msg := skip(t, fromAlice, KindText); msg.ID != hello.ID || msg.History {
+		t.Errorf("want %+v get %+v", hello, msg)
+	}
+	if msg := skip(t, events, KindDelivered); msg.Ref != hello.ID || msg.From != "alice" {
+		t.Errorf("want delivered to alice get %+v", msg)
+	}
+	sent, _ := alice.Send("veo la pantalla")
+	if msg := skip(t, events, KindText); msg.ID != sent.ID || msg.From != "alice" {
+		t.Errorf("want %+v get %+v", sent, msg)
+	}
+
+	//late joiner gets the history and the same name is not taken
+	bob, fromBob := joinRoom(t, room, "alice")
+	defer bob.Close()
+	for _, want := range []Message{hello, sent} {
+		msg := next(t, fromBob)
+		if msg.Kind != KindText || msg.ID != want.ID || !msg.History {
+			t.Errorf("want history %+v get %+v", want, msg)
+		}
+	}
+	if msg := next(t, fromBob); msg.Kind != KindJoin || msg.From != "alice (2)" {
+		t.Errorf("want join of alice (2) get %+v", msg)
+	}
+	skip(t, fromAlice, KindRoster)
+
+	sent, _ = bob.Send("yo también")
+	msg := skip(t, fromAlice, KindText)
+	if msg.ID != sent.ID || msg.From != "alice (2)" {
+		t.Errorf("want %+v get %+v", sent, msg)
+	}
+	if ack := skip(t, fromBob, KindDelivered); ack.Ref != sent.ID {
+		t.Errorf("want delivered of %s get %+v", sent.ID, ack)
+	}
+	alice.MarkRead()
+	if ack := skip(t, fromBob, KindRead); ack.Ref != sent.ID || ack.From != "alice" {
+		t.Errorf("want read by alice get %+v", ack)
+	}
+
+	bob.Close()
+	if msg := skip(t, fromAlice, KindLeave); msg.From != "alice (2)" {
+		t.Errorf("want leave of alice (2) get %+v", msg)
+	}
+	if want := []string{"customer", "alice"}; !reflect.DeepEqual(room.Roster(), want) {
+		t.Errorf("want roster %v get %v", want, room.Roster())
+	}
+}
+
+func TestRoomIdentified(t *testing.T) {
+	room := NewRoom("customer")
+	defer room.Close()
+
+	c1, c2 := net.Pipe()
+	go room.JoinAs(c2, "carol")
+	conn := NewConn(c1, "alice")
+	defer conn.Close()
+	recv := pump(conn)
+	if err := conn.Join(); err != nil {
+		t.Fatal(err)
+	}
+	//the name of the session not the one the member says
+	if msg := next(t, recv); msg.Kind != KindJoin || msg.From != "carol" {
+		t.Errorf("want join of carol get %+v", msg)
+	}
+	sent, _ := conn.Send("hola")
+	if msg := room.History()[0]; msg.ID != sent.ID || msg.From != "carol" {
+		t.Errorf("want text of carol get %+v", msg)
+	}
+}
+
+func TestRoomViewOnly(t *testing.T) {
+	room := NewRoom("customer")
+	defer room.Close()
+	room.ViewOnly = func(net.Conn) bool { return true }
+	events := make(chan Message, 64)
+	room.OnMessage(func(msg Message) { events <- msg })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go room.Serve(l)
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConn(nc, "dave")
+	defer conn.Close()
+	recv := pump(conn)
+	if err := conn.Join(); err != nil {
+		t.Fatal(err)
+	}
+	skip(t, recv, KindRoster)
+	conn.Send("hola")
+
+	//the member still reads the room, the ack comes after its text
+	hello := room.Send("buenos días")
+	if msg := skip(t, recv, KindText); msg.ID != hello.ID {
+		t.Errorf("want %+v get %+v", hello, msg)
+	}
+	for msg := next(t, events); msg.Kind != KindDelivered; msg = next(t, events) {
+		if msg.Kind == KindText || msg.Kind == KindTyping {
+			t.Errorf("want messages of view-only dropped get %+v", msg)
+		}
+	}
+	if history := room.History(); len(history) != 1 || history[0].ID != hello.ID {
+		t.Errorf("want only the text of the host get %+v", history)
+	}
+}
+
+func TestRoomSlowMember(t *testing.T) {
+	room := NewRoom("customer")
+	defer room.Close()
+
+	//the stalled member never reads
+	stalled, c2 := net.Pipe()
+	defer stalled.Close()
+	go room.Join(c2)
+	if err := NewConn(stalled, "bob").Join(); err != nil {
+		t.Fatal(err)
+	}
+	alice, fromAlice := joinRoom(t, room, "alice")
+	defer alice.Close()
+	skip(t, fromAlice, KindRoster)
+
+	//alice takes every message before the next one
+	var left []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < memberQueue+8; i++ {
+			room.Send("hola")
+			for msg := range fromAlice {
+				if msg.Kind == KindLeave {
+					left = append(left, msg.From)
+				}
+				if msg.Kind == KindText {
+					break
+				}
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("room blocked by the stalled member")
+	}
+	if !reflect.DeepEqual(left, []string{"bob"}) {
+		t.Errorf("want bob disconnected get %v", left)
+	}
+}
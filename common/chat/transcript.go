@@ -0,0 +1,286 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrInvalidSession id not usable as name of a transcript
+var ErrInvalidSession = errors.New("chat: invalid session id")
+
+//Transcript of the chat of a session, a file of JSON lines
+//on a directory named by the session id
+type Transcript struct {
+	mutex sync.Mutex
+	file  *os.File
+	seen  map[string]bool
+}
+
+//transcriptPath of *sessionID* on *dir*
+func transcriptPath(dir, sessionID string) (string, error) {
+	if sessionID == "" || sessionID == "." || sessionID == ".." ||
+		strings.ContainsAny(sessionID, `/\`) {
+		return "", ErrInvalidSession
+	}
+	return filepath.Join(dir, sessionID+".jsonl"), nil
+}
+
+//OpenTranscript of *sessionID* on *dir*, the messages
+//are appended to the recorded before
+func OpenTranscript(dir, sessionID string) (*Transcript, error) {
+	path, err := transcriptPath(dir, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	msgs, err := ReadTranscript(dir, sessionID)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transcript{file: file, seen: make(map[string]bool)}
+	for _, msg := range msgs {
+		t.seen[msg.ID] = true
+	}
+	return t, nil
+}
+
+//Record *msg* when it's text, join or leave. The messages
+//already recorded are skipped so history of the room
+//it's not repeated.
+func (t *Transcript) Record(msg Message) error {
+	switch msg.Kind {
+	case KindText, KindJoin, KindLeave:
+	default:
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if msg.ID != "" {
+		if t.seen[msg.ID] {
+			return nil
+		}
+		t.seen[msg.ID] = true
+	}
+	msg.History = false
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = t.file.Write(append(line, '\n'))
+	return err
+}
+
+//Close the file
+func (t *Transcript) Close() error {
+	return t.file.Close()
+}
+
+//ReadTranscript recorded of *sessionID* on *dir*
+func ReadTranscript(dir, sessionID string) ([]Message, error) {
+	path, err := transcriptPath(dir, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var msgs []Message
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4096), maxLine)
+	for scanner.Scan() {
+		var msg Message
+		//a line cut by a crash it's not a reason to lose the rest
+		if json.Unmarshal(scanner.Bytes(), &msg) == nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, scanner.Err()
+}
+
+//transcriptLine of *msg* as plain text
+func transcriptLine(msg Message) string {
+	if msg.Kind == KindText {
+		return msg.String()
+	}
+	return fmt.Sprintf("[%s] %s", msg.Time.Local().Format("15:04"), msg.Status())
+}
+
+//ExportText *msgs* a line per message
+func ExportText(w io.Writer, msgs []Message) error {
+	for _, msg := range msgs {
+		if _, err := io.WriteString(w, transcriptLine(msg)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ExportJSONL *msgs* a JSON line per message
+func ExportJSONL(w io.Writer, msgs []Message) error {
+	enc := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var transcriptHTML = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chat of session {{.Session}}</title>
+<style>
+.notice { color: gray; font-style: italic; }
+.from { font-weight: bold; }
+.text { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Chat of session {{.Session}}</h1>
+<table>
+{{range .Messages}}<tr class="{{if eq .Kind "text"}}message{{else}}notice{{end}}">
+<td>{{time .Time}}</td>
+{{if eq .Kind "text"}}<td class="from">{{if .From}}{{.From}}{{else}}remote{{end}}</td><td class="text">{{.Text}}</td>{{else}}<td colspan="2">{{.Status}}</td>{{end}}
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+//ExportHTML *msgs* of *sessionID* as a page
+func ExportHTML(w io.Writer, sessionID string, msgs []Message) error {
+	return transcriptHTML.Execute(w, struct {
+		Session  string
+		Messages []Message
+	}{sessionID, msgs})
+}
+
+//Archive of the transcripts on a directory, the connections
+//of a session share the transcript so the messages relayed
+//by a room are recorded once
+type Archive struct {
+	Dir string
+
+	mutex sync.Mutex
+	open  map[string]*archived
+}
+
+type archived struct {
+	t    *Transcript
+	refs int
+}
+
+//Recorders of the data going both ways on a connection of
+//*sessionID*, it's used by the server on audited sessions.
+//See remoton.Server.Audit
+func (a *Archive) Recorders(sessionID string) (io.WriteCloser, io.WriteCloser, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.open == nil {
+		a.open = make(map[string]*archived)
+	}
+	entry := a.open[sessionID]
+	if entry == nil {
+		t, err := OpenTranscript(a.Dir, sessionID)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry = &archived{t: t}
+		a.open[sessionID] = entry
+	}
+	entry.refs += 2
+	release := func() { a.release(sessionID) }
+	return &recorder{t: entry.t, release: release},
+		&recorder{t: entry.t, release: release}, nil
+}
+
+func (a *Archive) release(sessionID string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	entry := a.open[sessionID]
+	if entry == nil {
+		return
+	}
+	entry.refs--
+	if entry.refs == 0 {
+		entry.t.Close()
+		delete(a.open, sessionID)
+	}
+}
+
+//Read the transcript of *sessionID*
+func (a *Archive) Read(sessionID string) ([]Message, error) {
+	return ReadTranscript(a.Dir, sessionID)
+}
+
+//recorder of the lines of a direction of the connection
+type recorder struct {
+	t       *Transcript
+	release func()
+
+	mutex  sync.Mutex
+	buf    []byte
+	closed bool
+}
+
+//Write the data, the messages are recorded when the line it's complete
+func (r *recorder) Write(data []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.buf = append(r.buf, data...)
+	for {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(r.buf[:i]))
+		r.buf = r.buf[i+1:]
+		if line == "" {
+			continue
+		}
+		var msg Message
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &msg) != nil {
+			msg = Message{Kind: KindText, Text: line, Time: time.Now()}
+		}
+		r.t.Record(msg)
+	}
+	if len(r.buf) > maxLine {
+		r.buf = nil
+	}
+	r.buf = append([]byte(nil), r.buf...)
+	return len(data), nil
+}
+
+//Close the recorder, the transcript it's closed after the last
+func (r *recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.closed {
+		r.closed = true
+		r.release()
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestTranscript(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tr, err := OpenTranscript(dir, "sess1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := NewText("customer", "hola <b>")
+	tr.Record(hello)
+	tr.Record(Message{Kind: KindTyping, ID: newID(), From: "customer", Typing: true})
+	tr.Record(Message{Kind: KindJoin, ID: newID(), From: "alice"})
+	tr.Close()
+
+	//history of the room it's not recorded again
+	tr, err = OpenTranscript(dir, "sess1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello.History = true
+	tr.Record(hello)
+	tr.Record(NewText("alice", "ok"))
+	tr.Close()
+
+	msgs, err := ReadTranscript(dir, "sess1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || msgs[0].ID != hello.ID || msgs[1].Kind != KindJoin || msgs[2].Text != "ok" {
+		t.Fatalf("unexpected transcript %+v", msgs)
+	}
+
+	var text bytes.Buffer
+	ExportText(&text, msgs)
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	if len(lines) != 3 || lines[0][8:] != "customer: hola <b>" || lines[1][8:] != "alice joined" {
+		t.Errorf("unexpected text %q", text.String())
+	}
+	var page bytes.Buffer
+	if err := ExportHTML(&page, "sess1", msgs); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), "hola &lt;b&gt;") {
+		t.Errorf("want escaped text on %s", page.String())
+	}
+
+	if _, err := OpenTranscript(dir, "../sess1"); err != ErrInvalidSession {
+		t.Errorf("want %v get %v", ErrInvalidSession, err)
+	}
+}
+
+func TestArchiveRecorders(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	archive := &Archive{Dir: dir}
+
+	dialed1, listened1, err := archive.Recorders("sess2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed2, listened2, _ := archive.Recorders("sess2")
+
+	msg := NewText("alice", "se reinicia")
+	line, _ := json.Marshal(msg)
+	line = append(line, '\n')
+	//the message split between writes
+	dialed1.Write(line[:10])
+	dialed1.Write(line[10:])
+	//relayed by the room to the other supporter
+	listened2.Write(line)
+	listened1.Write([]byte("legacy peer\n"))
+	ack, _ := json.Marshal(Message{Kind: KindDelivered, ID: newID(), Ref: msg.ID})
+	dialed2.Write(append(ack, '\n'))
+
+	for _, w := range []interface{ Close() error }{dialed1, listened1, dialed2, listened2} {
+		w.Close()
+	}
+	if len(archive.open) != 0 {
+		t.Error("want transcript closed after the last recorder")
+	}
+
+	msgs, err := archive.Read("sess2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != msg.ID || msgs[1].Text != "legacy peer" {
+		t.Errorf("unexpected transcript %+v", msgs)
+	}
+}
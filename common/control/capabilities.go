@@ -0,0 +1,187 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Protocols a peer can support
+const (
+	ProtocolXpra  = "xpra"
+	ProtocolVNC   = "vnc"
+	ProtocolFiles = "files"
+	ProtocolChat  = "chat"
+	//ProtocolViewOnly the customer can switch the supporter to view-only
+	ProtocolViewOnly = "view-only"
+)
+
+//desktopProtocols by preference, one of them it's required
+var desktopProtocols = []string{ProtocolXpra, ProtocolVNC}
+
+//legacyProtocols of peers announcing only XpraVersion
+var legacyProtocols = []string{ProtocolXpra, ProtocolChat}
+
+//compressionNone always supported
+const compressionNone = "none"
+
+//Capabilities for this client
+type Capabilities struct {
+	//XpraVersion of running client xpra
+	XpraVersion string `json:"xpraVersion"`
+	//XpraRange versions of xpra of the peer accepted, see ParseRange,
+	//by default the same major of XpraVersion, the same minor before 1.0
+	XpraRange string `json:"xpraRange,omitempty"`
+	//Protocols supported by preference, by default xpra and chat
+	Protocols []string `json:"protocols,omitempty"`
+	//Encodings of the desktop by preference, empty when unknown
+	Encodings []string `json:"encodings,omitempty"`
+	//Compression algorithms by preference (remoton.CompressZstd...),
+	//by default none
+	Compression []string `json:"compression,omitempty"`
+}
+
+func (c Capabilities) protocols() []string {
+	if len(c.Protocols) == 0 {
+		return legacyProtocols
+	}
+	return c.Protocols
+}
+
+//xpraRange accepted by the peer
+func (c Capabilities) xpraRange() (*VersionRange, error) {
+	if c.XpraRange != "" {
+		return ParseRange(c.XpraRange)
+	}
+	v, err := parseVersion(c.XpraVersion)
+	if err != nil {
+		return nil, err
+	}
+	if v[0] == 0 {
+		return ParseRange(fmt.Sprintf("~%d.%d", v[0], v[1]))
+	}
+	return ParseRange(fmt.Sprintf("^%d.0", v[0]))
+}
+
+//Agreement what both peers will use
+type Agreement struct {
+	//Protocols supported by both in the order of the local peer
+	Protocols []string
+	//Desktop protocol to use, xpra or vnc
+	Desktop string
+	//Encodings supported by both, nil when a peer don't announce them
+	Encodings []string
+	//Compression algorithm to use
+	Compression string
+}
+
+//Supports *protocol* both peers
+func (a *Agreement) Supports(protocol string) bool {
+	return contains(a.Protocols, protocol)
+}
+
+//IncompatibleError why the peers can't work together
+type IncompatibleError struct {
+	Reasons []string
+}
+
+func (e *IncompatibleError) Error() string {
+	return "incompatible peers: " + strings.Join(e.Reasons, "; ")
+}
+
+//Negotiate the best set supported by *local* and *remote*,
+//preferences of *local* win
+func Negotiate(local, remote Capabilities) (*Agreement, error) {
+	var reasons []string
+	agreement := &Agreement{
+		Protocols: intersect(local.protocols(), remote.protocols()),
+	}
+
+	var xpraErr error
+	if contains(agreement.Protocols, ProtocolXpra) {
+		if xpraErr = xpraCompatible(local, remote); xpraErr != nil {
+			agreement.Protocols = remove(agreement.Protocols, ProtocolXpra)
+		}
+	}
+	for _, protocol := range agreement.Protocols {
+		if contains(desktopProtocols, protocol) {
+			agreement.Desktop = protocol
+			break
+		}
+	}
+	if agreement.Desktop == "" {
+		if xpraErr != nil {
+			reasons = append(reasons, xpraErr.Error())
+		}
+		reasons = append(reasons, fmt.Sprintf("no common desktop protocol, local %v remote %v",
+			local.protocols(), remote.protocols()))
+	}
+
+	if len(local.Encodings) > 0 && len(remote.Encodings) > 0 {
+		agreement.Encodings = intersect(local.Encodings, remote.Encodings)
+		if len(agreement.Encodings) == 0 {
+			reasons = append(reasons, fmt.Sprintf("no common encoding, local %v remote %v",
+				local.Encodings, remote.Encodings))
+		}
+	}
+
+	agreement.Compression = compressionNone
+	if common := intersect(local.Compression, remote.Compression); len(common) > 0 {
+		agreement.Compression = common[0]
+	}
+
+	if len(reasons) > 0 {
+		return nil, &IncompatibleError{Reasons: reasons}
+	}
+	return agreement, nil
+}
+
+//xpraCompatible every peer accepts the version of the other
+func xpraCompatible(local, remote Capabilities) error {
+	for _, peer := range []struct {
+		name, otherName string
+		caps, other     Capabilities
+	}{
+		{"local", "remote", local, remote},
+		{"remote", "local", remote, local},
+	} {
+		accepted, err := peer.caps.xpraRange()
+		if err != nil {
+			return fmt.Errorf("xpra of %s peer: %s", peer.name, err)
+		}
+		if !accepted.Match(peer.other.XpraVersion) {
+			return fmt.Errorf("xpra %s of %s peer not in %s accepted by %s peer",
+				peer.other.XpraVersion, peer.otherName, accepted, peer.name)
+		}
+	}
+	return nil
+}
+
+//intersect elements of *a* on *b* in the order of *a*
+func intersect(a, b []string) []string {
+	var common []string
+	for _, e := range a {
+		if contains(b, e) && !contains(common, e) {
+			common = append(common, e)
+		}
+	}
+	return common
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, s string) []string {
+	var rest []string
+	for _, e := range list {
+		if !strings.EqualFold(e, s) {
+			rest = append(rest, e)
+		}
+	}
+	return rest
+}
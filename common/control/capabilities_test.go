@@ -0,0 +1,151 @@
+package control
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVersionRange(t *testing.T) {
+	tests := []struct {
+		rang    string
+		version string
+		want    bool
+	}{
+		{"", "anything", true},
+		{">=0.15.0 <0.18.0", "0.17.6", true},
+		{">=0.15.0 <0.18.0", "v0.17.6-r14322", true},
+		{">=0.15.0 <0.18.0", "0.18.0", false},
+		{"~0.15", "0.15.9", true},
+		{"~0.15", "0.16.0", false},
+		{"0.15.x", "0.15.2", true},
+		{"0.15", "0.14.9", false},
+		{"^0.15.2", "0.15.1", false},
+		{"^0.15.2", "0.15.3", true},
+		{"^1.2.0", "1.9.0", true},
+		{"^1.2.0", "2.0.0", false},
+		{"0.14.x || >=2.0", "0.14.1", true},
+		{"0.14.x || >=2.0", "2.1", true},
+		{"0.14.x || >=2.0", "1.0", false},
+		{"=0.15.1", "0.15.1", true},
+		{"0.15.1", "0.15.2", false},
+		{"*", "3.0", true},
+		{">=0.15", "", false},
+	}
+
+	for _, test := range tests {
+		r, err := ParseRange(test.rang)
+		if err != nil {
+			t.Fatalf("%q: %v", test.rang, err)
+		}
+		if got := r.Match(test.version); got != test.want {
+			t.Errorf("%q match %q want %v get %v", test.rang, test.version, test.want, got)
+		}
+	}
+
+	for _, invalid := range []string{">=a.b", "1.2.3.4", "||"} {
+		if _, err := ParseRange(invalid); err == nil {
+			t.Errorf("%q: want error", invalid)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	local := Capabilities{
+		XpraVersion: "0.17.6",
+		XpraRange:   ">=0.15 <0.18",
+		Protocols:   []string{ProtocolXpra, ProtocolVNC, ProtocolFiles, ProtocolChat},
+		Encodings:   []string{"h264", "png", "jpeg"},
+		Compression: []string{"zstd", "lz4", "none"},
+	}
+	remote := Capabilities{
+		XpraVersion: "0.15.10",
+		XpraRange:   "^0.15 || ^0.17",
+		Protocols:   []string{ProtocolChat, ProtocolFiles, ProtocolXpra},
+		Encodings:   []string{"jpeg", "png"},
+		Compression: []string{"lz4", "none"},
+	}
+
+	agreement, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Agreement{
+		Protocols:   []string{ProtocolXpra, ProtocolFiles, ProtocolChat},
+		Desktop:     ProtocolXpra,
+		Encodings:   []string{"png", "jpeg"},
+		Compression: "lz4",
+	}
+	if !reflect.DeepEqual(agreement, want) {
+		t.Errorf("want %+v get %+v", want, agreement)
+	}
+	if !agreement.Supports(ProtocolFiles) || agreement.Supports(ProtocolVNC) {
+		t.Errorf("want files without vnc get %v", agreement.Protocols)
+	}
+}
+
+func TestNegotiateFallbackVNC(t *testing.T) {
+	local := Capabilities{XpraVersion: "0.17.6", Protocols: []string{ProtocolXpra, ProtocolVNC}}
+	remote := Capabilities{XpraVersion: "2.0", Protocols: []string{ProtocolXpra, ProtocolVNC}}
+
+	agreement, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agreement.Desktop != ProtocolVNC || agreement.Supports(ProtocolXpra) {
+		t.Errorf("want vnc get %+v", agreement)
+	}
+}
+
+func TestNegotiateXpraMajor(t *testing.T) {
+	//by default the same major it's accepted
+	agreement, err := Negotiate(
+		Capabilities{XpraVersion: "4.4.6", Protocols: []string{ProtocolXpra}},
+		Capabilities{XpraVersion: "4.0.6", Protocols: []string{ProtocolXpra}})
+	if err != nil || agreement.Desktop != ProtocolXpra {
+		t.Errorf("want xpra get %+v %v", agreement, err)
+	}
+	_, err = Negotiate(
+		Capabilities{XpraVersion: "4.4.6", Protocols: []string{ProtocolXpra}},
+		Capabilities{XpraVersion: "5.0", Protocols: []string{ProtocolXpra}})
+	if err == nil || !strings.Contains(err.Error(), "xpra 5.0 of remote peer not in ^4.0") {
+		t.Errorf("want report of xpra version get %v", err)
+	}
+}
+
+func TestNegotiateLegacy(t *testing.T) {
+	//peers announcing only the version of xpra
+	agreement, err := Negotiate(
+		Capabilities{XpraVersion: "0.15.2", Compression: []string{"zstd"}},
+		Capabilities{XpraVersion: "v0.15.10-r100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agreement.Desktop != ProtocolXpra || !agreement.Supports(ProtocolChat) ||
+		agreement.Compression != "none" || agreement.Encodings != nil {
+		t.Errorf("want xpra and chat without compression get %+v", agreement)
+	}
+}
+
+func TestNegotiateIncompatible(t *testing.T) {
+	_, err := Negotiate(
+		Capabilities{XpraVersion: "0.15.2", Encodings: []string{"h264"}},
+		Capabilities{XpraVersion: "0.17.0", Encodings: []string{"png"}})
+	incompatible, ok := err.(*IncompatibleError)
+	if !ok {
+		t.Fatalf("want incompatible error get %v", err)
+	}
+	if len(incompatible.Reasons) != 3 {
+		t.Errorf("want xpra, desktop and encoding reasons get %v", incompatible.Reasons)
+	}
+	if !strings.Contains(err.Error(), "xpra 0.17.0 of remote peer not in ~0.15") {
+		t.Errorf("want report of xpra version get %v", err)
+	}
+
+	_, err = Negotiate(
+		Capabilities{Protocols: []string{ProtocolVNC}},
+		Capabilities{Protocols: []string{ProtocolChat}})
+	if err == nil || !strings.Contains(err.Error(), "no common desktop protocol") {
+		t.Errorf("want no desktop protocol get %v", err)
+	}
+}
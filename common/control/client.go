@@ -0,0 +1,191 @@
+package control
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"time"
+
+	"github.com/bit4bit/remoton/common/jsonrpc2"
+	"github.com/bit4bit/remoton/common/p2p/stun"
+	"github.com/bit4bit/remoton/common/procs"
+	"github.com/bit4bit/remoton/common/sysinfo"
+)
+
+//helloTimeout legacy peers wait more data and never answer the hello
+var helloTimeout = time.Second * 5
+
+//Client of the protocol used by the supporter
+type Client struct {
+	rpc *rpc.Client
+	//Version negotiated, zero for legacy peers
+	Version int
+	//Peer capabilities of the client
+	Peer Capabilities
+}
+
+//NewClient negotiate the protocol over *conn* announcing *caps*
+func NewClient(conn io.ReadWriteCloser, caps Capabilities) (*Client, error) {
+	c := &Client{rpc: jsonrpc2.NewClient(conn)}
+
+	var hello HelloResponse
+	err := c.rpc.Call(ServiceName+".Hello", HelloRequest{Version: Version, Capabilities: caps}, &hello)
+	if err != nil {
+		c.rpc.Close()
+		return nil, err
+	}
+	if _, err := negotiate(hello.Version); err != nil || hello.Version > Version {
+		c.rpc.Close()
+		return nil, jsonrpc2.NewError(CodeVersion, "unsupported protocol version")
+	}
+	c.Version = hello.Version
+	c.Peer = hello.Capabilities
+	return c, nil
+}
+
+//NewLegacyClient over *conn* for peers speaking gob
+func NewLegacyClient(conn io.ReadWriteCloser) (*Client, error) {
+	c := &Client{rpc: rpc.NewClient(conn)}
+	if err := c.rpc.Call(LegacyServiceName+".GetCapabilities", struct{}{}, &c.Peer); err != nil {
+		c.rpc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//Dial the protocol with connections of *dial*, peers without it
+//are reached on a new connection with the legacy gob methods
+func Dial(dial func() (net.Conn, error), caps Capabilities) (*Client, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(helloTimeout))
+	c, err := NewClient(conn, caps)
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		return c, nil
+	}
+	//a peer with the protocol answer the errors
+	if _, ok := err.(rpc.ServerError); ok {
+		return nil, jsonrpc2.ParseError(err)
+	}
+	if e, ok := err.(*jsonrpc2.Error); ok {
+		return nil, e
+	}
+
+	conn, err = dial()
+	if err != nil {
+		return nil, err
+	}
+	return NewLegacyClient(conn)
+}
+
+//Legacy the peer only speaks the gob methods
+func (c *Client) Legacy() bool {
+	return c.Version == 0
+}
+
+//Platform of the client
+func (c *Client) Platform() (PlatformResponse, error) {
+	var res PlatformResponse
+	if !c.Legacy() {
+		return res, c.call("Platform", Empty{}, &res)
+	}
+
+	if err := c.rpc.Call(LegacyServiceName+".GetOS", struct{}{}, &res.OS); err != nil {
+		return res, err
+	}
+	err := c.rpc.Call(LegacyServiceName+".GetArch", struct{}{}, &res.Arch)
+	return res, err
+}
+
+//Network how the client it's reached, legacy peers
+//can answer part of it
+func (c *Client) Network() (NetworkResponse, error) {
+	var res NetworkResponse
+	if !c.Legacy() {
+		return res, c.call("Network", Empty{}, &res)
+	}
+
+	var ip net.IP
+	if c.rpc.Call(LegacyServiceName+".GetExternalIP", struct{}{}, &ip) == nil {
+		res.ExternalIP = ip.String()
+	}
+	c.rpc.Call(LegacyServiceName+".GetExternalPort", struct{}{}, &res.ExternalPort)
+	var nat stun.Result
+	if c.rpc.Call(LegacyServiceName+".GetNAT", struct{}{}, &nat) == nil {
+		res.NAT = string(nat.NAT)
+		if nat.Mapped != nil {
+			res.Mapped = nat.Mapped.String()
+		}
+	}
+	if res == (NetworkResponse{}) {
+		return res, errors.New("control: network unknown")
+	}
+	return res, nil
+}
+
+//SystemInfo of the machine of the client
+func (c *Client) SystemInfo() (*sysinfo.Info, error) {
+	info := &sysinfo.Info{}
+	if !c.Legacy() {
+		return info, c.call("SystemInfo", Empty{}, info)
+	}
+	return info, c.rpc.Call(LegacyServiceName+".GetSystemInfo", struct{}{}, info)
+}
+
+//ListProcesses running on the client, the error
+//it's ErrDenied without consent of the customer
+func (c *Client) ListProcesses() ([]procs.Process, error) {
+	if !c.Legacy() {
+		var res ProcessesResponse
+		err := c.call("Processes", Empty{}, &res)
+		return res.Processes, err
+	}
+	var processes []procs.Process
+	err := c.rpc.Call(LegacyServiceName+".ListProcesses", struct{}{}, &processes)
+	return processes, legacyError(err)
+}
+
+//KillProcess *pid* of the client
+func (c *Client) KillProcess(pid int) error {
+	if !c.Legacy() {
+		return c.call("Kill", KillRequest{PID: pid}, &Empty{})
+	}
+	return legacyError(c.rpc.Call(LegacyServiceName+".KillProcess", pid, &struct{}{}))
+}
+
+//View waits the view-only mode changes after *revision*, the
+//first call with revision -1 answers the current mode
+func (c *Client) View(revision int) (ViewResponse, error) {
+	var res ViewResponse
+	if c.Legacy() {
+		return res, jsonrpc2.NewError(CodeUnavailable, "view-only unsupported")
+	}
+	return res, c.call("View", ViewRequest{Revision: revision}, &res)
+}
+
+//legacyError the gob methods answer the errors of the protocol as strings
+func legacyError(err error) error {
+	if _, ok := err.(rpc.ServerError); ok {
+		if e := jsonrpc2.ParseError(err); e.Code != jsonrpc2.CodeServer {
+			return e
+		}
+	}
+	return err
+}
+
+func (c *Client) call(method string, req interface{}, reply interface{}) error {
+	err := c.rpc.Call(ServiceName+"."+method, req, reply)
+	if _, ok := err.(rpc.ServerError); ok {
+		return jsonrpc2.ParseError(err)
+	}
+	return err
+}
+
+//Close the connection
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
@@ -0,0 +1,115 @@
+// Package control it's the protocol between the client and the
+// supporter over the "rpc" service.
+//
+// It's JSON-RPC 2.0 (see jsonrpc2) so the browser client can use it,
+// every connection starts with Remoton.Hello negotiating the version
+// of the protocol and exchanging the capabilities of the peers.
+// Connections speaking gob are served by the legacy net/rpc methods.
+package control
+
+import (
+	"github.com/bit4bit/remoton/common/jsonrpc2"
+	"github.com/bit4bit/remoton/common/procs"
+	"github.com/bit4bit/remoton/common/sysinfo"
+)
+
+const (
+	//Version of the protocol implemented
+	Version = 1
+	//MinVersion oldest version of the protocol accepted
+	MinVersion = 1
+
+	//ServiceName of the methods on JSON-RPC
+	ServiceName = "Remoton"
+	//LegacyServiceName of the gob methods
+	LegacyServiceName = "RemotonClient"
+)
+
+//Error codes of the protocol
+const (
+	//CodeVersion the versions of the peers are incompatible
+	CodeVersion = -32001
+	//CodeHelloRequired methods called before Hello
+	CodeHelloRequired = -32002
+	//CodeUnavailable the peer can't answer the request
+	CodeUnavailable = -32003
+	//CodeDenied the customer didn't allow the request
+	CodeDenied = -32004
+)
+
+var (
+	//ErrDenied answer of the requests the customer didn't allow
+	ErrDenied = jsonrpc2.NewError(CodeDenied, "denied by the customer")
+	//ErrViewOnly answer of the requests changing the client on
+	//connections the customer allowed only to view
+	ErrViewOnly = jsonrpc2.NewError(CodeDenied, "view-only access")
+
+	errHelloRequired = jsonrpc2.NewError(CodeHelloRequired, "hello required")
+)
+
+//Empty params or result
+type Empty struct{}
+
+//HelloRequest first request of the supporter
+type HelloRequest struct {
+	//Version higher supported by the supporter
+	Version      int          `json:"version"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+//HelloResponse the version chosen by the client
+type HelloResponse struct {
+	Version      int          `json:"version"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+//PlatformResponse system running the client
+type PlatformResponse struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+//NetworkResponse how the client it's reached from internet,
+//fields are empty when unknown
+type NetworkResponse struct {
+	ExternalIP   string `json:"externalIP,omitempty"`
+	ExternalPort int    `json:"externalPort,omitempty"`
+	//NAT kind detected with STUN
+	NAT string `json:"nat,omitempty"`
+	//Mapped public udp address detected with STUN
+	Mapped string `json:"mapped,omitempty"`
+}
+
+//ProcessesResponse running on the client
+type ProcessesResponse struct {
+	Processes []procs.Process `json:"processes"`
+}
+
+//KillRequest process of the client to kill
+type KillRequest struct {
+	PID int `json:"pid"`
+}
+
+//Provider answer the requests of the supporter
+type Provider interface {
+	Capabilities() Capabilities
+	Platform() (PlatformResponse, error)
+	Network() (NetworkResponse, error)
+	SystemInfo() (*sysinfo.Info, error)
+	//Processes and Kill return ErrDenied without consent of the customer
+	Processes() ([]procs.Process, error)
+	Kill(pid int) error
+	//View waits the view-only mode changes after *revision*
+	View(revision int) (ViewResponse, error)
+}
+
+//negotiate the version to use with a peer supporting up to *version*
+func negotiate(version int) (int, error) {
+	if version < MinVersion {
+		return 0, jsonrpc2.NewError(CodeVersion, "unsupported protocol version")
+	}
+	if version > Version {
+		version = Version
+	}
+	return version, nil
+}
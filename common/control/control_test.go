@@ -0,0 +1,400 @@
+package control
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bit4bit/remoton/common/jsonrpc2"
+	"github.com/bit4bit/remoton/common/p2p/stun"
+	"github.com/bit4bit/remoton/common/procs"
+	"github.com/bit4bit/remoton/common/sysinfo"
+)
+
+type fakeProvider struct{}
+
+func (fakeProvider) Capabilities() Capabilities {
+	return Capabilities{XpraVersion: "0.15"}
+}
+
+func (fakeProvider) Platform() (PlatformResponse, error) {
+	return PlatformResponse{OS: "linux", Arch: "amd64"}, nil
+}
+
+func (fakeProvider) Network() (NetworkResponse, error) {
+	return NetworkResponse{}, errors.New("no gateway")
+}
+
+func (fakeProvider) SystemInfo() (*sysinfo.Info, error) {
+	return &sysinfo.Info{Hostname: "helpdesk-01", OS: "linux", CPUs: 4,
+		Displays: []sysinfo.Display{{Name: "eDP-1", Width: 1920, Height: 1080}}}, nil
+}
+
+func (fakeProvider) Processes() ([]procs.Process, error) {
+	return []procs.Process{{PID: 1, Name: "init"}, {PID: 742, PPID: 1, Name: "firefox"}}, nil
+}
+
+func (fakeProvider) Kill(pid int) error {
+	return ErrDenied
+}
+
+func (fakeProvider) View(revision int) (ViewResponse, error) {
+	return ViewResponse{}, nil
+}
+
+//viewProvider switched by the test
+type viewProvider struct {
+	fakeProvider
+	view *ViewSwitch
+}
+
+func (p viewProvider) View(revision int) (ViewResponse, error) {
+	return p.view.Wait(revision, ViewWait), nil
+}
+
+//legacyClient the gob methods of old clients
+type legacyClient struct{}
+
+func (legacyClient) GetCapabilities(args struct{}, reply *Capabilities) error {
+	*reply = Capabilities{XpraVersion: "0.14"}
+	return nil
+}
+
+func (legacyClient) GetOS(args struct{}, reply *string) error {
+	*reply = "windows"
+	return nil
+}
+
+func (legacyClient) GetArch(args struct{}, reply *string) error {
+	*reply = "386"
+	return nil
+}
+
+func (legacyClient) GetExternalIP(args struct{}, reply *net.IP) error {
+	*reply = net.IPv4(33, 44, 55, 66)
+	return nil
+}
+
+func (legacyClient) GetExternalPort(args struct{}, reply *int) error {
+	*reply = 9932
+	return nil
+}
+
+func (legacyClient) GetSystemInfo(args struct{}, reply *sysinfo.Info) error {
+	*reply = sysinfo.Info{Hostname: "legacy", OS: "windows"}
+	return nil
+}
+
+func (legacyClient) ListProcesses(args struct{}, reply *[]procs.Process) error {
+	return ErrDenied
+}
+
+func (legacyClient) GetNAT(args struct{}, reply *stun.Result) error {
+	*reply = stun.Result{NAT: stun.NATFullCone}
+	return nil
+}
+
+func legacyServer() *rpc.Server {
+	srv := rpc.NewServer()
+	srv.RegisterName(LegacyServiceName, legacyClient{})
+	return srv
+}
+
+//dialer connections served by *serve*
+func dialer(serve func(conn net.Conn)) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		cli, conn := net.Pipe()
+		go serve(conn)
+		return cli, nil
+	}
+}
+
+func TestDial(t *testing.T) {
+	dial := dialer(func(conn net.Conn) {
+		ServeConn(conn, fakeProvider{}, legacyServer())
+	})
+
+	c, err := Dial(dial, Capabilities{XpraVersion: "0.15"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Legacy() || c.Version != Version {
+		t.Errorf("want version %d get %d", Version, c.Version)
+	}
+	if c.Peer.XpraVersion != "0.15" {
+		t.Errorf("want peer capabilities get %+v", c.Peer)
+	}
+
+	platform, err := c.Platform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform != (PlatformResponse{OS: "linux", Arch: "amd64"}) {
+		t.Errorf("want linux/amd64 get %+v", platform)
+	}
+
+	_, err = c.Network()
+	if e := jsonrpc2.ParseError(err); e == nil || e.Code != CodeUnavailable {
+		t.Errorf("want code %d get %v", CodeUnavailable, err)
+	}
+
+	info, err := c.SystemInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Hostname != "helpdesk-01" || info.CPUs != 4 || len(info.Displays) != 1 {
+		t.Errorf("want system info get %+v", info)
+	}
+
+	processes, err := c.ListProcesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processes) != 2 || processes[1].Name != "firefox" {
+		t.Errorf("want processes get %+v", processes)
+	}
+	err = c.KillProcess(742)
+	if e := jsonrpc2.ParseError(err); e == nil || e.Code != CodeDenied {
+		t.Errorf("want code %d get %v", CodeDenied, err)
+	}
+}
+
+//killProvider kills the processes
+type killProvider struct {
+	fakeProvider
+	killed *int32
+}
+
+func (p killProvider) Kill(pid int) error {
+	atomic.AddInt32(p.killed, 1)
+	return nil
+}
+
+func TestKillViewOnly(t *testing.T) {
+	var killed int32
+	dial := dialer(func(conn net.Conn) {
+		ServeViewOnly(conn, killProvider{killed: &killed}, nil)
+	})
+	c, err := Dial(dial, Capabilities{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//the view-only supporter can still look
+	if _, err := c.ListProcesses(); err != nil {
+		t.Error(err)
+	}
+	err = c.KillProcess(742)
+	if e := jsonrpc2.ParseError(err); e == nil || e.Code != CodeDenied {
+		t.Errorf("want code %d get %v", CodeDenied, err)
+	}
+	if atomic.LoadInt32(&killed) != 0 {
+		t.Error("want process not killed")
+	}
+}
+
+func TestHelloRequired(t *testing.T) {
+	cli, conn := net.Pipe()
+	go ServeConn(conn, fakeProvider{}, nil)
+	client := jsonrpc2.NewClient(cli)
+	defer client.Close()
+
+	var platform PlatformResponse
+	err := client.Call(ServiceName+".Platform", Empty{}, &platform)
+	if e := jsonrpc2.ParseError(err); e == nil || e.Code != CodeHelloRequired {
+		t.Errorf("want code %d get %v", CodeHelloRequired, err)
+	}
+
+	var hello HelloResponse
+	err = client.Call(ServiceName+".Hello", HelloRequest{Version: MinVersion - 1}, &hello)
+	if e := jsonrpc2.ParseError(err); e == nil || e.Code != CodeVersion {
+		t.Errorf("want code %d get %v", CodeVersion, err)
+	}
+
+	//newer supporters use our version
+	err = client.Call(ServiceName+".Hello", HelloRequest{Version: Version + 1}, &hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.Version != Version {
+		t.Errorf("want version %d get %d", Version, hello.Version)
+	}
+	if err := client.Call(ServiceName+".Platform", Empty{}, &platform); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDialLegacyShim(t *testing.T) {
+	//clients using ServeConn answer gob
+	dial := dialer(func(conn net.Conn) {
+		ServeConn(conn, fakeProvider{}, legacyServer())
+	})
+	c, err := NewLegacyClient(mustDial(t, dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testLegacy(t, c)
+}
+
+func TestDialLegacyPeer(t *testing.T) {
+	timeout := helloTimeout
+	helloTimeout = time.Millisecond * 200
+	defer func() { helloTimeout = timeout }()
+
+	//old clients only speak gob
+	dial := dialer(func(conn net.Conn) {
+		legacyServer().ServeConn(conn)
+	})
+	c, err := Dial(dial, Capabilities{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Legacy() {
+		t.Error("want legacy client")
+	}
+	testLegacy(t, c)
+}
+
+func mustDial(t *testing.T, dial func() (net.Conn, error)) net.Conn {
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func testLegacy(t *testing.T, c *Client) {
+	if c.Peer.XpraVersion != "0.14" {
+		t.Errorf("want peer capabilities get %+v", c.Peer)
+	}
+	platform, err := c.Platform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform != (PlatformResponse{OS: "windows", Arch: "386"}) {
+		t.Errorf("want windows/386 get %+v", platform)
+	}
+	network, err := c.Network()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NetworkResponse{ExternalIP: "33.44.55.66", ExternalPort: 9932, NAT: string(stun.NATFullCone)}
+	if network != want {
+		t.Errorf("want %+v get %+v", want, network)
+	}
+	info, err := c.SystemInfo()
+	if err != nil || info.Hostname != "legacy" {
+		t.Errorf("want legacy system info get %+v %v", info, err)
+	}
+	_, err = c.ListProcesses()
+	if e, ok := err.(*jsonrpc2.Error); !ok || e.Code != CodeDenied {
+		t.Errorf("want code %d get %v", CodeDenied, err)
+	}
+}
+
+func TestView(t *testing.T) {
+	view := NewViewSwitch(true)
+	dial := dialer(func(conn net.Conn) {
+		ServeConn(conn, viewProvider{view: view}, nil)
+	})
+	c, err := Dial(dial, Capabilities{XpraVersion: "0.15"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	res, err := c.View(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.ViewOnly || res.Revision != 0 {
+		t.Errorf("want view-only at revision 0 get %+v", res)
+	}
+
+	changed := make(chan ViewResponse, 1)
+	go func() {
+		res, err := c.View(res.Revision)
+		if err != nil {
+			t.Error(err)
+		}
+		changed <- res
+	}()
+	time.Sleep(time.Millisecond * 50)
+	view.Set(true)
+	view.Set(false)
+	select {
+	case res := <-changed:
+		if res.ViewOnly || res.Revision != 1 {
+			t.Errorf("want full control at revision 1 get %+v", res)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting the view")
+	}
+}
+
+func TestViewSwitchTimeout(t *testing.T) {
+	view := NewViewSwitch(false)
+	res := view.Wait(0, time.Millisecond*10)
+	if res.ViewOnly || res.Revision != 0 {
+		t.Errorf("want unchanged view get %+v", res)
+	}
+}
+
+//countedConn counts the bytes read
+type countedConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func TestMeasure(t *testing.T) {
+	var counted *countedConn
+	dial := func() (net.Conn, error) {
+		conn, err := dialer(func(conn net.Conn) {
+			ServeConn(conn, fakeProvider{}, nil)
+		})()
+		counted = &countedConn{Conn: conn}
+		return counted, err
+	}
+	c, err := Dial(dial, Capabilities{XpraVersion: "0.15"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	link, err := c.Measure(3, 64<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Latency <= 0 || link.Throughput <= 0 {
+		t.Errorf("want link measured get %+v", link)
+	}
+
+	var res ProbeResponse
+	if err := c.call("Probe", ProbeRequest{Size: 16}, &res); err != nil || len(res.Data) != 16 {
+		t.Errorf("want 16 bytes get %d %v", len(res.Data), err)
+	}
+	//the probe travels without encoding
+	read := atomic.LoadInt64(&counted.read)
+	if err := c.call("Probe", ProbeRequest{Size: 64 << 10}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if read = atomic.LoadInt64(&counted.read) - read; read > 64<<10+256 {
+		t.Errorf("want the probe of %d bytes read as it is get %d", 64<<10, read)
+	}
+	err = c.call("Probe", ProbeRequest{Size: MaxProbe + 1}, &res)
+	if e, ok := err.(*jsonrpc2.Error); !ok || e.Code != jsonrpc2.CodeInvalidParams {
+		t.Errorf("want code %d get %v", jsonrpc2.CodeInvalidParams, err)
+	}
+}
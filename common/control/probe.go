@@ -0,0 +1,82 @@
+package control
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/bit4bit/remoton/common/jsonrpc2"
+)
+
+//MaxProbe bytes answered by a probe
+const MaxProbe = 1 << 20
+
+//ProbeRequest asks Size bytes to measure the link
+type ProbeRequest struct {
+	Size int `json:"size"`
+}
+
+//probeAlphabet of the probes, JSON sends its bytes as they are
+const probeAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+//ProbeResponse random bytes of probeAlphabet, they travel without
+//encoding and the tunnel can't compress them
+type ProbeResponse struct {
+	Data string `json:"data"`
+}
+
+//Link between the supporter and the client measured with probes
+type Link struct {
+	//Latency of a round trip
+	Latency time.Duration
+	//Throughput bytes per second from the client to the supporter
+	Throughput float64
+}
+
+//Probe answers random bytes to measure the link
+func (s *Service) Probe(req ProbeRequest, reply *ProbeResponse) error {
+	if err := s.ready(); err != nil {
+		return err
+	}
+	if req.Size < 0 || req.Size > MaxProbe {
+		return jsonrpc2.NewError(jsonrpc2.CodeInvalidParams, "invalid probe size")
+	}
+	data := make([]byte, req.Size)
+	rand.Read(data)
+	for i, b := range data {
+		data[i] = probeAlphabet[b%byte(len(probeAlphabet))]
+	}
+	reply.Data = string(data)
+	return nil
+}
+
+//Measure the link, the latency it's the best of *rounds* empty probes
+//and the throughput it's measured with a probe of *size* bytes, the
+//time of the empty probe it's the overhead of the request.
+//The probes go on the control tunnel relayed by the server, the
+//desktop going p2p may be faster
+func (c *Client) Measure(rounds, size int) (Link, error) {
+	var link Link
+	if c.Legacy() {
+		return link, jsonrpc2.NewError(CodeUnavailable, "probe unsupported")
+	}
+	for i := 0; i < rounds; i++ {
+		start := time.Now()
+		if err := c.call("Probe", ProbeRequest{}, &ProbeResponse{}); err != nil {
+			return link, err
+		}
+		if elapsed := time.Since(start); link.Latency == 0 || elapsed < link.Latency {
+			link.Latency = elapsed
+		}
+	}
+
+	start := time.Now()
+	if err := c.call("Probe", ProbeRequest{Size: size}, &ProbeResponse{}); err != nil {
+		return link, err
+	}
+	transfer := time.Since(start) - link.Latency
+	if transfer < time.Millisecond {
+		transfer = time.Millisecond
+	}
+	link.Throughput = float64(size) / transfer.Seconds()
+	return link, nil
+}
@@ -0,0 +1,173 @@
+package control
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//semver version major.minor.patch, prerelease and build are ignored
+type semver [3]int
+
+//parseVersion accepts "v0.17.6-r14322" or "0.15"
+func parseVersion(s string) (semver, error) {
+	var v semver
+	orig := s
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 || parts[0] == "" {
+		return v, fmt.Errorf("invalid version %q", orig)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", orig)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v semver) compare(o semver) int {
+	for i := range v {
+		switch {
+		case v[i] < o[i]:
+			return -1
+		case v[i] > o[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+func (v semver) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+type comparator struct {
+	op string
+	v  semver
+}
+
+func (c comparator) match(v semver) bool {
+	cmp := v.compare(c.v)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	}
+	return cmp == 0
+}
+
+//VersionRange set of versions like ">=0.15.0 <0.18.0 || 1.x"
+//comparators separated by space must match all, alternatives are
+//separated by "||". Operators: = > >= < <= ~ (same minor) ^ (same major
+//or same minor on 0.x), "0.15" or "0.15.x" it's the same minor
+type VersionRange struct {
+	alternatives [][]comparator
+	text         string
+}
+
+//ParseRange parse *s*, an empty range match every version
+func ParseRange(s string) (*VersionRange, error) {
+	r := &VersionRange{text: strings.TrimSpace(s)}
+	if r.text == "" {
+		return r, nil
+	}
+	for _, alt := range strings.Split(r.text, "||") {
+		var set []comparator
+		for _, field := range strings.Fields(alt) {
+			comparators, err := parseComparator(field)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, comparators...)
+		}
+		if len(set) == 0 {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+		r.alternatives = append(r.alternatives, set)
+	}
+	return r, nil
+}
+
+func parseComparator(s string) ([]comparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			s = s[len(prefix):]
+			break
+		}
+	}
+
+	//wildcards "0.15.x" or partial "0.15" are the same minor
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	for len(parts) > 0 {
+		last := parts[len(parts)-1]
+		if last != "x" && last != "*" {
+			break
+		}
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) == 0 {
+		return []comparator{{">=", semver{}}}, nil
+	}
+	v, err := parseVersion(strings.Join(parts, "."))
+	if err != nil {
+		return nil, err
+	}
+	partial := len(parts) < 3
+
+	switch {
+	case op == "~" || (op == "" || op == "=") && partial && len(parts) == 2:
+		return []comparator{{">=", v}, {"<", semver{v[0], v[1] + 1, 0}}}, nil
+	case (op == "" || op == "=") && partial:
+		return []comparator{{">=", v}, {"<", semver{v[0] + 1, 0, 0}}}, nil
+	case op == "^":
+		upper := semver{v[0] + 1, 0, 0}
+		if v[0] == 0 {
+			upper = semver{0, v[1] + 1, 0}
+		}
+		return []comparator{{">=", v}, {"<", upper}}, nil
+	case op == "":
+		op = "="
+	}
+	return []comparator{{op, v}}, nil
+}
+
+//Match *version*, invalid versions only match the empty range
+func (r *VersionRange) Match(version string) bool {
+	if len(r.alternatives) == 0 {
+		return true
+	}
+	v, err := parseVersion(version)
+	if err != nil {
+		return false
+	}
+	for _, set := range r.alternatives {
+		all := true
+		for _, c := range set {
+			if !c.match(v) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *VersionRange) String() string {
+	return r.text
+}
@@ -0,0 +1,182 @@
+package control
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+
+	"github.com/bit4bit/remoton/common/jsonrpc2"
+	"github.com/bit4bit/remoton/common/sysinfo"
+)
+
+//Service methods of the protocol, one for every connection
+type Service struct {
+	provider Provider
+	//viewOnly the requests changing the client are denied
+	viewOnly bool
+
+	mutex   sync.Mutex
+	version int
+}
+
+//NewService for a connection answered by *provider*
+func NewService(provider Provider) *Service {
+	return &Service{provider: provider}
+}
+
+//NewViewOnlyService for a connection the customer allowed only to view
+func NewViewOnlyService(provider Provider) *Service {
+	return &Service{provider: provider, viewOnly: true}
+}
+
+func (s *Service) ready() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.version == 0 {
+		return errHelloRequired
+	}
+	return nil
+}
+
+//Hello negotiate the version and exchange capabilities
+func (s *Service) Hello(req HelloRequest, reply *HelloResponse) error {
+	version, err := negotiate(req.Version)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.version = version
+	s.mutex.Unlock()
+
+	*reply = HelloResponse{Version: version, Capabilities: s.provider.Capabilities()}
+	return nil
+}
+
+//Platform of the client
+func (s *Service) Platform(req Empty, reply *PlatformResponse) error {
+	if err := s.ready(); err != nil {
+		return err
+	}
+	res, err := s.provider.Platform()
+	*reply = res
+	return unavailable(err)
+}
+
+//Network how the client it's reached
+func (s *Service) Network(req Empty, reply *NetworkResponse) error {
+	if err := s.ready(); err != nil {
+		return err
+	}
+	res, err := s.provider.Network()
+	*reply = res
+	return unavailable(err)
+}
+
+//SystemInfo of the machine of the client
+func (s *Service) SystemInfo(req Empty, reply *sysinfo.Info) error {
+	if err := s.ready(); err != nil {
+		return err
+	}
+	info, err := s.provider.SystemInfo()
+	if err != nil {
+		return unavailable(err)
+	}
+	*reply = *info
+	return nil
+}
+
+//Processes running on the client
+func (s *Service) Processes(req Empty, reply *ProcessesResponse) error {
+	if err := s.ready(); err != nil {
+		return err
+	}
+	processes, err := s.provider.Processes()
+	reply.Processes = processes
+	return unavailable(err)
+}
+
+//Kill a process of the client
+func (s *Service) Kill(req KillRequest, reply *Empty) error {
+	if err := s.ready(); err != nil {
+		return err
+	}
+	if s.viewOnly {
+		return ErrViewOnly
+	}
+	return unavailable(s.provider.Kill(req.PID))
+}
+
+//View waits the customer switches the view-only mode
+func (s *Service) View(req ViewRequest, reply *ViewResponse) error {
+	if err := s.ready(); err != nil {
+		return err
+	}
+	res, err := s.provider.View(req.Revision)
+	*reply = res
+	return unavailable(err)
+}
+
+func unavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*jsonrpc2.Error); ok {
+		return err
+	}
+	return jsonrpc2.NewError(CodeUnavailable, err.Error())
+}
+
+//bufferedConn conn with the bytes peeked
+type bufferedConn struct {
+	*bufio.Reader
+	io.WriteCloser
+}
+
+//ServeConn the protocol on *conn*, connections speaking gob are
+//served by *legacy* or closed when it's nil
+func ServeConn(conn io.ReadWriteCloser, provider Provider, legacy *rpc.Server) {
+	serveConn(conn, NewService(provider), legacy)
+}
+
+//ServeViewOnly the protocol on *conn* of a supporter the customer
+//allowed only to view, see ServeConn
+func ServeViewOnly(conn io.ReadWriteCloser, provider Provider, legacy *rpc.Server) {
+	serveConn(conn, NewViewOnlyService(provider), legacy)
+}
+
+func serveConn(conn io.ReadWriteCloser, service *Service, legacy *rpc.Server) {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	bconn := bufferedConn{Reader: reader, WriteCloser: conn}
+
+	//a gob stream never starts with '{'
+	if first[0] != '{' {
+		if legacy == nil {
+			conn.Close()
+			return
+		}
+		legacy.ServeConn(bconn)
+		return
+	}
+
+	srv := rpc.NewServer()
+	srv.RegisterName(ServiceName, service)
+	jsonrpc2.ServeConn(srv, bconn)
+}
+
+//Serve every connection accepted on *l* until it's closed
+func Serve(l net.Listener, provider Provider, legacy *rpc.Server) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go ServeConn(conn, provider, legacy)
+	}
+}
@@ -0,0 +1,74 @@
+package control
+
+import (
+	"sync"
+	"time"
+)
+
+//ViewWait the longest a View request waits a change
+var ViewWait = time.Second * 30
+
+//ViewRequest waits the view changes after Revision
+type ViewRequest struct {
+	Revision int `json:"revision"`
+}
+
+//ViewResponse how the supporter sees the desktop of the client
+type ViewResponse struct {
+	//ViewOnly the supporter can't use the keyboard and mouse
+	ViewOnly bool `json:"viewOnly"`
+	//Revision incremented on every change
+	Revision int `json:"revision"`
+}
+
+//ViewSwitch the view-only mode switched by the customer
+type ViewSwitch struct {
+	mutex    sync.Mutex
+	viewOnly bool
+	revision int
+	changed  chan struct{}
+}
+
+//NewViewSwitch starting on *viewOnly*
+func NewViewSwitch(viewOnly bool) *ViewSwitch {
+	return &ViewSwitch{viewOnly: viewOnly, changed: make(chan struct{})}
+}
+
+//Set the mode, the supporters waiting are answered
+func (v *ViewSwitch) Set(viewOnly bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.viewOnly == viewOnly {
+		return
+	}
+	v.viewOnly = viewOnly
+	v.revision++
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+//ViewOnly current mode
+func (v *ViewSwitch) ViewOnly() bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.viewOnly
+}
+
+//Wait the mode changes after *revision* or *timeout*
+func (v *ViewSwitch) Wait(revision int, timeout time.Duration) ViewResponse {
+	v.mutex.Lock()
+	changed := v.changed
+	res := ViewResponse{ViewOnly: v.viewOnly, Revision: v.revision}
+	v.mutex.Unlock()
+	if res.Revision != revision {
+		return res
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(timeout):
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return ViewResponse{ViewOnly: v.viewOnly, Revision: v.revision}
+}
@@ -0,0 +1,216 @@
+package filetransfer
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	//redialDelay between the dials of a lost connection
+	redialDelay = time.Second
+	//resumeTimeout waiting the peer to reconnect
+	resumeTimeout = time.Second * 10
+)
+
+//maxResumes of a transfer after connection lost
+const maxResumes = 3
+
+//send *name* with the peers of *current* resuming the
+//transfer when the connection it's lost
+func send(current func() (*Peer, error), name string, progress func(sent, total int64)) error {
+	var err error
+	for resumes := 0; resumes <= maxResumes; resumes++ {
+		var peer *Peer
+		peer, err = current()
+		if err != nil {
+			return err
+		}
+		err = peer.Send(name, progress)
+		if err != ErrConnectionLost {
+			return err
+		}
+	}
+	return err
+}
+
+//Client peer dialing the service, the connection it's
+//redialed when lost until it's closed
+type Client struct {
+	dial  func() (net.Conn, error)
+	conf  Config
+	delay time.Duration
+
+	mutex  sync.Mutex
+	peer   *Peer
+	closed bool
+	//done closed by Close, it stops the redial
+	done chan struct{}
+}
+
+//Dial the service with connections of *dial*
+func Dial(dial func() (net.Conn, error), conf Config) (*Client, error) {
+	c := &Client{dial: dial, conf: conf, delay: redialDelay, done: make(chan struct{})}
+	if _, err := c.current(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//current peer, dialing when the connection was lost
+func (c *Client) current() (*Peer, error) {
+	c.mutex.Lock()
+	closed, peer := c.closed, c.peer
+	c.mutex.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if peer != nil && !peer.lost() {
+		return peer, nil
+	}
+
+	//Close doesn't wait the dial
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, ErrClosed
+	}
+	//dialed meanwhile by another sender
+	if c.peer != peer && !c.peer.lost() {
+		conn.Close()
+		return c.peer, nil
+	}
+	c.peer = NewPeer(conn, c.conf)
+	go c.redial(c.peer)
+	return c.peer, nil
+}
+
+//redial after *peer* it's lost so the other side can send
+func (c *Client) redial(peer *Peer) {
+	select {
+	case <-peer.Done():
+	case <-c.done:
+		return
+	}
+	for {
+		select {
+		case <-time.After(c.delay):
+		case <-c.done:
+			return
+		}
+		c.mutex.Lock()
+		replaced := c.peer != peer
+		c.mutex.Unlock()
+		if replaced {
+			return
+		}
+		if _, err := c.current(); err == nil || err == ErrClosed {
+			return
+		}
+	}
+}
+
+//Send the file *name* resuming it after reconnects
+func (c *Client) Send(name string, progress func(sent, total int64)) error {
+	return send(c.current, name, progress)
+}
+
+//Close the connection, a dial in progress it's closed when it ends
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	peer := c.peer
+	c.mutex.Unlock()
+	if peer != nil {
+		return peer.Close()
+	}
+	return nil
+}
+
+//Server peer listening the service, the files are sent
+//to the last connected peer
+type Server struct {
+	conf Config
+	//ViewOnly reports the connections of the supporters the customer
+	//allowed only to view, their offers are rejected
+	ViewOnly func(conn net.Conn) bool
+
+	mutex     sync.Mutex
+	peer      *Peer
+	connected chan struct{}
+}
+
+//NewServer of the service
+func NewServer(conf Config) *Server {
+	return &Server{conf: conf, connected: make(chan struct{})}
+}
+
+//Serve the connections of *l* until it's closed, the
+//previous peer it's closed when another one connects
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		conf := s.conf
+		if s.ViewOnly != nil && s.ViewOnly(conn) {
+			conf.Prompt = nil
+		}
+		s.mutex.Lock()
+		replaced := s.peer
+		s.peer = NewPeer(conn, conf)
+		close(s.connected)
+		s.connected = make(chan struct{})
+		s.mutex.Unlock()
+		if replaced != nil {
+			replaced.Close()
+		}
+	}
+}
+
+//current peer, waiting it to reconnect when the connection was lost
+func (s *Server) current() (*Peer, error) {
+	timeout := time.After(resumeTimeout)
+	for {
+		s.mutex.Lock()
+		peer, connected := s.peer, s.connected
+		s.mutex.Unlock()
+		if peer == nil {
+			return nil, ErrNotConnected
+		}
+		if !peer.lost() {
+			return peer, nil
+		}
+		select {
+		case <-connected:
+		case <-timeout:
+			return nil, ErrNotConnected
+		}
+	}
+}
+
+//Send the file *name* to the peer resuming it after reconnects
+func (s *Server) Send(name string, progress func(sent, total int64)) error {
+	return send(s.current, name, progress)
+}
+
+//Close the connection of the peer
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	peer := s.peer
+	s.mutex.Unlock()
+	if peer != nil {
+		return peer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,482 @@
+package filetransfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "filetransfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+//tempFile of *size* random bytes
+func tempFile(t *testing.T, dir, name string, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+//results of Config.Received in order
+type results struct {
+	mutex sync.Mutex
+	paths []string
+	errs  []error
+	ch    chan struct{}
+	next  int
+}
+
+func newResults() *results {
+	return &results{ch: make(chan struct{}, 16)}
+}
+
+func (r *results) received(offer Offer, path string, err error) {
+	r.mutex.Lock()
+	r.paths = append(r.paths, path)
+	r.errs = append(r.errs, err)
+	r.mutex.Unlock()
+	r.ch <- struct{}{}
+}
+
+func (r *results) wait(t *testing.T) (string, error) {
+	select {
+	case <-r.ch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting received")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.next++
+	return r.paths[r.next-1], r.errs[r.next-1]
+}
+
+func acceptAll(Offer) bool { return true }
+
+func pipe(a, b Config) (*Peer, *Peer) {
+	c1, c2 := net.Pipe()
+	return NewPeer(c1, a), NewPeer(c2, b)
+}
+
+func assertFile(t *testing.T, path string, want []byte) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("want %d bytes on %s get %d distinct", len(want), path, len(data))
+	}
+}
+
+func TestSend(t *testing.T) {
+	src, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	name, data := tempFile(t, src, "install.log", chunkSize*3+17)
+
+	res := newResults()
+	var offered Offer
+	sender, receiver := pipe(Config{}, Config{Dir: dst, Received: res.received,
+		Prompt: func(o Offer) bool {
+			offered = o
+			return true
+		}})
+	defer sender.Close()
+	defer receiver.Close()
+
+	var sent int64
+	err := sender.Send(name, func(n, total int64) { sent = n })
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if offered.Name != "install.log" || offered.Size != int64(len(data)) ||
+		offered.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected offer %+v", offered)
+	}
+	if sent != int64(len(data)) {
+		t.Errorf("want progress %d get %d", len(data), sent)
+	}
+	path, err := res.wait(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dst, "install.log") {
+		t.Errorf("unexpected path %s", path)
+	}
+	assertFile(t, path, data)
+
+	//existing files are not overwritten
+	if err := sender.Send(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	path, _ = res.wait(t)
+	if path != filepath.Join(dst, "install (1).log") {
+		t.Errorf("unexpected path %s", path)
+	}
+}
+
+func TestSendBothWays(t *testing.T) {
+	dir1, dir2 := tempDir(t), tempDir(t)
+	defer os.RemoveAll(dir1)
+	defer os.RemoveAll(dir2)
+	name1, data1 := tempFile(t, dir1, "from1.bin", chunkSize*4)
+	name2, data2 := tempFile(t, dir2, "from2.bin", chunkSize*2+1)
+
+	res1, res2 := newResults(), newResults()
+	peer1, peer2 := pipe(Config{Dir: dir1, Prompt: acceptAll, Received: res1.received},
+		Config{Dir: dir2, Prompt: acceptAll, Received: res2.received})
+	defer peer1.Close()
+	defer peer2.Close()
+
+	errs := make(chan error, 2)
+	go func() { errs <- peer1.Send(name1, nil) }()
+	go func() { errs <- peer2.Send(name2, nil) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, _ := res2.wait(t)
+	assertFile(t, path, data1)
+	path, _ = res1.wait(t)
+	assertFile(t, path, data2)
+}
+
+func TestReject(t *testing.T) {
+	src, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	name, _ := tempFile(t, src, "setup.exe", 100)
+
+	sender, receiver := pipe(Config{}, Config{Dir: dst})
+	defer sender.Close()
+	defer receiver.Close()
+	if err := sender.Send(name, nil); err != ErrRejected {
+		t.Errorf("want %v get %v", ErrRejected, err)
+	}
+	files, _ := ioutil.ReadDir(dst)
+	if len(files) != 0 {
+		t.Errorf("want empty dir get %d files", len(files))
+	}
+}
+
+func partName(dir, name string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return filepath.Join(dir, "."+name+"."+hex.EncodeToString(sum[:])[:16]+".part")
+}
+
+func TestResumePartial(t *testing.T) {
+	src, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	name, data := tempFile(t, src, "dump.tar", chunkSize*5)
+	offset := chunkSize*2 + 100
+	ioutil.WriteFile(partName(dst, "dump.tar", data), data[:offset], 0600)
+
+	res := newResults()
+	sender, receiver := pipe(Config{}, Config{Dir: dst, Prompt: acceptAll, Received: res.received})
+	defer sender.Close()
+	defer receiver.Close()
+
+	first := int64(-1)
+	err := sender.Send(name, func(sent, total int64) {
+		if first < 0 {
+			first = sent
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != int64(offset+chunkSize) {
+		t.Errorf("want resume at %d get first chunk until %d", offset, first)
+	}
+	path, _ := res.wait(t)
+	assertFile(t, path, data)
+	if _, err := os.Stat(partName(dst, "dump.tar", data)); !os.IsNotExist(err) {
+		t.Error("want partial file removed")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	src, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	name, data := tempFile(t, src, "report.pdf", chunkSize)
+	//corrupted partial file
+	ioutil.WriteFile(partName(dst, "report.pdf", data), make([]byte, 1000), 0600)
+
+	res := newResults()
+	sender, receiver := pipe(Config{}, Config{Dir: dst, Prompt: acceptAll, Received: res.received})
+	defer sender.Close()
+	defer receiver.Close()
+
+	err := sender.Send(name, nil)
+	if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("want remote error get %v", err)
+	}
+	if _, err := res.wait(t); err != ErrChecksum {
+		t.Errorf("want %v get %v", ErrChecksum, err)
+	}
+
+	//the partial file was discarded
+	if err := sender.Send(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := res.wait(t)
+	assertFile(t, path, data)
+}
+
+//dropConn closed after writing *limit* bytes
+type dropConn struct {
+	net.Conn
+	mutex sync.Mutex
+	limit int
+}
+
+func (c *dropConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.limit -= len(b)
+	drop := c.limit < 0
+	c.mutex.Unlock()
+	if drop {
+		c.Conn.Close()
+	}
+	return c.Conn.Write(b)
+}
+
+func TestResumeReconnect(t *testing.T) {
+	delay := redialDelay
+	redialDelay = time.Millisecond * 10
+	defer func() { redialDelay = delay }()
+
+	src, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	name, data := tempFile(t, src, "core.dump", chunkSize*8)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	res := newResults()
+	server := NewServer(Config{Dir: dst, Prompt: acceptAll, Received: res.received})
+	go server.Serve(l)
+	defer server.Close()
+
+	var dials int32
+	client, err := Dial(func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if atomic.AddInt32(&dials, 1) > 1 || err != nil {
+			return conn, err
+		}
+		return &dropConn{Conn: conn, limit: chunkSize * 3}, nil
+	}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Send(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.wait(t); err != ErrConnectionLost {
+		t.Errorf("want %v get %v", ErrConnectionLost, err)
+	}
+	path, err := res.wait(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, path, data)
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("want 2 dials get %d", n)
+	}
+}
+
+func TestClientCloseDialing(t *testing.T) {
+	delay := redialDelay
+	redialDelay = time.Millisecond * 10
+	defer func() { redialDelay = delay }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := NewServer(Config{})
+	go server.Serve(l)
+
+	//the redial blocks until the end of the test
+	block := make(chan struct{})
+	defer close(block)
+	redialing := make(chan struct{})
+	var dials int32
+	client, err := Dial(func() (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			close(redialing)
+			<-block
+		}
+		return net.Dial("tcp", l.Addr().String())
+	}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	select {
+	case <-redialing:
+	case <-time.After(time.Second * 5):
+		t.Fatal("want redial of the lost connection")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- client.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waits the dial")
+	}
+	if _, err := client.current(); err != ErrClosed {
+		t.Errorf("want %v get %v", ErrClosed, err)
+	}
+}
+
+func TestServerSend(t *testing.T) {
+	src, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	name, data := tempFile(t, src, "notes.txt", 5000)
+
+	server := NewServer(Config{})
+	if err := server.Send(name, nil); err != ErrNotConnected {
+		t.Errorf("want %v get %v", ErrNotConnected, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+	defer server.Close()
+
+	res := newResults()
+	client, err := Dial(func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	}, Config{Dir: dst, Prompt: acceptAll, Received: res.received})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	//wait the server accepts the connection
+	for i := 0; i < 100; i++ {
+		if err = server.Send(name, nil); err != ErrNotConnected {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := res.wait(t)
+	assertFile(t, path, data)
+}
+
+func TestServerReplacedPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := NewServer(Config{})
+	go server.Serve(l)
+	defer server.Close()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	//the peer of the first connection it's closed
+	first.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := first.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want %v get %v", io.EOF, err)
+	}
+}
+
+func TestServerViewOnly(t *testing.T) {
+	src, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	name, _ := tempFile(t, src, "setup.exe", 100)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := NewServer(Config{Dir: dst, Prompt: acceptAll})
+	server.ViewOnly = func(net.Conn) bool { return true }
+	go server.Serve(l)
+	defer server.Close()
+
+	client, err := Dial(func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Send(name, nil); err != ErrRejected {
+		t.Errorf("want %v get %v", ErrRejected, err)
+	}
+	files, _ := ioutil.ReadDir(dst)
+	if len(files) != 0 {
+		t.Errorf("want empty dir get %d files", len(files))
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := map[string]string{
+		"report.pdf":          "report.pdf",
+		"../../etc/passwd":    "passwd",
+		`..\..\windows\a.ini`: "a.ini",
+		".bashrc":             ".bashrc",
+		"..":                  "",
+		"":                    "",
+		"/":                   "",
+	}
+	for name, want := range tests {
+		got, err := sanitize(name)
+		if want == "" && err == nil {
+			t.Errorf("want error on %q get %q", name, got)
+		}
+		if want != "" && got != want {
+			t.Errorf("want %q on %q get %q %v", want, name, got, err)
+		}
+	}
+}
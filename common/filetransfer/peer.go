@@ -0,0 +1,415 @@
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//Config of a peer
+type Config struct {
+	//Dir where the received files are saved
+	Dir string
+	//Prompt the user to accept an offer, offers are rejected when nil
+	Prompt func(offer Offer) bool
+	//Received called when a file was saved on *path* or the transfer failed
+	Received func(offer Offer, path string, err error)
+}
+
+//Peer of a connection, it sends and receives files
+type Peer struct {
+	conn io.ReadWriteCloser
+	conf Config
+
+	wmutex sync.Mutex
+
+	mutex    sync.Mutex
+	nextID   uint32
+	outgoing map[uint32]chan frame
+	incoming map[uint32]*incoming
+
+	done chan struct{}
+	err  error
+}
+
+//NewPeer over *conn*, the frames are read until it's closed
+func NewPeer(conn io.ReadWriteCloser, conf Config) *Peer {
+	p := &Peer{
+		conn:     conn,
+		conf:     conf,
+		outgoing: make(map[uint32]chan frame),
+		incoming: make(map[uint32]*incoming),
+		done:     make(chan struct{}),
+	}
+	go p.read()
+	return p
+}
+
+//Done closed when the connection it's lost
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+//Err of the connection after Done
+func (p *Peer) Err() error {
+	<-p.done
+	return p.err
+}
+
+func (p *Peer) lost() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//Close the connection, the partial files are kept
+func (p *Peer) Close() error {
+	err := p.conn.Close()
+	<-p.done
+	return err
+}
+
+func (p *Peer) write(typ byte, id uint32, payload []byte) error {
+	p.wmutex.Lock()
+	defer p.wmutex.Unlock()
+	return writeFrame(p.conn, typ, id, payload)
+}
+
+func (p *Peer) writeJSON(typ byte, id uint32, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.write(typ, id, payload)
+}
+
+func (p *Peer) read() {
+	var err error
+	for {
+		var f frame
+		f, err = readFrame(p.conn)
+		if err != nil {
+			break
+		}
+		p.dispatch(f)
+	}
+
+	p.mutex.Lock()
+	p.err = err
+	pending := p.incoming
+	p.incoming = make(map[uint32]*incoming)
+	p.mutex.Unlock()
+	close(p.done)
+
+	for _, inc := range pending {
+		inc.file.Close()
+		p.received(inc.offer, "", ErrConnectionLost)
+	}
+}
+
+func (p *Peer) dispatch(f frame) {
+	p.mutex.Lock()
+	replies := p.outgoing[f.id]
+	inc := p.incoming[f.id]
+	p.mutex.Unlock()
+
+	switch f.typ {
+	case frameOffer:
+		var offer Offer
+		f.decode(&offer)
+		//the user may take a while answering
+		go p.offered(f.id, offer)
+	case frameData, frameDone, frameCancel:
+		if inc == nil {
+			return
+		}
+		if err := p.receive(inc, f); err != nil {
+			p.finish(f.id, inc, "", err)
+		}
+	case frameAccept, frameReject, frameVerified, frameError:
+		if replies == nil {
+			return
+		}
+		select {
+		case replies <- f:
+		default:
+		}
+	}
+}
+
+func (p *Peer) received(offer Offer, path string, err error) {
+	if p.conf.Received != nil {
+		p.conf.Received(offer, path, err)
+	}
+}
+
+//incoming file being received
+type incoming struct {
+	offer   Offer
+	name    string
+	part    string
+	file    *os.File
+	hash    hash.Hash
+	written int64
+}
+
+//offered *offer* accepted when the user wants it, the
+//partial file of a previous transfer it's continued
+func (p *Peer) offered(id uint32, offer Offer) {
+	name, err := sanitize(offer.Name)
+	if err != nil || offer.Size < 0 || !validSHA256(offer.SHA256) {
+		p.writeJSON(frameReject, id, failure{Reason: "invalid offer"})
+		return
+	}
+	if p.conf.Prompt == nil || !p.conf.Prompt(offer) {
+		p.writeJSON(frameReject, id, failure{Reason: "rejected by the user"})
+		return
+	}
+
+	inc, err := openIncoming(p.conf.Dir, name, offer)
+	if err != nil {
+		p.writeJSON(frameReject, id, failure{Reason: err.Error()})
+		p.received(offer, "", err)
+		return
+	}
+	p.mutex.Lock()
+	p.incoming[id] = inc
+	p.mutex.Unlock()
+	if err := p.writeJSON(frameAccept, id, accept{Offset: inc.written}); err != nil {
+		p.finish(id, inc, "", err)
+	}
+}
+
+//openIncoming the partial file of *offer* on *dir*
+func openIncoming(dir, name string, offer Offer) (*incoming, error) {
+	part := filepath.Join(dir, "."+name+"."+offer.SHA256[:16]+".part")
+	file, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	inc := &incoming{offer: offer, name: name, part: part, file: file, hash: sha256.New()}
+
+	offset, err := io.Copy(inc.hash, file)
+	if err == nil && offset > offer.Size {
+		inc.hash.Reset()
+		offset = 0
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	inc.written = offset
+	return inc, nil
+}
+
+//receive a frame of the sender of *inc*
+func (p *Peer) receive(inc *incoming, f frame) error {
+	switch f.typ {
+	case frameCancel:
+		return f.remoteError()
+	case frameData:
+		if inc.written+int64(len(f.payload)) > inc.offer.Size {
+			return errors.New("more data than offered")
+		}
+		if _, err := inc.file.Write(f.payload); err != nil {
+			return err
+		}
+		inc.hash.Write(f.payload)
+		inc.written += int64(len(f.payload))
+		return nil
+	}
+
+	//frameDone
+	if inc.written != inc.offer.Size {
+		return fmt.Errorf("received %d of %d bytes", inc.written, inc.offer.Size)
+	}
+	if hex.EncodeToString(inc.hash.Sum(nil)) != inc.offer.SHA256 {
+		inc.file.Close()
+		os.Remove(inc.part)
+		return ErrChecksum
+	}
+	if err := inc.file.Close(); err != nil {
+		return err
+	}
+	dest, err := rename(inc.part, filepath.Dir(inc.part), inc.name)
+	if err != nil {
+		return err
+	}
+	p.finish(f.id, inc, dest, nil)
+	return nil
+}
+
+//finish the incoming transfer *id* telling the result to the sender
+func (p *Peer) finish(id uint32, inc *incoming, dest string, err error) {
+	p.mutex.Lock()
+	delete(p.incoming, id)
+	p.mutex.Unlock()
+	inc.file.Close()
+
+	//not blocking the reading of frames while the peer writes
+	if err == nil {
+		go p.write(frameVerified, id, nil)
+	} else if _, ok := err.(*RemoteError); !ok {
+		go p.writeJSON(frameError, id, failure{Reason: err.Error()})
+	}
+	p.received(inc.offer, dest, err)
+}
+
+//Send the file *name*, *progress* it's called after every chunk
+//when not nil. A transfer offered again resumes the partial file
+//kept by the receiver.
+func (p *Peer) Send(name string, progress func(sent, total int64)) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return err
+	}
+	offer := Offer{Name: filepath.Base(name), Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}
+
+	p.mutex.Lock()
+	p.nextID++
+	id := p.nextID
+	replies := make(chan frame, 2)
+	p.outgoing[id] = replies
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		delete(p.outgoing, id)
+		p.mutex.Unlock()
+	}()
+
+	if err := p.writeJSON(frameOffer, id, offer); err != nil {
+		return p.broken()
+	}
+	reply, err := p.wait(replies)
+	if err != nil {
+		return err
+	}
+	var acc accept
+	if err := reply.decode(&acc); err != nil || acc.Offset < 0 || acc.Offset > size {
+		p.writeJSON(frameCancel, id, failure{Reason: "invalid offset"})
+		return errors.New("filetransfer: invalid offset")
+	}
+	if _, err := file.Seek(acc.Offset, io.SeekStart); err != nil {
+		p.writeJSON(frameCancel, id, failure{Reason: err.Error()})
+		return err
+	}
+
+	sent := acc.Offset
+	buf := make([]byte, chunkSize)
+	for sent < size {
+		select {
+		case reply := <-replies:
+			return reply.remoteError()
+		default:
+		}
+
+		n, err := file.Read(buf)
+		if err != nil {
+			p.writeJSON(frameCancel, id, failure{Reason: err.Error()})
+			return err
+		}
+		if err := p.write(frameData, id, buf[:n]); err != nil {
+			return p.broken()
+		}
+		sent += int64(n)
+		if progress != nil {
+			progress(sent, size)
+		}
+	}
+
+	if err := p.write(frameDone, id, nil); err != nil {
+		return p.broken()
+	}
+	_, err = p.wait(replies)
+	return err
+}
+
+//wait the answer of the receiver, nil error on accept and verified
+func (p *Peer) wait(replies chan frame) (frame, error) {
+	select {
+	case reply := <-replies:
+		switch reply.typ {
+		case frameReject:
+			return reply, ErrRejected
+		case frameError:
+			return reply, reply.remoteError()
+		}
+		return reply, nil
+	case <-p.done:
+		return frame{}, ErrConnectionLost
+	}
+}
+
+//broken connection closed so the transfer can be resumed on other
+func (p *Peer) broken() error {
+	p.conn.Close()
+	<-p.done
+	return ErrConnectionLost
+}
+
+//sanitize *name* of the peer without directories
+func sanitize(name string) (string, error) {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == ".." || name == "/" {
+		return "", errors.New("invalid name")
+	}
+	return name, nil
+}
+
+func validSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+//rename *part* to *name* on *dir*, existing files are not overwritten
+func rename(part, dir, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	dest := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+	return dest, os.Rename(part, dest)
+}
+
+//DefaultDir for the received files, the Downloads folder of the user
+func DefaultDir() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = os.Getenv("USERPROFILE")
+	}
+	if home == "" {
+		return os.TempDir()
+	}
+	downloads := filepath.Join(home, "Downloads")
+	if info, err := os.Stat(downloads); err == nil && info.IsDir() {
+		return downloads
+	}
+	return home
+}
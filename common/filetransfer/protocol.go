@@ -0,0 +1,130 @@
+// Package filetransfer sends files between the client and the
+// supporter over the "files" service.
+//
+// Both peers of a connection send and receive, every transfer starts
+// with an offer the user accepts or rejects, the file it's sent in
+// chunks and verified with SHA-256. Partial files are kept so the
+// transfer resumes when it's offered again after a reconnect.
+package filetransfer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Service name on the session
+const Service = "files"
+
+//ServiceCompressed name of the service compressed, the peers
+//agree the compression with the capabilities of the control package
+const ServiceCompressed = "files-compressed"
+
+const (
+	//sent by the peer sending the file
+	frameOffer byte = iota + 1
+	frameData
+	frameDone
+	frameCancel
+	//sent by the peer receiving the file
+	frameAccept
+	frameReject
+	frameVerified
+	frameError
+)
+
+const (
+	headerSize = 9
+	chunkSize  = 32 * 1024
+	//maxFrame bigger frames are a broken peer
+	maxFrame = 1024 * 1024
+)
+
+var (
+	//ErrRejected the peer didn't accept the file
+	ErrRejected = errors.New("filetransfer: rejected")
+	//ErrChecksum the file received it's not the offered
+	ErrChecksum = errors.New("filetransfer: checksum mismatch")
+	//ErrConnectionLost before the transfer finished
+	ErrConnectionLost = errors.New("filetransfer: connection lost")
+	//ErrNotConnected there is no peer to send
+	ErrNotConnected = errors.New("filetransfer: not connected")
+	//ErrClosed the client was closed
+	ErrClosed = errors.New("filetransfer: closed")
+
+	errFrameSize = errors.New("filetransfer: frame too big")
+)
+
+//Offer of a file to the peer
+type Offer struct {
+	//Name of the file without directories
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	//SHA256 of the file in hex
+	SHA256 string `json:"sha256"`
+}
+
+type accept struct {
+	//Offset bytes the receiver already has
+	Offset int64 `json:"offset"`
+}
+
+type failure struct {
+	Reason string `json:"reason"`
+}
+
+//RemoteError the peer failed the transfer
+type RemoteError struct {
+	Reason string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("filetransfer: peer: %s", e.Reason)
+}
+
+//frame type(1) id(4) length(4) payload
+type frame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+}
+
+func writeFrame(w io.Writer, typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint32(buf[5:], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+	size := binary.BigEndian.Uint32(header[5:])
+	if size > maxFrame {
+		return frame{}, errFrameSize
+	}
+	f := frame{typ: header[0], id: binary.BigEndian.Uint32(header[1:]),
+		payload: make([]byte, size)}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	return f, nil
+}
+
+func (f frame) decode(v interface{}) error {
+	return json.Unmarshal(f.payload, v)
+}
+
+//remoteError of a frameError or frameCancel
+func (f frame) remoteError() error {
+	var fail failure
+	f.decode(&fail)
+	return &RemoteError{Reason: fail.Reason}
+}
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 
 	"github.com/mattn/go-gtk/gdkpixbuf"
+	"github.com/mattn/go-gtk/glib"
 	"github.com/mattn/go-gtk/gtk"
 )
 
@@ -58,3 +59,59 @@ func GetIconGdkPixbuf() *gdkpixbuf.Pixbuf {
 	}
 	return pixbuf
 }
+
+//GtkMain runs *f* on the main loop of GTK and waits it,
+//the widgets can't be used from other goroutines
+func GtkMain(f func()) {
+	done := make(chan struct{})
+	glib.IdleAdd(func() bool {
+		defer close(done)
+		f()
+		return false
+	})
+	<-done
+}
+
+//GtkIdle runs *f* on the main loop of GTK without waiting it,
+//for the callbacks called from the main loop too
+func GtkIdle(f func()) {
+	glib.IdleAdd(func() bool {
+		f()
+		return false
+	})
+}
+
+//GtkConfirm ask *question* to the user, true when answered yes
+func GtkConfirm(parent *gtk.Window, question string) bool {
+	dialog := gtk.NewMessageDialog(parent, gtk.DIALOG_MODAL,
+		gtk.MESSAGE_QUESTION, gtk.BUTTONS_YES_NO, question)
+	defer dialog.Destroy()
+	return dialog.Run() == gtk.RESPONSE_YES
+}
+
+//GtkChoose ask *question* to the user with a button per choice,
+//the index of the choice answered or -1 when closed
+func GtkChoose(parent *gtk.Window, question string, choices ...string) int {
+	dialog := gtk.NewMessageDialog(parent, gtk.DIALOG_MODAL,
+		gtk.MESSAGE_QUESTION, gtk.BUTTONS_NONE, question)
+	defer dialog.Destroy()
+	for i, choice := range choices {
+		dialog.AddButton(choice, gtk.ResponseType(i))
+	}
+	response := int(dialog.Run())
+	if response < 0 || response >= len(choices) {
+		return -1
+	}
+	return response
+}
+
+//GtkChooseFile ask the user a file to open, empty when cancelled
+func GtkChooseFile(parent *gtk.Window, title string) string {
+	dialog := gtk.NewFileChooserDialog(title, parent, gtk.FILE_CHOOSER_ACTION_OPEN,
+		"_Cancel", gtk.RESPONSE_CANCEL, "_Open", gtk.RESPONSE_ACCEPT)
+	defer dialog.Destroy()
+	if dialog.Run() != gtk.RESPONSE_ACCEPT {
+		return ""
+	}
+	return dialog.GetFilename()
+}
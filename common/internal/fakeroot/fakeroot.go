@@ -0,0 +1,29 @@
+//Package fakeroot creates file trees for the tests reading
+//the system from a root directory
+package fakeroot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Create a temporary root with *files*, the names are relative
+//to the root. The caller removes it
+func Create(t testing.TB, files map[string]string) string {
+	root, err := ioutil.TempDir("", "fakeroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
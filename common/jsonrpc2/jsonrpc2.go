@@ -0,0 +1,291 @@
+// Package jsonrpc2 implements JSON-RPC 2.0 codecs for net/rpc.
+//
+// Messages are JSON objects one after other on the stream,
+// batches are not supported. Errors keep the JSON-RPC code
+// when they are created with NewError.
+package jsonrpc2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+	"sync"
+)
+
+const version = "2.0"
+
+//Error codes defined by JSON-RPC 2.0
+const (
+	CodeParse          = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternal       = -32603
+	//CodeServer default for errors without code
+	CodeServer = -32000
+)
+
+//Error object of a response
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+//NewError with *code*, returned by a method the client receives the code
+func NewError(code int, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+//Error the code survive net/rpc that only keeps the text
+func (e *Error) Error() string {
+	return fmt.Sprintf("[%d] %s", e.Code, e.Message)
+}
+
+//ParseError get the code of an error returned by rpc.Client.Call,
+//errors without code are CodeServer
+func ParseError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	msg := err.Error()
+	var code int
+	if n, _ := fmt.Sscanf(msg, "[%d] ", &code); n == 1 {
+		return &Error{Code: code, Message: msg[strings.Index(msg, "] ")+2:]}
+	}
+	if strings.HasPrefix(msg, "rpc: can't find") {
+		return &Error{Code: CodeMethodNotFound, Message: msg}
+	}
+	return &Error{Code: CodeServer, Message: msg}
+}
+
+type request struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  *json.RawMessage `json:"params,omitempty"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+}
+
+type response struct {
+	Version string           `json:"jsonrpc"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+	ID      *json.RawMessage `json:"id"`
+}
+
+type clientResponse struct {
+	Version string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result"`
+	Error   *Error           `json:"error"`
+	ID      *uint64          `json:"id"`
+}
+
+var null = json.RawMessage("null")
+
+type serverCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	req request
+	cur *pendingRequest
+
+	mutex   sync.Mutex
+	seq     uint64
+	pending map[uint64]*pendingRequest
+}
+
+type pendingRequest struct {
+	id *json.RawMessage
+	//invalid reason the request can't be served
+	invalid *Error
+}
+
+//NewServerCodec JSON-RPC 2.0 for rpc.Server.ServeCodec
+func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &serverCodec{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		pending: make(map[uint64]*pendingRequest),
+	}
+}
+
+//ServeConn JSON-RPC 2.0 on *conn* with the methods of *srv*
+func ServeConn(srv *rpc.Server, conn io.ReadWriteCloser) {
+	srv.ServeCodec(NewServerCodec(conn))
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.req = request{}
+	if err := c.dec.Decode(&c.req); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return err
+		}
+		//the stream can't be resynchronized
+		c.enc.Encode(response{Version: version, ID: &null,
+			Error: NewError(CodeParse, err.Error())})
+		return err
+	}
+
+	c.cur = &pendingRequest{id: c.req.ID}
+	switch {
+	case c.req.Version != version:
+		c.cur.invalid = NewError(CodeInvalidRequest, "jsonrpc must be "+version)
+	case !strings.Contains(c.req.Method, "."):
+		c.cur.invalid = NewError(CodeMethodNotFound, "method not found: "+c.req.Method)
+	}
+
+	//net/rpc discard the body and answer with an error
+	r.ServiceMethod = c.req.Method
+	if c.cur.invalid != nil {
+		r.ServiceMethod = "."
+	}
+
+	c.mutex.Lock()
+	c.seq++
+	c.pending[c.seq] = c.cur
+	r.Seq = c.seq
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(x interface{}) error {
+	if x == nil || c.cur.invalid != nil || c.req.Params == nil {
+		return nil
+	}
+	//positional params with a single element are accepted
+	params := []byte(*c.req.Params)
+	if len(params) > 0 && params[0] == '[' {
+		var list []json.RawMessage
+		if err := json.Unmarshal(params, &list); err != nil || len(list) != 1 {
+			return c.invalidParams(errors.New("want a single positional param"))
+		}
+		params = list[0]
+	}
+	if err := json.Unmarshal(params, x); err != nil {
+		return c.invalidParams(err)
+	}
+	return nil
+}
+
+func (c *serverCodec) invalidParams(err error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cur.invalid = NewError(CodeInvalidParams, err.Error())
+	return c.cur.invalid
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.mutex.Lock()
+	req, ok := c.pending[r.Seq]
+	if !ok {
+		c.mutex.Unlock()
+		return errors.New("jsonrpc2: invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.mutex.Unlock()
+
+	//notification
+	if req.id == nil {
+		return nil
+	}
+
+	resp := response{Version: version, ID: req.id}
+	if r.Error == "" {
+		resp.Result = x
+		if x == nil {
+			resp.Result = &null
+		}
+	} else {
+		c.mutex.Lock()
+		resp.Error = req.invalid
+		c.mutex.Unlock()
+		if resp.Error == nil {
+			resp.Error = ParseError(errors.New(r.Error))
+		}
+	}
+	return c.enc.Encode(resp)
+}
+
+func (c *serverCodec) Close() error {
+	return c.c.Close()
+}
+
+type clientCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	resp clientResponse
+}
+
+//NewClientCodec JSON-RPC 2.0 for rpc.NewClientWithCodec
+func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &clientCodec{
+		dec: json.NewDecoder(conn),
+		enc: json.NewEncoder(conn),
+		c:   conn,
+	}
+}
+
+//NewClient JSON-RPC 2.0 over *conn*
+func NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodec(conn))
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, param interface{}) error {
+	params, err := json.Marshal(param)
+	if err != nil {
+		return err
+	}
+	id, _ := json.Marshal(r.Seq)
+	raw := json.RawMessage(params)
+	rawID := json.RawMessage(id)
+	return c.enc.Encode(request{
+		Version: version,
+		Method:  r.ServiceMethod,
+		Params:  &raw,
+		ID:      &rawID,
+	})
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	c.resp = clientResponse{}
+	if err := c.dec.Decode(&c.resp); err != nil {
+		return err
+	}
+	if c.resp.ID == nil {
+		//error without id, the server can't parse our requests
+		if c.resp.Error != nil {
+			return c.resp.Error
+		}
+		return errors.New("jsonrpc2: response without id")
+	}
+
+	r.Seq = *c.resp.ID
+	r.Error = ""
+	if c.resp.Error != nil {
+		r.Error = c.resp.Error.Error()
+	} else if c.resp.Result == nil {
+		r.Error = "jsonrpc2: response without result"
+	}
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(x interface{}) error {
+	if x == nil || c.resp.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(*c.resp.Result, x)
+}
+
+func (c *clientCodec) Close() error {
+	return c.c.Close()
+}
@@ -0,0 +1,134 @@
+package jsonrpc2
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Arith int
+
+func (t *Arith) Multiply(args *Args, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func (t *Arith) Divide(args *Args, reply *int) error {
+	if args.B == 0 {
+		return NewError(-32010, "divide by zero")
+	}
+	*reply = args.A / args.B
+	return nil
+}
+
+func (t *Arith) Fail(args *Args, reply *int) error {
+	return errors.New("failed")
+}
+
+func serve(t *testing.T) net.Conn {
+	srv := rpc.NewServer()
+	srv.Register(new(Arith))
+	cli, conn := net.Pipe()
+	go ServeConn(srv, conn)
+	return cli
+}
+
+func TestClient(t *testing.T) {
+	client := NewClient(serve(t))
+	defer client.Close()
+
+	var reply int
+	if err := client.Call("Arith.Multiply", &Args{7, 5}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != 35 {
+		t.Errorf("want %d get %d", 35, reply)
+	}
+
+	err := client.Call("Arith.Divide", &Args{1, 0}, &reply)
+	if e := ParseError(err); e == nil || e.Code != -32010 || e.Message != "divide by zero" {
+		t.Errorf("want code %d get %v", -32010, err)
+	}
+	err = client.Call("Arith.Fail", &Args{}, &reply)
+	if e := ParseError(err); e == nil || e.Code != CodeServer || e.Message != "failed" {
+		t.Errorf("want code %d get %v", CodeServer, err)
+	}
+	err = client.Call("Arith.Unknown", &Args{}, &reply)
+	if e := ParseError(err); e == nil || e.Code != CodeMethodNotFound {
+		t.Errorf("want code %d get %v", CodeMethodNotFound, err)
+	}
+}
+
+func TestServerRaw(t *testing.T) {
+	conn := serve(t)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		request string
+		id      string
+		result  string
+		code    int
+	}{
+		{`{"jsonrpc":"2.0","method":"Arith.Multiply","params":{"A":2,"B":3},"id":"a"}`, `"a"`, `6`, 0},
+		{`{"jsonrpc":"2.0","method":"Arith.Multiply","params":[{"A":2,"B":4}],"id":1}`, `1`, `8`, 0},
+		{`{"jsonrpc":"1.0","method":"Arith.Multiply","params":{},"id":2}`, `2`, ``, CodeInvalidRequest},
+		{`{"jsonrpc":"2.0","method":"multiply","params":{},"id":3}`, `3`, ``, CodeMethodNotFound},
+		{`{"jsonrpc":"2.0","method":"Arith.Multiply","params":{"A":"x"},"id":4}`, `4`, ``, CodeInvalidParams},
+		{`{"jsonrpc":"2.0","method":"Arith.Multiply","params":[1,2],"id":5}`, `5`, ``, CodeInvalidParams},
+	}
+
+	for _, test := range tests {
+		if _, err := conn.Write([]byte(test.request + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res struct {
+			Version string          `json:"jsonrpc"`
+			Result  json.RawMessage `json:"result"`
+			Error   *Error          `json:"error"`
+			ID      json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(line), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Version != version || string(res.ID) != test.id {
+			t.Errorf("%s: want id %s get %s", test.request, test.id, line)
+		}
+		if test.code == 0 && (res.Error != nil || string(res.Result) != test.result) {
+			t.Errorf("%s: want result %s get %s", test.request, test.result, line)
+		}
+		if test.code != 0 && (res.Error == nil || res.Error.Code != test.code) {
+			t.Errorf("%s: want code %d get %s", test.request, test.code, line)
+		}
+	}
+
+	//notifications are not answered
+	conn.Write([]byte(`{"jsonrpc":"2.0","method":"Arith.Multiply","params":{"A":1,"B":1}}` + "\n"))
+	conn.Write([]byte(`{"jsonrpc":"2.0","method":"Arith.Multiply","params":{"A":3,"B":3},"id":9}` + "\n"))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, `"id":9`) {
+		t.Errorf("want response of id 9 get %s", line)
+	}
+
+	//parse error closes the connection
+	conn.Write([]byte("{invalid\n"))
+	line, _ = reader.ReadString('\n')
+	if !strings.Contains(line, `"code":-32700`) {
+		t.Errorf("want parse error get %s", line)
+	}
+}
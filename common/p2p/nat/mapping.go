@@ -0,0 +1,97 @@
+package nat
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//mapRetries random external ports tried when the internal it's taken
+	mapRetries = 8
+	//mapPortMin lowest random external port
+	mapPortMin = 10000
+)
+
+//ErrNoFreePort the gateway rejected every external port tried
+var ErrNoFreePort = errors.New("nat: no free external port")
+
+//Mapping port mapped on the gateway, it's renewed
+//before expire until Close
+type Mapping struct {
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+
+	nat     Interface
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+//NewMapping map *intport* to a free external port of the gateway,
+//the same port it's tried first
+func NewMapping(m Interface, protocol string, intport int, name string) (*Mapping, error) {
+	extport, err := addFreeMapping(m, protocol, intport, name)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := &Mapping{
+		Protocol:     protocol,
+		InternalPort: intport,
+		ExternalPort: extport,
+		nat:          m,
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	go mapping.renew(name)
+	return mapping, nil
+}
+
+//renew the mapping added by NewMapping every mapUpdateInterval,
+//it's removed on Close
+func (m *Mapping) renew(name string) {
+	defer close(m.stopped)
+	refresh := time.NewTimer(mapUpdateInterval)
+	defer func() {
+		refresh.Stop()
+		m.nat.DeleteMapping(m.Protocol, m.ExternalPort, m.InternalPort)
+	}()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-refresh.C:
+			m.nat.AddMapping(m.Protocol, m.ExternalPort, m.InternalPort, name, mapTimeout)
+			refresh.Reset(mapUpdateInterval)
+		}
+	}
+}
+
+func addFreeMapping(m Interface, protocol string, intport int, name string) (int, error) {
+	extport := intport
+	for i := 0; i <= mapRetries; i++ {
+		if err := m.AddMapping(protocol, extport, intport, name, mapTimeout); err == nil {
+			return extport, nil
+		}
+		extport = mapPortMin + rand.Intn(65536-mapPortMin)
+	}
+	return 0, ErrNoFreePort
+}
+
+//ExternalIP of the gateway
+func (m *Mapping) ExternalIP() (net.IP, error) {
+	return m.nat.ExternalIP()
+}
+
+//Close stop renewing and remove the mapping from the gateway
+func (m *Mapping) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+	})
+	<-m.stopped
+	return nil
+}
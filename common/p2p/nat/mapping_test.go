@@ -0,0 +1,136 @@
+package nat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeNAT gateway with some external ports already taken
+type fakeNAT struct {
+	mutex    sync.Mutex
+	taken    map[int]bool
+	mappings map[int]int
+	adds     int
+}
+
+func newFakeNAT(taken ...int) *fakeNAT {
+	n := &fakeNAT{taken: make(map[int]bool), mappings: make(map[int]int)}
+	for _, port := range taken {
+		n.taken[port] = true
+	}
+	return n
+}
+
+func (n *fakeNAT) AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.taken[extport] {
+		return errors.New("conflict")
+	}
+	n.adds++
+	n.mappings[extport] = intport
+	return nil
+}
+
+func (n *fakeNAT) DeleteMapping(protocol string, extport, intport int) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.mappings, extport)
+	return nil
+}
+
+func (n *fakeNAT) ExternalIP() (net.IP, error) {
+	return net.IPv4(33, 44, 55, 66), nil
+}
+
+func (n *fakeNAT) String() string {
+	return fmt.Sprintf("fake(%v)", n.taken)
+}
+
+func (n *fakeNAT) state() (int, map[int]int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	mappings := make(map[int]int)
+	for ext, in := range n.mappings {
+		mappings[ext] = in
+	}
+	return n.adds, mappings
+}
+
+func TestMappingSamePort(t *testing.T) {
+	n := newFakeNAT()
+	m, err := NewMapping(n, "TCP", 9932, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ExternalPort != 9932 {
+		t.Errorf("want external port %d get %d", 9932, m.ExternalPort)
+	}
+	//renewed after mapUpdateInterval
+	time.Sleep(50 * time.Millisecond)
+	if adds, _ := n.state(); adds != 1 {
+		t.Errorf("want mapping added once get %d adds", adds)
+	}
+	if ip, _ := m.ExternalIP(); !ip.Equal(net.IPv4(33, 44, 55, 66)) {
+		t.Errorf("want external ip of the gateway get %v", ip)
+	}
+
+	m.Close()
+	if _, mappings := n.state(); len(mappings) != 0 {
+		t.Errorf("want mapping removed get %v", mappings)
+	}
+}
+
+func TestMappingFreePort(t *testing.T) {
+	n := newFakeNAT(9932)
+	m, err := NewMapping(n, "TCP", 9932, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if m.ExternalPort == 9932 || m.ExternalPort < mapPortMin || m.ExternalPort > 65535 {
+		t.Errorf("want free external port get %d", m.ExternalPort)
+	}
+	if _, mappings := n.state(); mappings[m.ExternalPort] != 9932 {
+		t.Errorf("want %d mapped to %d get %v", m.ExternalPort, 9932, mappings)
+	}
+}
+
+func TestMappingNoFreePort(t *testing.T) {
+	n := newFakeNAT()
+	for port := 0; port < 65536; port++ {
+		n.taken[port] = true
+	}
+	if _, err := NewMapping(n, "TCP", 9932, "test"); err != ErrNoFreePort {
+		t.Errorf("want %v get %v", ErrNoFreePort, err)
+	}
+}
+
+func TestMappingRenew(t *testing.T) {
+	interval := mapUpdateInterval
+	mapUpdateInterval = 20 * time.Millisecond
+	defer func() { mapUpdateInterval = interval }()
+
+	n := newFakeNAT()
+	m, err := NewMapping(n, "UDP", 5000, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	m.Close()
+
+	adds, mappings := n.state()
+	if adds < 3 {
+		t.Errorf("want mapping renewed get %d adds", adds)
+	}
+	if len(mappings) != 0 {
+		t.Errorf("want mapping removed get %v", mappings)
+	}
+	//closing twice it's safe
+	m.Close()
+}
@@ -88,10 +88,10 @@ func Parse(spec string) (Interface, error) {
 	}
 }
 
-const (
-	mapTimeout        = 20 * time.Minute
-	mapUpdateInterval = 15 * time.Minute
-)
+const mapTimeout = 20 * time.Minute
+
+// mapUpdateInterval must be lower than mapTimeout, tests change it.
+var mapUpdateInterval = 15 * time.Minute
 
 // Map adds a port mapping on m and keeps it alive until c is closed.
 // This function is typically invoked in its own goroutine.
@@ -101,7 +101,7 @@ func Map(m Interface, c chan struct{}, protocol string, extport, intport int, na
 		refresh.Stop()
 		m.DeleteMapping(protocol, extport, intport)
 	}()
-	if err := m.AddMapping(protocol, intport, extport, name, mapTimeout); err != nil {
+	if err := m.AddMapping(protocol, extport, intport, name, mapTimeout); err != nil {
 	} else {
 	}
 	for {
@@ -111,7 +111,7 @@ func Map(m Interface, c chan struct{}, protocol string, extport, intport int, na
 				return
 			}
 		case <-refresh.C:
-			if err := m.AddMapping(protocol, intport, extport, name, mapTimeout); err != nil {
+			if err := m.AddMapping(protocol, extport, intport, name, mapTimeout); err != nil {
 			}
 			refresh.Reset(mapUpdateInterval)
 		}
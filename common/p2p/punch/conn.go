@@ -0,0 +1,530 @@
+package punch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	//ErrPeerTimeout nothing received from the peer
+	ErrPeerTimeout = errors.New("punch: peer not responding")
+	errClosed      = errors.New("punch: use of closed connection")
+)
+
+const (
+	//mss max payload of a data packet, small enough to avoid fragmentation
+	mss = 1200
+	//window max packets waiting acknowledge
+	window = 256
+	//sackSize bitmap of segments received after the ack
+	sackSize = window / 8
+	//ackLen of the payload of an ack: ack, free window and sack
+	ackLen = 4 + 2 + sackSize
+	//rcvBuffer bytes received waiting the reader
+	rcvBuffer = window * mss
+	//initialCwnd packets sent before the first ack
+	initialCwnd = 10
+
+	flagFin byte = 1
+
+	tickInterval  = time.Millisecond * 20
+	keepAlive     = time.Second * 5
+	peerTimeout   = time.Second * 30
+	closeTimeout  = time.Second * 3
+	minRTO        = time.Millisecond * 100
+	maxRTO        = time.Second
+	initialRTO    = time.Millisecond * 300
+	dataHeaderLen = 5
+)
+
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "punch: i/o timeout" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+
+type segment struct {
+	seq     uint32
+	fin     bool
+	data    []byte
+	sent    time.Time
+	retries uint
+	//sacked received out of order by the peer
+	sacked bool
+	//fast already retransmitted before timeout
+	fast bool
+}
+
+//Conn reliable ordered stream over a punched udp path,
+//data it's retransmitted until the peer acknowledge it.
+//The packets in flight are limited by the free window
+//of the peer and by the congestion window
+type Conn struct {
+	pc    net.PacketConn
+	peer  net.Addr
+	token []byte
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	sndNext  uint32
+	inflight []*segment
+	finSent  bool
+	lastSend time.Time
+	rto      time.Duration
+	srtt     time.Duration
+	//rwnd free window of the peer in packets
+	rwnd int
+	//cwnd congestion window in packets, it grows by one every
+	//ack on slow start and every cwnd acks above ssthresh
+	cwnd     int
+	ssthresh int
+	acked    int
+	//recover sequence sent when the window was reduced, the losses
+	//before it reduce it once
+	recover uint32
+
+	rcvNext  uint32
+	pending  map[uint32]*segment
+	rbuf     bytes.Buffer
+	eof      bool
+	lastRecv time.Time
+	//advertised free window on the last ack
+	advertised int
+
+	err       error
+	closed    bool
+	rdeadline time.Time
+	wdeadline time.Time
+	done      chan struct{}
+}
+
+func newConn(pc net.PacketConn, peer net.Addr, token []byte) *Conn {
+	now := time.Now()
+	c := &Conn{
+		pc:       pc,
+		peer:     peer,
+		token:    token,
+		rto:      initialRTO,
+		rwnd:     window,
+		cwnd:     initialCwnd,
+		ssthresh: window,
+		pending:  make(map[uint32]*segment),
+		lastRecv: now,
+		lastSend: now,
+		done:     make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	go c.readLoop()
+	go c.timerLoop()
+	return c
+}
+
+//before compare sequence numbers with wrap around
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (c *Conn) readLoop() {
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if addr.String() != c.peer.String() {
+			continue
+		}
+		typ, payload := parse(buf[:n])
+
+		c.mutex.Lock()
+		c.lastRecv = time.Now()
+		switch typ {
+		case typeSyn, typeSynAck:
+			//our last syn-ack was lost
+			if bytes.Equal(payload, c.token) {
+				c.send(packet(typeSynAck, c.token))
+			}
+		case typeData:
+			if len(payload) >= dataHeaderLen {
+				c.receive(&segment{
+					seq:  binary.BigEndian.Uint32(payload[:4]),
+					fin:  payload[4]&flagFin != 0,
+					data: append([]byte(nil), payload[dataHeaderLen:]...),
+				})
+			}
+		case typeAck:
+			if len(payload) == ackLen {
+				c.acknowledged(binary.BigEndian.Uint32(payload[:4]),
+					int(binary.BigEndian.Uint16(payload[4:6])), payload[6:])
+			}
+		}
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+	}
+}
+
+//freeWindow packets the reader has room for
+func (c *Conn) freeWindow() int {
+	free := (rcvBuffer - c.rbuf.Len()) / mss
+	if free < 0 {
+		return 0
+	}
+	if free > window {
+		return window
+	}
+	return free
+}
+
+//receive deliver in order, out of order segments wait the missing
+//ones, the segments beyond the free window are dropped unacknowledged
+func (c *Conn) receive(seg *segment) {
+	if !before(seg.seq, c.rcvNext) && before(seg.seq, c.rcvNext+uint32(c.freeWindow())) {
+		c.pending[seg.seq] = seg
+	}
+	for {
+		next, ok := c.pending[c.rcvNext]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.rcvNext)
+		c.rcvNext++
+		c.rbuf.Write(next.data)
+		if next.fin {
+			c.eof = true
+		}
+	}
+	c.sendAck()
+}
+
+//acknowledged everything before *ack* and the segments on *sack*,
+//the peer has room for *rwnd* packets after ack
+func (c *Conn) acknowledged(ack uint32, rwnd int, sack []byte) {
+	c.rwnd = rwnd
+	now := time.Now()
+	i := 0
+	for ; i < len(c.inflight) && before(c.inflight[i].seq, ack); i++ {
+		seg := c.inflight[i]
+		//only samples without retransmission are reliable
+		if seg.retries == 0 && !seg.fast {
+			c.updateRTO(now.Sub(seg.sent))
+		}
+		c.grow()
+	}
+	c.inflight = c.inflight[i:]
+
+	last := -1
+	for i, seg := range c.inflight {
+		n := seg.seq - ack - 1
+		if n < window && sack[n/8]&(1<<(n%8)) != 0 {
+			seg.sacked = true
+			last = i
+		}
+	}
+	//segments before one received are lost
+	for _, seg := range c.inflight[:last+1] {
+		if !seg.sacked && !seg.fast {
+			seg.fast = true
+			c.reduce(seg, c.cwnd/2)
+			c.sendSegment(seg)
+		}
+	}
+}
+
+//grow the congestion window by a packet acknowledged
+func (c *Conn) grow() {
+	if c.cwnd < c.ssthresh {
+		c.cwnd++
+	} else if c.acked++; c.acked >= c.cwnd {
+		c.acked = 0
+		c.cwnd++
+	}
+	if c.cwnd > window {
+		c.cwnd = window
+	}
+}
+
+//reduce the congestion window to *cwnd* by the loss of *seg*,
+//once for the losses of the packets in flight
+func (c *Conn) reduce(seg *segment, cwnd int) {
+	if before(seg.seq, c.recover) {
+		return
+	}
+	c.recover = c.sndNext
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < 2 {
+		c.ssthresh = 2
+	}
+	c.cwnd = cwnd
+	if c.cwnd < 1 {
+		c.cwnd = 1
+	}
+	c.acked = 0
+}
+
+//canSend a new packet, the first one in flight probes
+//a peer without free window
+func (c *Conn) canSend() bool {
+	limit := c.cwnd
+	if c.rwnd < limit {
+		limit = c.rwnd
+	}
+	return len(c.inflight) < limit || len(c.inflight) == 0
+}
+
+func (c *Conn) updateRTO(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (c.srtt*7 + rtt) / 8
+	}
+	c.rto = c.srtt * 2
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+func (c *Conn) timerLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mutex.Lock()
+		now := time.Now()
+		if now.Sub(c.lastRecv) > peerTimeout {
+			c.mutex.Unlock()
+			c.fail(ErrPeerTimeout)
+			return
+		}
+		for _, seg := range c.inflight {
+			if seg.sacked {
+				continue
+			}
+			backoff := c.rto << seg.retries
+			if backoff > maxRTO || backoff <= 0 {
+				backoff = maxRTO
+			}
+			if now.Sub(seg.sent) > backoff {
+				if seg.retries == 0 {
+					c.reduce(seg, 1)
+				}
+				seg.retries++
+				c.sendSegment(seg)
+			}
+		}
+		if now.Sub(c.lastSend) > keepAlive {
+			c.sendAck()
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func (c *Conn) send(b []byte) {
+	c.lastSend = time.Now()
+	c.pc.WriteTo(b, c.peer)
+}
+
+func (c *Conn) sendAck() {
+	var ack [ackLen]byte
+	binary.BigEndian.PutUint32(ack[:4], c.rcvNext)
+	c.advertised = c.freeWindow()
+	binary.BigEndian.PutUint16(ack[4:6], uint16(c.advertised))
+	for seq := range c.pending {
+		n := seq - c.rcvNext - 1
+		if n < window {
+			ack[6+n/8] |= 1 << (n % 8)
+		}
+	}
+	c.send(packet(typeAck, ack[:]))
+}
+
+func (c *Conn) sendSegment(seg *segment) {
+	var header [dataHeaderLen]byte
+	binary.BigEndian.PutUint32(header[:4], seg.seq)
+	if seg.fin {
+		header[4] = flagFin
+	}
+	seg.sent = time.Now()
+	c.send(packet(typeData, header[:], seg.data))
+}
+
+//fail stop the connection with *err* unless already closed
+func (c *Conn) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+}
+
+//wait for a change of state until *deadline*
+func (c *Conn) wait(deadline time.Time) error {
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return deadlineError{}
+		}
+		t := time.AfterFunc(d, func() {
+			c.mutex.Lock()
+			c.cond.Broadcast()
+			c.mutex.Unlock()
+		})
+		defer t.Stop()
+	}
+	c.cond.Wait()
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.rbuf.Len() == 0 {
+		switch {
+		case c.closed:
+			return 0, errClosed
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err := c.wait(c.rdeadline); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.rbuf.Read(b)
+	//the peer waits the window opened
+	if c.advertised < window/4 && c.freeWindow() >= window/4 {
+		c.sendAck()
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > mss {
+			chunk = chunk[:mss]
+		}
+		if err := c.push(chunk, false); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+//push a new segment waiting room on the window
+func (c *Conn) push(data []byte, fin bool) error {
+	for {
+		switch {
+		case c.closed:
+			return errClosed
+		case c.err != nil:
+			return c.err
+		case c.finSent:
+			return errors.New("punch: write after close write")
+		}
+		if c.canSend() {
+			break
+		}
+		if err := c.wait(c.wdeadline); err != nil {
+			return err
+		}
+	}
+
+	seg := &segment{seq: c.sndNext, fin: fin, data: append([]byte(nil), data...)}
+	c.sndNext++
+	c.inflight = append(c.inflight, seg)
+	c.sendSegment(seg)
+	return nil
+}
+
+//CloseWrite the peer reads io.EOF after all the data
+func (c *Conn) CloseWrite() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closeWrite()
+}
+
+func (c *Conn) closeWrite() error {
+	if c.finSent {
+		return nil
+	}
+	err := c.push(nil, true)
+	c.finSent = true
+	return err
+}
+
+//Close send pending data and release the udp socket
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return errClosed
+	}
+	if c.err == nil && c.closeWrite() == nil {
+		deadline := time.Now().Add(closeTimeout)
+		for len(c.inflight) > 0 && c.err == nil {
+			if c.wait(deadline) != nil {
+				break
+			}
+		}
+	}
+	c.closed = true
+	close(c.done)
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+
+	return c.pc.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rdeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.wdeadline = t
+	c.cond.Broadcast()
+	return nil
+}
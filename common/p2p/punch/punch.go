@@ -0,0 +1,100 @@
+// Package punch provides UDP hole punching between peers behind NAT
+// and a reliable stream on top of the punched path.
+//
+// Every peer learns its public endpoint asking a STUN server
+// (see stun.Discover) with the same socket, the endpoints are exchanged
+// out of band and both peers call Punch at the same time.
+package punch
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	//ErrTimeout the peer didn't answer
+	ErrTimeout = errors.New("punch: timeout")
+)
+
+//magic every packet starts with it, other traffic it's ignored
+var magic = []byte{'R', 'M'}
+
+const (
+	typeSyn byte = iota + 1
+	typeSynAck
+	typeData
+	typeAck
+)
+
+const (
+	//probeInterval between retries of syns
+	probeInterval = time.Millisecond * 100
+	maxPacket     = 1500
+)
+
+func packet(typ byte, payload ...[]byte) []byte {
+	b := append([]byte(nil), magic...)
+	b = append(b, typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+//parse type and payload of packet, zero type when it's not ours
+func parse(b []byte) (byte, []byte) {
+	if len(b) < len(magic)+1 || !bytes.Equal(b[:len(magic)], magic) {
+		return 0, nil
+	}
+	return b[len(magic)], b[len(magic)+1:]
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+//Punch open a path to *peer* sending packets at the same time
+//the peer does, both peers must use the same *token*.
+//The returned Conn owns *pc*
+func Punch(pc net.PacketConn, peer *net.UDPAddr, token []byte, timeout time.Duration) (*Conn, error) {
+	syn := packet(typeSyn, token)
+	synAck := packet(typeSynAck, token)
+
+	defer pc.SetReadDeadline(time.Time{})
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, maxPacket)
+	var from net.Addr = peer
+	for time.Now().Before(deadline) {
+		if _, err := pc.WriteTo(syn, from); err != nil {
+			return nil, err
+		}
+
+		pc.SetReadDeadline(time.Now().Add(probeInterval))
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, err
+			}
+			typ, payload := parse(buf[:n])
+			if (typ != typeSyn && typeSynAck != typ) || !bytes.Equal(payload, token) {
+				continue
+			}
+			//the nat of the peer can use other port than announced
+			from = addr
+			if _, err := pc.WriteTo(synAck, from); err != nil {
+				return nil, err
+			}
+			//the peer has our packets
+			if typ == typeSynAck {
+				return newConn(pc, from, token), nil
+			}
+		}
+	}
+	return nil, ErrTimeout
+}
@@ -0,0 +1,214 @@
+package punch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bit4bit/remoton/common/p2p/stun"
+)
+
+//lossyConn drop every *n* packet written
+type lossyConn struct {
+	net.PacketConn
+	n     int32
+	count int32
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.n > 0 && atomic.AddInt32(&c.count, 1)%c.n == 0 {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func stunServer(t *testing.T) (string, func()) {
+	pc := listenUDP(t)
+	go (&stun.Server{Primary: pc}).Serve()
+	return pc.LocalAddr().String(), func() { pc.Close() }
+}
+
+func punchPair(t *testing.T, loss int32) (*Conn, *Conn) {
+	server, done := stunServer(t)
+	defer done()
+
+	pca := &lossyConn{PacketConn: listenUDP(t), n: loss}
+	pcb := &lossyConn{PacketConn: listenUDP(t), n: loss}
+	addra, err := stun.Discover(pca, server, time.Second*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrb, err := stun.Discover(pcb, server, time.Second*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := []byte("session-token")
+	connc := make(chan *Conn)
+	go func() {
+		conn, err := Punch(pcb, addra, token, time.Second*5)
+		if err != nil {
+			t.Error(err)
+		}
+		connc <- conn
+	}()
+	conna, err := Punch(pca, addrb, token, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connb := <-connc
+	if connb == nil {
+		t.FailNow()
+	}
+	return conna, connb
+}
+
+func TestPunchInvalidToken(t *testing.T) {
+	pca := listenUDP(t)
+	pcb := listenUDP(t)
+	defer pca.Close()
+	defer pcb.Close()
+
+	go Punch(pcb, pca.LocalAddr().(*net.UDPAddr), []byte("other"), time.Millisecond*500)
+	_, err := Punch(pca, pcb.LocalAddr().(*net.UDPAddr), []byte("token"), time.Millisecond*500)
+	if err != ErrTimeout {
+		t.Errorf("want %v get %v", ErrTimeout, err)
+	}
+}
+
+func testStream(t *testing.T, loss int32, size int) {
+	conna, connb := punchPair(t, loss)
+	defer connb.Close()
+
+	data := make([]byte, size)
+	rand.Read(data)
+
+	go func() {
+		if _, err := conna.Write(data); err != nil {
+			t.Error(err)
+		}
+		conna.Close()
+	}()
+
+	connb.SetReadDeadline(time.Now().Add(time.Second * 20))
+	received, err := ioutil.ReadAll(connb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("want %d bytes get %d", len(data), len(received))
+	}
+}
+
+func TestStream(t *testing.T) {
+	testStream(t, 0, 1024*1024)
+}
+
+func TestStreamLoss(t *testing.T) {
+	testStream(t, 7, 256*1024)
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	conna, connb := punchPair(t, 0)
+	defer conna.Close()
+	defer connb.Close()
+
+	go func() {
+		data, _ := ioutil.ReadAll(connb)
+		connb.Write(append([]byte("reply:"), data...))
+		connb.CloseWrite()
+	}()
+
+	conna.Write([]byte("request"))
+	conna.CloseWrite()
+	conna.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data, err := ioutil.ReadAll(conna)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "reply:request" {
+		t.Errorf("want %v get %v", "reply:request", string(data))
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	conna, connb := punchPair(t, 0)
+	defer conna.Close()
+	defer connb.Close()
+
+	conna.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err := conna.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("want timeout get %v", err)
+	}
+
+	//closed connection unblock readers
+	errc := make(chan error)
+	go func() {
+		_, err := connb.Read(make([]byte, 1))
+		errc <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	connb.Close()
+	select {
+	case err := <-errc:
+		if err == nil || err == io.EOF {
+			t.Errorf("want error get %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("read not unblocked by close")
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	conna, connb := punchPair(t, 0)
+	defer connb.Close()
+
+	data := make([]byte, rcvBuffer*4)
+	rand.Read(data)
+
+	//the reader it's stalled, the writer waits the window
+	conna.SetWriteDeadline(time.Now().Add(time.Millisecond * 500))
+	n, err := conna.Write(data)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("want timeout get %v", err)
+	}
+	connb.mutex.Lock()
+	buffered := connb.rbuf.Len()
+	for _, seg := range connb.pending {
+		buffered += len(seg.data)
+	}
+	connb.mutex.Unlock()
+	if buffered > rcvBuffer {
+		t.Errorf("want at most %d bytes buffered get %d", rcvBuffer, buffered)
+	}
+
+	conna.SetWriteDeadline(time.Time{})
+	go func() {
+		if _, err := conna.Write(data[n:]); err != nil {
+			t.Error(err)
+		}
+		conna.Close()
+	}()
+	connb.SetReadDeadline(time.Now().Add(time.Second * 20))
+	received, err := ioutil.ReadAll(connb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("want %d bytes get %d", len(data), len(received))
+	}
+}
@@ -0,0 +1,186 @@
+package stun
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+//NATType behaviour of the NAT in front of a socket
+type NATType string
+
+const (
+	//NATUnknown the server can't tell more than the mapped address
+	NATUnknown NATType = "unknown"
+	//NATBlocked no answer from the server, udp it's filtered
+	NATBlocked NATType = "blocked"
+	//NATOpen the socket has a public address
+	NATOpen NATType = "open"
+	//NATFullCone anybody can send to the mapped address
+	NATFullCone NATType = "full-cone"
+	//NATRestricted only hosts contacted before can send to the mapped
+	//address, when the server has a single ip it's reported for full cone too
+	NATRestricted NATType = "restricted"
+	//NATPortRestricted only address and port contacted before can send,
+	//when the alternate of the server has other ip it's reported for restricted too
+	NATPortRestricted NATType = "port-restricted"
+	//NATSymmetric the mapped address change with every destination
+	NATSymmetric NATType = "symmetric"
+)
+
+//Punchable peers can open a direct udp path announcing the mapped address
+func (t NATType) Punchable() bool {
+	switch t {
+	case NATOpen, NATFullCone, NATRestricted, NATPortRestricted:
+		return true
+	}
+	return false
+}
+
+var (
+	//ErrTimeout the server didn't answer
+	ErrTimeout = errors.New("stun: timeout")
+)
+
+const (
+	//retryInterval between retransmission of requests
+	retryInterval = time.Millisecond * 100
+	maxPacket     = 1500
+)
+
+//Result of the discovery
+type Result struct {
+	NAT NATType
+	//Mapped public address of the socket
+	Mapped *net.UDPAddr
+}
+
+//Discover ask the *server* the public address of *pc*
+func Discover(pc net.PacketConn, server string, timeout time.Duration) (*net.UDPAddr, error) {
+	saddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	res, err := bind(pc, saddr, 0, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return res.mapped, nil
+}
+
+//DetectNAT discover the public address of *pc* and the behaviour of the
+//NAT (RFC 5780 subset), every test waits at most *timeout*
+func DetectNAT(pc net.PacketConn, server string, timeout time.Duration) (*Result, error) {
+	saddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := bind(pc, saddr, 0, timeout)
+	if err == ErrTimeout {
+		return &Result{NAT: NATBlocked}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	result := &Result{NAT: NATUnknown, Mapped: res.mapped}
+	if isLocal(pc.LocalAddr(), res.mapped) {
+		result.NAT = NATOpen
+		return result, nil
+	}
+	if res.other == nil {
+		return result, nil
+	}
+	//server listening on every interface
+	if res.other.IP.IsUnspecified() {
+		res.other.IP = saddr.IP
+	}
+
+	//filtering must be tested before contacting the other address,
+	//the NAT allows answers from there after that
+	_, err = bind(pc, saddr, changeIP|changePort, timeout)
+	switch err {
+	case nil:
+		result.NAT = NATRestricted
+		if !res.other.IP.Equal(saddr.IP) {
+			result.NAT = NATFullCone
+		}
+	case ErrTimeout:
+		result.NAT = NATPortRestricted
+	default:
+		return nil, err
+	}
+
+	other, err := bind(pc, res.other, 0, timeout)
+	if err == ErrTimeout {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if other.mapped.String() != res.mapped.String() {
+		result.NAT = NATSymmetric
+	}
+	return result, nil
+}
+
+//isLocal *mapped* it's the address of the socket
+func isLocal(local net.Addr, mapped *net.UDPAddr) bool {
+	laddr, ok := local.(*net.UDPAddr)
+	if !ok || laddr.Port != mapped.Port {
+		return false
+	}
+	if !laddr.IP.IsUnspecified() {
+		return laddr.IP.Equal(mapped.IP)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(mapped.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+//bind send a binding request to *server* until an answer it's received
+func bind(pc net.PacketConn, server *net.UDPAddr, change uint32, timeout time.Duration) (*message, error) {
+	req, err := newRequest(change)
+	if err != nil {
+		return nil, err
+	}
+	packet := req.encode()
+
+	defer pc.SetReadDeadline(time.Time{})
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, maxPacket)
+	for time.Now().Before(deadline) {
+		if _, err := pc.WriteTo(packet, server); err != nil {
+			return nil, err
+		}
+
+		pc.SetReadDeadline(time.Now().Add(retryInterval))
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, err
+			}
+			res, err := decode(buf[:n])
+			if err != nil || res.typ != typeBindingResponse ||
+				res.txid != req.txid || res.mapped == nil {
+				continue
+			}
+			return res, nil
+		}
+	}
+	return nil, ErrTimeout
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
@@ -0,0 +1,195 @@
+// Package stun implements a subset of STUN (RFC 5389) for learning
+// the public address of a udp socket and the kind of NAT in front of it.
+//
+// Only binding requests are supported with the attributes
+// MAPPED-ADDRESS, XOR-MAPPED-ADDRESS, CHANGE-REQUEST and OTHER-ADDRESS,
+// authentication and FINGERPRINT are not implemented.
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	magicCookie = 0x2112A442
+	headerSize  = 20
+
+	typeBindingRequest  = 0x0001
+	typeBindingResponse = 0x0101
+
+	attrMappedAddress    = 0x0001
+	attrChangeRequest    = 0x0003
+	attrXorMappedAddress = 0x0020
+	attrOtherAddress     = 0x802C
+
+	changeIP   = 0x04
+	changePort = 0x02
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+var errMessage = errors.New("stun: invalid message")
+
+//message binding request or response
+type message struct {
+	typ  uint16
+	txid [12]byte
+
+	mapped *net.UDPAddr
+	other  *net.UDPAddr
+	change uint32
+}
+
+func newRequest(change uint32) (*message, error) {
+	m := &message{typ: typeBindingRequest, change: change}
+	if _, err := rand.Read(m.txid[:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//IsMessage it's a STUN message, allow sharing a socket with other protocols
+func IsMessage(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0xc0 == 0 &&
+		binary.BigEndian.Uint32(b[4:8]) == magicCookie
+}
+
+func (m *message) encode() []byte {
+	b := make([]byte, headerSize, 64)
+	binary.BigEndian.PutUint16(b[0:2], m.typ)
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	copy(b[8:20], m.txid[:])
+
+	if m.change != 0 {
+		var v [4]byte
+		binary.BigEndian.PutUint32(v[:], m.change)
+		b = appendAttr(b, attrChangeRequest, v[:])
+	}
+	if m.mapped != nil {
+		b = appendAttr(b, attrMappedAddress, encodeAddr(m.mapped, nil))
+		b = appendAttr(b, attrXorMappedAddress, encodeAddr(m.mapped, m.txid[:]))
+	}
+	if m.other != nil {
+		b = appendAttr(b, attrOtherAddress, encodeAddr(m.other, nil))
+	}
+
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerSize))
+	return b
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[0:2], typ)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+	b = append(b, header[:]...)
+	b = append(b, value...)
+	//attributes are aligned to 4 bytes
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func decode(b []byte) (*message, error) {
+	if !IsMessage(b) {
+		return nil, errMessage
+	}
+	size := int(binary.BigEndian.Uint16(b[2:4]))
+	if size%4 != 0 || headerSize+size > len(b) {
+		return nil, errMessage
+	}
+
+	m := &message{typ: binary.BigEndian.Uint16(b[0:2])}
+	copy(m.txid[:], b[8:20])
+
+	attrs := b[headerSize : headerSize+size]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		length := int(binary.BigEndian.Uint16(attrs[2:4]))
+		padded := (length + 3) &^ 3
+		if 4+padded > len(attrs) {
+			return nil, errMessage
+		}
+		value := attrs[4 : 4+length]
+
+		var err error
+		switch typ {
+		case attrMappedAddress:
+			//XOR-MAPPED-ADDRESS wins when both are present
+			if m.mapped == nil {
+				m.mapped, err = decodeAddr(value, nil)
+			}
+		case attrXorMappedAddress:
+			m.mapped, err = decodeAddr(value, m.txid[:])
+		case attrOtherAddress:
+			m.other, err = decodeAddr(value, nil)
+		case attrChangeRequest:
+			if len(value) != 4 {
+				return nil, errMessage
+			}
+			m.change = binary.BigEndian.Uint32(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs = attrs[4+padded:]
+	}
+	return m, nil
+}
+
+//encodeAddr xored with cookie and *txid* when not nil
+func encodeAddr(addr *net.UDPAddr, txid []byte) []byte {
+	family := byte(familyIPv4)
+	ip := addr.IP.To4()
+	if ip == nil {
+		family = familyIPv6
+		ip = addr.IP.To16()
+	}
+
+	b := make([]byte, 4+len(ip))
+	b[1] = family
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[4:], ip)
+	if txid != nil {
+		xorAddr(b, txid)
+	}
+	return b
+}
+
+func decodeAddr(b []byte, txid []byte) (*net.UDPAddr, error) {
+	if len(b) < 4 {
+		return nil, errMessage
+	}
+	switch {
+	case b[1] == familyIPv4 && len(b) == 8:
+	case b[1] == familyIPv6 && len(b) == 20:
+	default:
+		return nil, errMessage
+	}
+
+	b = append([]byte(nil), b...)
+	if txid != nil {
+		xorAddr(b, txid)
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(b[4:]),
+		Port: int(binary.BigEndian.Uint16(b[2:4])),
+	}, nil
+}
+
+//xorAddr port and address of b xored with magic cookie and *txid*
+func xorAddr(b []byte, txid []byte) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], magicCookie)
+	copy(key[4:], txid)
+
+	b[2] ^= key[0]
+	b[3] ^= key[1]
+	for i := range b[4:] {
+		b[4+i] ^= key[i]
+	}
+}
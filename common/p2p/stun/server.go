@@ -0,0 +1,70 @@
+package stun
+
+import (
+	"net"
+	"sync"
+)
+
+//Server answer binding requests on *Primary*, when *Alternate*
+//it's set the clients can test the filtering of their NAT
+//asking the answer from there (CHANGE-REQUEST)
+type Server struct {
+	Primary net.PacketConn
+	//Alternate other port or ip of the same host, optional
+	Alternate net.PacketConn
+}
+
+//Serve until the sockets are closed
+func (s *Server) Serve() error {
+	if s.Alternate == nil {
+		return s.serve(s.Primary, nil)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.serve(s.Alternate, s.Primary)
+	}()
+	err := s.serve(s.Primary, s.Alternate)
+	wg.Wait()
+	return err
+}
+
+//serve requests on *pc* answering from *other* on CHANGE-REQUEST
+func (s *Server) serve(pc, other net.PacketConn) error {
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		s.handle(pc, other, buf[:n], addr)
+	}
+}
+
+func (s *Server) handle(pc, other net.PacketConn, b []byte, addr net.Addr) {
+	req, err := decode(b)
+	if err != nil || req.typ != typeBindingRequest {
+		return
+	}
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	res := &message{typ: typeBindingResponse, txid: req.txid, mapped: uaddr}
+	if other != nil {
+		res.other, _ = other.LocalAddr().(*net.UDPAddr)
+	}
+
+	from := pc
+	if req.change&(changeIP|changePort) != 0 {
+		//not supported, the client reads it as filtered
+		if other == nil {
+			return
+		}
+		from = other
+	}
+	from.WriteTo(res.encode(), addr)
+}
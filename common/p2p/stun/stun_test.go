@@ -0,0 +1,284 @@
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = time.Millisecond * 300
+
+func listenUDP(t *testing.T, addr string) net.PacketConn {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+//stunServer primary on 127.0.0.1 and the alternate on *alternate*
+func stunServer(t *testing.T, alternate string) (string, func()) {
+	srv := &Server{Primary: listenUDP(t, "127.0.0.1:0")}
+	if alternate != "" {
+		srv.Alternate = listenUDP(t, alternate)
+	}
+	go srv.Serve()
+	return srv.Primary.LocalAddr().String(), func() {
+		srv.Primary.Close()
+		if srv.Alternate != nil {
+			srv.Alternate.Close()
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type natPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+//fakeNAT translate the packets of the client to real sockets
+type fakeNAT struct {
+	t          *testing.T
+	symmetric  bool
+	filterIP   bool
+	filterPort bool
+
+	mutex    sync.Mutex
+	outs     map[string]net.PacketConn
+	allowed  map[string]bool
+	packets  chan natPacket
+	deadline time.Time
+}
+
+func newFakeNAT(t *testing.T, symmetric, filterIP, filterPort bool) *fakeNAT {
+	return &fakeNAT{t: t, symmetric: symmetric, filterIP: filterIP, filterPort: filterPort,
+		outs: make(map[string]net.PacketConn), allowed: make(map[string]bool),
+		packets: make(chan natPacket, 16)}
+}
+
+func (n *fakeNAT) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	key := ""
+	if n.symmetric {
+		key = addr.String()
+	}
+	out, ok := n.outs[key]
+	if !ok {
+		out = listenUDP(n.t, "127.0.0.1:0")
+		n.outs[key] = out
+		go n.forward(out)
+	}
+	n.allowed[addr.String()] = true
+	n.allowed[addr.(*net.UDPAddr).IP.String()] = true
+	return out.WriteTo(b, addr)
+}
+
+func (n *fakeNAT) forward(out net.PacketConn) {
+	buf := make([]byte, maxPacket)
+	for {
+		size, addr, err := out.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		n.mutex.Lock()
+		pass := true
+		if n.filterPort {
+			pass = n.allowed[addr.String()]
+		} else if n.filterIP {
+			pass = n.allowed[addr.(*net.UDPAddr).IP.String()]
+		}
+		n.mutex.Unlock()
+		if pass {
+			n.packets <- natPacket{append([]byte(nil), buf[:size]...), addr}
+		}
+	}
+}
+
+func (n *fakeNAT) ReadFrom(b []byte) (int, net.Addr, error) {
+	n.mutex.Lock()
+	deadline := n.deadline
+	n.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(time.Until(deadline))
+	}
+	select {
+	case p := <-n.packets:
+		return copy(b, p.b), p.addr, nil
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	}
+}
+
+func (n *fakeNAT) Close() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, out := range n.outs {
+		out.Close()
+	}
+	return nil
+}
+
+func (n *fakeNAT) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+}
+
+func (n *fakeNAT) SetDeadline(t time.Time) error {
+	return n.SetReadDeadline(t)
+}
+
+func (n *fakeNAT) SetReadDeadline(t time.Time) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.deadline = t
+	return nil
+}
+
+func (n *fakeNAT) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestMessage(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 168, 1, 10), Port: 9932},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	} {
+		req, err := newRequest(changePort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &message{typ: typeBindingResponse, txid: req.txid, mapped: addr, other: addr}
+
+		for _, m := range []*message{req, res} {
+			b := m.encode()
+			if !IsMessage(b) {
+				t.Fatal("want message")
+			}
+			decoded, err := decode(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.typ != m.typ || decoded.txid != m.txid || decoded.change != m.change {
+				t.Errorf("want %+v get %+v", m, decoded)
+			}
+			if m.mapped != nil && decoded.mapped.String() != m.mapped.String() {
+				t.Errorf("want mapped %v get %v", m.mapped, decoded.mapped)
+			}
+		}
+	}
+
+	if IsMessage([]byte("RM\x01not a stun message")) {
+		t.Error("want not a message")
+	}
+	if _, err := decode(append(newMessageHeader(), 0, 1, 0, 8)); err != errMessage {
+		t.Errorf("want %v get %v", errMessage, err)
+	}
+}
+
+//newMessageHeader header announcing one attribute of 8 bytes
+func newMessageHeader() []byte {
+	m := &message{typ: typeBindingResponse}
+	b := m.encode()
+	b[3] = 12
+	return b
+}
+
+func TestDiscover(t *testing.T) {
+	server, done := stunServer(t, "")
+	defer done()
+
+	pc := listenUDP(t, "127.0.0.1:0")
+	defer pc.Close()
+	addr, err := Discover(pc, server, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != pc.LocalAddr().String() {
+		t.Errorf("want %v get %v", pc.LocalAddr(), addr)
+	}
+}
+
+func TestDiscoverTimeout(t *testing.T) {
+	silent := listenUDP(t, "127.0.0.1:0")
+	defer silent.Close()
+
+	pc := listenUDP(t, "127.0.0.1:0")
+	defer pc.Close()
+	if _, err := Discover(pc, silent.LocalAddr().String(), testTimeout); err != ErrTimeout {
+		t.Errorf("want %v get %v", ErrTimeout, err)
+	}
+}
+
+func TestDetectNAT(t *testing.T) {
+	tests := []struct {
+		name                            string
+		alternate                       string
+		symmetric, filterIP, filterPort bool
+		want                            NATType
+	}{
+		{"full cone", "127.0.0.2:0", false, false, false, NATFullCone},
+		{"restricted", "127.0.0.1:0", false, true, false, NATRestricted},
+		{"restricted other ip", "127.0.0.2:0", false, true, false, NATPortRestricted},
+		{"port restricted", "127.0.0.1:0", false, false, true, NATPortRestricted},
+		{"symmetric", "127.0.0.1:0", true, false, true, NATSymmetric},
+		{"without alternate", "", false, false, true, NATUnknown},
+	}
+
+	for _, test := range tests {
+		server, done := stunServer(t, test.alternate)
+		pc := newFakeNAT(t, test.symmetric, test.filterIP, test.filterPort)
+
+		res, err := DetectNAT(pc, server, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.NAT != test.want {
+			t.Errorf("%s: want %v get %v", test.name, test.want, res.NAT)
+		}
+		if res.Mapped == nil || res.Mapped.String() == pc.LocalAddr().String() {
+			t.Errorf("%s: want public address get %v", test.name, res.Mapped)
+		}
+		pc.Close()
+		done()
+	}
+}
+
+func TestDetectNATOpen(t *testing.T) {
+	server, done := stunServer(t, "127.0.0.1:0")
+	defer done()
+
+	pc := listenUDP(t, "127.0.0.1:0")
+	defer pc.Close()
+	res, err := DetectNAT(pc, server, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NAT != NATOpen {
+		t.Errorf("want %v get %v", NATOpen, res.NAT)
+	}
+}
+
+func TestDetectNATBlocked(t *testing.T) {
+	silent := listenUDP(t, "127.0.0.1:0")
+	defer silent.Close()
+
+	pc := listenUDP(t, "127.0.0.1:0")
+	defer pc.Close()
+	res, err := DetectNAT(pc, silent.LocalAddr().String(), testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NAT != NATBlocked || res.NAT.Punchable() {
+		t.Errorf("want %v get %v", NATBlocked, res.NAT)
+	}
+}
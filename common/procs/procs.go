@@ -0,0 +1,49 @@
+// Package procs lists and kills the processes of the client for the supporter.
+package procs
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	//ErrUnsupported listing processes it's not implemented for the system
+	ErrUnsupported = errors.New("procs: unsupported on this system")
+
+	errInvalidPID = errors.New("procs: invalid pid")
+	errOwnProcess = errors.New("procs: can't kill the remoton process")
+)
+
+//Process running on the machine
+type Process struct {
+	PID  int    `json:"pid"`
+	PPID int    `json:"ppid"`
+	Name string `json:"name"`
+	//Cmdline arguments joined by spaces
+	Cmdline string `json:"cmdline,omitempty"`
+	User    string `json:"user,omitempty"`
+	State   string `json:"state,omitempty"`
+	//Memory resident in bytes
+	Memory uint64 `json:"memory,omitempty"`
+}
+
+//Manager of the processes of the running system
+type Manager interface {
+	List() ([]Process, error)
+	Kill(pid int) error
+}
+
+//kill *pid* unless it's the own process
+func kill(pid int) error {
+	if pid <= 0 {
+		return errInvalidPID
+	}
+	if pid == os.Getpid() {
+		return errOwnProcess
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -0,0 +1,130 @@
+package procs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Linux processes from /proc
+type Linux struct {
+	//Root prefix of /proc, by default "/"
+	Root string
+	//LookupUser name of the *uid*, by default the users of the system
+	LookupUser func(uid string) (string, error)
+}
+
+//New manager for the running system
+func New() Manager {
+	return &Linux{}
+}
+
+func (l *Linux) path(elem ...string) string {
+	root := l.Root
+	if root == "" {
+		root = "/"
+	}
+	return filepath.Join(append([]string{root, "proc"}, elem...)...)
+}
+
+//List processes sorted by pid, the ones exiting while
+//reading are skipped
+func (l *Linux) List() ([]Process, error) {
+	entries, err := ioutil.ReadDir(l.path())
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	var processes []Process
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		p, ok := l.process(pid, users)
+		if ok {
+			processes = append(processes, p)
+		}
+	}
+	sort.Sort(byPID(processes))
+	return processes, nil
+}
+
+//Kill the process *pid*
+func (l *Linux) Kill(pid int) error {
+	return kill(pid)
+}
+
+//process of /proc/<pid>, *users* caches the names of the uids
+func (l *Linux) process(pid int, users map[string]string) (Process, bool) {
+	dir := strconv.Itoa(pid)
+	p := Process{PID: pid}
+
+	stat, err := ioutil.ReadFile(l.path(dir, "stat"))
+	if err != nil {
+		return p, false
+	}
+	//pid (name) state ppid ..., the name can have spaces and parens
+	start := strings.IndexByte(string(stat), '(')
+	end := strings.LastIndexByte(string(stat), ')')
+	if start < 0 || end < start {
+		return p, false
+	}
+	p.Name = string(stat[start+1 : end])
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) >= 2 {
+		p.State = fields[0]
+		p.PPID, _ = strconv.Atoi(fields[1])
+	}
+
+	if cmdline, err := ioutil.ReadFile(l.path(dir, "cmdline")); err == nil {
+		p.Cmdline = strings.TrimSpace(strings.Replace(string(cmdline), "\x00", " ", -1))
+	}
+
+	if statm, err := ioutil.ReadFile(l.path(dir, "statm")); err == nil {
+		if fields := strings.Fields(string(statm)); len(fields) >= 2 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			p.Memory = pages * uint64(os.Getpagesize())
+		}
+	}
+
+	status, _ := ioutil.ReadFile(l.path(dir, "status"))
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "Uid:" {
+			continue
+		}
+		uid := fields[1]
+		if _, ok := users[uid]; !ok {
+			users[uid] = uid
+			if name, err := l.lookupUser(uid); err == nil {
+				users[uid] = name
+			}
+		}
+		p.User = users[uid]
+		break
+	}
+	return p, true
+}
+
+type byPID []Process
+
+func (s byPID) Len() int           { return len(s) }
+func (s byPID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPID) Less(i, j int) bool { return s[i].PID < s[j].PID }
+
+func (l *Linux) lookupUser(uid string) (string, error) {
+	if l.LookupUser != nil {
+		return l.LookupUser(uid)
+	}
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
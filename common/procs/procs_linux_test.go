@@ -0,0 +1,90 @@
+package procs
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bit4bit/remoton/common/internal/fakeroot"
+)
+
+func TestList(t *testing.T) {
+	root := fakeroot.Create(t, map[string]string{
+		"proc/uptime":       "3725.52 7000.10\n",
+		"proc/1/stat":       "1 (systemd) S 0 1 1 0 -1 4194560\n",
+		"proc/1/cmdline":    "/sbin/init\x00splash\x00",
+		"proc/1/statm":      "41000 2000 1500 200 0 3000 0\n",
+		"proc/1/status":     "Name:\tsystemd\nUid:\t0\t0\t0\t0\n",
+		"proc/742/stat":     "742 (Web Content (1)) R 1 742 742 0 -1 4194304\n",
+		"proc/742/cmdline":  "",
+		"proc/742/statm":    "10 5 0 0 0 0 0\n",
+		"proc/742/status":   "Name:\tWeb Content\nUid:\t4242\t4242\t4242\t4242\n",
+		"proc/35/stat":      "35 (kworker/0:1) I 2 0 0 0 -1 69238880\n",
+		"proc/self/cmdline": "",
+	})
+	defer os.RemoveAll(root)
+
+	page := uint64(os.Getpagesize())
+	want := []Process{
+		{PID: 1, PPID: 0, Name: "systemd", Cmdline: "/sbin/init splash",
+			User: "root", State: "S", Memory: 2000 * page},
+		{PID: 35, PPID: 2, Name: "kworker/0:1", State: "I"},
+		{PID: 742, PPID: 1, Name: "Web Content (1)", User: "4242",
+			State: "R", Memory: 5 * page},
+	}
+	//uid 4242 it's unknown
+	lookup := func(uid string) (string, error) {
+		if uid == "0" {
+			return "root", nil
+		}
+		return "", errors.New("unknown uid " + uid)
+	}
+	processes, err := (&Linux{Root: root, LookupUser: lookup}).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(processes, want) {
+		t.Errorf("want %+v get %+v", want, processes)
+	}
+}
+
+func TestListRunning(t *testing.T) {
+	processes, err := New().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range processes {
+		if p.PID == os.Getpid() {
+			return
+		}
+	}
+	t.Errorf("want own process %d on %+v", os.Getpid(), processes)
+}
+
+func TestKill(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	if err := New().Kill(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		cmd.Process.Kill()
+		t.Fatal("process not killed")
+	}
+
+	for _, pid := range []int{0, -1, os.Getpid()} {
+		if err := New().Kill(pid); err == nil {
+			t.Errorf("want error killing %d", pid)
+		}
+	}
+}
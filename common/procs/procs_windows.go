@@ -0,0 +1,17 @@
+package procs
+
+//stub kill only, TODO list with the toolhelp api
+type stub struct{}
+
+//New manager for the running system
+func New() Manager {
+	return stub{}
+}
+
+func (stub) List() ([]Process, error) {
+	return nil, ErrUnsupported
+}
+
+func (stub) Kill(pid int) error {
+	return kill(pid)
+}
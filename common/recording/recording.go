@@ -0,0 +1,284 @@
+//Package recording saves the desktop stream of a session with the
+//time of every chunk, remoton-replay serves it again to a viewer.
+//
+//The file starts with the magic, the length of the metadata and the
+//metadata as JSON, then the chunks: direction, nanoseconds since the
+//start, length and data.
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	//ErrFormat the file it's not a recording
+	ErrFormat = errors.New("recording: invalid format")
+	//ErrClosed recording closed
+	ErrClosed = errors.New("recording: closed")
+)
+
+//magic starts the file, last byte it's the version
+var magic = []byte("RMREC\x01")
+
+//maxChunk longest chunk read
+const maxChunk = 1 << 28
+
+//Ext of the recording files
+const Ext = ".rec"
+
+//Direction of a chunk
+type Direction byte
+
+const (
+	//FromDesktop sent by the desktop of the client to the viewer
+	FromDesktop Direction = 'D'
+	//FromViewer sent by the viewer of the supporter to the desktop
+	FromViewer Direction = 'V'
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FromDesktop:
+		return "desktop"
+	case FromViewer:
+		return "viewer"
+	}
+	return fmt.Sprintf("direction(%d)", d)
+}
+
+//Metadata of the recorded session
+type Metadata struct {
+	Session string `json:"session"`
+	Service string `json:"service"`
+	//Protocol of the desktop xpra or vnc
+	Protocol string    `json:"protocol"`
+	Started  time.Time `json:"started"`
+	//Supporter viewing the desktop when known
+	Supporter string `json:"supporter,omitempty"`
+}
+
+//Chunk of the stream
+type Chunk struct {
+	Direction Direction
+	//Offset since the start of the recording
+	Offset time.Duration
+	Data   []byte
+}
+
+//Writer of a recording, safe for concurrent use
+type Writer struct {
+	mutex   sync.Mutex
+	w       io.WriteCloser
+	started time.Time
+	closed  bool
+	err     error
+}
+
+//NewWriter records on *w* the session of *meta*
+func NewWriter(w io.WriteCloser, meta Metadata) (*Writer, error) {
+	if meta.Started.IsZero() {
+		meta.Started = time.Now()
+	}
+	payload, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(nil), magic...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(magic):], uint32(len(payload)))
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		return nil, err
+	}
+	//time.Now has the monotonic clock, meta.Started may not
+	return &Writer{w: w, started: time.Now()}, nil
+}
+
+//Create a recording of *meta* on *dir*, the name has the session
+//and the time it started
+func Create(dir string, meta Metadata) (*Writer, error) {
+	if meta.Session == "" || filepath.Base(meta.Session) != meta.Session {
+		return nil, errors.New("recording: invalid session")
+	}
+	if meta.Started.IsZero() {
+		meta.Started = time.Now()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, meta.Session+"-"+meta.Started.Format("20060102-150405.000000000")+Ext)
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(file, meta)
+	if err != nil {
+		file.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return w, nil
+}
+
+//Record *b* sent on *direction*
+func (w *Writer) Record(direction Direction, b []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	header := make([]byte, 13)
+	header[0] = byte(direction)
+	binary.BigEndian.PutUint64(header[1:], uint64(time.Since(w.started)))
+	binary.BigEndian.PutUint32(header[9:], uint32(len(b)))
+	if _, err := w.w.Write(header); err != nil {
+		w.err = err
+		return err
+	}
+	_, w.err = w.w.Write(b)
+	return w.err
+}
+
+//Close the recording
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.w.Close()
+}
+
+//Desktop records the stream of *conn* connected to the desktop,
+//what it's read comes from the desktop and what it's written
+//from the viewer
+func (w *Writer) Desktop(conn net.Conn) net.Conn {
+	return &recordedConn{Conn: conn, w: w}
+}
+
+type recordedConn struct {
+	net.Conn
+	w *Writer
+}
+
+func (c *recordedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.w.Record(FromDesktop, b[:n])
+	}
+	return n, err
+}
+
+//Write records *b* before sending it, the answer of the desktop
+//can't be recorded before it
+func (c *recordedConn) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		c.w.Record(FromViewer, b)
+	}
+	return c.Conn.Write(b)
+}
+
+//CloseWrite half-close when the connection support it
+func (c *recordedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("recording: half-close not supported")
+}
+
+//Reader of a recording
+type Reader struct {
+	r        *bufio.Reader
+	Metadata Metadata
+}
+
+//NewReader of the recording on *r*
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+	header := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		return nil, ErrFormat
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, ErrFormat
+	}
+	size := binary.BigEndian.Uint32(header[len(magic):])
+	if size > maxChunk {
+		return nil, ErrFormat
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader.r, payload); err != nil {
+		return nil, ErrFormat
+	}
+	if err := json.Unmarshal(payload, &reader.Metadata); err != nil {
+		return nil, ErrFormat
+	}
+	return reader, nil
+}
+
+//Next chunk, io.EOF at the end of the recording
+func (r *Reader) Next() (Chunk, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Chunk{}, ErrFormat
+		}
+		return Chunk{}, err
+	}
+	size := binary.BigEndian.Uint32(header[9:])
+	if size > maxChunk {
+		return Chunk{}, ErrFormat
+	}
+	chunk := Chunk{
+		Direction: Direction(header[0]),
+		Offset:    time.Duration(binary.BigEndian.Uint64(header[1:])),
+		Data:      make([]byte, size),
+	}
+	if _, err := io.ReadFull(r.r, chunk.Data); err != nil {
+		return Chunk{}, ErrFormat
+	}
+	return chunk, nil
+}
+
+//Play the chunks of the desktop on *w* at their time divided
+//by *speed*, speed 0 plays them without waiting
+func (r *Reader) Play(w io.Writer, speed float64) error {
+	start := time.Now()
+	for {
+		chunk, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if chunk.Direction != FromDesktop {
+			continue
+		}
+		if speed > 0 {
+			at := time.Duration(float64(chunk.Offset) / speed)
+			if wait := at - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package recording
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//buffer in memory closed once
+type buffer struct {
+	bytes.Buffer
+	closed int
+}
+
+func (b *buffer) Close() error {
+	b.closed++
+	return nil
+}
+
+func TestRecording(t *testing.T) {
+	var file buffer
+	started := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	w, err := NewWriter(&file, Metadata{Session: "abc", Service: "nx", Protocol: "vnc",
+		Started: started, Supporter: "maria@helpdesk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record(FromDesktop, []byte("RFB 003.008\n"))
+	time.Sleep(time.Millisecond * 20)
+	w.Record(FromViewer, []byte("RFB 003.008\n"))
+	w.Record(FromDesktop, []byte{1, 2})
+	w.Close()
+	w.Close()
+	if file.closed != 1 {
+		t.Errorf("want closed once get %d", file.closed)
+	}
+	if err := w.Record(FromDesktop, []byte{3}); err != ErrClosed {
+		t.Errorf("want %v get %v", ErrClosed, err)
+	}
+
+	r, err := NewReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Metadata.Session != "abc" || r.Metadata.Protocol != "vnc" ||
+		!r.Metadata.Started.Equal(started) || r.Metadata.Supporter != "maria@helpdesk" {
+		t.Errorf("want metadata get %+v", r.Metadata)
+	}
+
+	var chunks []Chunk
+	for {
+		chunk, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("want 3 chunks get %d", len(chunks))
+	}
+	if chunks[0].Direction != FromDesktop || chunks[1].Direction != FromViewer ||
+		!bytes.Equal(chunks[2].Data, []byte{1, 2}) {
+		t.Errorf("want chunks in order get %+v", chunks)
+	}
+	if chunks[1].Offset < time.Millisecond*20 || chunks[2].Offset < chunks[1].Offset {
+		t.Errorf("want monotonic offsets get %v %v", chunks[1].Offset, chunks[2].Offset)
+	}
+
+	if _, err := NewReader(strings.NewReader("not a recording")); err != ErrFormat {
+		t.Errorf("want %v get %v", ErrFormat, err)
+	}
+}
+
+func TestDesktopConn(t *testing.T) {
+	var file buffer
+	w, err := NewWriter(&file, Metadata{Session: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desktop, local := net.Pipe()
+	conn := w.Desktop(local)
+	go func() {
+		desktop.Write([]byte("frame"))
+		b := make([]byte, 5)
+		io.ReadFull(desktop, b)
+		desktop.Close()
+	}()
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("input"))
+	conn.Close()
+	w.Close()
+
+	r, err := NewReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []Chunk{{Direction: FromDesktop, Data: []byte("frame")},
+		{Direction: FromViewer, Data: []byte("input")}} {
+		chunk, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Direction != want.Direction || !bytes.Equal(chunk.Data, want.Data) {
+			t.Errorf("want %s %q get %s %q", want.Direction, want.Data, chunk.Direction, chunk.Data)
+		}
+	}
+}
+
+func TestPlay(t *testing.T) {
+	var file buffer
+	w, err := NewWriter(&file, Metadata{Session: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record(FromDesktop, []byte("a"))
+	w.Record(FromViewer, []byte("x"))
+	time.Sleep(time.Millisecond * 200)
+	w.Record(FromDesktop, []byte("b"))
+	w.Close()
+	recorded := file.Bytes()
+
+	for _, test := range []struct {
+		speed    float64
+		min, max time.Duration
+	}{
+		{1, time.Millisecond * 200, time.Second},
+		{4, time.Millisecond * 50, time.Millisecond * 190},
+		{0, 0, time.Millisecond * 50},
+	} {
+		r, err := NewReader(bytes.NewReader(recorded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var played bytes.Buffer
+		start := time.Now()
+		if err := r.Play(&played, test.speed); err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		if played.String() != "ab" {
+			t.Errorf("want only the desktop get %q", played.String())
+		}
+		if elapsed < test.min || elapsed > test.max {
+			t.Errorf("speed %v: want between %v and %v get %v", test.speed, test.min, test.max, elapsed)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Create(dir, Metadata{Session: "../abc"}); err == nil {
+		t.Error("want error with invalid session")
+	}
+	started := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	w, err := Create(dir, Metadata{Session: "abc", Started: started})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	names, _ := filepath.Glob(filepath.Join(dir, "abc-20261019-120000*"+Ext))
+	if len(names) != 1 {
+		t.Errorf("want recording with the session and time get %v", names)
+	}
+}
@@ -0,0 +1,498 @@
+package rfb
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+//Relay joins the viewer with the server parsing the protocol
+type Relay struct {
+	//ViewOnly asked on every input of the viewer, keyboard, mouse
+	//and clipboard are dropped when it's true. nil allows them
+	ViewOnly func() bool
+	//OnEncodings called with the encodings asked by the viewer,
+	//the ones the relay can't parse are removed
+	OnEncodings func(encodings []Encoding)
+	//OnInit called with the desktop announced by the server
+	OnInit func(init ServerInit)
+
+	mutex     sync.Mutex
+	format    PixelFormat
+	observers []Observer
+}
+
+//Observe the framebuffer updates sent to the viewer
+func (r *Relay) Observe(o Observer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.observers = append(r.observers, o)
+}
+
+//Join *viewer* with *server* until one of them it's closed
+func (r *Relay) Join(viewer, server io.ReadWriteCloser) error {
+	defer viewer.Close()
+	defer server.Close()
+
+	fromViewer := newReader(viewer)
+	fromServer := newReader(server)
+	if err := r.handshake(fromViewer, viewer, fromServer, server); err != nil {
+		return err
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- r.viewerMessages(fromViewer, server)
+	}()
+	go func() {
+		errc <- r.serverMessages(fromServer, viewer)
+	}()
+	err := <-errc
+	viewer.Close()
+	server.Close()
+	<-errc
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+//forward the message read on *from* to *to*
+func forward(from *reader, to io.Writer) error {
+	if len(from.message()) == 0 {
+		return nil
+	}
+	_, err := to.Write(from.message())
+	from.reset()
+	return err
+}
+
+func (r *Relay) handshake(fromViewer *reader, viewer io.Writer, fromServer *reader, server io.Writer) error {
+	b, err := fromServer.read(12)
+	if err != nil {
+		return err
+	}
+	if _, err := ParseVersion(b); err != nil {
+		return err
+	}
+	if err := forward(fromServer, viewer); err != nil {
+		return err
+	}
+	b, err = fromViewer.read(12)
+	if err != nil {
+		return err
+	}
+	version, err := ParseVersion(b)
+	if err != nil {
+		return err
+	}
+	if err := forward(fromViewer, server); err != nil {
+		return err
+	}
+
+	security, err := r.security(version, fromViewer, viewer, fromServer, server)
+	if err != nil {
+		return err
+	}
+
+	//the result it's sent always since 3.8 and before for VNC authentication
+	if security == SecurityVNC || version.minor() == 8 {
+		result, err := fromServer.uint32()
+		if err != nil {
+			return err
+		}
+		if result != 0 {
+			if version.minor() == 8 {
+				fromServer.text(maxCutText)
+			}
+			forward(fromServer, viewer)
+			return ErrAuth
+		}
+		if err := forward(fromServer, viewer); err != nil {
+			return err
+		}
+	}
+
+	//ClientInit
+	if _, err := fromViewer.read(1); err != nil {
+		return err
+	}
+	if err := forward(fromViewer, server); err != nil {
+		return err
+	}
+
+	//ServerInit
+	b, err = fromServer.read(20)
+	if err != nil {
+		return err
+	}
+	init := ServerInit{
+		Width:  binary.BigEndian.Uint16(b),
+		Height: binary.BigEndian.Uint16(b[2:]),
+		Format: parsePixelFormat(b[4:]),
+	}
+	name, err := fromServer.text(maxCutText)
+	if err != nil {
+		return err
+	}
+	init.Name = string(name)
+	r.setFormat(init.Format)
+	if r.OnInit != nil {
+		r.OnInit(init)
+	}
+	return forward(fromServer, viewer)
+}
+
+//security type chosen, the types the relay can't follow are
+//removed from the offer of the server
+func (r *Relay) security(version Version, fromViewer *reader, viewer io.Writer, fromServer *reader, server io.Writer) (uint8, error) {
+	if version.minor() == 3 {
+		security, err := fromServer.uint32()
+		if err != nil {
+			return 0, err
+		}
+		if security == SecurityInvalid {
+			fromServer.text(maxCutText)
+			forward(fromServer, viewer)
+			return 0, ErrSecurity
+		}
+		if security != SecurityNone && security != SecurityVNC {
+			return 0, ErrSecurity
+		}
+		if err := forward(fromServer, viewer); err != nil {
+			return 0, err
+		}
+		return uint8(security), r.challenge(uint8(security), fromViewer, viewer, fromServer, server)
+	}
+
+	count, err := fromServer.uint8()
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		fromServer.text(maxCutText)
+		forward(fromServer, viewer)
+		return 0, ErrSecurity
+	}
+	types, err := fromServer.read(int(count))
+	if err != nil {
+		return 0, err
+	}
+	var offer []byte
+	for _, security := range types {
+		if security == SecurityNone || security == SecurityVNC {
+			offer = append(offer, security)
+		}
+	}
+	fromServer.reset()
+	if len(offer) == 0 {
+		return 0, ErrSecurity
+	}
+	if _, err := viewer.Write(append([]byte{byte(len(offer))}, offer...)); err != nil {
+		return 0, err
+	}
+
+	security, err := fromViewer.uint8()
+	if err != nil {
+		return 0, err
+	}
+	if security != SecurityNone && security != SecurityVNC {
+		return 0, ErrSecurity
+	}
+	if err := forward(fromViewer, server); err != nil {
+		return 0, err
+	}
+	return security, r.challenge(security, fromViewer, viewer, fromServer, server)
+}
+
+//challenge and response of the VNC authentication
+func (r *Relay) challenge(security uint8, fromViewer *reader, viewer io.Writer, fromServer *reader, server io.Writer) error {
+	if security != SecurityVNC {
+		return nil
+	}
+	if _, err := fromServer.read(16); err != nil {
+		return err
+	}
+	if err := forward(fromServer, viewer); err != nil {
+		return err
+	}
+	if _, err := fromViewer.read(16); err != nil {
+		return err
+	}
+	return forward(fromViewer, server)
+}
+
+func (r *Relay) setFormat(format PixelFormat) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.format = format
+}
+
+func (r *Relay) viewOnly() bool {
+	return r.ViewOnly != nil && r.ViewOnly()
+}
+
+//viewerMessages relayed to the server
+func (r *Relay) viewerMessages(from *reader, server io.Writer) error {
+	for {
+		kind, err := from.uint8()
+		if err != nil {
+			return err
+		}
+
+		input := false
+		switch kind {
+		case msgSetPixelFormat:
+			b, err := from.read(19)
+			if err != nil {
+				return err
+			}
+			r.setFormat(parsePixelFormat(b[3:]))
+		case msgSetEncodings:
+			if err := r.setEncodings(from); err != nil {
+				return err
+			}
+		case msgFramebufferUpdateRequest:
+			_, err = from.read(9)
+		case msgKeyEvent:
+			_, err = from.read(7)
+			input = true
+		case msgPointerEvent:
+			_, err = from.read(5)
+			input = true
+		case msgClientCutText:
+			if _, err = from.read(3); err == nil {
+				_, err = from.text(maxCutText)
+			}
+			input = true
+		default:
+			return ErrMessage
+		}
+		if err != nil {
+			return err
+		}
+
+		if input && r.viewOnly() {
+			from.reset()
+			continue
+		}
+		if err := forward(from, server); err != nil {
+			return err
+		}
+	}
+}
+
+//setEncodings rewrite the message without the unknown encodings
+func (r *Relay) setEncodings(from *reader) error {
+	if _, err := from.read(1); err != nil {
+		return err
+	}
+	count, err := from.uint16()
+	if err != nil {
+		return err
+	}
+	b, err := from.read(int(count) * 4)
+	if err != nil {
+		return err
+	}
+
+	var encodings []Encoding
+	for i := 0; i < len(b); i += 4 {
+		encoding := Encoding(binary.BigEndian.Uint32(b[i:]))
+		if encoding.known() {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if r.OnEncodings != nil {
+		r.OnEncodings(encodings)
+	}
+
+	msg := make([]byte, 4+len(encodings)*4)
+	msg[0] = msgSetEncodings
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(encodings)))
+	for i, encoding := range encodings {
+		binary.BigEndian.PutUint32(msg[4+i*4:], uint32(encoding))
+	}
+	from.replace(msg)
+	return nil
+}
+
+//serverMessages relayed to the viewer
+func (r *Relay) serverMessages(from *reader, viewer io.Writer) error {
+	for {
+		kind, err := from.uint8()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case msgFramebufferUpdate:
+			err = r.framebufferUpdate(from, viewer)
+		case msgSetColourMapEntries:
+			var count uint16
+			if _, err = from.read(3); err == nil {
+				if count, err = from.uint16(); err == nil {
+					_, err = from.read(int(count) * 6)
+				}
+			}
+		case msgBell:
+		case msgServerCutText:
+			if _, err = from.read(3); err == nil {
+				_, err = from.text(maxCutText)
+			}
+		default:
+			return ErrMessage
+		}
+		if err != nil {
+			return err
+		}
+		if err := forward(from, viewer); err != nil {
+			return err
+		}
+	}
+}
+
+//framebufferUpdate forwarded to *viewer* a rectangle at once
+func (r *Relay) framebufferUpdate(from *reader, viewer io.Writer) error {
+	if _, err := from.read(1); err != nil {
+		return err
+	}
+	count, err := from.uint16()
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	update := &Update{Format: r.format}
+	observers := r.observers
+	r.mutex.Unlock()
+	bpp := update.Format.bytesPerPixel()
+	if err := forward(from, viewer); err != nil {
+		return err
+	}
+
+	//0xffff rectangles ends with LastRect
+	for i := 0; count == 0xffff || i < int(count); i++ {
+		b, err := from.read(12)
+		if err != nil {
+			return err
+		}
+		rect := Rectangle{
+			X:        binary.BigEndian.Uint16(b),
+			Y:        binary.BigEndian.Uint16(b[2:]),
+			Width:    binary.BigEndian.Uint16(b[4:]),
+			Height:   binary.BigEndian.Uint16(b[6:]),
+			Encoding: Encoding(binary.BigEndian.Uint32(b[8:])),
+		}
+		if err := rectangleData(from, rect, bpp); err != nil {
+			return err
+		}
+		if err := forward(from, viewer); err != nil {
+			return err
+		}
+		if rect.Encoding == EncodingLastRect {
+			break
+		}
+		update.Rectangles = append(update.Rectangles, rect)
+	}
+
+	for _, observer := range observers {
+		observer(update)
+	}
+	return nil
+}
+
+//rectangleData read the bytes of *rect*
+func rectangleData(from *reader, rect Rectangle, bpp int) error {
+	w, h := int(rect.Width), int(rect.Height)
+	var err error
+	switch rect.Encoding {
+	case EncodingRaw:
+		err = readData(from, w*h*bpp)
+	case EncodingCopyRect:
+		_, err = from.read(4)
+	case EncodingRRE:
+		var count uint32
+		if count, err = from.uint32(); err == nil {
+			err = readData(from, bpp+int(count)*(bpp+8))
+		}
+	case EncodingHextile:
+		err = hextile(from, w, h, bpp)
+	case EncodingZlib, EncodingZRLE:
+		_, err = from.text(maxRectangle)
+	case EncodingCursor:
+		err = readData(from, w*h*bpp+(w+7)/8*h)
+	case EncodingDesktopSize, EncodingLastRect:
+	default:
+		err = ErrEncoding
+	}
+	return err
+}
+
+func readData(from *reader, size int) error {
+	if size > maxRectangle {
+		return ErrTooLarge
+	}
+	_, err := from.read(size)
+	return err
+}
+
+//Hextile subencoding bits
+const (
+	hextileRaw              = 1
+	hextileBackground       = 2
+	hextileForeground       = 4
+	hextileAnySubrects      = 8
+	hextileSubrectsColoured = 16
+)
+
+//hextile tiles of 16x16 pixels
+func hextile(from *reader, w, h, bpp int) error {
+	for y := 0; y < h; y += 16 {
+		th := h - y
+		if th > 16 {
+			th = 16
+		}
+		for x := 0; x < w; x += 16 {
+			tw := w - x
+			if tw > 16 {
+				tw = 16
+			}
+			sub, err := from.uint8()
+			if err != nil {
+				return err
+			}
+			if sub&hextileRaw != 0 {
+				if _, err := from.read(tw * th * bpp); err != nil {
+					return err
+				}
+				continue
+			}
+			size := 0
+			if sub&hextileBackground != 0 {
+				size += bpp
+			}
+			if sub&hextileForeground != 0 {
+				size += bpp
+			}
+			if _, err := from.read(size); err != nil {
+				return err
+			}
+			if sub&hextileAnySubrects == 0 {
+				continue
+			}
+			count, err := from.uint8()
+			if err != nil {
+				return err
+			}
+			subrect := 2
+			if sub&hextileSubrectsColoured != 0 {
+				subrect += bpp
+			}
+			if _, err := from.read(int(count) * subrect); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+//Package rfb understands the Remote Framebuffer protocol (RFC 6143)
+//spoken by VNC, the relay parses the tunnel between the viewer of the
+//supporter and the server of the client to enforce view-only,
+//log the encodings and observe the framebuffer updates.
+package rfb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+var (
+	//ErrVersion the peer don't speak RFB
+	ErrVersion = errors.New("rfb: invalid protocol version")
+	//ErrSecurity security type the relay can't follow
+	ErrSecurity = errors.New("rfb: unsupported security type")
+	//ErrAuth the server refused the viewer
+	ErrAuth = errors.New("rfb: authentication failed")
+	//ErrMessage message the relay don't know
+	ErrMessage = errors.New("rfb: unknown message")
+	//ErrEncoding rectangle with an encoding the relay don't know
+	ErrEncoding = errors.New("rfb: unknown encoding")
+	//ErrTooLarge message over the limits of the relay
+	ErrTooLarge = errors.New("rfb: message too large")
+)
+
+//Security types
+const (
+	SecurityInvalid = 0
+	SecurityNone    = 1
+	SecurityVNC     = 2
+)
+
+//Encoding of the rectangles, negative are pseudo-encodings
+type Encoding int32
+
+//Encodings understood by the relay
+const (
+	EncodingRaw         Encoding = 0
+	EncodingCopyRect    Encoding = 1
+	EncodingRRE         Encoding = 2
+	EncodingHextile     Encoding = 5
+	EncodingZlib        Encoding = 6
+	EncodingTight       Encoding = 7
+	EncodingZRLE        Encoding = 16
+	EncodingCursor      Encoding = -239
+	EncodingDesktopSize Encoding = -223
+	EncodingLastRect    Encoding = -224
+)
+
+var encodingNames = map[Encoding]string{
+	EncodingRaw:         "raw",
+	EncodingCopyRect:    "copyrect",
+	EncodingRRE:         "rre",
+	EncodingHextile:     "hextile",
+	EncodingZlib:        "zlib",
+	EncodingTight:       "tight",
+	EncodingZRLE:        "zrle",
+	EncodingCursor:      "cursor",
+	EncodingDesktopSize: "desktop-size",
+	EncodingLastRect:    "last-rect",
+}
+
+func (e Encoding) String() string {
+	if name, ok := encodingNames[e]; ok {
+		return name
+	}
+	switch {
+	case e >= -32 && e <= -23:
+		return "quality-" + strconv.Itoa(int(e+32))
+	case e >= -256 && e <= -247:
+		return "compress-" + strconv.Itoa(int(e+256))
+	}
+	return "encoding(" + strconv.Itoa(int(e)) + ")"
+}
+
+//known the relay can parse its rectangles, or it's a
+//pseudo-encoding without rectangles (quality and compression level)
+func (e Encoding) known() bool {
+	switch e {
+	case EncodingRaw, EncodingCopyRect, EncodingRRE, EncodingHextile,
+		EncodingZlib, EncodingZRLE, EncodingCursor, EncodingDesktopSize, EncodingLastRect:
+		return true
+	}
+	return (e >= -32 && e <= -23) || (e >= -256 && e <= -247)
+}
+
+//Messages of the viewer
+const (
+	msgSetPixelFormat           = 0
+	msgSetEncodings             = 2
+	msgFramebufferUpdateRequest = 3
+	msgKeyEvent                 = 4
+	msgPointerEvent             = 5
+	msgClientCutText            = 6
+)
+
+//Messages of the server
+const (
+	msgFramebufferUpdate   = 0
+	msgSetColourMapEntries = 1
+	msgBell                = 2
+	msgServerCutText       = 3
+)
+
+//maxCutText longest clipboard text relayed
+const maxCutText = 1 << 24
+
+//maxRectangle bytes of a rectangle
+const maxRectangle = 1 << 28
+
+//Version of the protocol as major.minor
+type Version struct {
+	Major, Minor int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+var versionFormat = regexp.MustCompile(`^RFB (\d{3})\.(\d{3})\n$`)
+
+//ParseVersion of the ProtocolVersion message
+func ParseVersion(b []byte) (Version, error) {
+	match := versionFormat.FindSubmatch(b)
+	if match == nil {
+		return Version{}, ErrVersion
+	}
+	major, _ := strconv.Atoi(string(match[1]))
+	minor, _ := strconv.Atoi(string(match[2]))
+	return Version{Major: major, Minor: minor}, nil
+}
+
+//minor used by the peers, unknown versions are 3.3
+func (v Version) minor() int {
+	if v.Major == 3 && (v.Minor == 7 || v.Minor == 8) {
+		return v.Minor
+	}
+	return 3
+}
+
+//PixelFormat of the framebuffer
+type PixelFormat struct {
+	BitsPerPixel uint8
+	Depth        uint8
+	BigEndian    bool
+	TrueColour   bool
+	RedMax       uint16
+	GreenMax     uint16
+	BlueMax      uint16
+	RedShift     uint8
+	GreenShift   uint8
+	BlueShift    uint8
+}
+
+func parsePixelFormat(b []byte) PixelFormat {
+	return PixelFormat{
+		BitsPerPixel: b[0],
+		Depth:        b[1],
+		BigEndian:    b[2] != 0,
+		TrueColour:   b[3] != 0,
+		RedMax:       binary.BigEndian.Uint16(b[4:]),
+		GreenMax:     binary.BigEndian.Uint16(b[6:]),
+		BlueMax:      binary.BigEndian.Uint16(b[8:]),
+		RedShift:     b[10],
+		GreenShift:   b[11],
+		BlueShift:    b[12],
+	}
+}
+
+//bytesPerPixel of the rectangles
+func (p PixelFormat) bytesPerPixel() int {
+	return int(p.BitsPerPixel) / 8
+}
+
+//ServerInit desktop announced by the server
+type ServerInit struct {
+	Width, Height uint16
+	Format        PixelFormat
+	Name          string
+}
+
+//Rectangle of a framebuffer update
+type Rectangle struct {
+	X, Y, Width, Height uint16
+	Encoding            Encoding
+}
+
+//Update of the framebuffer sent by the server, the data of the
+//rectangles it's streamed to the viewer as they're parsed
+type Update struct {
+	Format     PixelFormat
+	Rectangles []Rectangle
+}
+
+//Observer of the framebuffer updates, it must not retain the update
+type Observer func(update *Update)
+
+//maxKept bytes of the buffer kept between messages
+const maxKept = 1 << 16
+
+//reader reads the messages of a peer keeping the bytes to relay
+type reader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{r: bufio.NewReader(r)}
+}
+
+//read *n* bytes appended to the message
+func (r *reader) read(n int) ([]byte, error) {
+	start := len(r.buf)
+	r.buf = append(r.buf, make([]byte, n)...)
+	if _, err := io.ReadFull(r.r, r.buf[start:]); err != nil {
+		return nil, err
+	}
+	return r.buf[start:], nil
+}
+
+func (r *reader) uint8() (uint8, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *reader) uint16() (uint16, error) {
+	b, err := r.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	b, err := r.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+//text with the length before it
+func (r *reader) text(max uint32) ([]byte, error) {
+	size, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if size > max {
+		return nil, ErrTooLarge
+	}
+	return r.read(int(size))
+}
+
+//message read since the last reset
+func (r *reader) message() []byte {
+	return r.buf
+}
+
+//replace the message read by *msg*
+func (r *reader) replace(msg []byte) {
+	r.buf = append(r.buf[:0], msg...)
+}
+
+//reset the message, the buffer of a large one it's released
+func (r *reader) reset() {
+	if cap(r.buf) > maxKept {
+		r.buf = nil
+		return
+	}
+	r.buf = r.buf[:0]
+}
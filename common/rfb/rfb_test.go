@@ -0,0 +1,313 @@
+package rfb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bit4bit/remoton/common/recording"
+)
+
+//chunk of a recorded session, *from* it's S server, V viewer
+//or I input of the viewer
+type chunk struct {
+	from byte
+	data []byte
+}
+
+func readRecording(t *testing.T, name string) []chunk {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []chunk
+	for len(b) > 0 {
+		size := binary.BigEndian.Uint32(b[1:])
+		chunks = append(chunks, chunk{from: b[0], data: b[5 : 5+size]})
+		b = b[5+size:]
+	}
+	return chunks
+}
+
+//replay the recorded chunks through *relay*, the input it's
+//expected to be dropped when *viewOnly*
+func replay(t *testing.T, relay *Relay, chunks []chunk, viewOnly bool) {
+	replayServer(t, relay, chunks, viewOnly, func(conn net.Conn) net.Conn {
+		return conn
+	})
+}
+
+//replayServer replays the chunks with the connection of the relay
+//to the server wrapped by *wrap*
+func replayServer(t *testing.T, relay *Relay, chunks []chunk, viewOnly bool, wrap func(net.Conn) net.Conn) {
+	viewer, viewerRelay := net.Pipe()
+	server, serverRelay := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- relay.Join(viewerRelay, wrap(serverRelay))
+	}()
+
+	for i, c := range chunks {
+		from, to := viewer, server
+		if c.from == 'S' {
+			from, to = server, viewer
+		}
+		written := make(chan error, 1)
+		go func() {
+			_, err := from.Write(c.data)
+			written <- err
+		}()
+		if c.from != 'I' || !viewOnly {
+			got := make([]byte, len(c.data))
+			to.SetReadDeadline(time.Now().Add(time.Second * 5))
+			if _, err := io.ReadFull(to, got); err != nil {
+				t.Fatalf("chunk %d: %v", i, err)
+			}
+			if !bytes.Equal(got, c.data) {
+				t.Fatalf("chunk %d: want %x get %x", i, c.data, got)
+			}
+		}
+		if err := <-written; err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+
+	viewer.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("relay not closed")
+	}
+	server.Close()
+}
+
+func TestRelayRecorded(t *testing.T) {
+	chunks := readRecording(t, "testdata/tigervnc-3.8.rec")
+
+	var mutex sync.Mutex
+	var init ServerInit
+	var encodings []Encoding
+	var updates [][]Encoding
+	var formats []uint8
+	relay := &Relay{
+		OnInit: func(i ServerInit) {
+			init = i
+		},
+		OnEncodings: func(e []Encoding) {
+			encodings = e
+		},
+	}
+	relay.Observe(func(update *Update) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var kinds []Encoding
+		for _, rect := range update.Rectangles {
+			kinds = append(kinds, rect.Encoding)
+		}
+		updates = append(updates, kinds)
+		formats = append(formats, update.Format.BitsPerPixel)
+	})
+	replay(t, relay, chunks, false)
+
+	if init.Name != "remoton desktop" || init.Width != 64 || init.Height != 48 || init.Format.BitsPerPixel != 32 {
+		t.Errorf("want server init get %+v", init)
+	}
+	want := []Encoding{EncodingZRLE, EncodingHextile, EncodingRRE, EncodingCopyRect,
+		EncodingRaw, EncodingCursor, EncodingDesktopSize, EncodingLastRect, -26, -250}
+	if !reflect.DeepEqual(encodings, want) {
+		t.Errorf("want encodings %v get %v", want, encodings)
+	}
+	wantUpdates := [][]Encoding{
+		{EncodingRaw, EncodingCopyRect, EncodingHextile, EncodingRRE},
+		{EncodingCursor, EncodingDesktopSize},
+		{EncodingZRLE},
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(updates, wantUpdates) {
+		t.Errorf("want updates %v get %v", wantUpdates, updates)
+	}
+	for _, bpp := range formats {
+		if bpp != 16 {
+			t.Errorf("want updates on the format of the viewer get %d bpp", bpp)
+		}
+	}
+}
+
+//buffer in memory for a recording
+type buffer struct {
+	bytes.Buffer
+}
+
+func (b *buffer) Close() error {
+	return nil
+}
+
+//observeUpdates of *relay* by their encodings
+func observeUpdates(relay *Relay) func() [][]Encoding {
+	var mutex sync.Mutex
+	var updates [][]Encoding
+	relay.Observe(func(update *Update) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var kinds []Encoding
+		for _, rect := range update.Rectangles {
+			kinds = append(kinds, rect.Encoding)
+		}
+		updates = append(updates, kinds)
+	})
+	return func() [][]Encoding {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return updates
+	}
+}
+
+//TestRelayRecording replays the recording of a relayed session,
+//the viewer repeats the handshake of the recorded one
+func TestRelayRecording(t *testing.T) {
+	var file buffer
+	w, err := recording.NewWriter(&file, recording.Metadata{Session: "abc", Protocol: "vnc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &Relay{}
+	recorded := observeUpdates(relay)
+	replayServer(t, relay, readRecording(t, "testdata/tigervnc-3.8.rec"), false, w.Desktop)
+	w.Close()
+
+	reader, err := recording.NewReader(&file.Buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the chunks are the reads of the relay, the ones on the
+	//same direction are joined to send whole messages
+	var chunks []chunk
+	for {
+		c, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := byte('V')
+		if c.Direction == recording.FromDesktop {
+			from = 'S'
+		}
+		if n := len(chunks); n > 0 && chunks[n-1].from == from {
+			chunks[n-1].data = append(chunks[n-1].data, c.Data...)
+			continue
+		}
+		chunks = append(chunks, chunk{from: from, data: c.Data})
+	}
+
+	relay = &Relay{}
+	replayed := observeUpdates(relay)
+	replay(t, relay, chunks, false)
+	if len(recorded()) != 3 || !reflect.DeepEqual(replayed(), recorded()) {
+		t.Errorf("want updates %v get %v", recorded(), replayed())
+	}
+}
+
+func TestRelayViewOnly(t *testing.T) {
+	for _, name := range []string{"testdata/tigervnc-3.8.rec", "testdata/x11vnc-3.3.rec"} {
+		chunks := readRecording(t, name)
+		replay(t, &Relay{ViewOnly: func() bool { return true }}, chunks, true)
+	}
+}
+
+func TestRelayFilter(t *testing.T) {
+	viewer, viewerRelay := net.Pipe()
+	server, serverRelay := net.Pipe()
+	defer viewer.Close()
+	defer server.Close()
+	var encodings []Encoding
+	go (&Relay{OnEncodings: func(e []Encoding) {
+		encodings = e
+	}}).Join(viewerRelay, serverRelay)
+
+	exchange := func(from, to net.Conn, send, want []byte) {
+		go from.Write(send)
+		got := make([]byte, len(want))
+		to.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.ReadFull(to, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("want %x get %x", want, got)
+		}
+	}
+
+	exchange(server, viewer, []byte("RFB 003.008\n"), []byte("RFB 003.008\n"))
+	exchange(viewer, server, []byte("RFB 003.008\n"), []byte("RFB 003.008\n"))
+	//VeNCrypt and TLS can't be followed
+	exchange(server, viewer, []byte{3, 19, 1, 18}, []byte{1, 1})
+	exchange(viewer, server, []byte{1}, []byte{1})
+	exchange(server, viewer, []byte{0, 0, 0, 0}, []byte{0, 0, 0, 0})
+	exchange(viewer, server, []byte{1}, []byte{1})
+	init := []byte{0, 8, 0, 8, 8, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	exchange(server, viewer, init, init)
+	//tight it's removed
+	exchange(viewer, server,
+		[]byte{2, 0, 0, 2, 0, 0, 0, 7, 0, 0, 0, 0},
+		[]byte{2, 0, 0, 1, 0, 0, 0, 0})
+	if !reflect.DeepEqual(encodings, []Encoding{EncodingRaw}) {
+		t.Errorf("want raw get %v", encodings)
+	}
+}
+
+func TestEncodingString(t *testing.T) {
+	for encoding, want := range map[Encoding]string{
+		EncodingZRLE: "zrle",
+		-26:          "quality-6",
+		-250:         "compress-6",
+		99:           "encoding(99)",
+	} {
+		if encoding.String() != want {
+			t.Errorf("want %s get %s", want, encoding)
+		}
+	}
+}
+
+func TestRelayStreamRectangles(t *testing.T) {
+	viewer, viewerRelay := net.Pipe()
+	server, serverRelay := net.Pipe()
+	defer viewer.Close()
+	defer server.Close()
+	go (&Relay{}).Join(viewerRelay, serverRelay)
+
+	exchange := func(from, to net.Conn, send []byte) {
+		go from.Write(send)
+		got := make([]byte, len(send))
+		to.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := io.ReadFull(to, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, send) {
+			t.Fatalf("want %x get %x", send, got)
+		}
+	}
+
+	exchange(server, viewer, []byte("RFB 003.008\n"))
+	exchange(viewer, server, []byte("RFB 003.008\n"))
+	exchange(server, viewer, []byte{1, 1})
+	exchange(viewer, server, []byte{1})
+	exchange(server, viewer, []byte{0, 0, 0, 0})
+	exchange(viewer, server, []byte{1})
+	exchange(server, viewer, []byte{0, 8, 0, 8, 8, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	//the first rectangle arrives before the server sends the second
+	exchange(server, viewer, []byte{0, 0, 0, 2})
+	exchange(server, viewer, []byte{0, 0, 0, 0, 0, 2, 0, 1, 0, 0, 0, 0, 7, 9})
+	exchange(server, viewer, []byte{0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 5})
+}
@@ -1,21 +1,47 @@
 package common
 
 import (
+	"errors"
 	"net"
+	"net/rpc"
 	"runtime"
 
+	"github.com/bit4bit/remoton"
+	"github.com/bit4bit/remoton/common/control"
 	"github.com/bit4bit/remoton/common/p2p/nat"
+	"github.com/bit4bit/remoton/common/p2p/stun"
+	"github.com/bit4bit/remoton/common/procs"
+	"github.com/bit4bit/remoton/common/sysinfo"
+)
+
+var (
+	errNoExternalIP = errors.New("external ip unknown")
+	errNoMapping    = errors.New("port not mapped on the gateway")
+	errNoView       = errors.New("view-only mode unsupported")
 )
 
 //Capabilities for this client
-type Capabilities struct {
-	//XpraVersion of running client xpra
-	XpraVersion string
-}
+type Capabilities = control.Capabilities
 
 type RemotonClient struct {
 	Capabilities *Capabilities
 	NatIF        nat.Interface
+	//Mapping of the port for direct connections, optional
+	Mapping *nat.Mapping
+	//STUN result of the nat detection, optional
+	STUN *stun.Result
+	//SysInfo source of GetSystemInfo, by default the running system
+	SysInfo sysinfo.Source
+	//Processes of ListProcesses and KillProcess, by default the running system
+	Processes procs.Manager
+	//AllowProcesses consent of the customer to list and kill
+	//processes, denied when nil
+	AllowProcesses func() bool
+	//View view-only mode switched by the customer, unsupported when nil
+	View *control.ViewSwitch
+
+	//viewOnly access granted to the supporter of the connection
+	viewOnly bool
 }
 
 func (c *RemotonClient) GetCapabilities(args struct{}, reply *Capabilities) error {
@@ -23,17 +49,94 @@ func (c *RemotonClient) GetCapabilities(args struct{}, reply *Capabilities) erro
 	return nil
 }
 
-func (c *RemotonClient) GetExternalIP(args struct{}, reply *net.IP) (err error) {
-	*reply, err = c.NatIF.ExternalIP()
-	return
+//GetExternalIP asked to the gateway, or the one seen by the STUN server
+func (c *RemotonClient) GetExternalIP(args struct{}, reply *net.IP) error {
+	if c.NatIF != nil {
+		ip, err := c.NatIF.ExternalIP()
+		if err == nil {
+			*reply = ip
+			return nil
+		}
+	}
+	if c.STUN != nil && c.STUN.Mapped != nil {
+		*reply = c.STUN.Mapped.IP
+		return nil
+	}
+	return errNoExternalIP
 }
 
+//GetExternalPort mapped on the gateway for direct connections
 func (c *RemotonClient) GetExternalPort(args struct{}, reply *int) error {
-	//TODO this need to be dinamic
-	*reply = 9932
+	if c.Mapping == nil {
+		return errNoMapping
+	}
+	*reply = c.Mapping.ExternalPort
+	return nil
+}
+
+//GetNAT kind of nat and public udp address detected with STUN
+func (c *RemotonClient) GetNAT(args struct{}, reply *stun.Result) error {
+	if c.STUN == nil {
+		*reply = stun.Result{NAT: stun.NATUnknown}
+		return nil
+	}
+	*reply = *c.STUN
+	return nil
+}
+
+//GetSystemInfo hostname, versions, hardware and user of the running system
+func (c *RemotonClient) GetSystemInfo(args struct{}, reply *sysinfo.Info) error {
+	source := c.SysInfo
+	if source == nil {
+		source = sysinfo.New()
+	}
+	info, err := source.Info()
+	if err != nil {
+		return err
+	}
+	*reply = *info
 	return nil
 }
 
+//processes manager if the customer allowed it, *kill* it's
+//denied to the supporters allowed only to view
+func (c *RemotonClient) processes(kill bool) (procs.Manager, error) {
+	if c.AllowProcesses == nil || !c.AllowProcesses() {
+		return nil, control.ErrDenied
+	}
+	if kill && c.viewOnly {
+		return nil, control.ErrViewOnly
+	}
+	if c.Processes == nil {
+		return procs.New(), nil
+	}
+	return c.Processes, nil
+}
+
+//ListProcesses running on the system if the customer allowed it
+func (c *RemotonClient) ListProcesses(args struct{}, reply *[]procs.Process) error {
+	manager, err := c.processes(false)
+	if err != nil {
+		return err
+	}
+	processes, err := manager.List()
+	if err != nil {
+		return err
+	}
+	*reply = processes
+	return nil
+}
+
+//KillProcess *pid* if the customer allowed it and the
+//supporter has full access
+func (c *RemotonClient) KillProcess(pid int, reply *struct{}) error {
+	manager, err := c.processes(true)
+	if err != nil {
+		return err
+	}
+	return manager.Kill(pid)
+}
+
 //GetOS of running system it's the same runtime.GOOS
 func (c *RemotonClient) GetOS(args struct{}, reply *string) error {
 	*reply = runtime.GOOS
@@ -45,3 +148,79 @@ func (c *RemotonClient) GetArch(args struct{}, reply *string) error {
 	*reply = runtime.GOARCH
 	return nil
 }
+
+//ServeRPC the control protocol on the connections of *l*,
+//peers speaking gob use the methods of RemotonClient. The
+//supporters allowed only to view can't change the system
+func ServeRPC(l net.Listener, c *RemotonClient) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serveConn(conn)
+	}
+}
+
+//serveConn with the access granted by the customer on *conn*
+func (c *RemotonClient) serveConn(conn net.Conn) {
+	client := *c
+	client.viewOnly = remoton.ViewOnly(conn)
+	legacy := rpc.NewServer()
+	legacy.RegisterName(control.LegacyServiceName, &client)
+	if client.viewOnly {
+		control.ServeViewOnly(conn, remotonProvider{&client}, legacy)
+		return
+	}
+	control.ServeConn(conn, remotonProvider{&client}, legacy)
+}
+
+//remotonProvider answer the control protocol with RemotonClient
+type remotonProvider struct {
+	c *RemotonClient
+}
+
+func (p remotonProvider) Capabilities() control.Capabilities {
+	return *p.c.Capabilities
+}
+
+func (p remotonProvider) Platform() (control.PlatformResponse, error) {
+	return control.PlatformResponse{OS: runtime.GOOS, Arch: runtime.GOARCH}, nil
+}
+
+func (p remotonProvider) Network() (control.NetworkResponse, error) {
+	var res control.NetworkResponse
+	var ip net.IP
+	if p.c.GetExternalIP(struct{}{}, &ip) == nil {
+		res.ExternalIP = ip.String()
+	}
+	p.c.GetExternalPort(struct{}{}, &res.ExternalPort)
+	if p.c.STUN != nil {
+		res.NAT = string(p.c.STUN.NAT)
+		if p.c.STUN.Mapped != nil {
+			res.Mapped = p.c.STUN.Mapped.String()
+		}
+	}
+	return res, nil
+}
+
+func (p remotonProvider) SystemInfo() (*sysinfo.Info, error) {
+	info := &sysinfo.Info{}
+	return info, p.c.GetSystemInfo(struct{}{}, info)
+}
+
+func (p remotonProvider) Processes() ([]procs.Process, error) {
+	var processes []procs.Process
+	return processes, p.c.ListProcesses(struct{}{}, &processes)
+}
+
+func (p remotonProvider) Kill(pid int) error {
+	return p.c.KillProcess(pid, &struct{}{})
+}
+
+func (p remotonProvider) View(revision int) (control.ViewResponse, error) {
+	if p.c.View == nil {
+		return control.ViewResponse{}, errNoView
+	}
+	return p.c.View.Wait(revision, control.ViewWait), nil
+}
@@ -0,0 +1,143 @@
+// Package sysinfo describes the machine of the client for the supporter.
+package sysinfo
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Display geometry of a screen
+type Display struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+}
+
+//Info of the machine, fields are empty when unknown
+type Info struct {
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	//Distro name and version of the distribution
+	Distro string `json:"distro,omitempty"`
+	//Kernel version
+	Kernel   string `json:"kernel,omitempty"`
+	CPUModel string `json:"cpuModel,omitempty"`
+	CPUs     int    `json:"cpus"`
+	//MemoryTotal and MemoryAvailable in bytes
+	MemoryTotal     uint64    `json:"memoryTotal,omitempty"`
+	MemoryAvailable uint64    `json:"memoryAvailable,omitempty"`
+	Displays        []Display `json:"displays,omitempty"`
+	//Uptime in seconds
+	Uptime int64  `json:"uptime,omitempty"`
+	User   string `json:"user,omitempty"`
+	Locale string `json:"locale,omitempty"`
+}
+
+//Source of the information of the running system
+type Source interface {
+	Info() (*Info, error)
+}
+
+//String summary for humans, one field by line
+func (i *Info) String() string {
+	var b bytes.Buffer
+	line := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+
+	line("Hostname", i.Hostname)
+	line("OS", strings.TrimSpace(i.OS+" "+i.Arch))
+	line("Distro", i.Distro)
+	line("Kernel", i.Kernel)
+	cpu := i.CPUModel
+	if i.CPUs > 0 {
+		cpu = strings.TrimSpace(fmt.Sprintf("%d x %s", i.CPUs, i.CPUModel))
+	}
+	line("CPU", cpu)
+	if i.MemoryTotal > 0 {
+		line("Memory", fmt.Sprintf("%d MiB free of %d MiB",
+			i.MemoryAvailable>>20, i.MemoryTotal>>20))
+	}
+	for _, d := range i.Displays {
+		line("Display", fmt.Sprintf("%s %dx%d+%d+%d", d.Name, d.Width, d.Height, d.X, d.Y))
+	}
+	if i.Uptime > 0 {
+		line("Uptime", (time.Duration(i.Uptime) * time.Second).String())
+	}
+	line("User", i.User)
+	line("Locale", i.Locale)
+	return b.String()
+}
+
+//currentUser login name of the process
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	for _, env := range []string{"USER", "USERNAME"} {
+		if name := os.Getenv(env); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+//locale of the environment following the precedence of POSIX
+func locale() string {
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(env); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+//parseXrandr geometry of the connected outputs of `xrandr --query`
+func parseXrandr(out []byte) []Display {
+	var displays []Display
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "connected" {
+			continue
+		}
+		for _, field := range fields[2:] {
+			if d, ok := parseGeometry(field); ok {
+				d.Name = fields[0]
+				displays = append(displays, d)
+				break
+			}
+		}
+	}
+	return displays
+}
+
+//parseGeometry WIDTHxHEIGHT+X+Y
+func parseGeometry(s string) (Display, bool) {
+	var d Display
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return r == 'x' || r == '+'
+	})
+	if len(parts) != 4 || strings.Count(s, "x") != 1 || strings.Count(s, "+") != 2 {
+		return d, false
+	}
+	values := make([]int, 4)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return d, false
+		}
+		values[i] = n
+	}
+	d.Width, d.Height, d.X, d.Y = values[0], values[1], values[2], values[3]
+	return d, true
+}
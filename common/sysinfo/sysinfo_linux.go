@@ -0,0 +1,153 @@
+package sysinfo
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+//Linux information from /proc and /etc/os-release
+type Linux struct {
+	//Root prefix of /proc and /etc, by default "/"
+	Root string
+	//Xrandr output of `xrandr --query`, by default it runs xrandr
+	Xrandr func() ([]byte, error)
+}
+
+//New source for the running system
+func New() Source {
+	return &Linux{}
+}
+
+func (l *Linux) path(name string) string {
+	root := l.Root
+	if root == "" {
+		root = "/"
+	}
+	return filepath.Join(root, name)
+}
+
+func (l *Linux) read(name string) string {
+	data, err := ioutil.ReadFile(l.path(name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+//Info fields that can't be read are left empty
+func (l *Linux) Info() (*Info, error) {
+	info := &Info{
+		OS:     runtime.GOOS,
+		Arch:   runtime.GOARCH,
+		Kernel: l.read("proc/sys/kernel/osrelease"),
+		User:   currentUser(),
+		Locale: locale(),
+	}
+
+	info.Hostname = l.read("proc/sys/kernel/hostname")
+	if info.Hostname == "" {
+		info.Hostname, _ = os.Hostname()
+	}
+	info.Distro = l.distro()
+	info.CPUModel, info.CPUs = l.cpu()
+	info.MemoryTotal, info.MemoryAvailable = l.memory()
+	if fields := strings.Fields(l.read("proc/uptime")); len(fields) > 0 {
+		uptime, _ := strconv.ParseFloat(fields[0], 64)
+		info.Uptime = int64(uptime)
+	}
+	info.Displays = l.displays()
+	return info, nil
+}
+
+//distro PRETTY_NAME of os-release
+func (l *Linux) distro() string {
+	release := parseKeyValues(l.read("etc/os-release"), "=")
+	if name := release["PRETTY_NAME"]; name != "" {
+		return name
+	}
+	return strings.TrimSpace(release["NAME"] + " " + release["VERSION"])
+}
+
+func (l *Linux) cpu() (string, int) {
+	var model string
+	cpus := 0
+	scanner := bufio.NewScanner(strings.NewReader(l.read("proc/cpuinfo")))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "processor":
+			cpus++
+		case "model name":
+			if model == "" {
+				model = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	if cpus == 0 {
+		cpus = runtime.NumCPU()
+	}
+	return model, cpus
+}
+
+//memory total and available in bytes
+func (l *Linux) memory() (uint64, uint64) {
+	meminfo := parseKeyValues(l.read("proc/meminfo"), ":")
+	kb := func(key string) uint64 {
+		fields := strings.Fields(meminfo[key])
+		if len(fields) == 0 {
+			return 0
+		}
+		n, _ := strconv.ParseUint(fields[0], 10, 64)
+		return n * 1024
+	}
+	available := kb("MemAvailable")
+	//kernels before 3.14
+	if available == 0 {
+		available = kb("MemFree") + kb("Buffers") + kb("Cached")
+	}
+	return kb("MemTotal"), available
+}
+
+func (l *Linux) displays() []Display {
+	xrandr := l.Xrandr
+	if xrandr == nil {
+		xrandr = func() ([]byte, error) {
+			return exec.Command("xrandr", "--query").Output()
+		}
+	}
+	out, err := xrandr()
+	if err != nil {
+		return nil
+	}
+	return parseXrandr(out)
+}
+
+//parseKeyValues lines KEY<sep>VALUE, quotes of the values are removed
+func parseKeyValues(data, sep string) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewBufferString(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), sep, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `"'`)
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+	return values
+}
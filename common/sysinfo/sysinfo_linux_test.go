@@ -0,0 +1,105 @@
+package sysinfo
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bit4bit/remoton/common/internal/fakeroot"
+)
+
+const xrandrOutput = `Screen 0: minimum 8 x 8, current 3840 x 1080, maximum 32767 x 32767
+eDP-1 connected primary 1920x1080+0+0 (normal left inverted right x axis y axis) 309mm x 174mm
+   1920x1080     60.02*+
+HDMI-1 connected 1920x1080+1920+0 (normal left inverted right x axis y axis) 527mm x 296mm
+DP-1 disconnected (normal left inverted right x axis y axis)
+VGA-1 connected (normal left inverted right x axis y axis)
+`
+
+func TestParseXrandr(t *testing.T) {
+	want := []Display{
+		{Name: "eDP-1", Width: 1920, Height: 1080},
+		{Name: "HDMI-1", Width: 1920, Height: 1080, X: 1920},
+	}
+	if got := parseXrandr([]byte(xrandrOutput)); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v get %+v", want, got)
+	}
+}
+
+func TestLinux(t *testing.T) {
+	root := fakeroot.Create(t, map[string]string{
+		"etc/os-release": `NAME="Debian GNU/Linux"
+VERSION="9 (stretch)"
+PRETTY_NAME="Debian GNU/Linux 9 (stretch)"
+ID=debian
+`,
+		"proc/sys/kernel/osrelease": "4.9.0-8-amd64\n",
+		"proc/sys/kernel/hostname":  "helpdesk-01\n",
+		"proc/uptime":               "3725.52 7000.10\n",
+		"proc/cpuinfo": `processor	: 0
+model name	: Intel(R) Core(TM) i5-6200U CPU @ 2.30GHz
+
+processor	: 1
+model name	: Intel(R) Core(TM) i5-6200U CPU @ 2.30GHz
+`,
+		"proc/meminfo": `MemTotal:        8046576 kB
+MemFree:          512000 kB
+MemAvailable:    4023288 kB
+`,
+	})
+	defer os.RemoveAll(root)
+
+	source := &Linux{Root: root, Xrandr: func() ([]byte, error) {
+		return []byte(xrandrOutput), nil
+	}}
+	info, err := source.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Hostname != "helpdesk-01" || info.Kernel != "4.9.0-8-amd64" ||
+		info.Distro != "Debian GNU/Linux 9 (stretch)" {
+		t.Errorf("want host, kernel and distro get %+v", info)
+	}
+	if info.CPUs != 2 || !strings.HasPrefix(info.CPUModel, "Intel(R) Core(TM) i5-6200U") {
+		t.Errorf("want 2 cpus get %d %s", info.CPUs, info.CPUModel)
+	}
+	if info.MemoryTotal != 8046576*1024 || info.MemoryAvailable != 4023288*1024 {
+		t.Errorf("want memory from meminfo get %d %d", info.MemoryTotal, info.MemoryAvailable)
+	}
+	if info.Uptime != 3725 || len(info.Displays) != 2 {
+		t.Errorf("want uptime and displays get %d %v", info.Uptime, info.Displays)
+	}
+
+	summary := info.String()
+	for _, want := range []string{"Hostname: helpdesk-01", "Uptime: 1h2m5s",
+		"Display: HDMI-1 1920x1080+1920+0", "Memory: 3928 MiB free of 7857 MiB"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("want %q on summary get\n%s", want, summary)
+		}
+	}
+}
+
+func TestLinuxMissing(t *testing.T) {
+	root := fakeroot.Create(t, map[string]string{
+		"etc/os-release": "NAME=Alpine\nVERSION=3.8\n",
+		"proc/meminfo":   "MemTotal: 1024 kB\nMemFree: 100 kB\nBuffers: 10 kB\nCached: 20 kB\n",
+	})
+	defer os.RemoveAll(root)
+
+	source := &Linux{Root: root, Xrandr: func() ([]byte, error) {
+		return nil, errors.New("no display")
+	}}
+	info, err := source.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Distro != "Alpine 3.8" || info.Hostname == "" || info.CPUs == 0 {
+		t.Errorf("want fallbacks get %+v", info)
+	}
+	if info.MemoryAvailable != 130*1024 || info.Displays != nil {
+		t.Errorf("want available from free memory get %+v", info)
+	}
+}
@@ -0,0 +1,26 @@
+package sysinfo
+
+import (
+	"os"
+	"runtime"
+)
+
+//stub only what the go runtime knows, TODO query the windows api
+type stub struct{}
+
+//New source for the running system
+func New() Source {
+	return stub{}
+}
+
+func (stub) Info() (*Info, error) {
+	hostname, _ := os.Hostname()
+	return &Info{
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		CPUs:     runtime.NumCPU(),
+		User:     currentUser(),
+		Locale:   locale(),
+	}, nil
+}
@@ -0,0 +1,464 @@
+package remoton
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+//Compression algorithms negotiated by NewCompressConn
+const (
+	CompressNone = "none"
+	CompressLZ4  = "lz4"
+	CompressZstd = "zstd"
+)
+
+var (
+	//ErrCompressHandshake the peer don't speak the compression protocol
+	ErrCompressHandshake = errors.New("compress: invalid handshake")
+	//ErrCompressFrame the peer sent a corrupted frame
+	ErrCompressFrame = errors.New("compress: invalid frame")
+)
+
+//compressMagic starts the handshake, last byte it's the version
+var compressMagic = []byte("RMZ\x01")
+
+//compressRank when both peers support more than one algorithm
+//the first one of this list it's used
+var compressRank = []string{CompressZstd, CompressLZ4, CompressNone}
+
+const (
+	//compressFrameSize max uncompressed bytes on a frame
+	compressFrameSize = 64 * 1024
+	//compressMinSize smaller writes are sent uncompressed
+	compressMinSize = 64
+	//compressSample bytes to inspect on adaptive mode
+	compressSample = 512
+	//compressMaxEntropy bits per byte above data it's considered
+	//already compressed
+	compressMaxEntropy = 7.5
+)
+
+const (
+	compressFrameRaw byte = iota
+	compressFramePacked
+)
+
+//CompressOptions configure the compression layer
+type CompressOptions struct {
+	//Algorithms accepted by this peer, by default all of them,
+	//CompressNone it's always accepted
+	Algorithms []string
+	//Adaptive skip compression of payloads that look
+	//already compressed (images, archives, encrypted data)
+	Adaptive bool
+}
+
+//CompressAlgorithms supported by preference
+func CompressAlgorithms() []string {
+	return append([]string(nil), compressRank...)
+}
+
+func (c CompressOptions) algorithms() []string {
+	if len(c.Algorithms) == 0 {
+		return compressRank
+	}
+	return c.Algorithms
+}
+
+//CompressConn net.Conn compressed with the algorithm negotiated with
+//the peer, every write it's sent as one or more frames so it's safe
+//to use on message based protocols
+type CompressConn struct {
+	net.Conn
+	algorithm string
+	adaptive  bool
+	codec     compressCodec
+
+	r      *bufio.Reader
+	rmutex sync.Mutex
+	rbuf   []byte
+	packed []byte
+	plain  []byte
+
+	wmutex sync.Mutex
+	wbuf   []byte
+
+	once   sync.Once
+	closed bool
+}
+
+//NewCompressConn negotiate compression with the peer,
+//both peers must call it, *conn* it's closed on error
+func NewCompressConn(conn net.Conn, opts CompressOptions) (*CompressConn, error) {
+	algorithm, err := compressHandshake(conn, opts.algorithms())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	codec, err := newCompressCodec(algorithm)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &CompressConn{
+		Conn:      conn,
+		algorithm: algorithm,
+		adaptive:  opts.Adaptive,
+		codec:     codec,
+		r:         bufio.NewReader(conn),
+	}, nil
+}
+
+//compressHandshake send our algorithms and read the peer ones,
+//both peers choose the same using compressRank
+func compressHandshake(conn net.Conn, algorithms []string) (string, error) {
+	hello := append([]byte(nil), compressMagic...)
+	hello = append(hello, byte(len(algorithms)))
+	for _, algorithm := range algorithms {
+		if len(algorithm) > math.MaxUint8 {
+			return "", fmt.Errorf("compress: invalid algorithm %s", algorithm)
+		}
+		hello = append(hello, byte(len(algorithm)))
+		hello = append(hello, algorithm...)
+	}
+
+	//write while reading, the peer may be doing the same
+	//over an unbuffered connection
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(hello)
+		errc <- err
+	}()
+
+	peer, err := readCompressHello(conn)
+	if err != nil {
+		return "", err
+	}
+	if err := <-errc; err != nil {
+		return "", err
+	}
+
+	supported := func(list []string, algorithm string) bool {
+		if algorithm == CompressNone {
+			return true
+		}
+		for _, name := range list {
+			if name == algorithm {
+				return true
+			}
+		}
+		return false
+	}
+	for _, algorithm := range compressRank {
+		if supported(algorithms, algorithm) && supported(peer, algorithm) {
+			return algorithm, nil
+		}
+	}
+	return CompressNone, nil
+}
+
+func readCompressHello(r io.Reader) ([]string, error) {
+	header := make([]byte, len(compressMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(compressMagic)], compressMagic) {
+		return nil, ErrCompressHandshake
+	}
+
+	algorithms := make([]string, int(header[len(compressMagic)]))
+	var size [1]byte
+	for i := range algorithms {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		algorithms[i] = string(name)
+	}
+	return algorithms, nil
+}
+
+//Algorithm negotiated with the peer
+func (c *CompressConn) Algorithm() string {
+	return c.algorithm
+}
+
+func (c *CompressConn) Write(b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > compressFrameSize {
+			chunk = chunk[:compressFrameSize]
+		}
+		if err := c.writeFrame(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+//writeFrame header it's kind, uncompressed size and payload size
+func (c *CompressConn) writeFrame(chunk []byte) error {
+	const headerSize = 9
+
+	kind := compressFrameRaw
+	payload := chunk
+	if c.codec != nil && len(chunk) >= compressMinSize &&
+		!(c.adaptive && incompressible(chunk)) {
+		packed, err := c.codec.compress(c.wbuf[:0], chunk)
+		if err != nil {
+			return err
+		}
+		c.wbuf = packed
+		//compression must save something
+		if len(packed) < len(chunk) {
+			kind = compressFramePacked
+			payload = packed
+		}
+	}
+
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(chunk)))
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *CompressConn) Read(b []byte) (int, error) {
+	c.rmutex.Lock()
+	defer c.rmutex.Unlock()
+
+	for len(c.rbuf) == 0 {
+		if c.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *CompressConn) readFrame() error {
+	var header [9]byte
+	if _, err := io.ReadFull(c.r, header[:1]); err != nil {
+		//io.EOF only between frames
+		return err
+	}
+	if _, err := io.ReadFull(c.r, header[1:]); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	size := int(binary.BigEndian.Uint32(header[1:5]))
+	psize := int(binary.BigEndian.Uint32(header[5:9]))
+	if size > compressFrameSize || psize > size {
+		return ErrCompressFrame
+	}
+
+	switch header[0] {
+	case compressFrameRaw:
+		if psize != size {
+			return ErrCompressFrame
+		}
+		c.plain = grow(c.plain, size)
+		if _, err := io.ReadFull(c.r, c.plain); err != nil {
+			return unexpectedEOF(err)
+		}
+	case compressFramePacked:
+		if c.codec == nil {
+			return ErrCompressFrame
+		}
+		c.packed = grow(c.packed, psize)
+		if _, err := io.ReadFull(c.r, c.packed); err != nil {
+			return unexpectedEOF(err)
+		}
+		plain, err := c.codec.decompress(c.plain[:0], c.packed, size)
+		if err != nil {
+			return err
+		}
+		c.plain = plain
+	default:
+		return ErrCompressFrame
+	}
+
+	c.rbuf = c.plain
+	return nil
+}
+
+//CloseWrite the peer reads io.EOF after the last frame
+func (c *CompressConn) CloseWrite() error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	return closeWrite(c.Conn)
+}
+
+//Close the connection and release the codec, pending reads
+//and writes are unblocked
+func (c *CompressConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = c.Conn.Close()
+
+		c.rmutex.Lock()
+		c.wmutex.Lock()
+		c.closed = true
+		if c.codec != nil {
+			c.codec.close()
+		}
+		c.wmutex.Unlock()
+		c.rmutex.Unlock()
+	})
+	return err
+}
+
+func grow(b []byte, size int) []byte {
+	if cap(b) < size {
+		return make([]byte, size)
+	}
+	return b[:size]
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//incompressible estimate the entropy of a sample of *b*,
+//already compressed data it's near 8 bits per byte
+func incompressible(b []byte) bool {
+	if len(b) > compressSample {
+		b = b[:compressSample]
+	}
+
+	var freq [256]int
+	for _, v := range b {
+		freq[v]++
+	}
+
+	entropy := 0.0
+	total := float64(len(b))
+	for _, n := range freq {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / total
+		entropy -= p * math.Log2(p)
+	}
+
+	//small samples can't reach 8 bits
+	max := math.Log2(total)
+	if max > 8 {
+		max = 8
+	}
+	return entropy >= compressMaxEntropy*max/8
+}
+
+//compressCodec compress every frame independently
+type compressCodec interface {
+	compress(dst, src []byte) ([]byte, error)
+	decompress(dst, src []byte, size int) ([]byte, error)
+	close()
+}
+
+func newCompressCodec(algorithm string) (compressCodec, error) {
+	switch algorithm {
+	case CompressNone:
+		return nil, nil
+	case CompressLZ4:
+		return &lz4Codec{w: lz4.NewWriter(nil), r: lz4.NewReader(nil)}, nil
+	case CompressZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(compressFrameSize))
+		if err != nil {
+			enc.Close()
+			return nil, err
+		}
+		return &zstdCodec{enc: enc, dec: dec}, nil
+	}
+	return nil, fmt.Errorf("compress: unsupported algorithm %s", algorithm)
+}
+
+type lz4Codec struct {
+	w *lz4.Writer
+	r *lz4.Reader
+}
+
+func (c *lz4Codec) compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	c.w.Reset(buf)
+	if _, err := c.w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *lz4Codec) decompress(dst, src []byte, size int) ([]byte, error) {
+	c.r.Reset(bytes.NewReader(src))
+	dst = grow(dst, size)
+	if _, err := io.ReadFull(c.r, dst); err != nil {
+		return nil, ErrCompressFrame
+	}
+	return dst, nil
+}
+
+func (c *lz4Codec) close() {}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func (c *zstdCodec) compress(dst, src []byte) ([]byte, error) {
+	return c.enc.EncodeAll(src, dst), nil
+}
+
+func (c *zstdCodec) decompress(dst, src []byte, size int) ([]byte, error) {
+	plain, err := c.dec.DecodeAll(src, dst)
+	if err != nil || len(plain) != size {
+		return nil, ErrCompressFrame
+	}
+	return plain, nil
+}
+
+func (c *zstdCodec) close() {
+	c.enc.Close()
+	c.dec.Close()
+}
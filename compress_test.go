@@ -0,0 +1,251 @@
+package remoton
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//countConn count bytes written on the wire
+type countConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func compressPair(t *testing.T, a, b CompressOptions) (*CompressConn, *CompressConn, *countConn) {
+	ca, cb := net.Pipe()
+	counter := &countConn{Conn: ca}
+
+	type result struct {
+		conn *CompressConn
+		err  error
+	}
+	resc := make(chan result)
+	go func() {
+		conn, err := NewCompressConn(cb, b)
+		resc <- result{conn, err}
+	}()
+	conna, err := NewCompressConn(counter, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := <-resc
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	return conna, res.conn, counter
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want string
+	}{
+		{nil, nil, CompressZstd},
+		{[]string{CompressLZ4, CompressZstd}, nil, CompressZstd},
+		{[]string{CompressLZ4}, nil, CompressLZ4},
+		{[]string{CompressLZ4}, []string{CompressZstd}, CompressNone},
+		{[]string{CompressNone}, nil, CompressNone},
+		{[]string{"brotli"}, []string{"brotli", CompressLZ4}, CompressNone},
+	}
+
+	for _, test := range tests {
+		a, b, _ := compressPair(t,
+			CompressOptions{Algorithms: test.a},
+			CompressOptions{Algorithms: test.b})
+		if a.Algorithm() != test.want || b.Algorithm() != test.want {
+			t.Errorf("%v %v: want %v get %v and %v",
+				test.a, test.b, test.want, a.Algorithm(), b.Algorithm())
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestCompressRoundtrip(t *testing.T) {
+	text := bytes.Repeat([]byte("remoton compress layer "), 20000)
+	random := make([]byte, 200*1024)
+	rand.Read(random)
+
+	for _, algorithm := range []string{CompressNone, CompressLZ4, CompressZstd} {
+		for _, adaptive := range []bool{false, true} {
+			opts := CompressOptions{Algorithms: []string{algorithm}, Adaptive: adaptive}
+			a, b, counter := compressPair(t, opts, opts)
+
+			go func() {
+				a.Write(text)
+				a.Write(random)
+				//net.Pipe don't have half-close
+				a.Close()
+			}()
+			data, err := ioutil.ReadAll(b)
+			if err != nil {
+				t.Fatalf("%s: %s", algorithm, err)
+			}
+			if !bytes.Equal(data, append(append([]byte(nil), text...), random...)) {
+				t.Errorf("%s: corrupted data", algorithm)
+			}
+
+			//text compressed at least 10 times
+			overhead := int64(len(random) + len(text)/10)
+			written := atomic.LoadInt64(&counter.written)
+			if algorithm != CompressNone && written > overhead {
+				t.Errorf("%s: want compressed text get %d bytes on wire", algorithm, written)
+			}
+			if written < int64(len(random)) {
+				t.Errorf("%s: random data can't be compressed", algorithm)
+			}
+			a.Close()
+			b.Close()
+		}
+	}
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	if !incompressible(random) {
+		t.Error("want random data incompressible")
+	}
+	if incompressible(bytes.Repeat([]byte("abcd"), 1024)) {
+		t.Error("want text compressible")
+	}
+}
+
+func TestCompressHandshakeInvalid(t *testing.T) {
+	ca, cb := net.Pipe()
+	go func() {
+		cb.Write([]byte("GET / HTTP/1.1\r\n"))
+		io.Copy(ioutil.Discard, cb)
+	}()
+
+	_, err := NewCompressConn(ca, CompressOptions{})
+	if err != ErrCompressHandshake {
+		t.Errorf("want %v get %v", ErrCompressHandshake, err)
+	}
+	//closed on error
+	if _, err := cb.Write([]byte("x")); err == nil {
+		t.Error("want connection closed")
+	}
+}
+
+func TestCompressErrors(t *testing.T) {
+	a, b, _ := compressPair(t, CompressOptions{}, CompressOptions{})
+
+	//close unblock pending reads
+	errc := make(chan error)
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		errc <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	b.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("want error after close")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("read not unblocked by close")
+	}
+	if _, err := a.Write([]byte("lost")); err == nil {
+		t.Error("want error writing to closed peer")
+	}
+	a.Close()
+
+	//peer gone in the middle of a frame
+	ca, cb := net.Pipe()
+	go func() {
+		cb.Write(append(append([]byte(nil), compressMagic...), 0))
+		readCompressHello(cb)
+		cb.Write([]byte{compressFrameRaw, 0, 0, 0, 10, 0, 0, 0, 10, 'x'})
+		cb.Close()
+	}()
+	conn, err := NewCompressConn(ca, CompressOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(conn); err != io.ErrUnexpectedEOF {
+		t.Errorf("want %v get %v", io.ErrUnexpectedEOF, err)
+	}
+	conn.Close()
+}
+
+func TestSessionCompression(t *testing.T) {
+	ts := httptest.NewTLSServer(NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "testid"
+		}))
+	defer ts.Close()
+
+	rclient := &Client{Prefix: "", TLSConfig: &tls.Config{
+		InsecureSkipVerify: true,
+	}}
+	session, err := rclient.NewSession(ts.URL, "testsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Destroy()
+
+	opt := WithCompression(CompressOptions{Algorithms: []string{CompressLZ4}})
+	listeners := map[string]net.Listener{
+		"ws":  session.Listen("ws", opt),
+		"tcp": session.ListenTCP("tcp", opt),
+	}
+	dials := map[string]func(string, ...DialOption) (net.Conn, error){
+		"ws":  session.Dial,
+		"tcp": session.DialTCP,
+	}
+
+	text := bytes.Repeat([]byte("echo "), 50000)
+	for service, listener := range listeners {
+		go func(l net.Listener) {
+			conn, err := l.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+			conn.(closeWriter).CloseWrite()
+		}(listener)
+
+		conn, err := dials[service](service, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if algorithm := conn.(*CompressConn).Algorithm(); algorithm != CompressLZ4 {
+			t.Errorf("%s: want %v get %v", service, CompressLZ4, algorithm)
+		}
+		go func() {
+			conn.Write(text)
+			conn.(closeWriter).CloseWrite()
+		}()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		data, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Errorf("%s: %s", service, err)
+		}
+		if !bytes.Equal(data, text) {
+			t.Errorf("%s: want %d bytes get %d", service, len(text), len(data))
+		}
+		conn.Close()
+	}
+}
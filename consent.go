@@ -0,0 +1,234 @@
+package remoton
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//Access granted by the customer to the supporter
+type Access byte
+
+//Access levels, a denied connection it's closed
+const (
+	AccessDenied Access = iota
+	AccessViewOnly
+	AccessFull
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessViewOnly:
+		return "view only"
+	case AccessFull:
+		return "full control"
+	}
+	return "denied"
+}
+
+var (
+	//ErrConsentDenied the customer denied the connection
+	ErrConsentDenied = errors.New("consent: denied by the customer")
+	//ErrConsentHandshake the peer don't speak the consent protocol
+	ErrConsentHandshake = errors.New("consent: invalid handshake")
+)
+
+//consentMagic starts the handshake, last byte it's the version
+var consentMagic = []byte("RMA\x01")
+
+//consentTimeout waiting the identity of the supporter
+var consentTimeout = time.Second * 10
+
+//maxIdentitySize of the identity on the handshake
+const maxIdentitySize = 4096
+
+//Identity of the supporter presented to the customer
+type Identity struct {
+	//ID random of the supporter process, the same on all its connections
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Host string `json:"host,omitempty"`
+}
+
+//NewIdentity of the supporter *name* on this process
+func NewIdentity(name string) Identity {
+	id := make([]byte, 8)
+	rand.Read(id)
+	host, _ := os.Hostname()
+	return Identity{ID: hex.EncodeToString(id), Name: name, Host: host}
+}
+
+func (i Identity) String() string {
+	if i.Host == "" {
+		return i.Name
+	}
+	return i.Name + "@" + i.Host
+}
+
+//ConsentRequest of a supporter connecting to a service
+type ConsentRequest struct {
+	Service  string
+	Identity Identity
+}
+
+//Consent asks the customer the access of the supporter,
+//it may block until the customer answers
+type Consent func(req ConsentRequest) Access
+
+//RememberConsent asks *ask* once per supporter, the next connections
+//of the same identity get the same access. The questions are made
+//one at a time so the supporter opening many connections it's asked once
+func RememberConsent(ask Consent) Consent {
+	var mutex sync.Mutex
+	granted := make(map[string]Access)
+	return func(req ConsentRequest) Access {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if access, ok := granted[req.Identity.ID]; ok {
+			return access
+		}
+		access := ask(req)
+		granted[req.Identity.ID] = access
+		return access
+	}
+}
+
+//WithIdentity present *identity* to the customer on Dial,
+//the listener must use WithConsent
+func WithIdentity(identity Identity) DialOption {
+	return func(c *dialOptions) {
+		c.identity = &identity
+	}
+}
+
+//WithConsent ask *consent* before accepting every connection
+//of Listen, the dialer must use WithIdentity. Denied connections
+//are closed and Accept waits the next one
+func WithConsent(consent Consent) DialOption {
+	return func(c *dialOptions) {
+		c.consent = consent
+	}
+}
+
+//ConsentConn connection approved by the customer
+type ConsentConn struct {
+	net.Conn
+	Access   Access
+	Identity Identity
+}
+
+//CloseWrite half-close when the underlying connection support it
+func (c *ConsentConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+//ConsentOf *conn* approved by the customer, false when the
+//connection didn't ask for consent
+func ConsentOf(conn net.Conn) (*ConsentConn, bool) {
+	if pconn, ok := conn.(*P2PConn); ok {
+		conn = pconn.Conn
+	}
+	cconn, ok := conn.(*ConsentConn)
+	return cconn, ok
+}
+
+//ViewOnly *conn* the customer allowed only to view
+func ViewOnly(conn net.Conn) bool {
+	consent, ok := ConsentOf(conn)
+	return ok && consent.Access == AccessViewOnly
+}
+
+//consentRefused errors of the listener that must not stop the Accept
+func consentRefused(err error) bool {
+	return err == ErrConsentDenied || err == ErrConsentHandshake
+}
+
+//requestConsent present *identity* and wait the access granted
+func requestConsent(conn net.Conn, service string, identity Identity) (Access, error) {
+	payload, err := json.Marshal(struct {
+		Service  string   `json:"service"`
+		Identity Identity `json:"identity"`
+	}{service, identity})
+	if err != nil {
+		return AccessDenied, err
+	}
+	if len(payload) > maxIdentitySize {
+		return AccessDenied, errors.New("consent: identity too long")
+	}
+	hello := append([]byte(nil), consentMagic...)
+	hello = append(hello, 0, 0)
+	binary.BigEndian.PutUint16(hello[len(consentMagic):], uint16(len(payload)))
+	if _, err := conn.Write(append(hello, payload...)); err != nil {
+		return AccessDenied, err
+	}
+
+	reply := make([]byte, len(consentMagic)+1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return AccessDenied, ErrConsentDenied
+		}
+		return AccessDenied, err
+	}
+	if !bytes.Equal(reply[:len(consentMagic)], consentMagic) {
+		return AccessDenied, ErrConsentHandshake
+	}
+	access := Access(reply[len(consentMagic)])
+	if access != AccessViewOnly && access != AccessFull {
+		return AccessDenied, ErrConsentDenied
+	}
+	return access, nil
+}
+
+//acceptConsent read the identity of the supporter and answer
+//the access of *consent*
+func acceptConsent(conn net.Conn, service string, consent Consent) (Access, Identity, error) {
+	//a peer without the protocol may wait us to speak first
+	timer := time.AfterFunc(consentTimeout, func() { conn.Close() })
+	header := make([]byte, len(consentMagic)+2)
+	_, err := io.ReadFull(conn, header)
+	var payload []byte
+	if err == nil && bytes.Equal(header[:len(consentMagic)], consentMagic) {
+		size := binary.BigEndian.Uint16(header[len(consentMagic):])
+		if size > maxIdentitySize {
+			err = ErrConsentHandshake
+		} else {
+			payload = make([]byte, size)
+			_, err = io.ReadFull(conn, payload)
+		}
+	} else if err == nil {
+		err = ErrConsentHandshake
+	}
+	stopped := timer.Stop()
+	if err != nil || !stopped {
+		return AccessDenied, Identity{}, ErrConsentHandshake
+	}
+
+	var hello struct {
+		Identity Identity `json:"identity"`
+	}
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		return AccessDenied, Identity{}, ErrConsentHandshake
+	}
+
+	access := consent(ConsentRequest{Service: service, Identity: hello.Identity})
+	if access != AccessViewOnly && access != AccessFull {
+		access = AccessDenied
+	}
+	reply := append(append([]byte(nil), consentMagic...), byte(access))
+	if _, err := conn.Write(reply); err != nil {
+		//the supporter gone it's not an error of the listener
+		return AccessDenied, hello.Identity, ErrConsentHandshake
+	}
+	if access == AccessDenied {
+		return access, hello.Identity, ErrConsentDenied
+	}
+	return access, hello.Identity, nil
+}
@@ -0,0 +1,147 @@
+package remoton
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConsentHandshake(t *testing.T) {
+	supporter := NewIdentity("alice")
+	for _, want := range []Access{AccessFull, AccessViewOnly, AccessDenied} {
+		a, b := net.Pipe()
+		var asked ConsentRequest
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := acceptConsent(b, "nx", func(req ConsentRequest) Access {
+				asked = req
+				return want
+			})
+			errc <- err
+		}()
+
+		access, err := requestConsent(a, "nx", supporter)
+		lerr := <-errc
+		if want == AccessDenied {
+			if err != ErrConsentDenied || lerr != ErrConsentDenied {
+				t.Errorf("want denied get %v and %v", err, lerr)
+			}
+		} else if err != nil || lerr != nil || access != want {
+			t.Errorf("want %v get %v %v %v", want, access, err, lerr)
+		}
+		if asked.Service != "nx" || asked.Identity != supporter {
+			t.Errorf("unexpected request %+v", asked)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestConsentLegacyPeer(t *testing.T) {
+	timeout := consentTimeout
+	consentTimeout = time.Millisecond * 50
+	defer func() { consentTimeout = timeout }()
+
+	//the peer waits the server to speak first like RFB
+	a, b := net.Pipe()
+	defer a.Close()
+	_, _, err := acceptConsent(b, "nx", func(ConsentRequest) Access {
+		t.Error("legacy peer must not be asked")
+		return AccessFull
+	})
+	if err != ErrConsentHandshake {
+		t.Errorf("want %v get %v", ErrConsentHandshake, err)
+	}
+}
+
+func TestSessionConsent(t *testing.T) {
+	ts := httptest.NewTLSServer(NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "consentid"
+		}))
+	defer ts.Close()
+
+	rclient := &Client{Prefix: "", TLSConfig: &tls.Config{
+		InsecureSkipVerify: true,
+	}}
+	session, err := rclient.NewSession(ts.URL, "testsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Destroy()
+
+	intruder, supporter := NewIdentity("mallory"), NewIdentity("alice")
+	listener := session.Listen("chat", WithConsent(func(req ConsentRequest) Access {
+		if req.Identity.ID == supporter.ID {
+			return AccessViewOnly
+		}
+		return AccessDenied
+	}), WithCompression(CompressOptions{}))
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}()
+
+	if _, err := session.Dial("chat", WithIdentity(intruder), WithCompression(CompressOptions{})); err != ErrConsentDenied {
+		t.Errorf("want %v get %v", ErrConsentDenied, err)
+	}
+	conn, err := session.Dial("chat", WithIdentity(supporter), WithCompression(CompressOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if consent, ok := ConsentOf(conn); !ok || consent.Access != AccessViewOnly {
+		t.Errorf("want view only get %+v", consent)
+	}
+
+	var lconn net.Conn
+	select {
+	case lconn = <-accepted:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting accept")
+	}
+	defer lconn.Close()
+	consent, ok := ConsentOf(lconn)
+	if !ok || consent.Identity != supporter || consent.Access != AccessViewOnly {
+		t.Errorf("unexpected consent %+v", consent)
+	}
+	conn.Write([]byte("hola\n"))
+	line, _ := bufio.NewReader(lconn).ReadString('\n')
+	if line != "hola\n" {
+		t.Errorf("unexpected data %q", line)
+	}
+}
+
+func TestRememberConsent(t *testing.T) {
+	asked := 0
+	consent := RememberConsent(func(req ConsentRequest) Access {
+		asked++
+		if req.Identity.Name == "alice" {
+			return AccessFull
+		}
+		return AccessDenied
+	})
+	alice, bob := NewIdentity("alice"), NewIdentity("bob")
+	for _, service := range []string{"nx", "rpc", "chat"} {
+		if access := consent(ConsentRequest{Service: service, Identity: alice}); access != AccessFull {
+			t.Errorf("want %v get %v", AccessFull, access)
+		}
+		if access := consent(ConsentRequest{Service: service, Identity: bob}); access != AccessDenied {
+			t.Errorf("want %v get %v", AccessDenied, access)
+		}
+	}
+	if asked != 2 {
+		t.Errorf("want asked once per supporter get %d", asked)
+	}
+}
@@ -0,0 +1,91 @@
+//Package desktop shares the screen of the client with the supporter,
+//every backend speaks a desktop protocol of the control package
+//(xpra or vnc) and the peers choose one with the capabilities.
+package desktop
+
+import (
+	"errors"
+
+	"github.com/bit4bit/remoton/common/control"
+)
+
+var (
+	//ErrNoBackend the desktop protocol agreed has no backend here
+	ErrNoBackend = errors.New("desktop: no backend for the protocol")
+	//ErrNotRunning the backend wasn't started
+	ErrNotRunning = errors.New("desktop: backend not running")
+)
+
+//Backend server of the desktop on the client and viewer on the supporter
+type Backend interface {
+	//Protocol of control spoken by the backend
+	Protocol() string
+	//CanServe the server of the desktop it's installed
+	CanServe() bool
+	//CanAttach the viewer it's installed
+	CanAttach() bool
+	//Version of the program of the backend, empty when unknown
+	Version() string
+
+	SetPassword(password string)
+	//SetViewOnly used on the next Serve, Attach or Restart
+	SetViewOnly(viewOnly bool)
+
+	//Serve the desktop of this machine, the viewers connect to Addr
+	Serve(addr string) error
+	//Addr where the desktop it's served
+	Addr() string
+	//Attach the viewer to the desktop served on *addr*
+	Attach(addr string) error
+	//Restart the server or viewer with the current options
+	Restart() error
+	Terminate()
+}
+
+//Profiler backend with profiles of encoding and quality of the
+//viewer, see the profiles of the xpra package
+type Profiler interface {
+	//SetProfile used on the next Attach or Restart
+	SetProfile(name string, overrides map[string]string) error
+	Profile() string
+}
+
+//Backends known by preference, CanServe and CanAttach tell
+//if they are installed
+func Backends() []Backend {
+	return []Backend{NewXpra(), NewVNC()}
+}
+
+//ServerCapabilities desktop protocols served by *backends*
+func ServerCapabilities(backends ...Backend) control.Capabilities {
+	return capabilities(backends, Backend.CanServe)
+}
+
+//ViewerCapabilities desktop protocols viewed by *backends*
+func ViewerCapabilities(backends ...Backend) control.Capabilities {
+	return capabilities(backends, Backend.CanAttach)
+}
+
+func capabilities(backends []Backend, installed func(Backend) bool) control.Capabilities {
+	var caps control.Capabilities
+	for _, backend := range backends {
+		if !installed(backend) {
+			continue
+		}
+		if backend.Protocol() == control.ProtocolXpra {
+			caps.XpraVersion = backend.Version()
+		}
+		caps.Protocols = append(caps.Protocols, backend.Protocol())
+	}
+	return caps
+}
+
+//Choose the backend of *protocol* agreed with the peer
+func Choose(protocol string, backends ...Backend) (Backend, error) {
+	for _, backend := range backends {
+		if backend.Protocol() == protocol {
+			return backend, nil
+		}
+	}
+	return nil, ErrNoBackend
+}
@@ -0,0 +1,119 @@
+package desktop
+
+import (
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bit4bit/remoton/common/control"
+)
+
+//dummyRFB server greeting every connection with *greeting*
+func dummyRFB(t *testing.T, greeting string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(greeting))
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestVNCServer(t *testing.T) {
+	l := dummyRFB(t, "RFB 003.008\n")
+	defer l.Close()
+
+	v := &VNC{Server: l.Addr().String()}
+	if !v.CanServe() || v.CanAttach() {
+		t.Errorf("want serve without viewer")
+	}
+	if err := v.Serve("localhost:6900"); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Terminate()
+	if v.Addr() != l.Addr().String() {
+		t.Errorf("want served on %s get %s", l.Addr(), v.Addr())
+	}
+	if v.Version() != "3.8" {
+		t.Errorf("want RFB 3.8 get %q", v.Version())
+	}
+	if err := v.Restart(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVNCNotRFB(t *testing.T) {
+	l := dummyRFB(t, "HTTP/1.1 400\r\n")
+	defer l.Close()
+
+	v := &VNC{Server: l.Addr().String()}
+	if err := v.Serve("localhost:6900"); err != ErrNotRFB {
+		t.Errorf("want %v get %v", ErrNotRFB, err)
+	}
+}
+
+func TestVNCServeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	defer func(timeout time.Duration) { serveTimeout = timeout }(serveTimeout)
+	serveTimeout = time.Millisecond * 300
+	v := &VNC{Server: addr}
+	if err := v.Serve("localhost:6900"); err == nil {
+		t.Error("want error without server")
+	}
+}
+
+func TestVNCArgs(t *testing.T) {
+	args := serverArgs("6900", "/tmp/passwd", true)
+	want := []string{"-localhost", "-rfbport", "6900", "-forever", "-shared",
+		"-rfbauth", "/tmp/passwd", "-viewonly"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("want %v get %v", want, args)
+	}
+	args = viewerArgs("localhost:55123", "", false)
+	if !reflect.DeepEqual(args, []string{"localhost::55123"}) {
+		t.Errorf("want port syntax get %v", args)
+	}
+
+	//same file of vncpasswd
+	if got := hex.EncodeToString(rfbPassword("password")); got != "dbd83cfd727a1458" {
+		t.Errorf("want obfuscated password get %s", got)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	vnc := &VNC{Server: "localhost:5900"}
+	backends := []Backend{&Xpra{}, vnc}
+
+	caps := ServerCapabilities(backends...)
+	protocols := caps.Protocols
+	if len(protocols) == 0 || protocols[len(protocols)-1] != control.ProtocolVNC {
+		t.Errorf("want vnc served get %v", protocols)
+	}
+	if caps := ViewerCapabilities(backends...); len(caps.Protocols) > 1 {
+		t.Errorf("want vnc without viewer get %v", caps.Protocols)
+	}
+
+	backend, err := Choose(control.ProtocolVNC, backends...)
+	if err != nil || backend != vnc {
+		t.Errorf("want vnc backend get %v %v", backend, err)
+	}
+	if _, err := Choose("rdp", backends...); err != ErrNoBackend {
+		t.Errorf("want %v get %v", ErrNoBackend, err)
+	}
+}
@@ -0,0 +1,254 @@
+package desktop
+
+import (
+	"crypto/des"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/bit4bit/remoton/common/control"
+)
+
+var (
+	//ErrNotVNC not found on system x11vnc or vncviewer
+	ErrNotVNC = errors.New("desktop: vnc server or viewer not found")
+	//ErrNotRFB the server don't speak RFB
+	ErrNotRFB = errors.New("desktop: not a RFB server")
+)
+
+//serveTimeout waiting the RFB server accepts connections
+var serveTimeout = time.Second * 10
+
+//rfbKey fixed DES key of the VNC password files
+var rfbKey = []byte{0xe8, 0x4a, 0xd6, 0x60, 0xc4, 0x72, 0x1a, 0xe0}
+
+var rfbVersion = regexp.MustCompile(`^RFB (\d{3})\.(\d{3})\n$`)
+
+//VNC backend, the client shares its display with x11vnc or
+//any RFB server and the supporter views it with vncviewer
+type VNC struct {
+	//Server address of a running RFB server shared instead of
+	//x11vnc, the view-only mode it's up to the server
+	Server string
+	//ServerPath x11vnc by default
+	ServerPath string
+	//ViewerPath vncviewer by default
+	ViewerPath string
+
+	passwordFile string
+	viewOnly     bool
+	addr         string
+	addrServe    string
+	addrAttach   string
+	version      string
+	cmd          *exec.Cmd
+}
+
+//NewVNC backend with the programs found on the system
+func NewVNC() *VNC {
+	v := &VNC{}
+	v.ServerPath, _ = exec.LookPath("x11vnc")
+	v.ViewerPath, _ = exec.LookPath("vncviewer")
+	return v
+}
+
+func (v *VNC) Protocol() string {
+	return control.ProtocolVNC
+}
+
+func (v *VNC) CanServe() bool {
+	return v.Server != "" || v.ServerPath != ""
+}
+
+func (v *VNC) CanAttach() bool {
+	return v.ViewerPath != ""
+}
+
+//Version of RFB spoken by the server, empty before Serve
+func (v *VNC) Version() string {
+	return v.version
+}
+
+//SetPassword of the desktop, VNC only use the first 8 characters
+func (v *VNC) SetPassword(password string) {
+	if v.passwordFile != "" {
+		os.Remove(v.passwordFile)
+		v.passwordFile = ""
+	}
+	if password == "" {
+		return
+	}
+	file, err := ioutil.TempFile(os.TempDir(), "passwdvncremoton")
+	if err != nil {
+		panic(err)
+	}
+	file.Write(rfbPassword(password))
+	file.Close()
+	v.passwordFile = file.Name()
+}
+
+func (v *VNC) SetViewOnly(viewOnly bool) {
+	v.viewOnly = viewOnly
+}
+
+//Serve the display with x11vnc on *addr* or check the running Server
+func (v *VNC) Serve(addr string) error {
+	v.addrServe = addr
+	if v.Server != "" {
+		version, err := probeRFB(v.Server, serveTimeout)
+		if err != nil {
+			return err
+		}
+		v.addr, v.version = v.Server, version
+		return nil
+	}
+	if v.ServerPath == "" {
+		return ErrNotVNC
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(v.ServerPath, serverArgs(port, v.passwordFile, v.viewOnly)...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	version, err := probeRFB(addr, serveTimeout)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	v.cmd, v.addr, v.version = cmd, addr, version
+	return nil
+}
+
+func (v *VNC) Addr() string {
+	return v.addr
+}
+
+//Attach vncviewer to *addr*
+func (v *VNC) Attach(addr string) error {
+	if v.ViewerPath == "" {
+		return ErrNotVNC
+	}
+	cmd := exec.Command(v.ViewerPath, viewerArgs(addr, v.passwordFile, v.viewOnly)...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	v.cmd, v.addrAttach = cmd, addr
+	return nil
+}
+
+//Restart the viewer or the server, the viewers attached
+//to the server are disconnected
+func (v *VNC) Restart() error {
+	v.kill()
+	if v.addrAttach != "" {
+		return v.Attach(v.addrAttach)
+	}
+	if v.addrServe != "" {
+		return v.Serve(v.addrServe)
+	}
+	return ErrNotRunning
+}
+
+func (v *VNC) kill() {
+	if v.cmd != nil {
+		v.cmd.Process.Kill()
+		v.cmd.Wait()
+		v.cmd = nil
+	}
+}
+
+func (v *VNC) Terminate() {
+	v.kill()
+	if v.passwordFile != "" {
+		os.Remove(v.passwordFile)
+	}
+}
+
+//serverArgs of x11vnc listening on localhost *port*
+func serverArgs(port, passwordFile string, viewOnly bool) []string {
+	args := []string{"-localhost", "-rfbport", port, "-forever", "-shared"}
+	if passwordFile != "" {
+		args = append(args, "-rfbauth", passwordFile)
+	} else {
+		args = append(args, "-nopw")
+	}
+	if viewOnly {
+		args = append(args, "-viewonly")
+	}
+	return args
+}
+
+//viewerArgs of vncviewer connecting to *addr*
+func viewerArgs(addr, passwordFile string, viewOnly bool) []string {
+	var args []string
+	if passwordFile != "" {
+		args = append(args, "-passwd", passwordFile)
+	}
+	if viewOnly {
+		args = append(args, "-viewonly")
+	}
+	//host::port it's a port, host:display a display
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return append(args, addr)
+	}
+	return append(args, host+"::"+port)
+}
+
+//rfbPassword obfuscated like vncpasswd
+func rfbPassword(password string) []byte {
+	plain := make([]byte, 8)
+	copy(plain, password)
+	block, _ := des.NewCipher(rfbKey)
+	obfuscated := make([]byte, 8)
+	block.Encrypt(obfuscated, plain)
+	return obfuscated
+}
+
+//probeRFB waits the server on *addr* greets with the RFB version
+func probeRFB(addr string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	var err error
+	for time.Now().Before(deadline) {
+		var version string
+		version, err = rfbGreeting(addr, deadline)
+		if err == nil || err == ErrNotRFB {
+			return version, err
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return "", err
+}
+
+func rfbGreeting(addr string, deadline time.Time) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	greeting := make([]byte, 12)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return "", err
+	}
+	match := rfbVersion.FindSubmatch(greeting)
+	if match == nil {
+		return "", ErrNotRFB
+	}
+	major, _ := strconv.Atoi(string(match[1]))
+	minor, _ := strconv.Atoi(string(match[2]))
+	return fmt.Sprintf("%d.%d", major, minor), nil
+}
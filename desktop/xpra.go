@@ -0,0 +1,42 @@
+package desktop
+
+import (
+	"github.com/bit4bit/remoton/common/control"
+	"github.com/bit4bit/remoton/xpra"
+)
+
+//Xpra backend, the client shadows its display with xpra
+type Xpra struct {
+	*xpra.Xpra
+	addr string
+}
+
+//NewXpra backend
+func NewXpra() *Xpra {
+	return &Xpra{Xpra: &xpra.Xpra{Policy: xpra.DefaultPolicy}}
+}
+
+func (x *Xpra) Protocol() string {
+	return control.ProtocolXpra
+}
+
+func (x *Xpra) CanServe() bool {
+	return xpra.Available()
+}
+
+func (x *Xpra) CanAttach() bool {
+	return xpra.Available()
+}
+
+//Serve xpra shadow on *addr*
+func (x *Xpra) Serve(addr string) error {
+	if err := x.Bind(addr); err != nil {
+		return err
+	}
+	x.addr = addr
+	return nil
+}
+
+func (x *Xpra) Addr() string {
+	return x.addr
+}
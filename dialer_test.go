@@ -0,0 +1,127 @@
+package remoton
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+//pipeNetwork in memory network, every dial it's accepted by the listener
+type pipeNetwork struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	dials  int32
+}
+
+func newPipeNetwork() *pipeNetwork {
+	return &pipeNetwork{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *pipeNetwork) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&c.dials, 1)
+	client, server := net.Pipe()
+	select {
+	case c.conns <- server:
+		return client, nil
+	case <-c.closed:
+		return nil, errors.New("pipeNetwork: closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pipeNetwork) Accept() (net.Conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	case <-c.closed:
+		return nil, errors.New("pipeNetwork: closed")
+	}
+}
+
+func (c *pipeNetwork) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *pipeNetwork) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+//TestDialerPipe whole stack over net.Pipe
+func TestDialerPipe(t *testing.T) {
+	network := newPipeNetwork()
+	defer network.Close()
+
+	go http.Serve(network, NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "testid"
+		}))
+
+	rclient := Client{Prefix: "", Dialer: network,
+		Proxy: func(*http.Request) (*url.URL, error) { return nil, nil }}
+
+	session, err := rclient.NewSession("http://remoton.test", "testsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		lws, err := session.Listen("ws").Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(lws, lws)
+	}()
+	go func() {
+		ltcp, err := session.ListenTCP("tcp").Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(ltcp, ltcp)
+	}()
+
+	for service, dial := range map[string]func(string, ...DialOption) (net.Conn, error){
+		"ws":  session.Dial,
+		"tcp": session.DialTCP,
+	} {
+		conn, err := dial(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("echo\n"))
+		data, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		}
+		if strings.TrimSpace(data) != "echo" {
+			t.Errorf("%s: want %v get %v", service, "echo", data)
+		}
+		conn.Close()
+	}
+
+	if n := atomic.LoadInt32(&network.dials); n != 5 {
+		t.Errorf("want %d dials get %d", 5, n)
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"net/rpc"
 
 	"github.com/bit4bit/remoton"
+	"github.com/bit4bit/remoton/common/control"
+	"github.com/bit4bit/remoton/common/jsonrpc2"
+	"github.com/bit4bit/remoton/common/procs"
+	"github.com/bit4bit/remoton/common/sysinfo"
 )
 
 func testCounter() {
@@ -62,12 +66,65 @@ func testRpc() {
 	}
 
 	defer session.Destroy()
-	listener := session.Listen("rpc")
+	listener := session.Listen("arith")
 	println("Listen RPC")
 	arith := new(Arith)
 	srv := rpc.NewServer()
 	srv.Register(arith)
-	srv.Accept(listener)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			panic(err)
+		}
+		go jsonrpc2.ServeConn(srv, conn)
+	}
+}
+
+//testProvider answers the control protocol with fixed values
+type testProvider struct {
+	view *control.ViewSwitch
+}
+
+func (p testProvider) Capabilities() control.Capabilities {
+	return control.Capabilities{XpraVersion: "4.4.6",
+		Protocols: []string{control.ProtocolXpra, control.ProtocolChat, control.ProtocolViewOnly}}
+}
+
+func (p testProvider) Platform() (control.PlatformResponse, error) {
+	return control.PlatformResponse{OS: "linux", Arch: "amd64"}, nil
+}
+
+func (p testProvider) Network() (control.NetworkResponse, error) {
+	return control.NetworkResponse{}, nil
+}
+
+func (p testProvider) SystemInfo() (*sysinfo.Info, error) {
+	return &sysinfo.Info{}, nil
+}
+
+func (p testProvider) Processes() ([]procs.Process, error) {
+	return nil, control.ErrDenied
+}
+
+func (p testProvider) Kill(pid int) error {
+	return control.ErrDenied
+}
+
+func (p testProvider) View(revision int) (control.ViewResponse, error) {
+	return p.view.Wait(revision, control.ViewWait), nil
+}
+
+func testControl() {
+	rclient := remoton.Client{Prefix: "/remoton"}
+	session, err := rclient.NewSession("http://localhost:3000", "public")
+	if err != nil {
+		panic(err)
+	}
+
+	defer session.Destroy()
+	listener := session.Listen("rpc")
+	println("Listen Control")
+	control.Serve(listener, testProvider{view: control.NewViewSwitch(true)}, nil)
 }
 
 func main() {
@@ -81,6 +138,7 @@ func main() {
 	)
 	go testCounter()
 	go testRpc()
+	go testControl()
 	err := http.ListenAndServe(":3000", nil)
 	if err != nil {
 		panic(err)
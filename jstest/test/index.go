@@ -4,9 +4,12 @@ package main
 
 import (
 	"fmt"
-	"net/rpc"
+
+	"net"
 
 	"github.com/bit4bit/remoton"
+	"github.com/bit4bit/remoton/common/control"
+	"github.com/bit4bit/remoton/common/jsonrpc2"
 	"github.com/rusco/qunit"
 )
 
@@ -25,13 +28,14 @@ func main() {
 			session := &remoton.SessionClient{Client: rclient,
 				ID: "test", APIURL: "http://localhost:3000"}
 
-			conn, err := session.Dial("rpc")
+			conn, err := session.Dial("arith")
 			if err != nil {
 				qunit.Ok(false, err.Error())
+				return
 			}
 			defer conn.Close()
 
-			rpcclient := rpc.NewClient(conn)
+			rpcclient := jsonrpc2.NewClient(conn)
 			fmt.Println("remote call")
 			var reply int
 			err = rpcclient.Call("Arith.Multiply", &Args{7, 5}, &reply)
@@ -48,6 +52,37 @@ func main() {
 		}()
 		return nil
 	})
+	qunit.AsyncTest("Control", func() interface{} {
+		qunit.Expect(3)
+		go func() {
+			defer qunit.Start()
+			session := &remoton.SessionClient{Client: rclient,
+				ID: "test", APIURL: "http://localhost:3000"}
+
+			caps := control.Capabilities{XpraVersion: "4.0.6",
+				Protocols: []string{control.ProtocolXpra, control.ProtocolChat, control.ProtocolViewOnly}}
+			ctl, err := control.Dial(func() (net.Conn, error) {
+				return session.Dial("rpc")
+			}, caps)
+			if err != nil {
+				qunit.Ok(false, err.Error())
+				return
+			}
+			defer ctl.Close()
+
+			agreement, err := control.Negotiate(caps, ctl.Peer)
+			if err != nil {
+				qunit.Ok(false, err.Error())
+				return
+			}
+			qunit.Ok(!ctl.Legacy() && agreement.Desktop == control.ProtocolXpra, "Negotiated xpra")
+			platform, err := ctl.Platform()
+			qunit.Ok(err == nil && platform.OS == "linux", "Platform linux")
+			view, err := ctl.View(-1)
+			qunit.Ok(err == nil && view.ViewOnly, "View only")
+		}()
+		return nil
+	})
 	qunit.AsyncTest("Stream", func() interface{} {
 		qunit.Expect(1)
 		go func() {
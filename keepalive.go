@@ -0,0 +1,288 @@
+package remoton
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	//ErrKeepAliveTimeout the peer stop answering the heartbeat
+	ErrKeepAliveTimeout = errors.New("keepalive timeout peer not responding")
+)
+
+const (
+	//headerKeepAlive request heartbeat framing on tcp tunnels
+	headerKeepAlive = "X-Remoton-Keepalive"
+)
+
+//KeepAlive configure dead peer detection on tunnels
+type KeepAlive struct {
+	//Interval between heartbeats, zero disable keepalive
+	Interval time.Duration
+	//Timeout without receiving anything from the peer before
+	//closing the tunnel, by default 3 times Interval
+	Timeout time.Duration
+}
+
+//DefaultKeepAlive used by NewServer
+var DefaultKeepAlive = KeepAlive{Interval: time.Second * 30, Timeout: time.Second * 90}
+
+func (c KeepAlive) enabled() bool {
+	return c.Interval > 0
+}
+
+func (c KeepAlive) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return c.Interval * 3
+	}
+	return c.Timeout
+}
+
+//activityConn remember the last time something was readed
+type activityConn struct {
+	net.Conn
+	last int64
+}
+
+func newActivityConn(conn net.Conn) *activityConn {
+	return &activityConn{Conn: conn, last: time.Now().UnixNano()}
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activityConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *activityConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+}
+
+type pinger interface {
+	Ping() error
+}
+
+//keepAliveConn closes the connection when the peer stop sending
+//data or heartbeats, pinging the peer every interval if pinger given
+type keepAliveConn struct {
+	net.Conn
+	raw    *activityConn
+	pinger pinger
+
+	done chan struct{}
+	once sync.Once
+	err  error
+	//eof peer stop writing so can't check it anymore
+	eof int32
+}
+
+func newKeepAliveConn(conn net.Conn, raw *activityConn, p pinger, conf KeepAlive) *keepAliveConn {
+	c := &keepAliveConn{
+		Conn:   conn,
+		raw:    raw,
+		pinger: p,
+		done:   make(chan struct{}),
+	}
+	go c.watch(conf)
+	return c
+}
+
+func (c *keepAliveConn) watch(conf KeepAlive) {
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&c.eof) == 0 && c.raw.idle() > conf.timeout() {
+				c.close(ErrKeepAliveTimeout)
+				return
+			}
+			if c.pinger != nil {
+				if err := c.pinger.Ping(); err != nil {
+					c.close(err)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *keepAliveConn) close(reason error) error {
+	var err error
+	c.once.Do(func() {
+		c.err = reason
+		close(c.done)
+		//unblock pending writes to dead peer
+		if reason != nil {
+			c.raw.Close()
+		}
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+//Err reason of closing, nil when closed normally
+func (c *keepAliveConn) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *keepAliveConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		atomic.StoreInt32(&c.eof, 1)
+	}
+	if err != nil && c.Err() != nil {
+		err = c.Err()
+	}
+	return n, err
+}
+
+func (c *keepAliveConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil && c.Err() != nil {
+		err = c.Err()
+	}
+	return n, err
+}
+
+func (c *keepAliveConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *keepAliveConn) Close() error {
+	return c.close(nil)
+}
+
+//hijackActivity track activity of the hijacked connection
+type hijackActivity struct {
+	http.ResponseWriter
+	conn *activityConn
+}
+
+func (c *hijackActivity) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := c.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.conn = newActivityConn(conn)
+
+	//keep data already buffered
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	r := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), c.conn)
+	return c.conn, bufio.NewReadWriter(bufio.NewReader(r), brw.Writer), nil
+}
+
+const (
+	frameData byte = iota
+	framePing
+	framePong
+	frameClose
+)
+
+//framedConn heartbeat for tcp tunnels, every write it's
+//sent as a data frame and pings are answered with pongs,
+//a close frame it's the half-close
+type framedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remain int
+	eof    bool
+	wmutex sync.Mutex
+}
+
+func newFramedConn(conn net.Conn, r io.Reader) *framedConn {
+	return &framedConn{Conn: conn, r: bufio.NewReader(r)}
+}
+
+func (c *framedConn) writeFrame(typ byte, b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	buf := make([]byte, 5+len(b))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(b)))
+	copy(buf[5:], b)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *framedConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.writeFrame(frameData, b)
+}
+
+func (c *framedConn) Ping() error {
+	_, err := c.writeFrame(framePing, nil)
+	return err
+}
+
+//CloseWrite the peer will read io.EOF
+func (c *framedConn) CloseWrite() error {
+	_, err := c.writeFrame(frameClose, nil)
+	return err
+}
+
+func (c *framedConn) Read(b []byte) (int, error) {
+	for c.remain == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		var header [5]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint32(header[1:5]))
+		switch header[0] {
+		case frameData:
+			c.remain = size
+		case framePing:
+			if _, err := c.r.Discard(size); err != nil {
+				return 0, err
+			}
+			if _, err := c.writeFrame(framePong, nil); err != nil {
+				return 0, err
+			}
+		case framePong:
+			if _, err := c.r.Discard(size); err != nil {
+				return 0, err
+			}
+		case frameClose:
+			c.eof = true
+		default:
+			return 0, errors.New("framedConn: unknown frame")
+		}
+	}
+
+	if len(b) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.r.Read(b)
+	c.remain -= n
+	return n, err
+}
@@ -0,0 +1,161 @@
+package remoton
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tunnelClosed struct {
+	service string
+	err     error
+}
+
+func keepAliveServer(conf KeepAlive, closed chan tunnelClosed) *httptest.Server {
+	srv := NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "testid"
+		})
+	srv.KeepAlive = conf
+	srv.OnTunnelClose = func(sessionID, service string, err error) {
+		closed <- tunnelClosed{service, err}
+	}
+	return httptest.NewTLSServer(srv)
+}
+
+func keepAliveSession(t *testing.T, ts *httptest.Server, conf KeepAlive) *SessionClient {
+	rclient := &Client{Prefix: "", TLSConfig: &tls.Config{
+		InsecureSkipVerify: true,
+	}, KeepAlive: conf}
+	session, err := rclient.NewSession(ts.URL, "testsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+//TestKeepAliveIdle tunnel survive idle time longer than timeout
+func TestKeepAliveIdle(t *testing.T) {
+	conf := KeepAlive{Interval: time.Millisecond * 20, Timeout: time.Millisecond * 100}
+	closed := make(chan tunnelClosed, 4)
+	ts := keepAliveServer(conf, closed)
+	defer ts.Close()
+
+	session := keepAliveSession(t, ts, conf)
+	defer session.Destroy()
+
+	listeners := map[string]net.Listener{
+		"ws":  session.Listen("ws"),
+		"tcp": session.ListenTCP("tcp"),
+	}
+	dials := map[string]func(string, ...DialOption) (net.Conn, error){
+		"ws":  session.Dial,
+		"tcp": session.DialTCP,
+	}
+
+	for service, listener := range listeners {
+		go func(l net.Listener) {
+			conn, err := l.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(conn, conn)
+		}(listener)
+
+		conn, err := dials[service](service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//heartbeats are handled while reading
+		lines := make(chan string)
+		go func() {
+			data, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Errorf("%s: %s", service, err)
+			}
+			lines <- data
+		}()
+		time.Sleep(conf.Timeout * 2)
+
+		conn.Write([]byte("echo\n"))
+		if data := <-lines; strings.TrimSpace(data) != "echo" {
+			t.Errorf("%s: want %v get %v", service, "echo", data)
+		}
+		conn.Close()
+	}
+}
+
+//TestKeepAliveDeadPeer peer not reading closes both legs
+func TestKeepAliveDeadPeer(t *testing.T) {
+	conf := KeepAlive{Interval: time.Millisecond * 20, Timeout: time.Millisecond * 100}
+	closed := make(chan tunnelClosed, 4)
+	ts := keepAliveServer(conf, closed)
+	defer ts.Close()
+
+	session := keepAliveSession(t, ts, conf)
+	defer session.Destroy()
+	//dead peer never check the server
+	deadSession := keepAliveSession(t, ts, KeepAlive{Interval: time.Hour})
+	deadSession.ID = session.ID
+
+	listeners := map[string]net.Listener{
+		"ws":  session.Listen("ws"),
+		"tcp": session.ListenTCP("tcp"),
+	}
+	dials := map[string]func(string, ...DialOption) (net.Conn, error){
+		"ws":  deadSession.Dial,
+		"tcp": deadSession.DialTCP,
+	}
+
+	for service, listener := range listeners {
+		done := make(chan error)
+		go func(l net.Listener) {
+			conn, err := l.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			_, err = io.Copy(io.Discard, conn)
+			done <- err
+		}(listener)
+
+		conn, err := dials[service](service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%s: listener leg not closed", service)
+		}
+
+		timeout := false
+		for i := 0; i < 2; i++ {
+			select {
+			case c := <-closed:
+				if c.service != service {
+					t.Errorf("want service %s get %s", service, c.service)
+				}
+				if c.err == ErrKeepAliveTimeout {
+					timeout = true
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("%s: tunnel not closed", service)
+			}
+		}
+		if !timeout {
+			t.Errorf("%s: want reason %v", service, ErrKeepAliveTimeout)
+		}
+	}
+}
@@ -0,0 +1,687 @@
+package remoton
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bit4bit/remoton/common/p2p/nat"
+	"github.com/bit4bit/remoton/common/p2p/punch"
+	"github.com/bit4bit/remoton/common/p2p/stun"
+)
+
+//P2PPath how a P2PConn reach the peer
+type P2PPath string
+
+const (
+	//P2PDirect tcp connection between the peers
+	P2PDirect P2PPath = "direct"
+	//P2PRelay tunnel through the server
+	P2PRelay P2PPath = "relay"
+	//P2PUDP udp path opened with hole punching
+	P2PUDP P2PPath = "udp"
+)
+
+const (
+	//p2pSignalSuffix service where candidates are exchanged
+	p2pSignalSuffix = "-p2p"
+	//p2pSignalTimeout wait for the candidates of the peer
+	p2pSignalTimeout = time.Second * 5
+	//p2pMoreTimeout wait the candidates of the peer waiting
+	//the gateway and the STUN server
+	p2pMoreTimeout = time.Second * 15
+	//p2pDirectTimeout default timeout trying a candidate
+	p2pDirectTimeout = time.Second * 3
+	//p2pAnswerTimeout wait the dialer trying our tcp candidates
+	p2pAnswerTimeout = time.Second * 30
+	//p2pPunchTimeout both peers sending until the nats are open
+	p2pPunchTimeout = time.Second * 5
+	//p2pSTUNTimeout every test of the nat detection
+	p2pSTUNTimeout = time.Second
+	//p2pRetryDelay first wait after a failed accept on the server,
+	//it's doubled on every failure up to p2pRetryMax
+	p2pRetryDelay = time.Millisecond * 100
+	p2pRetryMax   = time.Second * 10
+	p2pTokenSize  = 16
+	p2pAccepted   = byte(1)
+)
+
+var (
+	//ErrP2PClosed the listener was closed
+	ErrP2PClosed = errors.New("p2p: listener closed")
+	errP2PToken  = errors.New("p2p: invalid token")
+
+	errNoRendezvous = errors.New("p2p: server without rendezvous")
+)
+
+//P2PConn connection to the peer direct or through the server
+type P2PConn struct {
+	net.Conn
+	//Path chosen to reach the peer
+	Path P2PPath
+}
+
+//CloseWrite half-close when the underlying connection support it
+func (c *P2PConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+//p2pOffer sent by the listener over the signal service
+type p2pOffer struct {
+	//Token the dialer must present on direct connections
+	Token string `json:"token"`
+	//Candidates addresses where the listener accept direct connections
+	Candidates []string `json:"candidates"`
+	//UDP public address of the listener for hole punching
+	UDP string `json:"udp,omitempty"`
+	//Rendezvous used by the listener, dialers without one use it
+	Rendezvous string `json:"rendezvous,omitempty"`
+	//More candidates follow on another offer, the udp goes last
+	More bool `json:"more,omitempty"`
+}
+
+//p2pAnswer sent by the dialer when can't connect to the candidates
+type p2pAnswer struct {
+	//UDP public address of the dialer for hole punching
+	UDP string `json:"udp,omitempty"`
+}
+
+//P2PConfig configure direct connections of ListenP2P
+type P2PConfig struct {
+	//NAT map the direct port on the gateway, when nil only
+	//local network addresses are offered
+	NAT nat.Interface
+	//ListenAddr for direct connections, by default ":0"
+	ListenAddr string
+}
+
+//P2PListener accept connections direct from the peer
+//or through the server
+type P2PListener struct {
+	session *SessionClient
+	service string
+	conf    P2PConfig
+	opts    dialOptions
+	token   string
+
+	direct net.Listener
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+
+	nat      *stun.Result
+	detected chan struct{}
+	mapping  *nat.Mapping
+	mapped   chan struct{}
+}
+
+//ListenP2P listen *service* for DialP2P, the peer connects direct
+//when any of our candidates it's reachable or through the server
+func (c *SessionClient) ListenP2P(service string, conf P2PConfig, opts ...DialOption) (*P2PListener, error) {
+	token := make([]byte, p2pTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	addr := conf.ListenAddr
+	if addr == "" {
+		addr = ":0"
+	}
+	direct, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &P2PListener{
+		session:  c,
+		service:  service,
+		conf:     conf,
+		opts:     newDialOptions(service, opts),
+		token:    hex.EncodeToString(token),
+		direct:   direct,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		detected: make(chan struct{}),
+		mapped:   make(chan struct{}),
+	}
+
+	go l.mapPort()
+	go l.detectNAT()
+	go l.acceptDirect()
+	go l.acceptRelay()
+	go l.acceptSignal()
+	return l, nil
+}
+
+//mapPort map the direct port on the gateway until Close
+func (c *P2PListener) mapPort() {
+	defer close(c.mapped)
+	if c.conf.NAT == nil {
+		return
+	}
+	port := c.direct.Addr().(*net.TCPAddr).Port
+	mapping, err := nat.NewMapping(c.conf.NAT, "TCP", port, "remoton "+c.service)
+	if err == nil {
+		c.mapping = mapping
+	}
+}
+
+//Mapping of the direct port on the gateway, nil without
+//P2PConfig.NAT or when the gateway rejected it
+func (c *P2PListener) Mapping() *nat.Mapping {
+	<-c.mapped
+	return c.mapping
+}
+
+func (c *P2PListener) detectNAT() {
+	defer close(c.detected)
+	res, err := c.session.DetectNAT()
+	if err != nil {
+		res = &stun.Result{NAT: stun.NATUnknown}
+	}
+	c.nat = res
+}
+
+//NAT in front of the listener, it waits the detection
+func (c *P2PListener) NAT() *stun.Result {
+	<-c.detected
+	return c.nat
+}
+
+//candidates addresses where the peer can reach the direct listener
+func (c *P2PListener) candidates() []string {
+	candidates := c.localCandidates()
+	for _, candidate := range c.publicCandidates() {
+		if !containsString(candidates, candidate) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+//localCandidates addresses of the direct listener on the local network
+func (c *P2PListener) localCandidates() []string {
+	laddr := c.direct.Addr().(*net.TCPAddr)
+	port := strconv.Itoa(laddr.Port)
+
+	var candidates []string
+	if !laddr.IP.IsUnspecified() {
+		candidates = append(candidates, c.direct.Addr().String())
+	} else {
+		addrs, _ := net.InterfaceAddrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+				continue
+			}
+			candidates = append(candidates, net.JoinHostPort(ipnet.IP.String(), port))
+		}
+	}
+	return candidates
+}
+
+//publicCandidates addresses of the direct listener mapped on the
+//gateway or without nat, it waits the mapping and the detection
+func (c *P2PListener) publicCandidates() []string {
+	port := strconv.Itoa(c.direct.Addr().(*net.TCPAddr).Port)
+
+	var candidates []string
+	if mapping := c.Mapping(); mapping != nil {
+		if ip, err := mapping.ExternalIP(); err == nil {
+			candidates = append(candidates,
+				net.JoinHostPort(ip.String(), strconv.Itoa(mapping.ExternalPort)))
+		}
+	}
+	//public address without nat
+	if res := c.NAT(); res.NAT == stun.NATOpen {
+		candidate := net.JoinHostPort(res.Mapped.IP.String(), port)
+		if !containsString(candidates, candidate) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+//acceptSignal send our candidates to every dialer
+func (c *P2PListener) acceptSignal() {
+	c.acceptServer(c.session.ListenTCP(c.service+p2pSignalSuffix), func(conn net.Conn) bool {
+		go c.signal(conn)
+		return true
+	})
+}
+
+//acceptServer hand the connections of *l* to *handle* until the
+//listener it's closed or *handle* refuses, the failures of the
+//server are retried with backoff
+func (c *P2PListener) acceptServer(l net.Listener, handle func(conn net.Conn) bool) {
+	delay := p2pRetryDelay
+	for !c.closed() {
+		conn, err := l.Accept()
+		if isGatewayTimeout(err) {
+			continue
+		}
+		if err != nil {
+			select {
+			case <-time.After(delay):
+			case <-c.done:
+				return
+			}
+			if delay *= 2; delay > p2pRetryMax {
+				delay = p2pRetryMax
+			}
+			continue
+		}
+		delay = p2pRetryDelay
+		if c.closed() {
+			conn.Close()
+			return
+		}
+		if !handle(conn) {
+			return
+		}
+	}
+}
+
+//signal offer our candidates and punch when the dialer answer,
+//the local candidates go first without waiting the gateway
+//and the STUN server
+func (c *P2PListener) signal(conn net.Conn) {
+	defer conn.Close()
+
+	enc := json.NewEncoder(conn)
+	local := c.localCandidates()
+	if err := enc.Encode(p2pOffer{Token: c.token, Candidates: local, More: true}); err != nil {
+		return
+	}
+
+	offer := p2pOffer{Token: c.token}
+	for _, candidate := range c.publicCandidates() {
+		if !containsString(local, candidate) {
+			offer.Candidates = append(offer.Candidates, candidate)
+		}
+	}
+	var pc net.PacketConn
+	//behind symmetric nat the dialer can't reach the announced port
+	if c.NAT().NAT.Punchable() {
+		var addr *net.UDPAddr
+		var err error
+		pc, addr, err = c.session.discoverUDP(c.session.Rendezvous)
+		if err == nil {
+			offer.UDP = addr.String()
+			offer.Rendezvous = c.session.Rendezvous
+		}
+	}
+	if err := enc.Encode(offer); err != nil || pc == nil {
+		if pc != nil {
+			pc.Close()
+		}
+		return
+	}
+
+	//dialer try tcp candidates before answer
+	var answer p2pAnswer
+	conn.SetReadDeadline(time.Now().Add(p2pAnswerTimeout))
+	err := json.NewDecoder(conn).Decode(&answer)
+	peer, perr := net.ResolveUDPAddr("udp", answer.UDP)
+	if err != nil || answer.UDP == "" || perr != nil {
+		pc.Close()
+		return
+	}
+
+	uconn, err := punch.Punch(pc, peer, []byte(c.token), p2pPunchTimeout)
+	if err != nil {
+		pc.Close()
+		return
+	}
+	c.deliver(&P2PConn{Conn: uconn, Path: P2PUDP})
+}
+
+//acceptRelay the connections through the server
+func (c *P2PListener) acceptRelay() {
+	c.acceptServer(c.session.ListenTCP(c.service), func(conn net.Conn) bool {
+		return c.deliver(&P2PConn{Conn: conn, Path: P2PRelay})
+	})
+}
+
+func (c *P2PListener) acceptDirect() {
+	for {
+		conn, err := c.direct.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := c.verify(conn); err != nil {
+				conn.Close()
+				return
+			}
+			c.deliver(&P2PConn{Conn: conn, Path: P2PDirect})
+		}()
+	}
+}
+
+//verify only peers of the session know the token
+func (c *P2PListener) verify(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(p2pDirectTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	token := make([]byte, len(c.token))
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(token, []byte(c.token)) != 1 {
+		return errP2PToken
+	}
+	_, err := conn.Write([]byte{p2pAccepted})
+	return err
+}
+
+//isGatewayTimeout nobody dialed while listening
+func isGatewayTimeout(err error) bool {
+	e, ok := err.(ErrHTTP)
+	return ok && e.Code == http.StatusGatewayTimeout
+}
+
+func (c *P2PListener) deliver(conn net.Conn) bool {
+	select {
+	case c.conns <- conn:
+		return true
+	case <-c.done:
+		conn.Close()
+		return false
+	}
+}
+
+func (c *P2PListener) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//Accept next connection of the peer, direct or relayed
+func (c *P2PListener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case conn := <-c.conns:
+			pconn := conn.(*P2PConn)
+			wconn, err := c.opts.wrap(pconn.Conn, nil)
+			if consentRefused(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			pconn.Conn = wconn
+			return pconn, nil
+		case <-c.done:
+			return nil, ErrP2PClosed
+		}
+	}
+}
+
+//Close stop direct connections and remove the mapping on the gateway,
+//the session it's not destroyed
+func (c *P2PListener) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.direct.Close()
+		if mapping := c.Mapping(); mapping != nil {
+			mapping.Close()
+		}
+	})
+	return err
+}
+
+//Addr of the direct listener
+func (c *P2PListener) Addr() net.Addr {
+	return c.direct.Addr()
+}
+
+//DialP2P connect to *service* listened with ListenP2P trying
+//direct tcp connection first, udp hole punching when the server
+//has a rendezvous and falling back to the server
+func (c *SessionClient) DialP2P(service string, opts ...DialOption) (*P2PConn, error) {
+	options := newDialOptions(service, opts)
+
+	if signal, dec, offer, err := c.p2pSignal(service); err == nil {
+		conn := c.dialP2PPeer(signal, dec, offer)
+		signal.Close()
+		if conn != nil {
+			wconn, err := options.wrap(conn.Conn, nil)
+			if err != nil {
+				return nil, err
+			}
+			conn.Conn = wconn
+			return conn, nil
+		}
+	}
+
+	conn, err := options.wrap(c.dialTCP(service, "/dial"))
+	if err != nil {
+		return nil, err
+	}
+	return &P2PConn{Conn: conn, Path: P2PRelay}, nil
+}
+
+//dialP2PPeer try the candidates of *offer* and the ones following
+//on *dec*, the answer it's sent over *signal* so the listener can
+//punch at the same time
+func (c *SessionClient) dialP2PPeer(signal net.Conn, dec *json.Decoder, offer *p2pOffer) *P2PConn {
+	enc := json.NewEncoder(signal)
+
+	for {
+		for _, candidate := range c.directCandidates(offer) {
+			conn, err := c.dialP2PDirect(candidate, offer.Token)
+			if err == nil {
+				enc.Encode(p2pAnswer{})
+				return &P2PConn{Conn: conn, Path: P2PDirect}
+			}
+		}
+		if !offer.More {
+			break
+		}
+		next := &p2pOffer{}
+		signal.SetReadDeadline(time.Now().Add(p2pMoreTimeout))
+		if err := dec.Decode(next); err != nil {
+			return nil
+		}
+		signal.SetReadDeadline(time.Time{})
+		offer = next
+	}
+
+	pc, addr, err := c.punchSocket(offer)
+	if err != nil {
+		enc.Encode(p2pAnswer{})
+		return nil
+	}
+	//the listener punch when receive the answer
+	if err := enc.Encode(p2pAnswer{UDP: addr.String()}); err != nil {
+		pc.Close()
+		return nil
+	}
+	peer, _ := net.ResolveUDPAddr("udp", offer.UDP)
+	conn, err := punch.Punch(pc, peer, []byte(offer.Token), p2pPunchTimeout)
+	if err != nil {
+		pc.Close()
+		return nil
+	}
+	return &P2PConn{Conn: conn, Path: P2PUDP}
+}
+
+//directCandidates of *offer* to dial, none with a proxy
+//because they would bypass it
+func (c *SessionClient) directCandidates(offer *p2pOffer) []string {
+	if c.Proxy != nil {
+		return nil
+	}
+	return offer.Candidates
+}
+
+//punchSocket udp socket for punching when the listener offer it
+func (c *SessionClient) punchSocket(offer *p2pOffer) (net.PacketConn, *net.UDPAddr, error) {
+	if offer.UDP == "" {
+		return nil, nil, errors.New("p2p: peer without udp")
+	}
+	if _, err := net.ResolveUDPAddr("udp", offer.UDP); err != nil {
+		return nil, nil, err
+	}
+	//sessions created by the peer don't know the rendezvous
+	if c.Rendezvous == "" {
+		return c.discoverUDP(offer.Rendezvous)
+	}
+	return c.discoverUDP(c.Rendezvous)
+}
+
+//p2pSignal get the first candidates of the peer, the next ones
+//follow on the decoder. A peer without ListenP2P don't answer
+//so we wait p2pSignalTimeout
+func (c *SessionClient) p2pSignal(service string) (net.Conn, *json.Decoder, *p2pOffer, error) {
+	type result struct {
+		conn  net.Conn
+		dec   *json.Decoder
+		offer *p2pOffer
+		err   error
+	}
+	resc := make(chan result, 1)
+	//the server holds the dial until the peer listens
+	ctx, cancel := context.WithTimeout(context.Background(), p2pSignalTimeout)
+	defer cancel()
+
+	go func() {
+		conn, err := c.dialTCPContext(ctx, service+p2pSignalSuffix, "/dial")
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+
+		var offer p2pOffer
+		dec := json.NewDecoder(conn)
+		conn.SetReadDeadline(time.Now().Add(p2pSignalTimeout))
+		if err := dec.Decode(&offer); err != nil {
+			conn.Close()
+			resc <- result{err: err}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		resc <- result{conn, dec, &offer, nil}
+	}()
+
+	timeout := time.NewTimer(p2pSignalTimeout)
+	defer timeout.Stop()
+	select {
+	case res := <-resc:
+		return res.conn, res.dec, res.offer, res.err
+	case <-timeout.C:
+		//the peer can answer late
+		go func() {
+			if res := <-resc; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, nil, nil, errors.New("p2p: timeout waiting candidates")
+	}
+}
+
+//rendezvousAddr udp address of *rendezvous*, without host
+//it's the host of the server
+func (c *SessionClient) rendezvousAddr(rendezvous string) (string, error) {
+	host, port, err := net.SplitHostPort(rendezvous)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		burl, err := url.Parse(c.APIURL)
+		if err != nil {
+			return "", err
+		}
+		host = burl.Hostname()
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+//discoverUDP open a udp socket and learn its public address
+func (c *SessionClient) discoverUDP(rendezvous string) (net.PacketConn, *net.UDPAddr, error) {
+	if rendezvous == "" {
+		return nil, nil, errNoRendezvous
+	}
+	raddr, err := c.rendezvousAddr(rendezvous)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := stun.Discover(pc, raddr, p2pSignalTimeout)
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	return pc, addr, nil
+}
+
+//DetectNAT ask the STUN server of the session (Rendezvous)
+//the public address and the kind of nat
+func (c *SessionClient) DetectNAT() (*stun.Result, error) {
+	if c.Rendezvous == "" {
+		return nil, errNoRendezvous
+	}
+	raddr, err := c.rendezvousAddr(c.Rendezvous)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	return stun.DetectNAT(pc, raddr, p2pSTUNTimeout)
+}
+
+//dialP2PDirect the candidate *addr* with the dialer of the
+//client and present *token*
+func (c *SessionClient) dialP2PDirect(addr, token string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p2pDirectTimeout)
+	defer cancel()
+	conn, err := c.dialer().DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(p2pDirectTimeout))
+	var ack [1]byte
+	if _, err := io.WriteString(conn, token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, ack[:]); err != nil || ack[0] != p2pAccepted {
+		conn.Close()
+		return nil, errP2PToken
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,385 @@
+package remoton
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bit4bit/remoton/common/p2p/stun"
+)
+
+func p2pSession(t *testing.T, rendezvous string) (*SessionClient, func()) {
+	srv := NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "testid"
+		})
+	srv.Rendezvous = rendezvous
+	ts := httptest.NewTLSServer(srv)
+
+	rclient := &Client{Prefix: "", TLSConfig: &tls.Config{
+		InsecureSkipVerify: true,
+	}}
+	session, err := rclient.NewSession(ts.URL, "testsrv")
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return session, func() {
+		session.Destroy()
+		//unblock pending listeners
+		ts.CloseClientConnections()
+		ts.Close()
+	}
+}
+
+func p2pEcho(t *testing.T, l *P2PListener) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+}
+
+func testP2PPath(t *testing.T, session *SessionClient, service string, want P2PPath) {
+	conn, err := session.DialP2P(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.Path != want {
+		t.Errorf("want path %v get %v", want, conn.Path)
+	}
+	conn.Write([]byte("echo\n"))
+	data, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Error(err)
+	}
+	if strings.TrimSpace(data) != "echo" {
+		t.Errorf("want %v get %v", "echo", data)
+	}
+}
+
+func TestP2PDirect(t *testing.T) {
+	session, done := p2pSession(t, "")
+	defer done()
+
+	l, err := session.ListenP2P("nx", P2PConfig{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	p2pEcho(t, l)
+
+	testP2PPath(t, session, "nx", P2PDirect)
+	testP2PPath(t, session, "nx", P2PDirect)
+}
+
+//addrDialer records the addresses dialed
+type addrDialer struct {
+	net.Dialer
+	mutex sync.Mutex
+	addrs []string
+}
+
+func (d *addrDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mutex.Unlock()
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func (d *addrDialer) dialed(addr string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return containsString(d.addrs, addr)
+}
+
+//TestP2PDirectDialer the candidates are dialed with Client.Dialer
+//and skipped with a proxy
+func TestP2PDirectDialer(t *testing.T) {
+	session, done := p2pSession(t, "")
+	defer done()
+
+	dialer := &addrDialer{}
+	client := *session.Client
+	client.Dialer = dialer
+	dialing := *session
+	dialing.Client = &client
+	proxied := dialing
+	pclient := client
+	pclient.Proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	proxied.Client = &pclient
+
+	l, err := session.ListenP2P("nx", P2PConfig{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	p2pEcho(t, l)
+
+	testP2PPath(t, &dialing, "nx", P2PDirect)
+	if !dialer.dialed(l.Addr().String()) {
+		t.Error("want the candidate dialed with Client.Dialer")
+	}
+	testP2PPath(t, &proxied, "nx", P2PRelay)
+}
+
+func TestP2PRelayFallback(t *testing.T) {
+	session, done := p2pSession(t, "")
+	defer done()
+
+	l, err := session.ListenP2P("nx", P2PConfig{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	p2pEcho(t, l)
+	//candidate offered but unreachable
+	l.direct.Close()
+
+	testP2PPath(t, session, "nx", P2PRelay)
+}
+
+func TestP2PInvalidToken(t *testing.T) {
+	session, done := p2pSession(t, "")
+	defer done()
+
+	l, err := session.ListenP2P("nx", P2PConfig{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	token := strings.Repeat("0", len(l.token))
+	if _, err := session.dialP2PDirect(l.Addr().String(), token); err == nil {
+		t.Error("want direct connection rejected")
+	}
+}
+
+//TestP2PSignalCancel the dial waiting the peer it's interrupted
+//and the server doesn't pair it later
+func TestP2PSignalCancel(t *testing.T) {
+	session, done := p2pSession(t, "")
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	if _, err := session.dialTCPContext(ctx, "nx", "/dial"); err != context.DeadlineExceeded {
+		t.Fatalf("want %v get %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("want dial interrupted get %v", elapsed)
+	}
+	//the server notices the dial gone
+	time.Sleep(time.Millisecond * 100)
+
+	go func() {
+		conn, err := session.ListenTCP("nx").Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	conn, err := session.DialTCP("nx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("echo\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || data != "echo\n" {
+		t.Errorf("want echo get %q %v", data, err)
+	}
+}
+
+func TestP2PUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go (&stun.Server{Primary: pc}).Serve()
+
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	session, done := p2pSession(t, ":"+port)
+	defer done()
+	if session.Rendezvous != ":"+port {
+		t.Errorf("want rendezvous %v get %v", ":"+port, session.Rendezvous)
+	}
+
+	l, err := session.ListenP2P("nx", P2PConfig{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	p2pEcho(t, l)
+	//tcp candidate unreachable
+	l.direct.Close()
+
+	testP2PPath(t, session, "nx", P2PUDP)
+
+	//dialer without rendezvous use the one of the listener
+	dialer := &SessionClient{Client: session.Client, ID: session.ID,
+		APIURL: session.APIURL, hclient: session.hclient}
+	testP2PPath(t, dialer, "nx", P2PUDP)
+}
+
+func TestP2PDetectNAT(t *testing.T) {
+	primary, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	alternate, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alternate.Close()
+	go (&stun.Server{Primary: primary, Alternate: alternate}).Serve()
+
+	session, done := p2pSession(t, primary.LocalAddr().String())
+	defer done()
+
+	res, err := session.DetectNAT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NAT != stun.NATOpen || !res.Mapped.IP.IsLoopback() {
+		t.Errorf("want %v get %v %v", stun.NATOpen, res.NAT, res.Mapped)
+	}
+
+	l, err := session.ListenP2P("nx", P2PConfig{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.NAT().NAT != stun.NATOpen {
+		t.Errorf("want listener %v get %v", stun.NATOpen, l.NAT().NAT)
+	}
+}
+
+//fakeGateway nat.Interface with the direct port already taken
+type fakeGateway struct {
+	mutex    sync.Mutex
+	taken    int
+	mappings map[int]int
+	//hold the mappings until closed when not nil
+	hold chan struct{}
+}
+
+func (g *fakeGateway) AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error {
+	if g.hold != nil {
+		<-g.hold
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if extport == g.taken {
+		return errors.New("conflict")
+	}
+	g.mappings[extport] = intport
+	return nil
+}
+
+func (g *fakeGateway) DeleteMapping(protocol string, extport, intport int) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.mappings, extport)
+	return nil
+}
+
+func (g *fakeGateway) ExternalIP() (net.IP, error) {
+	return net.IPv4(127, 0, 0, 1), nil
+}
+
+func (g *fakeGateway) String() string {
+	return "fake"
+}
+
+func (g *fakeGateway) count() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.mappings)
+}
+
+func TestP2PMapping(t *testing.T) {
+	session, done := p2pSession(t, "")
+	defer done()
+
+	direct, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := direct.Addr().(*net.TCPAddr).Port
+	direct.Close()
+
+	gateway := &fakeGateway{taken: port, mappings: make(map[int]int)}
+	l, err := session.ListenP2P("nx", P2PConfig{NAT: gateway,
+		ListenAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := l.Mapping()
+	if mapping == nil {
+		t.Fatal("want mapping")
+	}
+	if mapping.ExternalPort == port || mapping.InternalPort != port {
+		t.Errorf("want free external port for %d get %d", port, mapping.ExternalPort)
+	}
+	external := net.JoinHostPort("127.0.0.1", strconv.Itoa(mapping.ExternalPort))
+	if !containsString(l.candidates(), external) {
+		t.Errorf("want candidate %v get %v", external, l.candidates())
+	}
+
+	l.Close()
+	if gateway.count() != 0 {
+		t.Error("want mapping removed on close")
+	}
+}
+
+//TestP2PSlowGateway the local candidates are offered
+//without waiting the gateway
+func TestP2PSlowGateway(t *testing.T) {
+	session, done := p2pSession(t, "")
+	defer done()
+
+	gateway := &fakeGateway{mappings: make(map[int]int), hold: make(chan struct{})}
+	l, err := session.ListenP2P("nx", P2PConfig{NAT: gateway, ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	defer close(gateway.hold)
+	p2pEcho(t, l)
+
+	start := time.Now()
+	testP2PPath(t, session, "nx", P2PDirect)
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Errorf("want direct connection without the gateway get %v", elapsed)
+	}
+}
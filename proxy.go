@@ -0,0 +1,205 @@
+package remoton
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func (c *Client) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if c.Proxy != nil {
+		return c.Proxy
+	}
+	return http.ProxyFromEnvironment
+}
+
+func (c *Client) dialer() Dialer {
+	if c.Dialer != nil {
+		return c.Dialer
+	}
+	return &net.Dialer{}
+}
+
+//proxyDialer adapts Dialer to proxy.Dialer
+type proxyDialer struct {
+	Dialer
+}
+
+func (c proxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+func (c *Client) tlsConfig(serverName string) *tls.Config {
+	var conf *tls.Config
+	if c.TLSConfig == nil {
+		conf = &tls.Config{}
+	} else {
+		conf = c.TLSConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = serverName
+	}
+	return conf
+}
+
+//dialURL open a connection to the host of *u* going through
+//the proxy when needed, the connection it's secured with TLS
+//for https and wss schemes
+func (c *Client) dialURL(u *url.URL) (net.Conn, error) {
+	return c.dialURLContext(context.Background(), u)
+}
+
+//dialURLContext like dialURL, *ctx* interrupts the dial
+//and the TLS handshake
+func (c *Client) dialURLContext(ctx context.Context, u *url.URL) (net.Conn, error) {
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	addr := canonicalAddr(u)
+
+	//proxy selection from environment only knows http and https
+	purl := *u
+	if secure {
+		purl.Scheme = "https"
+	} else {
+		purl.Scheme = "http"
+	}
+	proxyURL, err := c.proxyFunc()(&http.Request{URL: &purl, Header: make(http.Header)})
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if proxyURL == nil {
+		conn, err = c.dialer().DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialProxy(ctx, c.dialer(), proxyURL, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if secure {
+		host, _, _ := net.SplitHostPort(addr)
+		tconn := tls.Client(conn, c.tlsConfig(host))
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tconn, nil
+	}
+	return conn, nil
+}
+
+//dialProxy connect to *addr* through *proxyURL*, *ctx*
+//interrupts the dial and the handshake with the proxy
+func dialProxy(ctx context.Context, dialer Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", canonicalAddr(proxyURL), auth, proxyDialer{dialer})
+		if err != nil {
+			return nil, err
+		}
+		//the handshake takes the deadline of ctx
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http", "https":
+		return dialConnect(ctx, dialer, proxyURL, addr)
+	}
+	return nil, fmt.Errorf("dialProxy: unsupported proxy scheme %s", proxyURL.Scheme)
+}
+
+//dialConnect open a tunnel using HTTP CONNECT
+func dialConnect(ctx context.Context, dialer Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	paddr := canonicalAddr(proxyURL)
+	conn, err := dialer.DialContext(ctx, "tcp", paddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if proxyURL.Scheme == "https" {
+		host, _, _ := net.SplitHostPort(paddr)
+		tconn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("dialConnect: proxy response error %s", resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+//bufferedConn keeps data readed ahead of the proxy response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+//canonicalAddr host:port of url using default port of scheme
+func canonicalAddr(u *url.URL) string {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https", "wss":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,240 @@
+package remoton
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//connectProxy minimal HTTP CONNECT proxy with basic auth
+func connectProxy(t *testing.T, user, pass string, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if u, p, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization")); !ok || u != user || p != pass {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		atomic.AddInt32(hits, 1)
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		src, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		buf.Flush()
+		<-pipe(dst, src)
+		dst.Close()
+		src.Close()
+	}))
+}
+
+func parseProxyAuth(auth string) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return r.BasicAuth()
+}
+
+//socks5Proxy minimal SOCKS5 proxy without authentication
+func socks5Proxy(t *testing.T, hits *int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 262)
+		//greeting
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+		//request
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		var host string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 3:
+			io.ReadFull(conn, buf[:1])
+			n := buf[0]
+			io.ReadFull(conn, buf[:n])
+			host = string(buf[:n])
+		default:
+			return
+		}
+		io.ReadFull(conn, buf[:2])
+		port := binary.BigEndian.Uint16(buf[:2])
+		dst, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer dst.Close()
+		atomic.AddInt32(hits, 1)
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		<-pipe(dst, conn)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l
+}
+
+func testProxySession(t *testing.T, proxyURL *url.URL) {
+	ts := httptest.NewTLSServer(NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "testid"
+		}))
+	defer ts.Close()
+
+	rclient := Client{Prefix: "", TLSConfig: &tls.Config{
+		InsecureSkipVerify: true,
+	}, Proxy: http.ProxyURL(proxyURL)}
+
+	session, err := rclient.NewSession(ts.URL, "testsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Destroy()
+
+	go func() {
+		lws, err := session.Listen("ws").Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(lws, lws)
+	}()
+	go func() {
+		ltcp, err := session.ListenTCP("tcp").Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(ltcp, ltcp)
+	}()
+
+	for service, dial := range map[string]func(string, ...DialOption) (net.Conn, error){
+		"ws":  session.Dial,
+		"tcp": session.DialTCP,
+	} {
+		conn, err := dial(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("echo\n"))
+		data, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		}
+		if strings.TrimSpace(data) != "echo" {
+			t.Errorf("%s: want %v get %v", service, "echo", data)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyHTTPConnect(t *testing.T) {
+	var hits int32
+	ps := connectProxy(t, "user", "secret", &hits)
+	defer ps.Close()
+
+	purl, _ := url.Parse(ps.URL)
+	purl.User = url.UserPassword("user", "secret")
+	testProxySession(t, purl)
+
+	//session, websocket and tcp on both ends
+	if n := atomic.LoadInt32(&hits); n != 5 {
+		t.Errorf("want %d connections through proxy get %d", 5, n)
+	}
+}
+
+func TestProxyHTTPConnectAuthRequired(t *testing.T) {
+	var hits int32
+	ps := connectProxy(t, "user", "secret", &hits)
+	defer ps.Close()
+
+	purl, _ := url.Parse(ps.URL)
+	u, _ := url.Parse("https://127.0.0.1:1/")
+	if _, err := (&Client{Proxy: http.ProxyURL(purl)}).dialURL(u); err == nil {
+		t.Error("want error without proxy credentials")
+	}
+}
+
+func TestProxySOCKS5(t *testing.T) {
+	var hits int32
+	l := socks5Proxy(t, &hits)
+	defer l.Close()
+
+	testProxySession(t, &url.URL{Scheme: "socks5", Host: l.Addr().String()})
+	if n := atomic.LoadInt32(&hits); n != 5 {
+		t.Errorf("want %d connections through proxy get %d", 5, n)
+	}
+}
+
+//TestProxyStalled the handshake with a proxy not answering ends with the context
+func TestProxyStalled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	u, _ := url.Parse("http://127.0.0.1:1/")
+	for _, scheme := range []string{"http", "socks5"} {
+		purl := &url.URL{Scheme: scheme, Host: l.Addr().String()}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		start := time.Now()
+		_, err := (&Client{Proxy: http.ProxyURL(purl)}).dialURLContext(ctx, u)
+		cancel()
+		if err == nil {
+			t.Errorf("%s: want error of the stalled proxy", scheme)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second*2 {
+			t.Errorf("%s: want handshake interrupted get %v", scheme, elapsed)
+		}
+	}
+}
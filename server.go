@@ -2,6 +2,7 @@ package remoton
 
 import (
 	"encoding/json"
+	"io"
 	"net"
 	"net/http"
 	"time"
@@ -46,12 +47,38 @@ type Server struct {
 	//one for the producer and one for the consumer
 	sessions    *sessionManager
 	idGenerator func() string
+
+	//KeepAlive heartbeat of tunnels, by default DefaultKeepAlive
+	KeepAlive KeepAlive
+
+	//OnTunnelClose called when a tunnel it's closed with the reason,
+	//err it's ErrKeepAliveTimeout when the peer stop responding
+	OnTunnelClose func(sessionID, service string, err error)
+
+	//Rendezvous udp address announced to clients for hole punching,
+	//without host clients use the host of the server.
+	//See punch.Serve
+	Rendezvous string
+
+	//Audit returns the writers getting the data sent by the dialer
+	//and by the listener of the connections of sessions created with
+	//the audit flag, they are closed with the tunnel. Nil writers for
+	//services not recorded. Sessions can't be audited when nil.
+	//See WithAudit
+	Audit func(sessionID, service string) (dialed, listened io.WriteCloser, err error)
+
+	//pipeTCP disable direct join of tcp tunnels
+	pipeTCP bool
 }
 
 //NewServer create a new http.Listener, *authFunc* for custom authentication and
 //idGenerator for identify connections
 func NewServer(authFunc func(authToken string, r *http.Request) bool, idGenerator func() string) *Server {
-	r := &Server{httprouter.New(), NewSessionManager(), idGenerator}
+	r := &Server{Router: httprouter.New(),
+		sessions:    NewSessionManager(),
+		idGenerator: idGenerator,
+		KeepAlive:   DefaultKeepAlive,
+	}
 	r.RedirectFixedPath = false
 
 	r.POST("/session", hAuth(authFunc, r.hNewSession))
@@ -66,12 +93,18 @@ func NewServer(authFunc func(authToken string, r *http.Request) bool, idGenerato
 func (c *Server) hNewSession(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	id := c.idGenerator()
 
-	c.sessions.Add(id, newSession(id))
+	session := newSession(id)
+	session.audit = c.Audit != nil && r.Header.Get(headerAudit) != ""
+	c.sessions.Add(id, session)
 
 	resp := struct {
-		ID string
+		ID         string
+		Rendezvous string `json:",omitempty"`
+		Audit      bool   `json:",omitempty"`
 	}{
-		ID: id,
+		ID:         id,
+		Rendezvous: c.Rendezvous,
+		Audit:      session.audit,
 	}
 	data, err := json.Marshal(resp)
 	if err != nil {
@@ -103,17 +136,40 @@ func (c *Server) hSessionDial(w http.ResponseWriter, r *http.Request, params htt
 	}
 
 	kservice := params.ByName("service")
+	if !session.audit && c.canDialDirect(r, params) {
+		c.dialDirect(w, params, session.Service(kservice))
+		return
+	}
+
 	if trans, ok := tunnelTypes[params.ByName("tunnel")]; ok {
-		listen, tunnel := net.Pipe()
+		listen, tunnel := tunnelPipe()
+		if session.audit {
+			dialed, listened, err := c.Audit(params.ByName("id"), kservice)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if dialed != nil {
+				defer dialed.Close()
+				tunnel.(*tunnelConn).tee = dialed
+			}
+			if listened != nil {
+				defer listened.Close()
+				listen.(*tunnelConn).tee = listened
+			}
+		}
 		service := session.Service(kservice)
 		select {
 		case service <- listen:
 			defer tunnel.Close()
-			trans(tunnel).ServeHTTP(w, r)
+			c.serveTunnel(trans(tunnel), w, r, params)
 			return
 		case <-time.After(timeoutDefaultDial):
 			w.WriteHeader(http.StatusGatewayTimeout)
 			return
+		case <-r.Context().Done():
+			//client gone
+			return
 		}
 	}
 
@@ -133,12 +189,24 @@ func (c *Server) hSessionListen(w http.ResponseWriter, r *http.Request, params h
 		chtunnel := session.Service(kservice)
 		select {
 		case tunnel := <-chtunnel:
+			if direct, ok := tunnel.(*directConn); ok {
+				var err error
+				tunnel, err = direct.accept()
+				defer func() { direct.finish(err) }()
+				if err != nil {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+			}
 			defer tunnel.Close()
-			trans(tunnel).ServeHTTP(w, r)
+			c.serveTunnel(trans(tunnel), w, r, params)
 			return
 		case <-time.After(timeoutDefaultListen):
 			w.WriteHeader(http.StatusGatewayTimeout)
 			return
+		case <-r.Context().Done():
+			//client gone, don't pair it with a dialer
+			return
 		}
 
 	}
@@ -146,6 +214,48 @@ func (c *Server) hSessionListen(w http.ResponseWriter, r *http.Request, params h
 	w.WriteHeader(http.StatusInternalServerError)
 }
 
+//canDialDirect tcp dial without heartbeat can be joined directly
+func (c *Server) canDialDirect(r *http.Request, params httprouter.Params) bool {
+	if c.pipeTCP || params.ByName("tunnel") != "tcp" {
+		return false
+	}
+	return !c.KeepAlive.enabled() || r.Header.Get(headerKeepAlive) == ""
+}
+
+//dialDirect hand the connection of the dial to the listen side,
+//it waits the end of the relay for OnTunnelClose
+func (c *Server) dialDirect(w http.ResponseWriter, params httprouter.Params, service chan net.Conn) {
+	direct, err := hijackDirect(w)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case service <- direct:
+	case <-time.After(timeoutDefaultDial):
+		direct.reject(http.StatusGatewayTimeout)
+		return
+	case <-direct.gone:
+		//client gone
+		direct.Close()
+		return
+	}
+
+	<-direct.done
+	if c.OnTunnelClose != nil {
+		c.OnTunnelClose(params.ByName("id"), params.ByName("service"), direct.err)
+	}
+}
+
+func (c *Server) serveTunnel(h http.Handler, w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	status := &tunnelStatus{keepAlive: c.KeepAlive}
+	h.ServeHTTP(w, withTunnelStatus(r, status))
+	if c.OnTunnelClose != nil {
+		c.OnTunnelClose(params.ByName("id"), params.ByName("service"), status.err)
+	}
+}
+
 func hAuth(authTokenFunc func(authToken string, r *http.Request) bool, handler httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		if !authTokenFunc(r.Header.Get("X-Auth-Token"), r) {
@@ -3,11 +3,16 @@ package remoton
 import (
 	"bufio"
 	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 //TestDialAndListen test websocket tunnel
@@ -121,3 +126,239 @@ func TestDialAndListenTCP(t *testing.T) {
 	dconn.Write([]byte("transfer"))
 	dconn.Close()
 }
+
+//TestTunnelCloseLegs OnTunnelClose it's called for the dial and the listen
+func TestTunnelCloseLegs(t *testing.T) {
+	closed := make(chan tunnelClosed, 4)
+	ts := keepAliveServer(DefaultKeepAlive, closed)
+	defer ts.Close()
+	for _, keepAlive := range []KeepAlive{{}, DefaultKeepAlive} {
+		session := keepAliveSession(t, ts, keepAlive)
+		go func() {
+			lconn, err := session.ListenTCP("tcp").Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(ioutil.Discard, lconn)
+			lconn.Close()
+		}()
+		dconn, err := session.DialTCP("tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dconn.Write([]byte("data"))
+		dconn.Close()
+
+		for leg := 0; leg < 2; leg++ {
+			select {
+			case c := <-closed:
+				if c.service != "tcp" {
+					t.Errorf("want tcp closed get %v", c.service)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("keepalive %v: want both legs closed get %d", keepAlive.enabled(), leg)
+			}
+		}
+		session.Destroy()
+	}
+}
+
+//benchmarkTunnel relay of the server as the tools use it,
+//over TLS with heartbeat
+func benchmarkTunnel(b *testing.B, tunnel string) {
+	ts := httptest.NewTLSServer(NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "testid"
+		}))
+	defer ts.Close()
+
+	rclient := Client{Prefix: "", TLSConfig: &tls.Config{
+		InsecureSkipVerify: true,
+	}, KeepAlive: DefaultKeepAlive}
+	session, err := rclient.NewSession(ts.URL, "testsrv")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer session.Destroy()
+
+	if tunnel == "websocket" {
+		benchmarkTransfer(b, session.Listen("bench"), session.Dial)
+		return
+	}
+	benchmarkTransfer(b, session.ListenTCP("bench"), session.DialTCP)
+}
+
+//benchmarkTunnelTCP plain tcp without heartbeat, joined
+//directly or by the in memory pipe
+func benchmarkTunnelTCP(b *testing.B, pipeTCP bool) {
+	srv := NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "testid"
+		})
+	srv.pipeTCP = pipeTCP
+	//plain http so the relay can splice
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	rclient := Client{Prefix: "", Proxy: func(*http.Request) (*url.URL, error) {
+		return nil, nil
+	}}
+	session, err := rclient.NewSession(ts.URL, "testsrv")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer session.Destroy()
+
+	benchmarkTransfer(b, session.ListenTCP("bench"), session.DialTCP)
+}
+
+func benchmarkTransfer(b *testing.B, listen net.Listener, dial func(string, ...DialOption) (net.Conn, error)) {
+	done := make(chan struct{})
+	go func() {
+		lconn, err := listen.Accept()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		io.Copy(ioutil.Discard, lconn)
+		lconn.Close()
+		close(done)
+	}()
+
+	dconn, err := dial("bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dconn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	dconn.(closeWriter).CloseWrite()
+	<-done
+	dconn.Close()
+}
+
+func BenchmarkTunnelTCP(b *testing.B) {
+	benchmarkTunnel(b, "tcp")
+}
+
+func BenchmarkTunnelWebsocket(b *testing.B) {
+	benchmarkTunnel(b, "websocket")
+}
+
+//BenchmarkTunnelTCPDirect dial and listen sockets joined directly
+func BenchmarkTunnelTCPDirect(b *testing.B) {
+	benchmarkTunnelTCP(b, false)
+}
+
+//BenchmarkTunnelTCPPipe dial and listen joined by in memory pipe
+func BenchmarkTunnelTCPPipe(b *testing.B) {
+	benchmarkTunnelTCP(b, true)
+}
+
+//auditBuffer writer of Server.Audit
+type auditBuffer struct {
+	mutex  sync.Mutex
+	data   []byte
+	closed bool
+}
+
+func (b *auditBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+func (b *auditBuffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	return nil
+}
+
+func (b *auditBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.data)
+}
+
+func TestAudit(t *testing.T) {
+	srv := NewServer(func(authToken string, r *http.Request) bool {
+		return authToken == "testsrv"
+	}, func() string {
+		return "auditid"
+	})
+	dialed, listened := &auditBuffer{}, &auditBuffer{}
+	var audited []string
+	srv.Audit = func(sessionID, service string) (io.WriteCloser, io.WriteCloser, error) {
+		audited = append(audited, sessionID+"/"+service)
+		return dialed, listened, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/remoton/", http.StripPrefix("/remoton", srv))
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+
+	rclient := Client{Prefix: "/remoton", TLSConfig: &tls.Config{
+		InsecureSkipVerify: true,
+	}}
+	plain, err := rclient.NewSession(ts.URL, "testsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Audit {
+		t.Error("want session without audit")
+	}
+	session, err := rclient.NewSession(ts.URL, "testsrv", WithAudit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.Audit {
+		t.Fatal("want audited session")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lconn, err := session.Listen("chat").Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer lconn.Close()
+		line, _ := bufio.NewReader(lconn).ReadString('\n')
+		lconn.Write([]byte("pong " + line))
+	}()
+
+	conn, err := session.Dial("chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping\n"))
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	<-done
+	if reply != "pong ping\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if got := dialed.String(); got != "ping\n" {
+		t.Errorf("want dialed data %q get %q", "ping\n", got)
+	}
+	if got := listened.String(); got != "pong ping\n" {
+		t.Errorf("want listened data %q get %q", "pong ping\n", got)
+	}
+	if len(audited) != 1 || audited[0] != "auditid/chat" {
+		t.Errorf("unexpected audited %v", audited)
+	}
+}
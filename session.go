@@ -6,10 +6,15 @@ import (
 	"sync/atomic"
 )
 
+//headerAudit request an audited session
+const headerAudit = "X-Remoton-Audit"
+
 //Session create from client
 type srvSession struct {
 	mutex   sync.Mutex
 	service map[string]chan net.Conn
+	//audit the connections with Server.Audit
+	audit bool
 
 	Stat struct {
 		Services int64
@@ -22,16 +27,13 @@ func newSession(auth string) *srvSession {
 	}
 }
 
-func (c *srvSession) initService(id string) {
+//Service channel of *id*, created on the first use
+func (c *srvSession) Service(id string) chan net.Conn {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	if _, ok := c.service[id]; !ok {
 		c.service[id] = make(chan net.Conn)
 	}
-}
-
-func (c *srvSession) Service(id string) chan net.Conn {
-	c.initService(id)
 	return c.service[id]
 }
 
@@ -2,11 +2,17 @@
 package remoton
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/net/websocket"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
 func init() {
@@ -14,26 +20,56 @@ func init() {
 	RegisterTunnelType("tcp", tcpTunnel)
 }
 
-func webSocketTunnel(src net.Conn) http.Handler {
+type tunnelStatusKey struct{}
 
-	handshake := func(conf *websocket.Config, r *http.Request) error {
-		conf.Protocol = []string{"binary"}
-		return nil
-	}
+//tunnelStatus shared between server and tunnel handler
+type tunnelStatus struct {
+	keepAlive KeepAlive
+	//err reason of closing the tunnel
+	err error
+}
 
-	handler := websocket.Handler(func(ws *websocket.Conn) {
-		ws.PayloadType = websocket.BinaryFrame
-		<-pipe(src, ws)
-		ws.Close()
-		src.Close()
-	})
+func withTunnelStatus(r *http.Request, status *tunnelStatus) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tunnelStatusKey{}, status))
+}
 
-	ws := websocket.Server{
-		Handshake: handshake,
-		Handler:   handler,
+func getTunnelStatus(r *http.Request) *tunnelStatus {
+	if status, ok := r.Context().Value(tunnelStatusKey{}).(*tunnelStatus); ok {
+		return status
 	}
+	return &tunnelStatus{}
+}
+
+func webSocketTunnel(src net.Conn) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := getTunnelStatus(r)
+		hw := &hijackActivity{ResponseWriter: w}
+
+		var protocol wsProtocol
+		handshake := func(conf *websocket.Config, r *http.Request) error {
+			protocol = chooseWsProtocol(conf.Protocol, status.keepAlive.enabled())
+			conf.Protocol = []string{protocol.name}
+			return nil
+		}
 
-	return ws
+		handler := websocket.Handler(func(ws *websocket.Conn) {
+			wsconn := newWsConn(ws, protocol)
+			var conn net.Conn = wsconn
+			if status.keepAlive.enabled() {
+				kconn := newKeepAliveConn(wsconn, hw.conn, wsconn, status.keepAlive)
+				defer func() { status.err = kconn.Err() }()
+				conn = kconn
+			}
+			<-pipe(src, conn)
+			conn.Close()
+			src.Close()
+		})
+
+		websocket.Server{
+			Handshake: handshake,
+			Handler:   handler,
+		}.ServeHTTP(hw, r)
+	})
 }
 
 type tcpTunnelHandler struct {
@@ -41,38 +77,422 @@ type tcpTunnelHandler struct {
 }
 
 func (c *tcpTunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn, buf, err := w.(http.Hijacker).Hijack()
+	status := getTunnelStatus(r)
+	keepAlive := status.keepAlive.enabled() && r.Header.Get(headerKeepAlive) != ""
+
+	var conn net.Conn
+	var buf *bufio.ReadWriter
+	var err error
+	hw := &hijackActivity{ResponseWriter: w}
+	if keepAlive {
+		conn, buf, err = hw.Hijack()
+	} else {
+		//keep *net.TCPConn for splice
+		conn, buf, err = w.(http.Hijacker).Hijack()
+	}
 	if err != nil {
 		panic(err)
 	}
 
 	defer conn.Close()
 	fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\n")
+	if keepAlive {
+		fmt.Fprintf(buf, "%s: 1\r\n", headerKeepAlive)
+	}
 	buf.WriteString("\r\n")
 	buf.Flush()
 
 	if conn == nil {
 		panic("unexpected nil conn")
 	}
+
+	if keepAlive {
+		framed := newFramedConn(conn, buf.Reader)
+		kconn := newKeepAliveConn(framed, hw.conn, framed, status.keepAlive)
+		<-pipe(c.endpoint, kconn)
+		kconn.Close()
+		status.err = kconn.Err()
+		return
+	}
+	if buf.Reader.Buffered() > 0 {
+		conn = &bufferedConn{conn, buf.Reader}
+	}
 	<-pipe(c.endpoint, conn)
 }
 
+//directConn hijacked connection of a tcp dial, it's joined
+//directly with the listen side without in memory pipe.
+//When both sides are plain tcp the relay it's done by
+//(*net.TCPConn).ReadFrom that uses splice(2) on linux
+type directConn struct {
+	conn net.Conn
+	buf  *bufio.ReadWriter
+	//peeked closed when the watch of the dial ends
+	peeked  chan struct{}
+	peekErr error
+	//gone closed when the dial it's closed while waiting
+	gone chan struct{}
+	//done closed by the listen side when the relay ends
+	done chan struct{}
+	err  error
+}
+
+//hijackDirect take the connection of dial without answering
+func hijackDirect(w http.ResponseWriter) (*directConn, error) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	direct := &directConn{
+		conn:   conn,
+		buf:    buf,
+		peeked: make(chan struct{}),
+		gone:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go direct.watch()
+	return direct, nil
+}
+
+//watch the dial while it waits the listen side, the
+//hijacked connection don't notice when the client leaves
+func (c *directConn) watch() {
+	defer close(c.peeked)
+	_, c.peekErr = c.buf.Reader.Peek(1)
+	if c.peekErr != nil && !errors.Is(c.peekErr, os.ErrDeadlineExceeded) {
+		close(c.gone)
+	}
+}
+
+//accept answer the dial and return the endpoint for listen side
+func (c *directConn) accept() (net.Conn, error) {
+	//stop the watch before handing the reader
+	c.conn.SetReadDeadline(time.Now())
+	<-c.peeked
+	c.conn.SetReadDeadline(time.Time{})
+	if isClosedChan(c.gone) {
+		c.conn.Close()
+		return nil, c.peekErr
+	}
+
+	fmt.Fprintf(c.buf, "HTTP/1.1 200 OK\r\n\r\n")
+	if err := c.buf.Flush(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	if c.buf.Reader.Buffered() > 0 {
+		return &bufferedConn{c.conn, c.buf.Reader}, nil
+	}
+	return c.conn, nil
+}
+
+//finish the relay with *err*, the dial side reports it
+func (c *directConn) finish(err error) {
+	c.err = err
+	close(c.done)
+}
+
+//reject answer the dial with *code* and close it
+func (c *directConn) reject(code int) {
+	fmt.Fprintf(c.buf, "HTTP/1.1 %d %s\r\n\r\n", code, http.StatusText(code))
+	c.buf.Flush()
+	c.conn.Close()
+}
+
+//directConn only travel over service channels
+func (c *directConn) Read(b []byte) (int, error)         { return 0, errDirectConn }
+func (c *directConn) Write(b []byte) (int, error)        { return 0, errDirectConn }
+func (c *directConn) Close() error                       { return c.conn.Close() }
+func (c *directConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *directConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *directConn) SetDeadline(t time.Time) error      { return errDirectConn }
+func (c *directConn) SetReadDeadline(t time.Time) error  { return errDirectConn }
+func (c *directConn) SetWriteDeadline(t time.Time) error { return errDirectConn }
+
+var errDirectConn = errors.New("directConn: not accepted")
+
 func tcpTunnel(src net.Conn) http.Handler {
 	return &tcpTunnelHandler{src}
 }
 
+//closeWriter connections supporting half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+var errNoHalfClose = errors.New("half-close not supported")
+
+func closeWrite(conn io.Writer) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+//pipe copy data in both directions, when a direction ends it's
+//propagated with CloseWrite and the other direction keeps going.
+//The channel receive the first error or nil when both directions
+//ended, if half-close not supported it returns on first end
 func pipe(dst io.ReadWriteCloser, src io.ReadWriteCloser) chan error {
+	result := make(chan error, 1)
 	errc := make(chan error, 2)
 
-	go func() {
+	cp := func(dst io.ReadWriteCloser, src io.ReadWriteCloser) {
 		_, err := io.Copy(dst, src)
+		if err == nil {
+			err = closeWrite(dst)
+		}
 		errc <- err
-	}()
+	}
+	go cp(dst, src)
+	go cp(src, dst)
+
+	//when the peer of tunnel it's closed stop waiting the other direction
+	var peerClosed <-chan struct{}
+	for _, conn := range []io.ReadWriteCloser{dst, src} {
+		if tconn, ok := conn.(*tunnelConn); ok {
+			peerClosed = tconn.peer.closed
+		}
+	}
 
 	go func() {
-		_, err := io.Copy(src, dst)
-		errc <- err
+		err := <-errc
+		if err == nil {
+			select {
+			case err = <-errc:
+			case <-peerClosed:
+			}
+		}
+		if err == errNoHalfClose {
+			err = nil
+		}
+		result <- err
 	}()
 
-	return errc
+	return result
 }
+
+//Join copy data between *a* and *b* until both directions
+//end propagating half-close, both connections are closed at end
+func Join(a, b io.ReadWriteCloser) error {
+	err := <-pipe(a, b)
+	a.Close()
+	b.Close()
+	return err
+}
+
+//pipeDeadline of a direction of tunnelConn, as the one of net.Pipe
+type pipeDeadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+//set the deadline, the zero time disables it
+func (d *pipeDeadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	//the timer already fired is closing cancel
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(wait, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+//wait channel closed when the deadline expires
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+//tunnelConn in memory connection between dial and listen with
+//half-close and deadlines
+type tunnelConn struct {
+	wmutex sync.Mutex
+	rdRx   <-chan []byte
+	rdTx   chan<- int
+	wrTx   chan<- []byte
+	wrRx   <-chan int
+
+	peer   *tunnelConn
+	closed chan struct{}
+	once   sync.Once
+	//writeClosed by CloseWrite, the peer reads io.EOF
+	writeClosed chan struct{}
+	writeOnce   sync.Once
+
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+	//tee gets the data written when not nil, see Server.Audit
+	tee io.Writer
+}
+
+//tunnelPipe like net.Pipe but supporting CloseWrite
+func tunnelPipe() (net.Conn, net.Conn) {
+	cb1 := make(chan []byte)
+	cb2 := make(chan []byte)
+	cn1 := make(chan int)
+	cn2 := make(chan int)
+	newConn := func() *tunnelConn {
+		return &tunnelConn{
+			closed:        make(chan struct{}),
+			writeClosed:   make(chan struct{}),
+			readDeadline:  makePipeDeadline(),
+			writeDeadline: makePipeDeadline(),
+		}
+	}
+	a := newConn()
+	a.rdRx, a.rdTx, a.wrTx, a.wrRx = cb1, cn1, cb2, cn2
+	b := newConn()
+	b.rdRx, b.rdTx, b.wrTx, b.wrRx = cb2, cn2, cb1, cn1
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	switch {
+	case isClosedChan(c.closed):
+		return 0, io.ErrClosedPipe
+	case isClosedChan(c.peer.closed), isClosedChan(c.peer.writeClosed):
+		return 0, io.EOF
+	case isClosedChan(c.readDeadline.wait()):
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	select {
+	case bw := <-c.rdRx:
+		n := copy(b, bw)
+		c.rdTx <- n
+		return n, nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	case <-c.peer.closed:
+		return 0, io.EOF
+	case <-c.peer.writeClosed:
+		return 0, io.EOF
+	case <-c.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	n, err := c.write(b)
+	if c.tee != nil && n > 0 {
+		c.tee.Write(b[:n])
+	}
+	return n, err
+}
+
+func (c *tunnelConn) write(b []byte) (n int, err error) {
+	switch {
+	case isClosedChan(c.closed), isClosedChan(c.writeClosed), isClosedChan(c.peer.closed):
+		return 0, io.ErrClosedPipe
+	case isClosedChan(c.writeDeadline.wait()):
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	for once := true; once || len(b) > 0; once = false {
+		select {
+		case c.wrTx <- b:
+			nw := <-c.wrRx
+			b = b[nw:]
+			n += nw
+		case <-c.closed:
+			return n, io.ErrClosedPipe
+		case <-c.writeClosed:
+			return n, io.ErrClosedPipe
+		case <-c.peer.closed:
+			return n, io.ErrClosedPipe
+		case <-c.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		}
+	}
+	return n, nil
+}
+
+//CloseWrite the peer reads io.EOF after the data written
+func (c *tunnelConn) CloseWrite() error {
+	c.writeOnce.Do(func() { close(c.writeClosed) })
+	return nil
+}
+
+func (c *tunnelConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return tunnelAddr{}
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return tunnelAddr{}
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	if isClosedChan(c.closed) {
+		return io.ErrClosedPipe
+	}
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	if isClosedChan(c.closed) {
+		return io.ErrClosedPipe
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	if isClosedChan(c.closed) {
+		return io.ErrClosedPipe
+	}
+	c.writeDeadline.set(t)
+	return nil
+}
+
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "tunnel" }
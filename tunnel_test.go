@@ -0,0 +1,177 @@
+package remoton
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+//TestHalfClose trailing data after shutdown(SHUT_WR) reach the peer
+func TestHalfClose(t *testing.T) {
+	ts := httptest.NewTLSServer(NewServer(
+		func(authToken string, r *http.Request) bool {
+			return authToken == "testsrv"
+		}, func() string {
+			return "testid"
+		}))
+	defer ts.Close()
+
+	for _, keepAlive := range []KeepAlive{{}, DefaultKeepAlive} {
+		rclient := &Client{Prefix: "", TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		}, KeepAlive: keepAlive}
+		session, err := rclient.NewSession(ts.URL, "testsrv")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listeners := map[string]net.Listener{
+			"ws":  session.Listen("ws"),
+			"tcp": session.ListenTCP("tcp"),
+		}
+		dials := map[string]func(string, ...DialOption) (net.Conn, error){
+			"ws":  session.Dial,
+			"tcp": session.DialTCP,
+		}
+
+		for service, listener := range listeners {
+			//answer after reading all the request
+			go func(l net.Listener) {
+				conn, err := l.Accept()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				data, err := ioutil.ReadAll(conn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Write(append([]byte("reply:"), data...))
+			}(listener)
+
+			conn, err := dials[service](service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write([]byte("request"))
+			if err := conn.(closeWriter).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			data, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Errorf("%s: %s", service, err)
+			}
+			if string(data) != "reply:request" {
+				t.Errorf("%s: want %v get %v", service, "reply:request", string(data))
+			}
+			conn.Close()
+		}
+		session.Destroy()
+	}
+}
+
+func TestTunnelPipe(t *testing.T) {
+	a, b := tunnelPipe()
+
+	go func() {
+		a.Write([]byte("ping"))
+		a.(closeWriter).CloseWrite()
+	}()
+	data, err := ioutil.ReadAll(b)
+	if err != nil || string(data) != "ping" {
+		t.Errorf("want %v get %v %v", "ping", string(data), err)
+	}
+
+	//write after half-close of peer
+	go b.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(a, buf); err != nil || string(buf) != "pong" {
+		t.Errorf("want %v get %v %v", "pong", string(buf), err)
+	}
+
+	b.Close()
+	if _, err := a.Write([]byte("closed")); err == nil {
+		t.Error("want error writing to closed peer")
+	}
+}
+
+func TestTunnelPipeDeadline(t *testing.T) {
+	a, b := tunnelPipe()
+	defer a.Close()
+	defer b.Close()
+
+	a.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	start := time.Now()
+	if _, err := a.Read(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Errorf("want %v get %v", os.ErrDeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("want read timeout get %v", elapsed)
+	}
+
+	//the deadline cleared reads again
+	a.SetReadDeadline(time.Time{})
+	go b.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(a, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("want %v get %v %v", "ping", string(buf), err)
+	}
+
+	b.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := b.Write([]byte("pong")); err != os.ErrDeadlineExceeded {
+		t.Errorf("want %v get %v", os.ErrDeadlineExceeded, err)
+	}
+}
+
+//TestWebsocketOldPeer without half-close a text frame it's data
+//and CloseWrite it's not supported
+func TestWebsocketOldPeer(t *testing.T) {
+	ts := httptest.NewServer(websocket.Server{
+		Handshake: func(conf *websocket.Config, r *http.Request) error {
+			conf.Protocol = []string{"binary"}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.TextFrame
+			ws.Write([]byte("text"))
+			io.Copy(ioutil.Discard, ws)
+		},
+	})
+	defer ts.Close()
+
+	conf, err := websocket.NewConfig("ws"+strings.TrimPrefix(ts.URL, "http"), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Protocol = offerWsProtocols(true)
+	ws, err := websocket.DialConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocol := negotiatedWsProtocol(ws)
+	if protocol.name != "binary" || protocol.keepAlive || protocol.halfClose {
+		t.Errorf("want binary get %+v", protocol)
+	}
+	conn := newWsConn(ws, protocol)
+	defer conn.Close()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "text" {
+		t.Errorf("want %v get %v %v", "text", string(buf), err)
+	}
+	if err := conn.CloseWrite(); err != errNoHalfClose {
+		t.Errorf("want %v get %v", errNoHalfClose, err)
+	}
+}
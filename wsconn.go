@@ -0,0 +1,167 @@
+package remoton
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+//wsFrame it's a websocket frame being readed
+type wsFrame interface {
+	io.Reader
+	PayloadType() byte
+	TrailerReader() io.Reader
+}
+
+//wsProtocol of the tunnel and its features, the peers
+//negotiate the first both support
+type wsProtocol struct {
+	name string
+	//keepAlive the server sends pings
+	keepAlive bool
+	//halfClose a empty text frame it's the half-close
+	halfClose bool
+}
+
+//wsProtocols by preference, old peers only know binary
+var wsProtocols = []wsProtocol{
+	{name: "binary.keepalive.halfclose", keepAlive: true, halfClose: true},
+	{name: "binary.keepalive", keepAlive: true},
+	{name: "binary.halfclose", halfClose: true},
+	{name: "binary"},
+}
+
+//offerWsProtocols names of the protocols, without keepalive when disabled
+func offerWsProtocols(keepAlive bool) []string {
+	var names []string
+	for _, protocol := range wsProtocols {
+		if !protocol.keepAlive || keepAlive {
+			names = append(names, protocol.name)
+		}
+	}
+	return names
+}
+
+//chooseWsProtocol of the *offers* of the peer, without
+//keepalive when disabled
+func chooseWsProtocol(offers []string, keepAlive bool) wsProtocol {
+	for _, protocol := range wsProtocols {
+		if protocol.keepAlive && !keepAlive {
+			continue
+		}
+		for _, offer := range offers {
+			if offer == protocol.name {
+				return protocol
+			}
+		}
+	}
+	return wsProtocols[len(wsProtocols)-1]
+}
+
+//negotiatedWsProtocol of the handshake done
+func negotiatedWsProtocol(ws *websocket.Conn) wsProtocol {
+	if protocols := ws.Config().Protocol; len(protocols) == 1 {
+		return chooseWsProtocol(protocols, true)
+	}
+	return wsProtocols[len(wsProtocols)-1]
+}
+
+//wsConn websocket tunnel, data goes as binary frames and a empty
+//text frame it's the half-close, like shutdown(SHUT_WR), when the
+//protocol negotiated supports it
+type wsConn struct {
+	*websocket.Conn
+	wmutex    sync.Mutex
+	halfClose bool
+
+	frame wsFrame
+	eof   bool
+}
+
+func newWsConn(ws *websocket.Conn, protocol wsProtocol) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, halfClose: protocol.halfClose}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		if c.frame == nil {
+			frame, err := c.Conn.NewFrameReader()
+			if err != nil {
+				return 0, err
+			}
+			handled, err := c.Conn.HandleFrame(frame)
+			if err != nil {
+				return 0, err
+			}
+			//control frame
+			if handled == nil {
+				continue
+			}
+			if c.halfClose && handled.PayloadType() == websocket.TextFrame {
+				io.Copy(io.Discard, handled)
+				c.eof = true
+				continue
+			}
+			c.frame = handled
+		}
+
+		n, err := c.frame.Read(b)
+		if err == io.EOF {
+			if trailer := c.frame.TrailerReader(); trailer != nil {
+				io.Copy(io.Discard, trailer)
+			}
+			c.frame = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *wsConn) writeFrame(payloadType byte) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	w, err := c.Conn.NewFrameWriter(payloadType)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(nil); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+//CloseWrite the peer will read io.EOF
+func (c *wsConn) CloseWrite() error {
+	if !c.halfClose {
+		return errNoHalfClose
+	}
+	return c.writeFrame(websocket.TextFrame)
+}
+
+func (c *wsConn) Ping() error {
+	return c.writeFrame(websocket.PingFrame)
+}
+
+func (c *wsConn) Close() error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,236 @@
+package xpra
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	//ReadyTimeout waiting xpra to be ready on Bind and Attach
+	ReadyTimeout = time.Second * 30
+	//TerminateTimeout waiting xpra to exit before killing it
+	TerminateTimeout = time.Second * 5
+)
+
+//logLines kept of every xpra for the ExitError
+const logLines = 20
+
+var (
+	xpraReady    = regexp.MustCompile(`xpra is ready\.`)
+	xpraAttached = regexp.MustCompile(`(?i)attached to`)
+	xpraClosing  = regexp.MustCompile(`closing tcp socket`)
+)
+
+//ExitError xpra exited before being ready or while running
+type ExitError struct {
+	//Mode of xpra shadow or attach
+	Mode string
+	//Code of exit, -1 when killed by a signal
+	Code int
+	//Log last lines written by xpra
+	Log []string
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("xpra %s exited with code %d", e.Mode, e.Code)
+	if len(e.Log) > 0 {
+		msg += ": " + e.Log[len(e.Log)-1]
+	}
+	return msg
+}
+
+//RestartPolicy of xpra when it exits by itself
+type RestartPolicy struct {
+	//OnFailure restart when xpra exits with error
+	OnFailure bool
+	//MaxRestarts since Bind or Attach, 0 unlimited
+	MaxRestarts int
+	//Delay before restarting
+	Delay time.Duration
+}
+
+//DefaultPolicy restarts a failed xpra three times
+var DefaultPolicy = RestartPolicy{OnFailure: true, MaxRestarts: 3, Delay: time.Second}
+
+//process of xpra supervised, its output it's logged line by line
+type process struct {
+	mode string
+	cmd  *exec.Cmd
+
+	ready   chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	//err of exit, valid after done
+	err error
+
+	mutex      sync.Mutex
+	log        []string
+	terminated bool
+}
+
+//startProcess of xpra with *args*, it's ready when a line of
+//its output matches *ready*
+func startProcess(mode string, args []string, ready *regexp.Regexp) (*process, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(xpraPath, args...)
+	platformCmd(cmd)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	w.Close()
+	log.Println("xpra", mode, "pid", cmd.Process.Pid)
+
+	p := &process{
+		mode:    mode,
+		cmd:     cmd,
+		ready:   make(chan struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	scanned := make(chan struct{})
+	go func() {
+		p.scan(r, ready)
+		close(scanned)
+	}()
+	go func() {
+		err := cmd.Wait()
+		//the children of xpra may keep the pipe open
+		select {
+		case <-scanned:
+		case <-time.After(time.Second):
+		}
+		p.err = p.exitError(err)
+		close(p.done)
+	}()
+	return p, nil
+}
+
+//scan the output of xpra
+func (p *process) scan(r io.ReadCloser, ready *regexp.Regexp) {
+	defer r.Close()
+	isReady := false
+	isClosing := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.Println("xpra "+p.mode+":", line)
+
+		p.mutex.Lock()
+		p.log = append(p.log, line)
+		if len(p.log) > logLines {
+			p.log = p.log[1:]
+		}
+		p.mutex.Unlock()
+
+		switch {
+		case !isReady && ready.MatchString(line):
+			isReady = true
+			close(p.ready)
+		case !isReady && !isClosing && xpraClosing.MatchString(line):
+			isClosing = true
+			close(p.closing)
+		}
+	}
+}
+
+//exitError of *err* returned by Wait, nil when xpra exited fine
+func (p *process) exitError(err error) error {
+	if err == nil {
+		return nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return &ExitError{
+		Mode: p.mode,
+		Code: exitErr.ExitCode(),
+		Log:  append([]string(nil), p.log...),
+	}
+}
+
+//waitReady until xpra it's ready, it's terminated when
+//it fails or *ctx* it's done
+func (p *process) waitReady(ctx context.Context) error {
+	select {
+	case <-p.ready:
+		return nil
+	case <-p.done:
+		if p.err != nil {
+			return p.err
+		}
+		return &ExitError{Mode: p.mode, Log: p.lines()}
+	case <-p.closing:
+		p.terminate()
+		return ErrClosingTCP
+	case <-ctx.Done():
+		p.terminate()
+		return ctx.Err()
+	}
+}
+
+func (p *process) lines() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.log...)
+}
+
+//terminate our xpra, it's killed when don't exit on time
+func (p *process) terminate() {
+	p.mutex.Lock()
+	p.terminated = true
+	p.mutex.Unlock()
+
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	//windows can't interrupt
+	if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+		p.cmd.Process.Kill()
+	}
+	select {
+	case <-p.done:
+	case <-time.After(TerminateTimeout):
+		log.Println("xpra", p.mode, "killing pid", p.cmd.Process.Pid)
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+//wait until xpra exits
+func (p *process) wait() error {
+	<-p.done
+	return p.err
+}
+
+//isTerminated by us, it didn't exit by itself
+func (p *process) isTerminated() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.terminated
+}
+
+//pid of xpra
+func (p *process) pid() int {
+	return p.cmd.Process.Pid
+}
@@ -0,0 +1,131 @@
+package xpra
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Profiles of encoding and quality of the viewer
+const (
+	ProfileLowBandwidth = "low-bandwidth"
+	ProfileBalanced     = "balanced"
+	ProfileHighQuality  = "high-quality"
+	ProfileLAN          = "lan"
+)
+
+var (
+	//ErrProfile unknown profile
+	ErrProfile = errors.New("xpra: unknown profile")
+	//ErrOption option that can't be overridden
+	ErrOption = errors.New("xpra: invalid option")
+)
+
+//Profiles options of xpra attach, the keys are the long
+//options without the dashes
+var Profiles = map[string]map[string]string{
+	ProfileLowBandwidth: {
+		"encoding":           "jpeg",
+		"min-speed":          "70",
+		"min-quality":        "10",
+		"quality":            "40",
+		"auto-refresh-delay": "2",
+		"desktop-scaling":    "auto",
+	},
+	ProfileBalanced: {
+		"min-speed":          "30",
+		"min-quality":        "50",
+		"auto-refresh-delay": "0.8",
+		"desktop-scaling":    "auto",
+	},
+	ProfileHighQuality: {
+		"min-speed":          "0",
+		"min-quality":        "80",
+		"auto-refresh-delay": "0.25",
+		"desktop-scaling":    "auto",
+	},
+	ProfileLAN: {
+		"encoding":           "rgb",
+		"min-speed":          "0",
+		"min-quality":        "100",
+		"auto-refresh-delay": "0.1",
+		"desktop-scaling":    "off",
+	},
+}
+
+//ProfileNames from the lower bandwidth to the higher
+var ProfileNames = []string{ProfileLowBandwidth, ProfileBalanced, ProfileHighQuality, ProfileLAN}
+
+var optionName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+//reservedOptions set by Xpra
+var reservedOptions = map[string]bool{
+	"auth":          true,
+	"password-file": true,
+	"readonly":      true,
+	"bind-tcp":      true,
+	"daemon":        true,
+}
+
+//ProfileFor the link with *latency* and *throughput* in bytes per second
+func ProfileFor(latency time.Duration, throughput float64) string {
+	switch {
+	case latency > time.Millisecond*250 || throughput < 256<<10:
+		return ProfileLowBandwidth
+	case latency > time.Millisecond*80 || throughput < 2<<20:
+		return ProfileBalanced
+	case latency < time.Millisecond*5 && throughput > 20<<20:
+		return ProfileLAN
+	}
+	return ProfileHighQuality
+}
+
+//ParseOptions of xpra as key=value separated by commas
+func ParseOptions(s string) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, option := range strings.Split(s, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrOption
+		}
+		options[strings.TrimPrefix(kv[0], "--")] = kv[1]
+	}
+	return options, checkOptions(options)
+}
+
+func checkOptions(options map[string]string) error {
+	for key, value := range options {
+		if !optionName.MatchString(key) || reservedOptions[key] || strings.ContainsAny(value, "\r\n") {
+			return ErrOption
+		}
+	}
+	return nil
+}
+
+//profileArgs of *name* with *overrides*, sorted by option
+func profileArgs(name string, overrides map[string]string) []string {
+	options := make(map[string]string)
+	for key, value := range Profiles[name] {
+		options[key] = value
+	}
+	for key, value := range overrides {
+		options[key] = value
+	}
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, len(keys))
+	for i, key := range keys {
+		args[i] = "--" + key + "=" + options[key]
+	}
+	return args
+}
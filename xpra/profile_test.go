@@ -0,0 +1,70 @@
+package xpra
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProfileArgs(t *testing.T) {
+	want := []string{"--auto-refresh-delay=0.8", "--desktop-scaling=auto", "--min-quality=50", "--min-speed=30"}
+	if args := profileArgs(ProfileBalanced, nil); !reflect.DeepEqual(args, want) {
+		t.Errorf("want %v get %v", want, args)
+	}
+	want = []string{"--auto-refresh-delay=2", "--desktop-scaling=auto", "--encoding=webp",
+		"--min-quality=10", "--min-speed=70", "--quality=40", "--speaker=on"}
+	args := profileArgs(ProfileLowBandwidth, map[string]string{"encoding": "webp", "speaker": "on"})
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("want %v get %v", want, args)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	options, err := ParseOptions("--min-quality=40, encoding=jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(options, map[string]string{"min-quality": "40", "encoding": "jpeg"}) {
+		t.Errorf("want options get %v", options)
+	}
+	for _, invalid := range []string{"quality", "password-file=/tmp/x", "readonly=no", "Bad=1"} {
+		if _, err := ParseOptions(invalid); err != ErrOption {
+			t.Errorf("%s: want %v get %v", invalid, ErrOption, err)
+		}
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	x := &Xpra{}
+	if x.Profile() != ProfileBalanced {
+		t.Errorf("want %s get %s", ProfileBalanced, x.Profile())
+	}
+	if err := x.SetProfile("fastest", nil); err != ErrProfile {
+		t.Errorf("want %v get %v", ErrProfile, err)
+	}
+	if err := x.SetProfile(ProfileLAN, map[string]string{"auth": "none"}); err != ErrOption {
+		t.Errorf("want %v get %v", ErrOption, err)
+	}
+	if err := x.SetProfile(ProfileLAN, nil); err != nil || x.Profile() != ProfileLAN {
+		t.Errorf("want %s get %s %v", ProfileLAN, x.Profile(), err)
+	}
+}
+
+func TestProfileFor(t *testing.T) {
+	for _, test := range []struct {
+		latency    time.Duration
+		throughput float64
+		want       string
+	}{
+		{time.Millisecond * 300, 50 << 20, ProfileLowBandwidth},
+		{time.Millisecond * 40, 100 << 10, ProfileLowBandwidth},
+		{time.Millisecond * 120, 5 << 20, ProfileBalanced},
+		{time.Millisecond * 30, 1 << 20, ProfileBalanced},
+		{time.Millisecond * 30, 8 << 20, ProfileHighQuality},
+		{time.Millisecond, 80 << 20, ProfileLAN},
+	} {
+		if got := ProfileFor(test.latency, test.throughput); got != test.want {
+			t.Errorf("%v %v: want %s get %s", test.latency, test.throughput, test.want, got)
+		}
+	}
+}
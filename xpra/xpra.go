@@ -1,23 +1,25 @@
 package xpra
 
 import (
-	"bytes"
+	"context"
 	"errors"
-	log "github.com/Sirupsen/logrus"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 var (
 	//ErrNotXPRA not found on system xpra
 	ErrNotXPRA = errors.New("Failed not found executable xpra")
 
-	//ErrClosingTCP error xpra
+	//ErrClosingTCP xpra closed the tcp socket before being ready
 	ErrClosingTCP = errors.New("closing tcp socket")
 )
 
@@ -34,21 +36,51 @@ var (
 	xpraArgsBind = []string{
 		"shadow", ":0", "--mdns=no",
 	}
+
+	//xpraArgsViewOnly the shadow server ignores the keyboard and mouse
+	//of the supporters when it honours --readonly, on the viewer it only
+	//stops sending them
+	xpraArgsViewOnly = []string{
+		"--readonly=yes",
+	}
 )
 
+//Available xpra on the system
+func Available() bool {
+	return xpraPathErr == nil
+}
+
 type Xpraer interface {
 	SetPassword(password string)
+	//SetViewOnly used on the next Attach, Bind or Restart
+	SetViewOnly(viewOnly bool)
+	//SetProfile of the viewer used on the next Attach or Restart
+	SetProfile(name string, overrides map[string]string) error
+	Profile() string
 	Attach(addr string) error
 	Bind(addr string) error
+	//Restart the running xpra with the current options
+	Restart() error
 	Version() string
 	Terminate()
 }
 
+//Xpra supervised, only the xpra started here it's terminated
 type Xpra struct {
+	//Policy restarting xpra when it exits by itself
+	Policy RestartPolicy
+
+	mutex        sync.Mutex
 	password     string
 	passwordFile string
 	addrAttach   string
 	addrBind     string
+	viewOnly     bool
+	profile      string
+	overrides    map[string]string
+	proc         *process
+	//cancelRestart of the supervisor restarting xpra
+	cancelRestart context.CancelFunc
 }
 
 func (c *Xpra) SetPassword(pass string) {
@@ -56,6 +88,43 @@ func (c *Xpra) SetPassword(pass string) {
 	c.passwordFile = generaPasswdFile(pass)
 }
 
+//SetViewOnly start xpra with --readonly, the running xpra
+//must Restart to use it disconnecting the supporters
+func (c *Xpra) SetViewOnly(viewOnly bool) {
+	c.viewOnly = viewOnly
+}
+
+//ViewOnly xpra started with --readonly
+func (c *Xpra) ViewOnly() bool {
+	return c.viewOnly
+}
+
+//SetProfile of encoding and quality of the viewer, the options
+//of *overrides* replace the ones of the profile
+func (c *Xpra) SetProfile(name string, overrides map[string]string) error {
+	if _, ok := Profiles[name]; !ok {
+		return ErrProfile
+	}
+	if err := checkOptions(overrides); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.profile = name
+	c.overrides = overrides
+	return nil
+}
+
+//Profile of the viewer, balanced by default
+func (c *Xpra) Profile() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.profile == "" {
+		return ProfileBalanced
+	}
+	return c.profile
+}
+
 //Version of system xpra
 func (c *Xpra) Version() string {
 	if xpraPathErr != nil {
@@ -67,100 +136,207 @@ func (c *Xpra) Version() string {
 	if err != nil {
 		return ""
 	}
-	return strings.TrimSpace(strings.Split(string(out), " ")[1])
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
 }
 
-//Attach to xpra
+//Attach to xpra waiting the viewer ready by ReadyTimeout
 func (c *Xpra) Attach(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ReadyTimeout)
+	defer cancel()
+	return c.AttachContext(ctx, addr)
+}
 
+//AttachContext to xpra waiting the viewer ready until *ctx* it's done
+func (c *Xpra) AttachContext(ctx context.Context, addr string) error {
 	if xpraPathErr != nil {
 		log.Error("xpra_attach:", xpraPathErr)
 		return xpraPathErr
 	}
 
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.addrAttach = addr
-	args := append(xpraArgsAttach, "tcp:"+addr)
-	args = append(args, "--min-speed=30", "--min-quality=50",
-		"--windows=yes",
-		"--notifications=no", "--speaker=off", "--auto-refresh-delay=0.8",
-		"--desktop-scaling=auto")
+	return c.start(ctx, "attach", c.attachArgs(), xpraAttached)
+}
+
+func (c *Xpra) attachArgs() []string {
+	args := append(xpraArgsAttach, "tcp:"+c.addrAttach)
+	args = append(args, "--windows=yes", "--notifications=no", "--speaker=off")
+	profile := c.profile
+	if profile == "" {
+		profile = ProfileBalanced
+	}
+	args = append(args, profileArgs(profile, c.overrides)...)
 	if c.passwordFile != "" {
 		args = append(args, "--auth=file", "--password-file="+c.passwordFile)
 	}
-	args = platformAttachArgs(args)
-
-	xpraCmd := exec.Command(xpraPath, args...)
-	platformCmd(xpraCmd)
-	if err := xpraCmd.Start(); err != nil {
-		log.Error("xpra_attach:", err)
-		return err
+	if c.viewOnly {
+		args = append(args, xpraArgsViewOnly...)
 	}
-
-	time.Sleep(time.Second)
-	return nil
+	return platformAttachArgs(args)
 }
 
-//Bind a xpra for listen connections
+//Bind a xpra for listen connections waiting it ready by ReadyTimeout
 func (c *Xpra) Bind(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ReadyTimeout)
+	defer cancel()
+	return c.BindContext(ctx, addr)
+}
+
+//BindContext a xpra for listen connections waiting it ready
+//until *ctx* it's done
+func (c *Xpra) BindContext(ctx context.Context, addr string) error {
 	if xpraPathErr != nil {
-		log.Error("xpra_attach:", xpraPathErr)
+		log.Error("xpra_bind:", xpraPathErr)
 		return xpraPathErr
 	}
 
-	var out bytes.Buffer
-	args := append(xpraArgsBind, "--bind-tcp="+addr)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addrBind = addr
+	args := c.bindArgs()
+	log.Println("XpraBind args: ", args)
+	return c.start(ctx, "shadow", args, xpraReady)
+}
+
+func (c *Xpra) bindArgs() []string {
+	args := append(xpraArgsBind, "--bind-tcp="+c.addrBind)
 	if c.passwordFile != "" {
 		args = append(args, "--auth=file", "--password-file="+c.passwordFile)
 	}
-	c.addrBind = addr
-	args = platformBindArgs(args)
-	log.Println("XpraBind args: ", args)
-	xpraCmd := exec.Command(xpraPath, args...)
-	platformCmd(xpraCmd)
+	if c.viewOnly {
+		args = append(args, xpraArgsViewOnly...)
+	}
+	return platformBindArgs(args)
+}
 
-	xpraCmd.Stderr = &out
-	xpraCmd.Stdout = &out
-	if err := xpraCmd.Start(); err != nil {
-		log.Error("xpra_bind:", err)
+//start xpra replacing the running one, it's supervised when ready
+func (c *Xpra) start(ctx context.Context, mode string, args []string, ready *regexp.Regexp) error {
+	c.stop()
+	proc, err := startProcess(mode, args, ready)
+	if err != nil {
+		log.Error("xpra_"+mode+":", err)
+		return err
+	}
+	if err := proc.waitReady(ctx); err != nil {
+		log.Error("xpra_"+mode+":", err)
 		return err
 	}
+	c.proc = proc
+	go c.supervise(proc, args, ready)
+	return nil
+}
 
-	xprayReady := regexp.MustCompile(`xpra is ready.`)
-	xprayError := regexp.MustCompile("failed")
-	xprayClosing := regexp.MustCompile("closing tcp socket localhost")
-	for {
-		time.Sleep(time.Second)
-		log.Println(out.String())
-		if xprayReady.Match(out.Bytes()) {
-			return nil
+//supervise *proc* restarting it by the Policy
+func (c *Xpra) supervise(proc *process, args []string, ready *regexp.Regexp) {
+	for restarts := 0; ; restarts++ {
+		err := proc.wait()
+		if proc.isTerminated() {
+			return
+		}
+		if err == nil {
+			log.Println("xpra", proc.mode, "exited")
+			return
 		}
+		log.Error("xpra_"+proc.mode+": ", err)
+		if !c.Policy.OnFailure || (c.Policy.MaxRestarts > 0 && restarts >= c.Policy.MaxRestarts) {
+			return
+		}
+		time.Sleep(c.Policy.Delay)
 
-		if xprayError.Match(out.Bytes()) {
-			str, _ := out.ReadString('\n')
-			return errors.New(str)
+		//Terminate, Pid and Restart don't wait the new xpra ready,
+		//Terminate and Restart cancel it
+		ctx, cancel := context.WithTimeout(context.Background(), ReadyTimeout)
+		c.mutex.Lock()
+		if c.proc != proc {
+			c.mutex.Unlock()
+			cancel()
+			return
 		}
-		if xprayClosing.Match(out.Bytes()) {
-			log.Error(out.String())
-			exec.Command("pkill", "xpra").Output()
-			return ErrClosingTCP
+		c.cancelRestart = cancel
+		c.mutex.Unlock()
+
+		log.Println("xpra", proc.mode, "restarting")
+		next, err := startProcess(proc.mode, args, ready)
+		if err == nil {
+			err = next.waitReady(ctx)
 		}
+		cancel()
+
+		c.mutex.Lock()
+		c.cancelRestart = nil
+		//replaced or terminated meanwhile
+		if c.proc != proc {
+			c.mutex.Unlock()
+			if err == nil {
+				next.terminate()
+			}
+			return
+		}
+		if err != nil {
+			log.Error("xpra_"+proc.mode+": ", err)
+			c.proc = nil
+			c.mutex.Unlock()
+			return
+		}
+		c.proc = next
+		c.mutex.Unlock()
+		proc = next
 	}
 }
 
-//Terminate running xpra
-func (c *Xpra) Terminate() {
-	if xpraPathErr == nil {
-		args := []string{"stop"}
-		if c.addrAttach != "" {
-			args = append(args, "tcp:"+c.addrAttach)
-		} else if c.addrBind != "" {
-			args = append(args, "tcp:"+c.addrBind)
-		}
+//stop the running xpra and its restart
+func (c *Xpra) stop() {
+	if c.cancelRestart != nil {
+		c.cancelRestart()
+		c.cancelRestart = nil
+	}
+	if c.proc != nil {
+		c.proc.terminate()
+		c.proc = nil
+	}
+}
 
-		if c.passwordFile != "" {
-			args = append(args, "--password-file="+c.passwordFile)
-		}
-		exec.Command(xpraPath, args...).Start()
+//Restart the attached or bound xpra, the supporter
+//attached to the server it's disconnected
+func (c *Xpra) Restart() error {
+	if xpraPathErr != nil {
+		return xpraPathErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ReadyTimeout)
+	defer cancel()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.addrAttach != "" {
+		return c.start(ctx, "attach", c.attachArgs(), xpraAttached)
+	}
+	if c.addrBind == "" {
+		return errors.New("xpra not running")
+	}
+	return c.start(ctx, "shadow", c.bindArgs(), xpraReady)
+}
+
+//Pid of the running xpra, 0 when it's not running
+func (c *Xpra) Pid() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.proc == nil {
+		return 0
+	}
+	return c.proc.pid()
+}
+
+//Terminate the xpra started here
+func (c *Xpra) Terminate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stop()
+	if c.passwordFile != "" {
 		syscall.Unlink(c.passwordFile)
 	}
 }
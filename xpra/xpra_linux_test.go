@@ -0,0 +1,339 @@
+package xpra
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//fakeXpra behaves as $FAKE_XPRA says and appends its pid
+//and arguments to $FAKE_XPRA_CALLS
+const fakeXpra = `#!/bin/sh
+echo "$$ $*" >> "$FAKE_XPRA_CALLS"
+if [ "$1" = "--version" ]; then
+	echo "xpra v4.4.6-r0"
+	exit 0
+fi
+ready() {
+	if [ "$1" = "attach" ]; then
+		echo "Attached to tcp://$2 (press Control-C to detach)"
+	else
+		echo "xpra is ready."
+	fi
+}
+case "$FAKE_XPRA" in
+ready)
+	echo "starting"
+	ready "$@"
+	exec sleep 60
+	;;
+fail)
+	echo "failed to open display :0" >&2
+	exit 3
+	;;
+hang)
+	exec sleep 60
+	;;
+closing)
+	echo "closing tcp socket localhost:6900"
+	exec sleep 60
+	;;
+crash-hang)
+	if [ -e "$FAKE_XPRA_CALLS.crashed" ]; then
+		exec sleep 60
+	fi
+	touch "$FAKE_XPRA_CALLS.crashed"
+	ready "$@"
+	sleep 0.2
+	exit 1
+	;;
+crash)
+	ready "$@"
+	sleep 0.2
+	echo "lost connection" >&2
+	exit 1
+	;;
+esac
+`
+
+var calls string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "fakexpra")
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "xpra"), []byte(fakeXpra), 0755); err != nil {
+		panic(err)
+	}
+	calls = filepath.Join(dir, "calls")
+	os.Setenv("FAKE_XPRA_CALLS", calls)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	xpraPath, xpraPathErr = exec.LookPath("xpra")
+
+	ReadyTimeout = time.Second * 5
+	TerminateTimeout = time.Second
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+//fake xpra in *mode*, the calls are reset
+func fake(t *testing.T, mode string) {
+	os.Setenv("FAKE_XPRA", mode)
+	os.Remove(calls)
+	os.Remove(calls + ".crashed")
+}
+
+//invocations of the fake xpra
+func invocations(t *testing.T) []string {
+	b, err := ioutil.ReadFile(calls)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func alive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+func TestBindReady(t *testing.T) {
+	fake(t, "ready")
+	x := &Xpra{}
+	x.SetViewOnly(true)
+	if err := x.Bind("localhost:6900"); err != nil {
+		t.Fatal(err)
+	}
+	pid := x.Pid()
+	if !alive(pid) {
+		t.Fatalf("want xpra %d running", pid)
+	}
+	got := invocations(t)
+	if len(got) != 1 || !strings.Contains(got[0], "shadow :0") ||
+		!strings.Contains(got[0], "--bind-tcp=localhost:6900") || !strings.Contains(got[0], "--readonly=yes") {
+		t.Errorf("want shadow args get %v", got)
+	}
+
+	x.Terminate()
+	if alive(pid) {
+		t.Errorf("want xpra %d terminated", pid)
+	}
+	if x.Pid() != 0 {
+		t.Errorf("want no xpra get %d", x.Pid())
+	}
+}
+
+func TestBindExitCode(t *testing.T) {
+	fake(t, "fail")
+	x := &Xpra{Policy: DefaultPolicy}
+	err := x.Bind("localhost:6900")
+	exitErr, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("want ExitError get %v", err)
+	}
+	if exitErr.Code != 3 || exitErr.Mode != "shadow" {
+		t.Errorf("want shadow exit 3 get %+v", exitErr)
+	}
+	if len(exitErr.Log) != 1 || exitErr.Log[0] != "failed to open display :0" {
+		t.Errorf("want the log of xpra get %v", exitErr.Log)
+	}
+	//not ready it's not restarted
+	time.Sleep(time.Millisecond * 100)
+	if got := invocations(t); len(got) != 1 {
+		t.Errorf("want one xpra get %v", got)
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	fake(t, "hang")
+	x := &Xpra{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	start := time.Now()
+	if err := x.BindContext(ctx, "localhost:6900"); err != context.DeadlineExceeded {
+		t.Fatalf("want %v get %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > time.Second*3 {
+		t.Errorf("want timeout get %v", time.Since(start))
+	}
+	got := invocations(t)
+	if len(got) != 1 {
+		t.Fatalf("want one xpra get %v", got)
+	}
+	pid, err := strconv.Atoi(strings.Fields(got[0])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alive(pid) {
+		t.Errorf("want xpra %d terminated on timeout", pid)
+	}
+}
+
+func TestBindClosing(t *testing.T) {
+	fake(t, "closing")
+	x := &Xpra{}
+	if err := x.Bind("localhost:6900"); err != ErrClosingTCP {
+		t.Errorf("want %v get %v", ErrClosingTCP, err)
+	}
+}
+
+func TestRestartOnFailure(t *testing.T) {
+	fake(t, "crash")
+	x := &Xpra{Policy: RestartPolicy{OnFailure: true, MaxRestarts: 2, Delay: time.Millisecond * 10}}
+	if err := x.Bind("localhost:6900"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for len(invocations(t)) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	//the last restart crashes too and it's not restarted
+	time.Sleep(time.Millisecond * 500)
+	if got := invocations(t); len(got) != 3 {
+		t.Errorf("want xpra started 3 times get %v", got)
+	}
+	x.Terminate()
+}
+
+func TestTerminateRestarting(t *testing.T) {
+	fake(t, "crash-hang")
+	x := &Xpra{Policy: RestartPolicy{OnFailure: true, Delay: time.Millisecond * 10}}
+	if err := x.Bind("localhost:6900"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for len(invocations(t)) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	got := invocations(t)
+	if len(got) != 2 {
+		t.Fatalf("want xpra restarted get %v", got)
+	}
+	pid, err := strconv.Atoi(strings.Fields(got[1])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the restarted xpra never gets ready
+	start := time.Now()
+	x.Pid()
+	x.Terminate()
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Errorf("want terminate without waiting the restart get %v", elapsed)
+	}
+	deadline = time.Now().Add(time.Second * 3)
+	for alive(pid) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if alive(pid) {
+		t.Errorf("want restarting xpra %d terminated", pid)
+	}
+	if x.Pid() != 0 {
+		t.Errorf("want no xpra get %d", x.Pid())
+	}
+}
+
+func TestNoRestart(t *testing.T) {
+	fake(t, "crash")
+	x := &Xpra{}
+	if err := x.Bind("localhost:6900"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 500)
+	if got := invocations(t); len(got) != 1 {
+		t.Errorf("want xpra started once get %v", got)
+	}
+	x.Terminate()
+}
+
+func TestTerminateOwnPid(t *testing.T) {
+	fake(t, "ready")
+	//another xpra of the user
+	other := exec.Command(xpraPath, "shadow", ":1")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Wait()
+	defer other.Process.Kill()
+
+	x := &Xpra{}
+	if err := x.Attach("localhost:6900"); err != nil {
+		t.Fatal(err)
+	}
+	pid := x.Pid()
+	if got := invocations(t); !strings.Contains(strings.Join(got, "\n"), "attach tcp:localhost:6900") {
+		t.Errorf("want attach args get %v", got)
+	}
+
+	x.Terminate()
+	if alive(pid) {
+		t.Errorf("want our xpra %d terminated", pid)
+	}
+	if !alive(other.Process.Pid) {
+		t.Errorf("want the other xpra %d running", other.Process.Pid)
+	}
+}
+
+func TestRestartViewOnly(t *testing.T) {
+	fake(t, "ready")
+	x := &Xpra{}
+	if err := x.Attach("localhost:6900"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.Terminate()
+	pid := x.Pid()
+
+	x.SetViewOnly(true)
+	if err := x.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if alive(pid) {
+		t.Errorf("want previous xpra %d terminated", pid)
+	}
+	got := invocations(t)
+	if len(got) != 2 || !strings.Contains(got[1], "--readonly=yes") {
+		t.Errorf("want attach again view only get %v", got)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	fake(t, "ready")
+	x := &Xpra{}
+	if v := x.Version(); v != "v4.4.6-r0" {
+		t.Errorf("want v4.4.6-r0 get %q", v)
+	}
+}
+
+func TestAttachProfile(t *testing.T) {
+	fake(t, "ready")
+	x := &Xpra{}
+	if err := x.SetProfile(ProfileLowBandwidth, map[string]string{"quality": "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Attach("localhost:6900"); err != nil {
+		t.Fatal(err)
+	}
+	defer x.Terminate()
+	got := invocations(t)
+	if len(got) != 1 || !strings.Contains(got[0], "--encoding=jpeg") ||
+		!strings.Contains(got[0], "--quality=20") || strings.Contains(got[0], "--quality=40") {
+		t.Errorf("want low bandwidth with quality 20 get %v", got)
+	}
+
+	x.SetProfile(ProfileLAN, nil)
+	if err := x.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	got = invocations(t)
+	if len(got) != 2 || !strings.Contains(got[1], "--encoding=rgb") || strings.Contains(got[1], "--quality=20") {
+		t.Errorf("want lan get %v", got)
+	}
+}